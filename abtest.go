@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/*
+ * A/B testing sends a fraction of requests to an alternate target. Which
+ * group a client is in is remembered using a cookie, so that the same
+ * client keeps going to the same target. Requests in the "test" group
+ * are sent to the alternate target using an absolute URI in the WURI
+ * command.
+ */
+
+const (
+	abCookieName = "X-AB-Group"
+	abControl    = "control"
+	abTest       = "test"
+)
+
+func enableABTesting(fraction float64, alternateTarget string) error {
+	if alternateTarget == "" {
+		updateSettings(func(s *settings) {
+			s.abTarget = nil
+			s.abFraction = 0
+		})
+		return nil
+	}
+
+	if fraction < 0 || fraction > 1 {
+		return fmt.Errorf("Invalid fraction %f: must be between 0 and 1", fraction)
+	}
+	target, err := url.Parse(alternateTarget)
+	if err != nil {
+		return err
+	}
+	if target.Scheme == "" || target.Host == "" {
+		return fmt.Errorf("Alternate target \"%s\" must be an absolute URL", alternateTarget)
+	}
+
+	updateSettings(func(s *settings) {
+		s.abTarget = target
+		s.abFraction = fraction
+	})
+	return nil
+}
+
+func getABGroup(id uint32) string {
+	req := getRequest(id)
+	if req == nil {
+		return ""
+	}
+	return req.abGroup
+}
+
+/*
+ * Decide which group the request is in, and if it's in the test group then
+ * send it to the alternate target.
+ */
+func (r *request) routeABTest() {
+	if r.settings.abTarget == nil {
+		return
+	}
+
+	cookie, err := r.req.Cookie(abCookieName)
+	if err == nil && (cookie.Value == abControl || cookie.Value == abTest) {
+		r.abGroup = cookie.Value
+	} else {
+		r.abCookie = true
+		if rand.Float64() < r.settings.abFraction {
+			r.abGroup = abTest
+		} else {
+			r.abGroup = abControl
+		}
+	}
+
+	if r.abGroup == abTest {
+		target := r.settings.abTarget
+		newURL := *r.req.URL
+		newURL.Scheme = target.Scheme
+		newURL.Host = target.Host
+		newURL.Path = strings.TrimSuffix(target.Path, "/") + r.req.URL.Path
+		newURL.RawPath = ""
+		r.req.URL = &newURL
+	}
+}
+
+/*
+ * If the client didn't already have a group, tell it which one it's in.
+ */
+func (r *response) setABCookie() {
+	if !r.request.abCookie {
+		return
+	}
+	cookie := &http.Cookie{
+		Name:  abCookieName,
+		Value: r.request.abGroup,
+		Path:  "/",
+	}
+	r.resp.Header.Add("Set-Cookie", cookie.String())
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("A/B Testing", func() {
+	var id uint32
+	var rid uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		rid = createResponse(testHandler)
+		Expect(rid).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		freeResponse(rid)
+		resetSettings()
+	})
+
+	It("Disabled", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(getABGroup(id)).Should(BeEmpty())
+	})
+
+	It("Test group", func() {
+		Expect(enableABTesting(1, "http://alternate:8080/base")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass?x=y", "", 0))
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WURI.*"))
+		Expect(cmd[4:]).Should(Equal("http://alternate:8080/base/pass?x=y"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(getABGroup(id)).Should(Equal("test"))
+
+		err = beginResponse(rid, id, 200, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+		cmd = pollResponse(rid, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("Set-Cookie")).Should(Equal("X-AB-Group=test; Path=/"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Control group", func() {
+		Expect(enableABTesting(0, "http://alternate:8080")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(getABGroup(id)).Should(Equal("control"))
+
+		err = beginResponse(rid, id, 200, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+		cmd := pollResponse(rid, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("Set-Cookie")).Should(Equal("X-AB-Group=control; Path=/"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Sticky group", func() {
+		Expect(enableABTesting(0, "http://alternate:8080")).Should(Succeed())
+		hdrs := addRequestHeader(makeRequestHeaders("GET", "/pass", "", 0), "Cookie", "X-AB-Group=test")
+		err := beginRequest(id, hdrs)
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WURI.*"))
+		Expect(cmd[4:]).Should(Equal("http://alternate:8080/pass"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(getABGroup(id)).Should(Equal("test"))
+
+		// No need to set the cookie again
+		err = beginResponse(rid, id, 200, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Invalid parameters", func() {
+		Expect(enableABTesting(1.5, "http://alternate:8080")).ShouldNot(Succeed())
+		Expect(enableABTesting(-0.1, "http://alternate:8080")).ShouldNot(Succeed())
+		Expect(enableABTesting(0.5, "/relative")).ShouldNot(Succeed())
+	})
+})
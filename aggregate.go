@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+/*
+ * Aggregation: instead of proxying the request, fetch a list of URLs one
+ * after the other and stream all their bodies back to the client as one
+ * response. The status and headers come from the first upstream that
+ * succeeds. The bodies are streamed, not buffered.
+ */
+
+// The HTTP client that is used when weaver itself talks to an upstream.
+var upstreamClient = &http.Client{
+	Transport: &pacedTransport{base: generationalTransport{}},
+}
+
+func setConcatResponses(id uint32, urls string, skipFailures bool) error {
+	req := getRequest(id)
+	if req == nil {
+		return fmt.Errorf("Unknown request: %d", id)
+	}
+	var list []string
+	for _, u := range strings.Split(urls, "\n") {
+		u = strings.TrimSpace(u)
+		if u != "" {
+			list = append(list, u)
+		}
+	}
+	if len(list) == 0 {
+		return fmt.Errorf("No URLs to concatenate")
+	}
+	req.concatURLs = list
+	req.concatSkipFailures = skipFailures
+	return nil
+}
+
+/*
+ * Fetch each URL in turn and write it to the response. If one fails and we
+ * are not skipping failures, then either send a 502 if nothing was sent
+ * yet, or an error command if we're already part way through the body.
+ */
+func (r *request) concatResponses() {
+	started := false
+
+	for _, u := range r.concatURLs {
+		resp, err := r.fetch("GET", u)
+		if err == nil && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+			resp.Body.Close()
+			err = fmt.Errorf("Upstream %s returned %d", u, resp.StatusCode)
+		}
+		if err != nil {
+			if r.concatSkipFailures {
+				continue
+			}
+			if started {
+				r.fail(err)
+			} else if isUpstreamBusy(err) {
+				r.reject(http.StatusServiceUnavailable, err.Error())
+			} else {
+				r.reject(http.StatusBadGateway, err.Error())
+			}
+			return
+		}
+
+		if !started {
+			hdrs := http.Header{}
+			if ct := resp.Header.Get("Content-Type"); ct != "" {
+				hdrs.Set("Content-Type", ct)
+			}
+			r.resp.headers = &hdrs
+			r.resp.WriteHeader(resp.StatusCode)
+			started = true
+		}
+
+		_, err = io.Copy(r.resp, resp.Body)
+		resp.Body.Close()
+		if err != nil && !r.concatSkipFailures {
+			r.fail(err)
+			return
+		}
+	}
+
+	if !started {
+		r.reject(http.StatusBadGateway, "No upstream succeeded")
+	}
+}
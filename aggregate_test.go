@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Concatenated Responses", func() {
+	var id uint32
+	var first, second, broken *httptest.Server
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+
+		first = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("Hello from the first server. "))
+		}))
+		second = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("Hello from the second server."))
+		}))
+		broken = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		first.Close()
+		second.Close()
+		broken.Close()
+	})
+
+	// Read commands until DONE and return everything that was written.
+	readResponse := func() (string, http.Header, []byte) {
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^SWCH.*"))
+		status := cmd[4:]
+
+		hdrs := http.Header{}
+		body := &bytes.Buffer{}
+		for cmd = pollRequest(id, true); cmd != "DONE"; cmd = pollRequest(id, true) {
+			switch cmd[:4] {
+			case cmdWhdr:
+				parseHeaders(hdrs, cmd[4:])
+			case cmdWbod:
+				body.Write(readBodyData(cmd))
+			default:
+				Fail(fmt.Sprintf("Unexpected command %s", cmd))
+			}
+		}
+		return status, hdrs, body.Bytes()
+	}
+
+	It("Concatenate two", func() {
+		err := setConcatResponses(id, first.URL+"\n"+second.URL, false)
+		Expect(err).Should(Succeed())
+		err = beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+
+		status, hdrs, body := readResponse()
+		Expect(status).Should(Equal("200"))
+		Expect(hdrs.Get("Content-Type")).Should(Equal("text/plain"))
+		Expect(string(body)).Should(Equal(
+			"Hello from the first server. Hello from the second server."))
+	})
+
+	It("Skip failures", func() {
+		err := setConcatResponses(id, broken.URL+"\n"+second.URL+"\n"+first.URL, true)
+		Expect(err).Should(Succeed())
+		err = beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+
+		status, hdrs, body := readResponse()
+		Expect(status).Should(Equal("200"))
+		Expect(hdrs.Get("Content-Type")).Should(Equal("application/json"))
+		Expect(string(body)).Should(Equal(
+			"Hello from the second server.Hello from the first server. "))
+	})
+
+	It("Fail before start", func() {
+		err := setConcatResponses(id, broken.URL+"\n"+first.URL, false)
+		Expect(err).Should(Succeed())
+		err = beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+
+		status, _, _ := readResponse()
+		Expect(status).Should(Equal("502"))
+	})
+
+	It("Fail part way", func() {
+		err := setConcatResponses(id, first.URL+"\n"+broken.URL, false)
+		Expect(err).Should(Succeed())
+		err = beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+
+		Expect(pollRequest(id, true)).Should(MatchRegexp("^SWCH.*"))
+		Expect(pollRequest(id, true)).Should(MatchRegexp("^WHDR.*"))
+		readBodyData(pollRequest(id, true))
+		Expect(pollRequest(id, true)).Should(MatchRegexp("^ERRR.+"))
+		Expect(pollRequest(id, false)).Should(BeEmpty())
+	})
+
+	It("No URLs", func() {
+		Expect(setConcatResponses(id, "\n", false)).ShouldNot(Succeed())
+	})
+})
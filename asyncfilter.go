@@ -0,0 +1,217 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+/*
+ * Let a response handler filter the body using a callback that finishes
+ * each chunk later, for instance after calling another service, without
+ * blocking the goroutine that is handling the response. Chunks are read
+ * from the target and handed to the filter on a separate goroutine, but only
+ * until a "window" of chunks are outstanding. Reading then stops until the
+ * filter calls "done" for the oldest one. Whatever the filter emits is sent
+ * on in the order of the chunks it came from. Handlers find
+ * SetBodyFilterAsync using a type assertion on the http.ResponseWriter.
+ */
+
+// AsyncBodyFilter filters one chunk of the body. It may call "emit" any
+// number of times, from any goroutine, and must call "done" once when it has
+// finished with the chunk. "last" is true for the last chunk, which may be
+// empty. The type is an alias, so a handler's interface may spell out the
+// func type instead.
+type AsyncBodyFilter = func(chunk []byte, last bool, emit func([]byte), done func(error))
+
+const defaultAsyncFilterWindow = 4
+
+func setAsyncFilterWindow(window int) {
+	updateSettings(func(s *settings) {
+		s.asyncFilterWindow = window
+	})
+}
+
+/*
+ * SetBodyFilterAsync replaces the response body with one that is passed
+ * through "filter." Nothing is read until the body is. It must be called
+ * before the handler reads the body or writes a response of its own, and
+ * before it returns.
+ */
+func (h *httpResponse) SetBodyFilterAsync(filter AsyncBodyFilter) error {
+	r, ok := h.handler.(*response)
+	if !ok {
+		return errNoResponseBody
+	}
+	window := r.request.settings.asyncFilterWindow
+	if window <= 0 {
+		window = defaultAsyncFilterWindow
+	}
+	set := false
+	r.phase.whileOpen(func() {
+		if r.readStarted || r.written {
+			return
+		}
+		r.resp.Body = &asyncFilterBody{
+			src:      r.resp.Body,
+			filter:   filter,
+			response: r,
+			window:   make(chan bool, window),
+			chunks:   make(chan *filteredChunk, window),
+			stop:     make(chan bool),
+			stopped:  make(chan bool),
+		}
+		set = true
+	})
+	if !set {
+		return tooLate(r.request, "SetBodyFilterAsync")
+	}
+	return nil
+}
+
+type filteredChunk struct {
+	lock     sync.Mutex
+	out      [][]byte
+	finished bool
+	result   chan error
+	release  func()
+}
+
+func (c *filteredChunk) emit(buf []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.finished || len(buf) == 0 {
+		return
+	}
+	saved := make([]byte, len(buf))
+	copy(saved, buf)
+	c.out = append(c.out, saved)
+}
+
+func (c *filteredChunk) done(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.finished {
+		return
+	}
+	c.finished = true
+	c.result <- err
+	c.release()
+}
+
+type asyncFilterBody struct {
+	src      io.ReadCloser
+	filter   AsyncBodyFilter
+	response *response
+	window   chan bool
+	chunks   chan *filteredChunk
+	stop     chan bool
+	stopped  chan bool
+	started  bool
+	out      [][]byte
+	err      error
+}
+
+func (b *asyncFilterBody) Read(buf []byte) (int, error) {
+	if !b.started {
+		// The first read happens here so that the response headers
+		// are flushed by the goroutine that owns them.
+		b.started = true
+		data, err := readChunk(b.src)
+		go b.pump(data, err)
+	}
+
+	for len(b.out) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		c, ok := <-b.chunks
+		if !ok {
+			b.err = io.EOF
+			continue
+		}
+		if err := <-c.result; err != nil {
+			b.err = err
+			b.response.bodyErr = err
+			continue
+		}
+		c.lock.Lock()
+		b.out = c.out
+		c.lock.Unlock()
+	}
+
+	n := copy(buf, b.out[0])
+	if n < len(b.out[0]) {
+		b.out[0] = b.out[0][n:]
+	} else {
+		b.out = b.out[1:]
+	}
+	return n, nil
+}
+
+func (b *asyncFilterBody) Close() error {
+	if b.started {
+		close(b.stop)
+		<-b.stopped
+		b.started = false
+	}
+	return b.src.Close()
+}
+
+/*
+ * Read chunks from the target and pass them to the filter, which happens
+ * one chunk behind so that we know which chunk is the last.
+ */
+func (b *asyncFilterBody) pump(data []byte, err error) {
+	defer close(b.stopped)
+	defer close(b.chunks)
+
+	for {
+		c := &filteredChunk{
+			result: make(chan error, 1),
+			release: func() {
+				<-b.window
+			},
+		}
+		select {
+		case b.window <- true:
+		case <-b.stop:
+			return
+		}
+		select {
+		case b.chunks <- c:
+		case <-b.stop:
+			return
+		}
+		if err != nil && err != io.EOF {
+			c.done(err)
+			return
+		}
+
+		last := err == io.EOF
+		var next []byte
+		var nextErr error
+		if !last {
+			next, nextErr = readChunk(b.src)
+			last = nextErr == io.EOF && len(next) == 0
+		}
+		b.filter(data, last, c.emit, c.done)
+		if last {
+			return
+		}
+		data, err = next, nextErr
+	}
+}
+
+/*
+ * Return the next non-empty chunk from "src," which may come with io.EOF
+ * if it was also the last.
+ */
+func readChunk(src io.Reader) ([]byte, error) {
+	buf := make([]byte, bodyBufSize)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 || err != nil {
+			return buf[:n], err
+		}
+	}
+}
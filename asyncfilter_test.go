@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync/atomic"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Async body filter", func() {
+	var id, rid uint32
+
+	BeforeEach(func() {
+		atomic.StoreInt32(&asyncFilterMaxInFlight, 0)
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		rid = createResponse(testHandler)
+		Expect(rid).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		freeResponse(rid)
+		resetSettings()
+	})
+
+	start := func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/asyncfilter", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		err = beginResponse(rid, id, 200, makeResponseHeaders("text/plain", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("RBOD"))
+	}
+
+	// Send the chunks from another goroutine, since reading may pause, and
+	// return the body, or the last command if it wasn't DONE.
+	run := func(chunks ...string) (string, string) {
+		go func() {
+			for i, c := range chunks {
+				sendResponseBodyChunk(rid, i == len(chunks)-1, []byte(c))
+			}
+		}()
+		var body []byte
+		cmd := pollResponse(rid, true)
+		for cmd[:4] == "WBOD" {
+			body = append(body, readBodyData(cmd)...)
+			cmd = pollResponse(rid, true)
+		}
+		return string(body), cmd
+	}
+
+	It("Keeps order", func() {
+		start()
+		body, cmd := run("the slowest chunk, ", "a slow one, ", "quick")
+		Expect(cmd).Should(Equal("DONE"))
+		Expect(body).Should(Equal("THE SLOWEST CHUNK, A SLOW ONE, QUICK."))
+		Expect(atomic.LoadInt32(&asyncFilterMaxInFlight)).Should(BeNumerically(">", 1))
+	})
+
+	It("Empty body", func() {
+		start()
+		body, cmd := run("")
+		Expect(cmd).Should(Equal("DONE"))
+		Expect(body).Should(Equal("."))
+	})
+
+	It("Window", func() {
+		setAsyncFilterWindow(1)
+		start()
+		body, cmd := run("one ", "two ", "three ", "four")
+		Expect(cmd).Should(Equal("DONE"))
+		Expect(body).Should(Equal("ONE TWO THREE FOUR."))
+		Expect(atomic.LoadInt32(&asyncFilterMaxInFlight)).Should(BeEquivalentTo(1))
+	})
+
+	It("Failure", func() {
+		start()
+		body, cmd := run("good, ", "bad, ", "good")
+		Expect(body).Should(Equal("GOOD, "))
+		Expect(cmd).Should(Equal("ERRRFilter failed"))
+	})
+})
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"hash"
 	"io"
 )
 
@@ -9,10 +11,18 @@ import (
 */
 import "C"
 
+var errBodyStopped = errors.New("The target stopped reading the request body")
+
 type requestBody struct {
 	handler commandHandler
 	started bool
 	curBuf  []byte
+	// The body was read to the end, or thrown away by Close
+	finished bool
+	// If it is set, everything that is read goes through "hash," whoever
+	// reads it, and "sum" is set once the whole body has been read.
+	hash hash.Hash
+	sum  []byte
 }
 
 func (b *requestBody) Read(buf []byte) (int, error) {
@@ -25,35 +35,63 @@ func (b *requestBody) Read(buf []byte) (int, error) {
 
 	cb := b.curBuf
 	if cb == nil {
-		// Will return nil at end of channel.
-		cb = <-b.handler.Bodies()
-	}
-
-	if cb == nil {
-		return 0, io.EOF
+		b.handler.SafePoint()
+		var err error
+		cb, err = b.nextChunk()
+		if err == io.EOF {
+			b.finished = true
+			if b.hash != nil {
+				b.sum = b.hash.Sum(nil)
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
 	}
 
-	if len(cb) <= len(buf) {
+	n := len(cb)
+	if n <= len(buf) {
 		copy(buf, cb)
 		//copy((*[1<<30]byte)(buf)[:], cb)
 		b.curBuf = nil
-		return len(cb), nil
+	} else {
+		n = len(buf)
+		copy(buf, cb[:n])
+		b.curBuf = cb[n:]
 	}
-
-	copy(buf, cb[:len(buf)])
-	b.curBuf = cb[len(buf):]
-	return len(buf), nil
+	if b.hash != nil {
+		b.hash.Write(buf[:n])
+	}
+	return n, nil
 }
 
 func (b *requestBody) Close() error {
 	if b.started {
 		// Need to clear the channel.
 		b.curBuf = nil
-		drained := <-b.handler.Bodies()
-		for drained != nil {
-			drained = <-b.handler.Bodies()
+		_, err := b.nextChunk()
+		for err == nil {
+			_, err = b.nextChunk()
 		}
 		b.started = false
+		b.finished = true
 	}
 	return nil
 }
+
+/*
+ * Wait for the next chunk from the caller. Return io.EOF at the end of the
+ * body, or errBodyStopped if we gave up on it.
+ */
+func (b *requestBody) nextChunk() ([]byte, error) {
+	select {
+	case cb := <-b.handler.Bodies():
+		// Will return nil at end of channel.
+		if cb == nil {
+			return nil, io.EOF
+		}
+		return cb, nil
+	case <-b.handler.BodyStopped():
+		return nil, errBodyStopped
+	}
+}
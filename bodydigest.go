@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+/*
+ * Optionally keep a SHA-256 hash of each request body that weaver sends to
+ * the target. It is computed a chunk at a time as the body is sent, so
+ * nothing extra is buffered, and it is available once the last chunk has
+ * gone out. This only covers bodies that weaver sends using WBOD. If the
+ * caller forwards the body itself, weaver never sees it.
+ */
+
+func setRequestBodyHashing(enabled bool) {
+	updateSettings(func(s *settings) {
+		s.hashRequestBodies = enabled
+	})
+}
+
+/*
+ * Wrap the body so that it is hashed as it is read. The hash is saved once
+ * the body has been read to the end, so a body that was cut short has none.
+ */
+func (r *request) hashBodyStream(body io.ReadCloser) io.ReadCloser {
+	if !r.settings.hashRequestBodies {
+		return body
+	}
+	h := sha256.New()
+	return &hashingBody{
+		Reader: io.TeeReader(body, h),
+		closer: body,
+		done: func() {
+			r.bodyLock.Lock()
+			r.bodyHash = h.Sum(nil)
+			r.bodyLock.Unlock()
+		},
+	}
+}
+
+/*
+ * RequestBodyHash returns the SHA-256 hash of the body that was sent to the
+ * target, or nil if it is not available (yet).
+ */
+func (r *request) RequestBodyHash() []byte {
+	r.bodyLock.Lock()
+	defer r.bodyLock.Unlock()
+	return r.bodyHash
+}
+
+func getRequestBodyHash(id uint32) (string, error) {
+	req := getRequest(id)
+	if req == nil {
+		return "", fmt.Errorf("Unknown request: %d", id)
+	}
+	return hex.EncodeToString(req.RequestBodyHash()), nil
+}
+
+type hashingBody struct {
+	io.Reader
+	closer io.Closer
+	done   func()
+}
+
+func (b *hashingBody) Read(buf []byte) (int, error) {
+	n, err := b.Reader.Read(buf)
+	if err == io.EOF && b.done != nil {
+		b.done()
+		b.done = nil
+	}
+	return n, err
+}
+
+func (b *hashingBody) Close() error {
+	return b.closer.Close()
+}
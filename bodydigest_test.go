@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/sha256"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Request Body Digest", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		resetSettings()
+	})
+
+	It("Off by default", func() {
+		err := beginRequest(id, makeRequestHeaders("POST", "/replacebody", "", 0))
+		Expect(err).Should(Succeed())
+		readBodyData(pollRequest(id, true))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(getRequest(id).RequestBodyHash()).Should(BeNil())
+	})
+
+	It("Hash while streaming", func() {
+		setRequestBodyHashing(true)
+		err := beginRequest(id, makeRequestHeaders("POST", "/streambody", "text/plain", 13))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("RBOD"))
+
+		// The first chunk goes out before the rest arrives.
+		sendRequestBodyChunk(id, false, []byte("Hello, "))
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+		Expect(string(readBodyData(cmd))).Should(Equal("Hello, "))
+		Expect(getRequest(id).RequestBodyHash()).Should(BeNil())
+
+		sendRequestBodyChunk(id, true, []byte("World!"))
+		cmd = pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+		Expect(string(readBodyData(cmd))).Should(Equal("World!"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		expected := sha256.Sum256([]byte("Hello, World!"))
+		Expect(getRequest(id).RequestBodyHash()).Should(Equal(expected[:]))
+		hash, err := getRequestBodyHash(id)
+		Expect(err).Should(Succeed())
+		Expect(hash).Should(HaveLen(64))
+	})
+
+	It("No hash of a body that was cut short", func() {
+		setRequestBodyHashing(true)
+		err := beginRequest(id, makeRequestHeaders("POST", "/streambody", "text/plain", 13))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("RBOD"))
+		sendRequestBodyChunk(id, false, []byte("Hello, "))
+		Expect(readBodyData(pollRequest(id, true))).Should(Equal([]byte("Hello, ")))
+
+		// The target answers before the rest of the body arrives.
+		rid := createResponse(testHandler)
+		defer freeResponse(rid)
+		Expect(beginResponse(rid, id, 200, makeResponseHeaders("text/plain", 0))).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("SBOD"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(getRequest(id).RequestBodyHash()).Should(BeNil())
+	})
+})
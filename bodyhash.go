@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+/*
+ * Optionally add a hash of the response body to the response headers, so
+ * that the client can check that it got what the target (and any handler
+ * that filtered the body) meant to send. Since the headers have to go out
+ * before the body, the whole body has to be read into memory and hashed
+ * before anything is sent.
+ */
+
+var bodyHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+/*
+ * Turn on body hashing. An empty header name turns it off.
+ */
+func setBodyHashHeader(name, algorithm string) error {
+	if name == "" {
+		updateSettings(func(s *settings) {
+			s.bodyHashHeader = ""
+			s.bodyHashAlgorithm = ""
+		})
+		return nil
+	}
+
+	alg := strings.ToLower(algorithm)
+	if bodyHashes[alg] == nil {
+		return fmt.Errorf("Unsupported hash algorithm: %s", algorithm)
+	}
+	updateSettings(func(s *settings) {
+		s.bodyHashHeader = http.CanonicalHeaderKey(name)
+		s.bodyHashAlgorithm = alg
+	})
+	return nil
+}
+
+/*
+ * Return true if the body should be hashed. This doesn't apply if the
+ * handler wrote a response of its own.
+ */
+func (r *response) hashingBody() bool {
+	return r.request.settings.bodyHashHeader != "" && !r.written
+}
+
+/*
+ * Read the whole body, after any handler filtered it, and add its hash to the
+ * headers. Then send the headers and the body that was read.
+ */
+func (r *response) flushHashedBody() {
+	s := r.request.settings
+	h := bodyHashes[s.bodyHashAlgorithm]()
+	buf := &bytes.Buffer{}
+	_, err := io.Copy(io.MultiWriter(buf, h), r.resp.Body)
+	r.resp.Body.Close()
+
+	r.resp.Header.Set(s.bodyHashHeader, hex.EncodeToString(h.Sum(nil)))
+	r.setBodyLength(buf.Len())
+	r.flushHeaders()
+	if r.flushSplitBody() {
+		return
+	}
+	if err == nil {
+		r.storeNegative(buf.Bytes())
+	}
+	readAndSend(r, ioutil.NopCloser(buf))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Body Hash", func() {
+	var id uint32
+	var rid uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		rid = createResponse(testHandler)
+		Expect(rid).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		freeResponse(rid)
+		resetSettings()
+	})
+
+	hashOf := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+
+	It("Bad algorithm", func() {
+		Expect(setBodyHashHeader("X-Body-Hash", "crc32")).ShouldNot(Succeed())
+		Expect(getSettings().bodyHashHeader).Should(BeEmpty())
+	})
+
+	It("Hash unmodified body", func() {
+		Expect(setBodyHashHeader("x-body-hash", "SHA256")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		msg := "Hello, Response Server!"
+		err = beginResponse(rid, id, 200, makeResponseHeaders("text/plain", len(msg)))
+		Expect(err).Should(Succeed())
+
+		Expect(pollResponse(rid, true)).Should(Equal("RBOD"))
+		sendResponseBodyChunk(rid, true, []byte(msg))
+
+		cmd := pollResponse(rid, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.+"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("X-Body-Hash")).Should(Equal(hashOf(msg)))
+
+		cmd = pollResponse(rid, true)
+		Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+		Expect(string(readBodyData(cmd))).Should(Equal(msg))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Hash filtered body", func() {
+		Expect(setBodyHashHeader("X-Body-Hash", "sha256")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/transformbodychunks", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		err = beginResponse(rid, id, 200, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+
+		// Headers are held back until the body has been read
+		Expect(pollResponse(rid, true)).Should(Equal("RBOD"))
+		sendResponseBodyChunk(rid, true, []byte("Hello, Response Server!"))
+
+		cmd := pollResponse(rid, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.+"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("X-Apigee-Transformed")).Should(Equal("yes"))
+		Expect(hdrs.Get("X-Body-Hash")).Should(Equal(hashOf("{Hello, Response Server!}")))
+
+		cmd = pollResponse(rid, true)
+		Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+		Expect(string(readBodyData(cmd))).Should(Equal("{Hello, Response Server!}"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Handler response is not hashed", func() {
+		Expect(setBodyHashHeader("X-Body-Hash", "sha256")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/responseerror2", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		err = beginResponse(rid, id, 200, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+
+		Expect(pollResponse(rid, true)).Should(MatchRegexp("^SWCH.*"))
+		cmd := pollResponse(rid, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.+"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("X-Body-Hash")).Should(BeEmpty())
+	})
+})
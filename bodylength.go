@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+/*
+ * When weaver reads the response body itself, check it against the
+ * Content-Length that the target sent. A short body means that the target
+ * went away, so the response ends with an error rather than looking
+ * complete. Anything past the declared length is not part of this response,
+ * so it is thrown away, and since the target can't be trusted to frame its
+ * responses, the response ends with "DONEclose" so that the caller doesn't
+ * reuse the connection.
+ */
+
+/*
+ * Wrap the body if the target declared its length.
+ */
+func (r *response) checkBodyLength() {
+	if r.resp.Header.Get("Transfer-Encoding") != "" || !bodyAllowed(r.request.req, r.resp.StatusCode) {
+		return
+	}
+	cl := r.resp.Header.Get("Content-Length")
+	if cl == "" {
+		return
+	}
+	declared, err := strconv.ParseInt(cl, 10, 64)
+	if err != nil || declared < 0 {
+		return
+	}
+	r.resp.Body = &lengthCheckedBody{
+		body:      r.resp.Body,
+		response:  r,
+		declared:  declared,
+		remaining: declared,
+	}
+}
+
+/*
+ * Return whether a response to "req" with "status" may have a body.
+ */
+func bodyAllowed(req *http.Request, status int) bool {
+	return req.Method != http.MethodHead && status >= 200 &&
+		status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+type lengthCheckedBody struct {
+	body      io.ReadCloser
+	response  *response
+	declared  int64
+	remaining int64
+}
+
+func (b *lengthCheckedBody) Read(p []byte) (int, error) {
+	if b.remaining == 0 {
+		b.discardExcess()
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.body.Read(p)
+	b.remaining -= int64(n)
+	if err == io.EOF && b.remaining > 0 {
+		err = fmt.Errorf("Response body truncated: got %d of %d bytes",
+			b.declared-b.remaining, b.declared)
+		b.response.bodyErr = err
+		updateStats(func(s *stats) {
+			s.ShortResponses++
+		})
+	}
+	return n, err
+}
+
+func (b *lengthCheckedBody) discardExcess() {
+	excess, _ := io.Copy(ioutil.Discard, b.body)
+	if excess == 0 {
+		return
+	}
+	b.response.closeClient = true
+	log.Printf("Response to %s %s had %d bytes past its Content-Length of %d",
+		b.response.request.req.Method, b.response.request.req.URL, excess, b.declared)
+	updateStats(func(s *stats) {
+		s.LongResponses++
+		s.DiscardedBytes += excess
+	})
+}
+
+func (b *lengthCheckedBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Response body length", func() {
+	var id, rid uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		rid = createResponse(testHandler)
+		Expect(rid).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		freeResponse(rid)
+	})
+
+	// Declare one length, send a body of another, and return the body that
+	// came back and the last command.
+	run := func(path string, declared int, chunks ...string) (string, string) {
+		err := beginRequest(id, makeRequestHeaders("GET", path, "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		err = beginResponse(rid, id, 200, makeResponseHeaders("text/plain", declared))
+		Expect(err).Should(Succeed())
+		go func() {
+			for i, c := range chunks {
+				sendResponseBodyChunk(rid, i == len(chunks)-1, []byte(c))
+			}
+		}()
+
+		body := &bytes.Buffer{}
+		cmd := pollResponse(rid, true)
+		for ; cmd[:4] == "RBOD" || cmd[:4] == "WHDR" || cmd[:4] == "WBOD"; cmd = pollResponse(rid, true) {
+			if cmd[:4] == "WBOD" {
+				body.Write(readBodyData(cmd))
+			}
+		}
+		return body.String(), cmd
+	}
+
+	It("Exact", func() {
+		body, cmd := run("/transformbodychunks", 13, "Hello, ", "World!")
+		Expect(body).Should(Equal("{Hello, }{World!}"))
+		Expect(cmd).Should(Equal("DONE"))
+	})
+
+	It("Short", func() {
+		before := getStats().ShortResponses
+		body, cmd := run("/transformbodychunks", 20, "Hello, ", "World!")
+		Expect(body).Should(Equal("{Hello, }{World!}"))
+		Expect(cmd).Should(Equal("ERRRResponse body truncated: got 13 of 20 bytes"))
+		Expect(getStats().ShortResponses).Should(Equal(before + 1))
+	})
+
+	It("Long", func() {
+		before := getStats()
+		body, cmd := run("/transformbodychunks", 9, "Hello, ", "World!")
+		Expect(body).Should(Equal("{Hello, }{Wo}"))
+		Expect(cmd).Should(Equal("DONEclose"))
+		after := getStats()
+		Expect(after.LongResponses).Should(Equal(before.LongResponses + 1))
+		Expect(after.DiscardedBytes).Should(Equal(before.DiscardedBytes + 4))
+	})
+
+	It("Short with async filter", func() {
+		// The filter never sees the last chunk, so it doesn't add "."
+		body, cmd := run("/asyncfilter", 20, "Hello, ", "World!")
+		Expect(body).Should(Equal("HELLO, WORLD!"))
+		Expect(cmd).Should(HavePrefix("ERRR"))
+	})
+
+	It("Exact with async filter", func() {
+		body, cmd := run("/asyncfilter", 13, "Hello, ", "World!")
+		Expect(body).Should(Equal("HELLO, WORLD!."))
+		Expect(cmd).Should(Equal("DONE"))
+	})
+})
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/*
+ * Built-in routes for trivial endpoints that aren't worth running the
+ * handler for: "healthz" answers with a 200 and "ok," and "favicon" answers
+ * with a 204 that browsers may cache, so that they stop asking. The routes
+ * are configured with one JSON object that gives the path of each, such as
+ * {"healthz": "/healthz", "favicon": "/favicon.ico"}. A route that isn't
+ * given is off, and they are all off by default.
+ */
+
+const (
+	builtinHealthz = "healthz"
+	builtinFavicon = "favicon"
+)
+
+const builtinHealthzMessage = "ok"
+
+type builtinRoutesConfig struct {
+	Healthz string `json:"healthz"`
+	Favicon string `json:"favicon"`
+}
+
+func setBuiltinRoutes(config string) error {
+	routes := make(map[string]string)
+	if strings.TrimSpace(config) != "" {
+		var c builtinRoutesConfig
+		d := json.NewDecoder(bytes.NewBufferString(config))
+		d.DisallowUnknownFields()
+		if err := d.Decode(&c); err != nil {
+			return fmt.Errorf("Invalid built-in routes: %v", err)
+		}
+		for kind, path := range map[string]string{
+			builtinHealthz: c.Healthz,
+			builtinFavicon: c.Favicon,
+		} {
+			if path == "" {
+				continue
+			}
+			if !strings.HasPrefix(path, "/") {
+				return fmt.Errorf("Invalid path for %s: \"%s\"", kind, path)
+			}
+			if routes[path] != "" {
+				return fmt.Errorf("Path \"%s\" is used twice", path)
+			}
+			routes[path] = kind
+		}
+	}
+	updateSettings(func(s *settings) {
+		s.builtinRoutes = routes
+	})
+	return nil
+}
+
+func (r *request) serveBuiltin() bool {
+	kind := r.settings.builtinRoutes[r.req.URL.Path]
+	if kind == "" || (r.req.Method != "GET" && r.req.Method != "HEAD") {
+		return false
+	}
+	hdrs := http.Header{}
+	r.resp.headers = &hdrs
+	switch kind {
+	case builtinHealthz:
+		hdrs.Set("Content-Type", "text/plain")
+		hdrs.Set("Cache-Control", "no-store")
+		r.resp.WriteHeader(http.StatusOK)
+		if r.req.Method != "HEAD" {
+			r.resp.Write([]byte(builtinHealthzMessage))
+		}
+	case builtinFavicon:
+		hdrs.Set("Cache-Control", "public, max-age=86400")
+		r.resp.WriteHeader(http.StatusNoContent)
+	}
+	return true
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Built-in routes", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		resetSettings()
+	})
+
+	It("Healthz", func() {
+		Expect(setBuiltinRoutes(`{"healthz": "/healthz"}`)).Should(Succeed())
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/healthz", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("SWCH200"))
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("WHDR"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("Content-Type")).Should(Equal("text/plain"))
+		cmd = pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("WBOD"))
+		Expect(string(readBodyData(cmd))).Should(Equal(builtinHealthzMessage))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Favicon", func() {
+		Expect(setBuiltinRoutes(`{"healthz": "/healthz", "favicon": "/favicon.ico"}`)).Should(Succeed())
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/favicon.ico", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("SWCH204"))
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("WHDR"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("Cache-Control")).Should(HavePrefix("public"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Disabled", func() {
+		Expect(setBuiltinRoutes(`{"healthz": "/pass"}`)).Should(Succeed())
+		Expect(setBuiltinRoutes("")).Should(Succeed())
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Other methods", func() {
+		Expect(setBuiltinRoutes(`{"healthz": "/pass"}`)).Should(Succeed())
+		Expect(beginRequest(id, makeRequestHeaders("DELETE", "/pass", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Invalid", func() {
+		Expect(setBuiltinRoutes(`{"healthz": "healthz"}`)).ShouldNot(Succeed())
+		Expect(setBuiltinRoutes(`{"healthz": "/x", "favicon": "/x"}`)).ShouldNot(Succeed())
+		Expect(setBuiltinRoutes(`{"robots": "/robots.txt"}`)).ShouldNot(Succeed())
+		Expect(getSettings().builtinRoutes).Should(BeEmpty())
+	})
+})
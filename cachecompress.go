@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+/*
+ * Bodies that weaver keeps in memory, such as in the negative cache, may be
+ * compressed using gzip at its fastest level. Each entry records whether it
+ * was compressed, so turning this on or off leaves existing entries usable.
+ * Small bodies, and content that is usually compressed already, are stored
+ * as they are, and so is anything that doesn't get smaller.
+ */
+
+const (
+	// CacheCompressionNone stores bodies as they are
+	CacheCompressionNone = "none"
+	// CacheCompressionGzip stores bodies compressed using gzip
+	CacheCompressionGzip = "gzip"
+
+	minCompressedBody = 256
+)
+
+func setCacheCompression(algorithm string) error {
+	switch algorithm {
+	case CacheCompressionNone, CacheCompressionGzip:
+	default:
+		return fmt.Errorf("Invalid cache compression: \"%s\"", algorithm)
+	}
+	updateSettings(func(s *settings) {
+		s.compressCache = algorithm == CacheCompressionGzip
+	})
+	return nil
+}
+
+/*
+ * Return whether a body with these headers is worth compressing.
+ */
+func shouldCompress(hdrs http.Header, body []byte) bool {
+	if len(body) < minCompressedBody {
+		return false
+	}
+	if hdrs.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(hdrs.Get("Content-Type"))
+	switch {
+	case strings.HasPrefix(mediaType, "image/"),
+		strings.HasPrefix(mediaType, "video/"),
+		strings.HasPrefix(mediaType, "audio/"):
+		return mediaType == "image/svg+xml"
+	case mediaType == "application/zip",
+		mediaType == "application/gzip",
+		mediaType == "application/x-gzip",
+		mediaType == "application/octet-stream":
+		return false
+	}
+	return true
+}
+
+/*
+ * Return the body to store, and whether it was compressed.
+ */
+func compressBody(hdrs http.Header, body []byte) ([]byte, bool) {
+	if !shouldCompress(hdrs, body) {
+		return body, false
+	}
+	buf := &bytes.Buffer{}
+	gz, _ := gzip.NewWriterLevel(buf, gzip.BestSpeed)
+	gz.Write(body)
+	gz.Close()
+	if buf.Len() >= len(body) {
+		return body, false
+	}
+	updateStats(func(s *stats) {
+		s.CacheBytesBeforeCompression += int64(len(body))
+		s.CacheBytesAfterCompression += int64(buf.Len())
+	})
+	return buf.Bytes(), true
+}
+
+func decompressBody(body []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return ioutil.ReadAll(gz)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cache Compression", func() {
+	text := bytes.Repeat([]byte("<p>Nothing to see here.</p>\n"), 200)
+
+	AfterEach(func() {
+		resetSettings()
+		clearNegativeCache()
+	})
+
+	textHeaders := func(contentType string) http.Header {
+		hdrs := http.Header{}
+		hdrs.Set("Content-Type", contentType)
+		return hdrs
+	}
+
+	It("Round trip", func() {
+		stored, compressed := compressBody(textHeaders("text/html; charset=utf-8"), text)
+		Expect(compressed).Should(BeTrue())
+		Expect(len(stored)).Should(BeNumerically("<", len(text)/5))
+		body, err := decompressBody(stored)
+		Expect(err).Should(Succeed())
+		Expect(body).Should(Equal(text))
+	})
+
+	It("Skip", func() {
+		_, compressed := compressBody(textHeaders("image/png"), text)
+		Expect(compressed).Should(BeFalse())
+		_, compressed = compressBody(textHeaders("image/svg+xml"), text)
+		Expect(compressed).Should(BeTrue())
+
+		gzipped := textHeaders("text/html")
+		gzipped.Set("Content-Encoding", "gzip")
+		_, compressed = compressBody(gzipped, text)
+		Expect(compressed).Should(BeFalse())
+
+		_, compressed = compressBody(textHeaders("text/plain"), []byte("Not found"))
+		Expect(compressed).Should(BeFalse())
+
+		random := make([]byte, 4096)
+		rand.New(rand.NewSource(1)).Read(random)
+		stored, compressed := compressBody(textHeaders("text/plain"), random)
+		Expect(compressed).Should(BeFalse())
+		Expect(stored).Should(Equal(random))
+	})
+
+	It("Invalid", func() {
+		Expect(setCacheCompression("snappy")).ShouldNot(Succeed())
+		Expect(setCacheCompression(CacheCompressionGzip)).Should(Succeed())
+		Expect(getSettings().compressCache).Should(BeTrue())
+		Expect(setCacheCompression(CacheCompressionNone)).Should(Succeed())
+		Expect(getSettings().compressCache).Should(BeFalse())
+	})
+
+	It("Capacity", func() {
+		expires := time.Now().Add(time.Minute)
+		putNegativeEntry("a", &negativeEntry{body: make([]byte, 100), expires: expires})
+		putNegativeEntry("b", &negativeEntry{body: make([]byte, 50), expires: expires})
+		Expect(getNegativeCacheBytes()).Should(Equal(150))
+		putNegativeEntry("a", &negativeEntry{body: make([]byte, 10), expires: expires})
+		Expect(getNegativeCacheBytes()).Should(Equal(60))
+
+		// Expired entries make room
+		putNegativeEntry("c", &negativeEntry{body: make([]byte, 10), expires: time.Now()})
+		putNegativeEntry("big", &negativeEntry{
+			body: make([]byte, maxNegativeCacheBytes-60), expires: expires})
+		Expect(getNegativeCacheBytes()).Should(Equal(maxNegativeCacheBytes))
+		putNegativeEntry("d", &negativeEntry{body: make([]byte, 1), expires: expires})
+		Expect(getNegativeEntry("d")).Should(BeNil())
+
+		clearNegativeCache()
+		Expect(getNegativeCacheBytes()).Should(BeZero())
+	})
+
+	It("Replay", func() {
+		Expect(setCacheCompression(CacheCompressionGzip)).Should(Succeed())
+		setNegativeCacheTTL(http.StatusNotFound, time.Minute)
+		before := getStats()
+
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		rid := createResponse(testHandler)
+		defer freeResponse(rid)
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass/compressed", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		err = beginResponse(rid, id, 404, makeResponseHeaders("text/html", len(text)))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("RBOD"))
+		sendResponseBodyChunk(rid, true, text)
+		Expect(readBodyData(pollResponse(rid, true))).Should(Equal(text))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+
+		stored := getNegativeCacheBytes()
+		Expect(stored).Should(BeNumerically("<", len(text)/5))
+		after := getStats()
+		Expect(after.CacheBytesBeforeCompression - before.CacheBytesBeforeCompression).Should(
+			BeEquivalentTo(len(text)))
+		Expect(after.CacheBytesAfterCompression - before.CacheBytesAfterCompression).Should(
+			BeEquivalentTo(stored))
+
+		cid := createRequest(testHandler)
+		defer freeRequest(cid)
+		err = beginRequest(cid, makeRequestHeaders("GET", "/pass/compressed", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(cid, true)).Should(Equal("SWCH404"))
+		cmd := pollRequest(cid, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("Content-Length")).Should(Equal(strconv.Itoa(len(text))))
+		Expect(readBodyData(pollRequest(cid, true))).Should(Equal(text))
+		Expect(pollRequest(cid, true)).Should(Equal("DONE"))
+	})
+})
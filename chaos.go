@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Chaos mode injects faults into the stream of commands returned by
+ * GoPollRequest and GoPollResponse, so that people who embed weaver can
+ * test how their code copes. It does nothing unless it is enabled.
+ *
+ * The spec is a list of "name=value" pairs separated by semicolons:
+ *
+ *   match=PREFIX    Only affect requests whose URI starts with PREFIX.
+ *                   Without it, every request is affected.
+ *   reorder=N       Return commands in random order within a window of N.
+ *   duplicate=LIST  Return each command in the comma-separated list twice.
+ *                   Only WHDR, WURI, and WSTA may be duplicated.
+ *   delaydone=MS    Wait MS milliseconds before returning DONE or ERRR.
+ *   nullpoll=BOOL   Return nothing (NULL) from the first poll that would
+ *                   have returned a command.
+ *   seed=N          Seed for the random reordering, so that tests repeat.
+ *
+ * Whatever the spec says, DONE or ERRR is still returned exactly once, as
+ * the last command. Commands that hand over a chunk (WBOD and WSHR) or ask
+ * for the body (RBOD) are never duplicated.
+ */
+
+type chaosSpec struct {
+	match     string
+	reorder   int
+	duplicate map[CommandID]bool
+	delayDone time.Duration
+	nullPoll  bool
+	seed      int64
+}
+
+var duplicableCommands = map[CommandID]bool{
+	WHDR: true,
+	WURI: true,
+	WSTA: true,
+}
+
+func parseChaosSpec(spec string) (*chaosSpec, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+
+	cs := &chaosSpec{
+		duplicate: make(map[CommandID]bool),
+		seed:      1,
+	}
+	for _, part := range strings.Split(spec, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid chaos setting: \"%s\"", part)
+		}
+		name := strings.TrimSpace(kv[0])
+		val := strings.TrimSpace(kv[1])
+
+		var err error
+		switch name {
+		case "match":
+			cs.match = val
+		case "reorder":
+			cs.reorder, err = strconv.Atoi(val)
+			if err == nil && cs.reorder < 0 {
+				err = fmt.Errorf("Invalid reorder window: %d", cs.reorder)
+			}
+		case "duplicate":
+			for _, cmdName := range strings.Split(val, ",") {
+				id, found := parseCommandID(strings.TrimSpace(cmdName))
+				if !found || !duplicableCommands[id] {
+					return nil, fmt.Errorf("Command may not be duplicated: \"%s\"", cmdName)
+				}
+				cs.duplicate[id] = true
+			}
+		case "delaydone":
+			var ms int
+			ms, err = strconv.Atoi(val)
+			cs.delayDone = time.Duration(ms) * time.Millisecond
+		case "nullpoll":
+			cs.nullPoll, err = strconv.ParseBool(val)
+		case "seed":
+			cs.seed, err = strconv.ParseInt(val, 10, 64)
+		default:
+			return nil, fmt.Errorf("Unknown chaos setting: \"%s\"", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cs, nil
+}
+
+func parseCommandID(name string) (CommandID, bool) {
+	for id := DONE; id < CommandID(len(_CommandID_index)-1); id++ {
+		if id.String() == name {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+/*
+ * Turn on chaos mode, or turn it off if the spec is empty.
+ */
+func enableChaosMode(spec string) error {
+	cs, err := parseChaosSpec(spec)
+	if err != nil {
+		return err
+	}
+	updateSettings(func(s *settings) {
+		s.chaos = cs
+	})
+	return nil
+}
+
+/*
+ * This sits between the command channel of a request or response and the
+ * code that polls it. It is only used by the polling goroutine.
+ */
+type chaosStream struct {
+	spec    *chaosSpec
+	cmds    chan command
+	request *request
+	checked bool
+	matched bool
+	nulled  bool
+	pending []command
+	repeat  *command
+	doneAt  time.Time
+	rnd     *rand.Rand
+}
+
+func newChaosStream(spec *chaosSpec, cmds chan command, req *request) *chaosStream {
+	return &chaosStream{
+		spec:    spec,
+		cmds:    cmds,
+		request: req,
+		rnd:     rand.New(rand.NewSource(spec.seed)),
+	}
+}
+
+func isTerminal(cmd command) bool {
+	return cmd.id == DONE || cmd.id == ERRR
+}
+
+func (c *chaosStream) poll(block bool) string {
+	if c.repeat != nil {
+		cmd := *c.repeat
+		c.repeat = nil
+		return cmd.String()
+	}
+	if !c.fill(block) {
+		return ""
+	}
+	if !c.matches() {
+		return c.take(0).String()
+	}
+	if c.spec.nullPoll && !c.nulled {
+		c.nulled = true
+		return ""
+	}
+
+	i := c.pick()
+	cmd := c.pending[i]
+	if isTerminal(cmd) && c.spec.delayDone > 0 {
+		if c.doneAt.IsZero() {
+			c.doneAt = time.Now().Add(c.spec.delayDone)
+		}
+		wait := c.doneAt.Sub(time.Now())
+		if wait > 0 {
+			if !block {
+				return ""
+			}
+			time.Sleep(wait)
+		}
+	}
+	c.take(i)
+	if c.spec.duplicate[cmd.id] {
+		c.repeat = &cmd
+	}
+	return cmd.String()
+}
+
+/*
+ * Make sure that there is at least one command pending, and, if commands are
+ * being reordered, gather up any more that are already waiting. Return false
+ * if there is nothing to return without blocking.
+ */
+func (c *chaosStream) fill(block bool) bool {
+	if len(c.pending) == 0 {
+		if block {
+			c.pending = append(c.pending, <-c.cmds)
+		} else {
+			select {
+			case cmd := <-c.cmds:
+				c.pending = append(c.pending, cmd)
+			default:
+				return false
+			}
+		}
+	}
+	if !c.matches() {
+		return true
+	}
+	for len(c.pending) < c.spec.reorder && !isTerminal(c.pending[len(c.pending)-1]) {
+		select {
+		case cmd := <-c.cmds:
+			c.pending = append(c.pending, cmd)
+		default:
+			return true
+		}
+	}
+	return true
+}
+
+/*
+ * Decide whether the request matches. This waits for the first command
+ * because the request goroutine records the URI before it sends anything.
+ */
+func (c *chaosStream) matches() bool {
+	if !c.checked {
+		_, uri := c.request.getTarget()
+		c.matched = strings.HasPrefix(uri, c.spec.match)
+		c.checked = true
+	}
+	return c.matched
+}
+
+/*
+ * Choose which pending command to return. DONE and ERRR always come last.
+ */
+func (c *chaosStream) pick() int {
+	n := len(c.pending)
+	if isTerminal(c.pending[n-1]) {
+		n--
+	}
+	if n <= 1 {
+		return 0
+	}
+	return c.rnd.Intn(n)
+}
+
+func (c *chaosStream) take(i int) command {
+	cmd := c.pending[i]
+	c.pending = append(c.pending[:i], c.pending[i+1:]...)
+	return cmd
+}
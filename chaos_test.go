@@ -0,0 +1,110 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Chaos Mode", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		resetSettings()
+	})
+
+	// Poll until DONE, freeing any chunks along the way
+	pollAll := func(id uint32) []string {
+		var cmds []string
+		for {
+			cmd := pollRequest(id, true)
+			if cmd == "" {
+				continue
+			}
+			if cmd[:4] == cmdWbod {
+				readBodyData(cmd)
+				cmd = cmdWbod
+			}
+			cmds = append(cmds, cmd[:4])
+			if cmd == cmdDone {
+				return cmds
+			}
+		}
+	}
+
+	It("Parse spec", func() {
+		cs, err := parseChaosSpec("")
+		Expect(err).Should(Succeed())
+		Expect(cs).Should(BeNil())
+
+		cs, err = parseChaosSpec("match=/foo; reorder=3;duplicate=WHDR,WURI;delaydone=20;nullpoll=true;seed=7")
+		Expect(err).Should(Succeed())
+		Expect(cs.match).Should(Equal("/foo"))
+		Expect(cs.reorder).Should(Equal(3))
+		Expect(cs.duplicate).Should(HaveKey(WHDR))
+		Expect(cs.duplicate).Should(HaveKey(WURI))
+		Expect(cs.delayDone).Should(Equal(20 * time.Millisecond))
+		Expect(cs.nullPoll).Should(BeTrue())
+		Expect(cs.seed).Should(BeEquivalentTo(7))
+
+		_, err = parseChaosSpec("duplicate=DONE")
+		Expect(err).ShouldNot(Succeed())
+		_, err = parseChaosSpec("duplicate=WBOD")
+		Expect(err).ShouldNot(Succeed())
+		_, err = parseChaosSpec("explode=yes")
+		Expect(err).ShouldNot(Succeed())
+		_, err = parseChaosSpec("reorder")
+		Expect(err).ShouldNot(Succeed())
+		Expect(enableChaosMode("reorder=-1")).ShouldNot(Succeed())
+	})
+
+	It("Null poll", func() {
+		Expect(enableChaosMode("nullpoll=true")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(BeEmpty())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Duplicate", func() {
+		Expect(enableChaosMode("duplicate=WHDR,WURI")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/completerequest", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollAll(id)).Should(Equal(
+			[]string{"WURI", "WURI", "WHDR", "WHDR", "WBOD", "DONE"}))
+	})
+
+	It("Reorder", func() {
+		Expect(enableChaosMode("reorder=4;seed=3")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/completerequest", "", 0))
+		Expect(err).Should(Succeed())
+		time.Sleep(50 * time.Millisecond)
+		cmds := pollAll(id)
+		Expect(cmds).Should(ConsistOf("WURI", "WHDR", "WBOD", "DONE"))
+		Expect(cmds[3]).Should(Equal("DONE"))
+	})
+
+	It("Delay done", func() {
+		Expect(enableChaosMode("delaydone=100")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		start := time.Now()
+		Expect(pollRequest(id, false)).Should(BeEmpty())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(time.Since(start)).Should(BeNumerically(">=", 100*time.Millisecond))
+	})
+
+	It("Match", func() {
+		Expect(enableChaosMode("match=/completeresponse;duplicate=WHDR")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/completerequest", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollAll(id)).Should(Equal([]string{"WURI", "WHDR", "WBOD", "DONE"}))
+	})
+})
@@ -0,0 +1,62 @@
+package main
+
+/*
+ * Let a handler decide how big the chunks of the body it writes are, for
+ * clients and intermediaries that care. Writes are buffered until there is
+ * a whole chunk, so each WBOD command has exactly that many bytes, except
+ * the last, which is sent when the handler returns or calls Flush. Handlers
+ * find SetResponseChunkSize using a type assertion on the
+ * http.ResponseWriter.
+ */
+
+/*
+ * SetResponseChunkSize makes everything written after this go out in chunks
+ * of "n" bytes. Zero goes back to sending each write as it is. Once the
+ * handler has returned, there is nothing left to write, and it returns an
+ * error.
+ */
+func (h *httpResponse) SetResponseChunkSize(n int) error {
+	if n <= 0 {
+		h.Flush()
+		n = 0
+	}
+	phase := h.phase()
+	if phase == nil || !phase.whileOpen(func() {
+		h.chunkSize = n
+	}) {
+		return tooLate(h.owner(), "SetResponseChunkSize")
+	}
+	return nil
+}
+
+/*
+ * Flush sends whatever is waiting for a chunk to fill up.
+ */
+func (h *httpResponse) Flush() {
+	if len(h.pending) == 0 {
+		return
+	}
+	chunk := h.pending
+	h.pending = nil
+	sendBodyChunk(h.handler, chunk)
+}
+
+/*
+ * Buffer a write, and send every chunk that it fills.
+ */
+func (h *httpResponse) writeChunked(buf []byte) {
+	for len(buf) > 0 {
+		if len(h.pending) == 0 && len(buf) >= h.chunkSize {
+			// A whole chunk doesn't need to be copied first.
+			sendBodyChunk(h.handler, buf[:h.chunkSize])
+			buf = buf[h.chunkSize:]
+			continue
+		}
+		n := minInt(h.chunkSize-len(h.pending), len(buf))
+		h.pending = append(h.pending, buf[:n]...)
+		buf = buf[n:]
+		if len(h.pending) == h.chunkSize {
+			h.Flush()
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Response chunk size", func() {
+	It("Chunks", func() {
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/chunksize", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("SWCH200"))
+
+		var chunks []string
+		for cmd := pollRequest(id, true); cmd != "DONE"; cmd = pollRequest(id, true) {
+			if cmd[:4] == "WBOD" {
+				chunks = append(chunks, string(readBodyData(cmd)))
+			}
+		}
+		// The Flush sends the odd byte out early.
+		Expect(chunks).Should(Equal([]string{
+			"abcdefgabc", "defgabcdef", "g", "0123456789", "012",
+		}))
+	})
+})
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+)
+
+/*
+ * Work out who the real client is from the Forwarded or X-Forwarded-For
+ * header. Anyone can put anything in those headers, so the addresses are
+ * read from the right, starting with the address that connected to us, and
+ * only the hops that belong to trusted proxies are skipped. The first one
+ * that doesn't is the client. Handlers find ClientIdentity using a type
+ * assertion on the http.ResponseWriter.
+ */
+
+// The client of a request as the chain of proxies reported it
+type clientIdentity struct {
+	// The address of the client, or nil if there is none
+	IP net.IP
+	// Every address that the request came through, starting with the one
+	// furthest from us and ending with the one that connected to us
+	Chain []net.IP
+	// True if every address after IP in the chain is a trusted proxy, so
+	// that IP was not made up by someone along the way
+	Trusted bool
+}
+
+type identityCache struct {
+	trusted  []*net.IPNet
+	identity clientIdentity
+}
+
+func setRemoteAddr(id uint32, addr string) error {
+	req := getRequest(id)
+	if req == nil {
+		return fmt.Errorf("Unknown request: %d", id)
+	}
+	if err := checkAddr(addr); err != nil {
+		return err
+	}
+	req.remoteAddr = addr
+	return nil
+}
+
+/*
+ * ClientIdentity returns the address of the client, skipping the proxies in
+ * "trusted," or nil if there is none. "chain" is every address that the
+ * request came through, starting with the one furthest from us and ending
+ * with the one that connected to us. "verified" is true if every address
+ * after the client in the chain is a trusted proxy, so that the client's
+ * address was not made up by someone along the way. The result is saved,
+ * so it is cheap to ask again.
+ */
+func (h *httpResponse) ClientIdentity(trusted []*net.IPNet) (ip net.IP, chain []net.IP, verified bool) {
+	var id clientIdentity
+	switch handler := h.handler.(type) {
+	case *request:
+		id = handler.clientIdentity(trusted)
+	case *response:
+		id = handler.request.clientIdentity(trusted)
+	}
+	return id.IP, id.Chain, id.Trusted
+}
+
+func (r *request) clientIdentity(trusted []*net.IPNet) clientIdentity {
+	r.bodyLock.Lock()
+	defer r.bodyLock.Unlock()
+	if r.identity == nil || !reflect.DeepEqual(r.identity.trusted, trusted) {
+		chain, anchored := r.forwardingChain()
+		r.identity = &identityCache{
+			trusted:  trusted,
+			identity: findClient(chain, anchored, trusted),
+		}
+	}
+	return r.identity.identity
+}
+
+/*
+ * Return the addresses that the request came through, with nil for any that
+ * couldn't be parsed, and whether the last one is the address that actually
+ * connected to us.
+ */
+func (r *request) forwardingChain() ([]net.IP, bool) {
+	var chain []net.IP
+	if fwd := r.origHeaders["Forwarded"]; len(fwd) > 0 {
+		for _, v := range fwd {
+			chain = append(chain, parseForwarded(v)...)
+		}
+	} else {
+		for _, v := range r.origHeaders["X-Forwarded-For"] {
+			for _, hop := range strings.Split(v, ",") {
+				chain = append(chain, parseForwardedIP(hop))
+			}
+		}
+	}
+
+	anchored := false
+	if r.proxyInfo != nil {
+		chain = append(chain, parseForwardedIP(r.proxyInfo.ClientAddr))
+		anchored = true
+	}
+	if r.remoteAddr != "" {
+		chain = append(chain, parseForwardedIP(r.remoteAddr))
+		anchored = true
+	}
+	return chain, anchored
+}
+
+/*
+ * Walk the chain from the right. An address that can't be parsed is skipped,
+ * but since a trusted proxy didn't write it, anything to the left of it
+ * can't be trusted either.
+ */
+func findClient(chain []net.IP, anchored bool, trusted []*net.IPNet) clientIdentity {
+	id := clientIdentity{Trusted: anchored}
+	for _, ip := range chain {
+		if ip != nil {
+			id.Chain = append(id.Chain, ip)
+		}
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := chain[i]
+		if ip == nil {
+			id.Trusted = false
+			continue
+		}
+		id.IP = ip
+		if !isTrustedProxy(ip, trusted) {
+			break
+		}
+	}
+	return id
+}
+
+func isTrustedProxy(ip net.IP, trusted []*net.IPNet) bool {
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Return the "for" addresses from an RFC 7239 Forwarded header.
+ */
+func parseForwarded(value string) []net.IP {
+	var ips []net.IP
+	for _, element := range strings.Split(value, ",") {
+		var ip net.IP
+		for _, pair := range strings.Split(element, ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+				ip = parseForwardedIP(kv[1])
+			}
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+/*
+ * Parse one hop, which may be quoted, have a port, or be an IPv6 address in
+ * brackets. Return nil for anything else, such as "unknown."
+ */
+func parseForwardedIP(hop string) net.IP {
+	hop = strings.Trim(strings.TrimSpace(hop), "\"")
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	} else {
+		hop = strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]")
+	}
+	return net.ParseIP(hop)
+}
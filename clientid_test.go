@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Client identity", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+	})
+
+	// Run "/clientid" with the extra headers, and return what it found.
+	clientID := func(extra ...string) string {
+		hdrs := makeRequestHeaders("GET", "/clientid", "", 0)
+		for i := 0; i < len(extra); i += 2 {
+			hdrs = addRequestHeader(hdrs, extra[i], extra[i+1])
+		}
+		err := beginRequest(id, hdrs)
+		Expect(err).Should(Succeed())
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("WHDR"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		newHdrs := http.Header{}
+		parseHeaders(newHdrs, cmd[4:])
+		return newHdrs.Get("X-Client-IP")
+	}
+
+	It("Invalid address", func() {
+		Expect(setRemoteAddr(id, "10.0.0.1")).ShouldNot(Succeed())
+		Expect(setRemoteAddr(id, "example.com:80")).ShouldNot(Succeed())
+		Expect(setRemoteAddr(0, "10.0.0.1:80")).ShouldNot(Succeed())
+	})
+
+	It("No X-Forwarded-For", func() {
+		Expect(setRemoteAddr(id, "203.0.113.7:5000")).Should(Succeed())
+		Expect(clientID()).Should(Equal("203.0.113.7 true"))
+	})
+
+	It("Trusted hops", func() {
+		Expect(setRemoteAddr(id, "10.0.0.1:5000")).Should(Succeed())
+		Expect(clientID("X-Forwarded-For", "203.0.113.7, 10.1.2.3")).
+			Should(Equal("203.0.113.7 true"))
+	})
+
+	It("Spoofed", func() {
+		// The client made up the first entry, but it is beyond the
+		// first untrusted hop, so it is ignored.
+		Expect(setRemoteAddr(id, "10.0.0.1:5000")).Should(Succeed())
+		Expect(clientID("X-Forwarded-For", "10.9.9.9, 198.51.100.1, 10.1.2.3")).
+			Should(Equal("198.51.100.1 true"))
+	})
+
+	It("Untrusted connection", func() {
+		Expect(setRemoteAddr(id, "198.51.100.1:5000")).Should(Succeed())
+		Expect(clientID("X-Forwarded-For", "203.0.113.7")).
+			Should(Equal("198.51.100.1 true"))
+	})
+
+	It("No anchor", func() {
+		Expect(clientID("X-Forwarded-For", "203.0.113.7")).
+			Should(Equal("203.0.113.7 false"))
+	})
+
+	It("IPv6 with ports", func() {
+		Expect(setRemoteAddr(id, "[fd00::1]:5000")).Should(Succeed())
+		Expect(clientID("X-Forwarded-For", "[2001:db8::17]:4711, fd00::2")).
+			Should(Equal("2001:db8::17 true"))
+	})
+
+	It("Malformed", func() {
+		Expect(setRemoteAddr(id, "10.0.0.1:5000")).Should(Succeed())
+		Expect(clientID("X-Forwarded-For", "203.0.113.7, garbage, 10.1.2.3")).
+			Should(Equal("203.0.113.7 false"))
+	})
+
+	It("Forwarded", func() {
+		Expect(setRemoteAddr(id, "10.0.0.1:5000")).Should(Succeed())
+		Expect(clientID(
+			"Forwarded", "for=\"[2001:db8:cafe::17]:4711\";proto=https, for=10.1.2.3",
+			"X-Forwarded-For", "192.0.2.99")).
+			Should(Equal("2001:db8:cafe::17 true"))
+	})
+
+	It("PROXY protocol", func() {
+		Expect(setProxyProtocolInfo(id, 1, "10.2.3.4:1234", "10.0.0.2:443")).Should(Succeed())
+		Expect(setRemoteAddr(id, "10.0.0.1:5000")).Should(Succeed())
+		Expect(clientID("X-Forwarded-For", "203.0.113.7")).
+			Should(Equal("203.0.113.7 true"))
+	})
+
+	It("Chain", func() {
+		chain := []net.IP{net.ParseIP("192.0.2.1"), nil, net.ParseIP("10.0.0.1")}
+		client := findClient(chain, true, testTrustedProxies)
+		Expect(client.IP.String()).Should(Equal("192.0.2.1"))
+		Expect(client.Chain).Should(HaveLen(2))
+		Expect(client.Trusted).Should(BeFalse())
+	})
+})
@@ -4,9 +4,9 @@ package main
 
 import "fmt"
 
-const _CommandID_name = "DONEERRRRBODWHDRWURIWSTASWCHWBOD"
+const _CommandID_name = "DONEERRRRBODWHDRWURIWSTASWCHWBODSBODWSHRWTRLXCMD"
 
-var _CommandID_index = [...]uint8{0, 4, 8, 12, 16, 20, 24, 28, 32}
+var _CommandID_index = [...]uint8{0, 4, 8, 12, 16, 20, 24, 28, 32, 36, 40, 44, 48}
 
 func (i CommandID) String() string {
 	if i < 0 || i >= CommandID(len(_CommandID_index)-1) {
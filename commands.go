@@ -1,5 +1,9 @@
 package main
 
+import (
+	"fmt"
+)
+
 //go:generate stringer -type=CommandID
 
 // Mapping of command IDs to names is generated by stringer -- re run
@@ -10,7 +14,9 @@ package main
 type CommandID int
 
 const (
-	// DONE indicates that no more commands will be delivered for this request or response
+	// DONE indicates that no more commands will be delivered for this request or response.
+	// On the response path it may be followed by "close," which means that the caller
+	// must close the client connection once the response has been sent.
 	DONE CommandID = iota
 	// ERRR indicates that there was an error processing a request or response. No more
 	// commands will be delivered.
@@ -33,10 +39,26 @@ const (
 	// WBOD indicates that the request or response body is being rewritten and should
 	// be replaced with the chunks identified by this command.
 	WBOD
+	// SBOD indicates that the target has already started to respond, or that a handler
+	// doesn't need the request body, so the caller should stop sending it. Any more
+	// chunks that it sends are discarded.
+	SBOD
+	// WSHR is like WBOD, but the chunk is a shared chunk. The caller must not modify
+	// or free it, and must release it using GoReleaseChunk once it has been sent.
+	WSHR
+	// WTRL indicates that the response has trailers, which are the headers in this
+	// command. It comes after the last chunk of the body.
+	WTRL
+	// XCMD is a command that a handler made up for the caller, which is how
+	// hosts add features of their own. The name comes first, followed by a
+	// space and the ID of a chunk holding the payload, if there is one.
+	XCMD
 )
 
 const (
 	cmdDone = "DONE"
+	// Sent after DONE when the client connection must be closed
+	doneClose = "close"
 	cmdErrr = "ERRR"
 	cmdRbod = "RBOD"
 	cmdWhdr = "WHDR"
@@ -44,6 +66,10 @@ const (
 	cmdWsta = "WSTA"
 	cmdSwch = "SWCH"
 	cmdWbod = "WBOD"
+	cmdSbod = "SBOD"
+	cmdWshr = "WSHR"
+	cmdWtrl = "WTRL"
+	cmdXcmd = "XCMD"
 )
 
 type command struct {
@@ -62,3 +88,18 @@ func (c command) String() string {
 	pfx := c.id.String()
 	return pfx + c.msg
 }
+
+/*
+ * Parse a command in the form returned by String, such as "WURI/foo".
+ */
+func parseCommand(s string) (command, error) {
+	if len(s) < 4 {
+		return command{}, fmt.Errorf("Invalid command: \"%s\"", s)
+	}
+	for id := DONE; id <= XCMD; id++ {
+		if s[:4] == id.String() {
+			return command{id: id, msg: s[4:]}, nil
+		}
+	}
+	return command{}, fmt.Errorf("Unknown command: \"%s\"", s[:4])
+}
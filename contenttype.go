@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+/*
+ * Some targets send the wrong Content-Type, such as text/plain for JSON.
+ * The caller can replace it for a single request, or have weaver guess it
+ * from the start of the body. Either way, this happens before the response
+ * handler runs and before anything that depends on the content type, like
+ * minification, looks at it.
+ */
+
+// How much of the body http.DetectContentType looks at
+const sniffLen = 512
+
+func setContentTypeOverride(id uint32, contentType string) error {
+	req := getRequest(id)
+	if req == nil {
+		return fmt.Errorf("Unknown request: %d", id)
+	}
+	if _, _, err := mime.ParseMediaType(contentType); err != nil {
+		return fmt.Errorf("Invalid content type \"%s\": %v", contentType, err)
+	}
+	req.contentType = contentType
+	return nil
+}
+
+func setContentTypeInference(id uint32) error {
+	req := getRequest(id)
+	if req == nil {
+		return fmt.Errorf("Unknown request: %d", id)
+	}
+	req.inferContentType = true
+	return nil
+}
+
+/*
+ * Set the charset of textual responses, for clients that would otherwise
+ * guess. An empty charset leaves them alone.
+ */
+func setResponseCharset(charset string) error {
+	charset = strings.TrimSpace(charset)
+	if strings.IndexFunc(charset, isNotCharsetChar) >= 0 {
+		return fmt.Errorf("Invalid charset \"%s\"", charset)
+	}
+	updateSettings(func(s *settings) {
+		s.responseCharset = charset
+	})
+	return nil
+}
+
+/*
+ * Add or replace the charset parameter of the Content-Type. This happens
+ * after the handler runs, so it applies to content types it sets as well.
+ */
+func (r *response) setCharset() {
+	charset := r.request.settings.responseCharset
+	ct := r.resp.Header.Get("Content-Type")
+	if charset == "" || ct == "" {
+		return
+	}
+	mediaType, params, err := mime.ParseMediaType(ct)
+	if err != nil || !isTextual(mediaType) {
+		return
+	}
+	params["charset"] = charset
+	if formatted := mime.FormatMediaType(mediaType, params); formatted != "" {
+		r.resp.Header.Set("Content-Type", formatted)
+	}
+}
+
+// Charset names are tokens, and nobody uses the odd characters that allows
+func isNotCharsetChar(c rune) bool {
+	if c >= 0x80 {
+		return true
+	}
+	return !isASCIILetter(byte(c)) && !(c >= '0' && c <= '9') && !strings.ContainsRune("-_.:+", c)
+}
+
+func isTextual(mediaType string) bool {
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript":
+		return true
+	}
+	return false
+}
+
+func (r *response) fixContentType() {
+	if ct := r.request.contentType; ct != "" {
+		r.resp.Header.Set("Content-Type", ct)
+	} else if r.request.inferContentType {
+		r.sniffContentType()
+	}
+}
+
+/*
+ * Guess the content type from the first chunk of the body, which is put
+ * back afterwards. A body that is still compressed is left alone. Reading
+ * it doesn't count as the handler reading it, so the headers may still
+ * change, and the body that is put back still counts as the original one
+ * when deciding whether to keep the validators.
+ */
+func (r *response) sniffContentType() {
+	if !bodyAllowed(r.request.req, r.resp.StatusCode) ||
+		r.resp.ContentLength == 0 || r.resp.Header.Get("Content-Encoding") != "" {
+		return
+	}
+	r.readingAhead = true
+	chunk, err := readChunk(r.resp.Body)
+	r.readingAhead = false
+	r.readStarted = false
+
+	r.resp.Header.Set("Content-Type", detectContentType(chunk))
+	var rest io.Reader = r.resp.Body
+	if err != nil {
+		rest = &errorReader{err: err}
+	}
+	r.resp.Body = &sniffedBody{
+		Reader: io.MultiReader(bytes.NewReader(chunk), rest),
+		Closer: r.resp.Body,
+	}
+	r.sniffedBody = r.resp.Body
+}
+
+type sniffedBody struct {
+	io.Reader
+	io.Closer
+}
+
+/*
+ * Like http.DetectContentType, which calls anything that is text
+ * text/plain, but also recognize JSON by its first character.
+ */
+func detectContentType(data []byte) string {
+	if len(data) > sniffLen {
+		data = data[:sniffLen]
+	}
+	ct := http.DetectContentType(data)
+	if strings.HasPrefix(ct, "text/plain") {
+		trimmed := bytes.TrimLeft(data, " \t\r\n")
+		if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+			return "application/json"
+		}
+	}
+	return ct
+}
+
+type errorReader struct {
+	err error
+}
+
+func (e *errorReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Content type override", func() {
+	var id, rid uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		rid = createResponse(testHandler)
+		Expect(rid).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		freeResponse(rid)
+		resetSettings()
+	})
+
+	// Send the body in two chunks, and return the new headers and body.
+	runWith := func(respHdrs, body string) (http.Header, string) {
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		err = beginResponse(rid, id, 200, respHdrs)
+		Expect(err).Should(Succeed())
+
+		var hdrs http.Header
+		buf := &bytes.Buffer{}
+		for cmd := pollResponse(rid, true); cmd != "DONE"; cmd = pollResponse(rid, true) {
+			switch cmd[:4] {
+			case "RBOD":
+				sendResponseBodyChunk(rid, false, []byte(body[:len(body)/2]))
+				sendResponseBodyChunk(rid, true, []byte(body[len(body)/2:]))
+			case "WHDR":
+				hdrs = http.Header{}
+				parseHeaders(hdrs, cmd[4:])
+			case "WBOD":
+				buf.Write(readBodyData(cmd))
+			default:
+				Fail("Unexpected command " + cmd)
+			}
+		}
+		return hdrs, buf.String()
+	}
+
+	run := func(contentType, body string) (http.Header, string) {
+		return runWith(makeResponseHeaders(contentType, len(body)), body)
+	}
+
+	It("Override", func() {
+		Expect(setContentTypeOverride(id, "application/json")).Should(Succeed())
+		hdrs, body := run("text/plain", "")
+		Expect(hdrs.Get("Content-Type")).Should(Equal("application/json"))
+		Expect(body).Should(BeEmpty())
+	})
+
+	It("Override before minification", func() {
+		Expect(setResponseMinification("text/html", true)).Should(Succeed())
+		Expect(setContentTypeOverride(id, "text/html")).Should(Succeed())
+		hdrs, body := run("text/plain", "<p>  Hello  </p>")
+		Expect(hdrs.Get("Content-Type")).Should(Equal("text/html"))
+		Expect(body).Should(Equal("<p> Hello </p>"))
+	})
+
+	It("Infer JSON", func() {
+		Expect(setContentTypeInference(id)).Should(Succeed())
+		hdrs, body := run("text/plain", "  {\"hello\": \"world\"}")
+		Expect(hdrs.Get("Content-Type")).Should(Equal("application/json"))
+		Expect(body).Should(Equal("  {\"hello\": \"world\"}"))
+	})
+
+	It("Infer and keep validators", func() {
+		Expect(setContentTypeInference(id)).Should(Succeed())
+		body := "{\"hello\": \"world\"}"
+		hdrs, out := runWith("ETag: \"abc\"\nLast-Modified: Thu, 01 Jan 2026 00:00:00 GMT\n"+
+			makeResponseHeaders("text/plain", len(body)), body)
+		Expect(hdrs.Get("Content-Type")).Should(Equal("application/json"))
+		// ETag isn't in canonical form.
+		Expect(hdrs["ETag"]).Should(Equal([]string{"\"abc\""}))
+		Expect(hdrs.Get("Last-Modified")).ShouldNot(BeEmpty())
+		Expect(out).Should(Equal(body))
+	})
+
+	It("Infer HTML before minification", func() {
+		Expect(setResponseMinification("text/html", true)).Should(Succeed())
+		Expect(setContentTypeInference(id)).Should(Succeed())
+		hdrs, body := run("application/octet-stream", "<!DOCTYPE html><p>  Hello  </p>")
+		Expect(hdrs.Get("Content-Type")).Should(HavePrefix("text/html"))
+		Expect(body).Should(Equal("<!DOCTYPE html><p> Hello </p>"))
+	})
+
+	It("Detect", func() {
+		Expect(detectContentType([]byte("[1, 2]"))).Should(Equal("application/json"))
+		Expect(detectContentType([]byte("Hello"))).Should(HavePrefix("text/plain"))
+		Expect(detectContentType([]byte("\x89PNG\r\n\x1a\n"))).Should(Equal("image/png"))
+	})
+
+	It("Charset", func() {
+		Expect(setResponseCharset("utf-8")).Should(Succeed())
+		hdrs, _ := run("text/html; charset=ISO-8859-1", "<p>Hello</p>")
+		Expect(hdrs.Get("Content-Type")).Should(Equal("text/html; charset=utf-8"))
+	})
+
+	It("Charset with other parameters", func() {
+		Expect(setResponseCharset("utf-8")).Should(Succeed())
+		hdrs, _ := run("text/plain;format=\"a b\"", "Hello")
+		Expect(hdrs.Get("Content-Type")).Should(Equal("text/plain; charset=utf-8; format=\"a b\""))
+	})
+
+	It("Charset after override", func() {
+		Expect(setResponseCharset("utf-8")).Should(Succeed())
+		Expect(setContentTypeOverride(id, "application/json")).Should(Succeed())
+		hdrs, _ := run("text/plain", "{}")
+		Expect(hdrs.Get("Content-Type")).Should(Equal("application/json; charset=utf-8"))
+	})
+
+	It("No charset for images", func() {
+		Expect(setResponseCharset("utf-8")).Should(Succeed())
+		hdrs, _ := run("image/png", "\x89PNG\r\n\x1a\n")
+		Expect(hdrs).Should(BeNil())
+	})
+
+	It("Invalid", func() {
+		Expect(setContentTypeOverride(id, "text/html; charset")).ShouldNot(Succeed())
+		Expect(setContentTypeOverride(0, "text/html")).ShouldNot(Succeed())
+		Expect(setContentTypeInference(0)).ShouldNot(Succeed())
+		Expect(setResponseCharset("utf 8")).ShouldNot(Succeed())
+		Expect(setResponseCharset("utf-8\"")).ShouldNot(Succeed())
+	})
+})
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+/*
+ * Cookies set by the target often name its own domain and path, or leave out
+ * attributes like Secure, so that they don't work once they pass through the
+ * proxy. A response handler may call RewriteSetCookies to fix them up.
+ * Handlers find it using a type assertion on the http.ResponseWriter.
+ */
+
+var errNoSetCookies = errors.New("Only a response handler can rewrite Set-Cookie headers")
+
+/*
+ * RewriteSetCookies calls "rewrite" for each cookie that the target set, and
+ * sends the cookie that it returns instead, or none if it returns nil. It
+ * must be called before the handler returns.
+ */
+func (h *httpResponse) RewriteSetCookies(rewrite func(c *http.Cookie) *http.Cookie) error {
+	r, ok := h.handler.(*response)
+	if !ok {
+		return errNoSetCookies
+	}
+	// "rewrite" may call other handler methods, so it runs on a copy.
+	cookies := http.Header{"Set-Cookie": r.resp.Header["Set-Cookie"]}
+	rewriteSetCookies(cookies, rewrite)
+	if !r.phase.whileOpen(func() {
+		if values := cookies["Set-Cookie"]; len(values) > 0 {
+			r.resp.Header["Set-Cookie"] = values
+		} else {
+			r.resp.Header.Del("Set-Cookie")
+		}
+	}) {
+		return tooLate(r.request, "RewriteSetCookies")
+	}
+	return nil
+}
+
+/*
+ * Call "rewrite" for each cookie in the Set-Cookie headers in "h," and replace
+ * the header with the cookie that it returns. If it returns nil, then the
+ * cookie is removed. Headers that can't be parsed are left alone.
+ */
+func rewriteSetCookies(h http.Header, rewrite func(c *http.Cookie) *http.Cookie) {
+	values := h["Set-Cookie"]
+	if len(values) == 0 {
+		return
+	}
+
+	var newValues []string
+	for _, value := range values {
+		c := parseSetCookie(value)
+		if c == nil {
+			newValues = append(newValues, value)
+			continue
+		}
+		c = rewrite(c)
+		if c != nil {
+			newValues = append(newValues, FormatSetCookie(c))
+		}
+	}
+
+	if len(newValues) == 0 {
+		h.Del("Set-Cookie")
+	} else {
+		h["Set-Cookie"] = newValues
+	}
+}
+
+/*
+ * Parse a single Set-Cookie header value, or return nil if it is invalid.
+ */
+func parseSetCookie(value string) *http.Cookie {
+	resp := http.Response{
+		Header: http.Header{"Set-Cookie": {value}},
+	}
+	cookies := resp.Cookies()
+	if len(cookies) == 0 {
+		return nil
+	}
+	return cookies[0]
+}
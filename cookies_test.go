@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Set-Cookie Rewrite", func() {
+	It("Rewrite domain", func() {
+		h := http.Header{}
+		h.Add("Set-Cookie", "session=abc123; Domain=target.internal; Path=/")
+		h.Add("Set-Cookie", "theme=dark; Domain=target.internal")
+		rewriteSetCookies(h, func(c *http.Cookie) *http.Cookie {
+			c.Domain = "example.com"
+			return c
+		})
+		Expect(h["Set-Cookie"]).Should(Equal([]string{
+			"session=abc123; Path=/; Domain=example.com",
+			"theme=dark; Domain=example.com",
+		}))
+	})
+
+	It("Drop cookie", func() {
+		h := http.Header{}
+		h.Add("Set-Cookie", "session=abc123")
+		h.Add("Set-Cookie", "tracking=xyz")
+		drop := func(c *http.Cookie) *http.Cookie {
+			if c.Name == "tracking" {
+				return nil
+			}
+			return c
+		}
+		rewriteSetCookies(h, drop)
+		Expect(h["Set-Cookie"]).Should(Equal([]string{"session=abc123"}))
+
+		h.Set("Set-Cookie", "tracking=xyz")
+		rewriteSetCookies(h, drop)
+		Expect(h).ShouldNot(HaveKey("Set-Cookie"))
+	})
+
+	It("Invalid cookie", func() {
+		h := http.Header{}
+		h.Add("Set-Cookie", "not a cookie")
+		rewriteSetCookies(h, func(c *http.Cookie) *http.Cookie {
+			return nil
+		})
+		Expect(h["Set-Cookie"]).Should(Equal([]string{"not a cookie"}))
+	})
+
+	It("Serialize", func() {
+		h := http.Header{}
+		h.Add("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT")
+		h.Add("Set-Cookie", "b=2")
+		parsed := http.Header{}
+		parseHeaders(parsed, serializeHeaders(h))
+		Expect(parsed).Should(Equal(h))
+	})
+
+	It("Response handler", func() {
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		rid := createResponse(testHandler)
+		defer freeResponse(rid)
+
+		err := beginRequest(id, makeRequestHeaders("GET", "/rewritecookies", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		hdrs := "Set-Cookie: session=abc123; Domain=target.internal\n" +
+			"Set-Cookie: tracking=xyz\n" + makeResponseHeaders("", 0)
+		err = beginResponse(rid, id, 200, hdrs)
+		Expect(err).Should(Succeed())
+
+		cmd := pollResponse(rid, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		lines := strings.Split(strings.TrimSpace(cmd[4:]), "\n")
+		Expect(lines).Should(ContainElement(
+			"Set-Cookie: session=abc123; Domain=proxy.example.com; Secure"))
+		Expect(lines).ShouldNot(ContainElement(ContainSubstring("tracking")))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Request handler", func() {
+		h := &httpResponse{handler: &request{}}
+		rewrite := func(c *http.Cookie) *http.Cookie { return c }
+		Expect(h.RewriteSetCookies(rewrite)).Should(Equal(errNoSetCookies))
+	})
+})
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Handle CORS for the targets, which then don't have to. The policy is
+ * given as one JSON object. Preflight requests, which are OPTIONS requests
+ * with an Access-Control-Request-Method header, are answered by weaver
+ * without running the handler: with a 204 and the policy if the origin is
+ * allowed, and a 403 otherwise. Responses to other requests from an allowed
+ * origin get Access-Control-Allow-Origin and friends. Either way, Origin is
+ * added to Vary, since the answer depends on it.
+ */
+
+type corsConfig struct {
+	AllowOrigins     []string `json:"allowOrigins"`
+	AllowMethods     []string `json:"allowMethods"`
+	AllowHeaders     []string `json:"allowHeaders"`
+	ExposeHeaders    []string `json:"exposeHeaders"`
+	AllowCredentials bool     `json:"allowCredentials"`
+	MaxAge           *int     `json:"maxAge"`
+}
+
+type corsPolicy struct {
+	anyOrigin   bool
+	origins     map[string]bool
+	methods     string
+	headers     string
+	expose      string
+	credentials bool
+	maxAge      string
+}
+
+var defaultCORSMethods = []string{"GET", "HEAD", "POST"}
+
+/*
+ * Set the policy from JSON. An empty string turns CORS handling off.
+ */
+func setCORS(config string) error {
+	if strings.TrimSpace(config) == "" {
+		updateSettings(func(s *settings) {
+			s.cors = nil
+		})
+		return nil
+	}
+	policy, err := parseCORSConfig(config)
+	if err != nil {
+		return err
+	}
+	updateSettings(func(s *settings) {
+		s.cors = policy
+	})
+	return nil
+}
+
+func parseCORSConfig(config string) (*corsPolicy, error) {
+	var c corsConfig
+	d := json.NewDecoder(bytes.NewBufferString(config))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&c); err != nil {
+		return nil, fmt.Errorf("Invalid CORS configuration: %v", err)
+	}
+	if len(c.AllowOrigins) == 0 {
+		return nil, errors.New("Invalid CORS configuration: allowOrigins is required")
+	}
+
+	p := &corsPolicy{
+		origins:     make(map[string]bool),
+		credentials: c.AllowCredentials,
+	}
+	for _, o := range c.AllowOrigins {
+		o = strings.TrimSpace(o)
+		switch {
+		case o == "*":
+			p.anyOrigin = true
+		case strings.Contains(o, "://") && !strings.ContainsAny(o, " ,*"):
+			p.origins[strings.ToLower(strings.TrimSuffix(o, "/"))] = true
+		default:
+			return nil, fmt.Errorf("Invalid CORS origin \"%s\"", o)
+		}
+	}
+	if p.anyOrigin && p.credentials {
+		// Browsers refuse "*" with credentials, and echoing the origin
+		// instead would let every site read responses with the user's
+		// cookies.
+		return nil, errors.New("Invalid CORS configuration: allowCredentials can't be used with the \"*\" origin")
+	}
+	if len(c.AllowMethods) == 0 {
+		c.AllowMethods = defaultCORSMethods
+	}
+	methods := make([]string, len(c.AllowMethods))
+	for i, m := range c.AllowMethods {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		if m == "" || strings.ContainsAny(m, " ,") {
+			return nil, fmt.Errorf("Invalid CORS method \"%s\"", m)
+		}
+		methods[i] = m
+	}
+	p.methods = strings.Join(methods, ", ")
+	var err error
+	if p.headers, err = joinCORSHeaders(c.AllowHeaders); err != nil {
+		return nil, err
+	}
+	if p.expose, err = joinCORSHeaders(c.ExposeHeaders); err != nil {
+		return nil, err
+	}
+	if c.MaxAge != nil {
+		if *c.MaxAge < 0 {
+			return nil, fmt.Errorf("Invalid CORS maxAge %d", *c.MaxAge)
+		}
+		p.maxAge = strconv.Itoa(*c.MaxAge)
+	}
+	return p, nil
+}
+
+func joinCORSHeaders(names []string) (string, error) {
+	canonical := make([]string, len(names))
+	for i, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" || (name != "*" && strings.ContainsAny(name, " \t:;,\"")) {
+			return "", fmt.Errorf("Invalid CORS header name \"%s\"", name)
+		}
+		if name != "*" {
+			name = http.CanonicalHeaderKey(name)
+		}
+		canonical[i] = name
+	}
+	return strings.Join(canonical, ", "), nil
+}
+
+/*
+ * Return the value for Access-Control-Allow-Origin, or "" if the origin is
+ * not allowed.
+ */
+func (p *corsPolicy) allowOrigin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	if p.anyOrigin {
+		return "*"
+	}
+	if p.origins[strings.ToLower(origin)] {
+		return origin
+	}
+	return ""
+}
+
+func (p *corsPolicy) addCommonHeaders(r *request, h http.Header, allowed string) {
+	r.setOwnHeader(h, "Access-Control-Allow-Origin", allowed)
+	if p.credentials {
+		r.setOwnHeader(h, "Access-Control-Allow-Credentials", "true")
+	}
+}
+
+/*
+ * Answer a preflight request.
+ */
+func (r *request) serveCORSPreflight() bool {
+	p := r.settings.cors
+	if p == nil || r.req.Method != "OPTIONS" ||
+		r.req.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	hdrs := http.Header{}
+	addVary(hdrs, "Origin")
+	allowed := p.allowOrigin(r.req.Header.Get("Origin"))
+	if allowed == "" {
+		r.resp.headers = &hdrs
+		r.resp.WriteHeader(http.StatusForbidden)
+		return true
+	}
+	p.addCommonHeaders(r, hdrs, allowed)
+	r.setOwnHeader(hdrs, "Access-Control-Allow-Methods", p.methods)
+	if p.headers != "" {
+		r.setOwnHeader(hdrs, "Access-Control-Allow-Headers", p.headers)
+	}
+	if p.maxAge != "" {
+		r.setOwnHeader(hdrs, "Access-Control-Max-Age", p.maxAge)
+	}
+	r.resp.headers = &hdrs
+	r.resp.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+func (r *response) setCORS() {
+	p := r.request.settings.cors
+	if p == nil {
+		return
+	}
+	addVary(r.resp.Header, "Origin")
+	allowed := p.allowOrigin(r.request.origHeaders.Get("Origin"))
+	if allowed == "" {
+		return
+	}
+	p.addCommonHeaders(r.request, r.resp.Header, allowed)
+	if p.expose != "" {
+		r.request.setOwnHeader(r.resp.Header, "Access-Control-Expose-Headers", p.expose)
+	}
+}
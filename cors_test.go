@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const testCORSConfig = `{
+	"allowOrigins": ["https://app.example.com"],
+	"allowMethods": ["get", "PUT"],
+	"allowHeaders": ["content-type", "X-Api-Key"],
+	"exposeHeaders": ["X-Request-Id"],
+	"allowCredentials": true,
+	"maxAge": 600
+}`
+
+var _ = Describe("CORS", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		resetSettings()
+	})
+
+	preflight := func(origin string) (string, http.Header) {
+		hdrs := makeRequestHeaders("OPTIONS", "/pass", "", 0)
+		hdrs = addRequestHeader(hdrs, "Origin", origin)
+		hdrs = addRequestHeader(hdrs, "Access-Control-Request-Method", "PUT")
+		Expect(beginRequest(id, hdrs)).Should(Succeed())
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("SWCH"))
+		status := cmd[4:]
+		cmd = pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("WHDR"))
+		respHdrs := http.Header{}
+		parseHeaders(respHdrs, cmd[4:])
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		return status, respHdrs
+	}
+
+	respond := func(origin string) http.Header {
+		hdrs := makeRequestHeaders("GET", "/pass", "", 0)
+		if origin != "" {
+			hdrs = addRequestHeader(hdrs, "Origin", origin)
+		}
+		Expect(beginRequest(id, hdrs)).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		rid := createResponse(testHandler)
+		defer freeResponse(rid)
+		Expect(beginResponse(rid, id, 200, makeResponseHeaders("", 0))).Should(Succeed())
+		cmd := pollResponse(rid, true)
+		Expect(cmd).Should(HavePrefix("WHDR"))
+		respHdrs := http.Header{}
+		parseHeaders(respHdrs, cmd[4:])
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+		return respHdrs
+	}
+
+	It("Preflight", func() {
+		Expect(setCORS(testCORSConfig)).Should(Succeed())
+		status, hdrs := preflight("https://app.example.com")
+		Expect(status).Should(Equal("204"))
+		Expect(hdrs.Get("Access-Control-Allow-Origin")).Should(Equal("https://app.example.com"))
+		Expect(hdrs.Get("Access-Control-Allow-Credentials")).Should(Equal("true"))
+		// The test parser splits values on commas.
+		Expect(strings.Join(hdrs["Access-Control-Allow-Methods"], ",")).Should(Equal("GET, PUT"))
+		Expect(strings.Join(hdrs["Access-Control-Allow-Headers"], ",")).Should(
+			Equal("Content-Type, X-Api-Key"))
+		Expect(hdrs.Get("Access-Control-Max-Age")).Should(Equal("600"))
+		Expect(hdrs.Get("Vary")).Should(Equal("Origin"))
+	})
+
+	It("Preflight from another origin", func() {
+		Expect(setCORS(testCORSConfig)).Should(Succeed())
+		status, hdrs := preflight("https://evil.example.com")
+		Expect(status).Should(Equal("403"))
+		Expect(hdrs.Get("Access-Control-Allow-Origin")).Should(BeEmpty())
+	})
+
+	It("Response", func() {
+		Expect(setCORS(testCORSConfig)).Should(Succeed())
+		hdrs := respond("https://app.example.com")
+		Expect(hdrs.Get("Access-Control-Allow-Origin")).Should(Equal("https://app.example.com"))
+		Expect(hdrs.Get("Access-Control-Expose-Headers")).Should(Equal("X-Request-Id"))
+		Expect(hdrs.Get("Access-Control-Allow-Methods")).Should(BeEmpty())
+		Expect(hdrs.Get("Vary")).Should(Equal("Origin"))
+	})
+
+	It("Response to another origin", func() {
+		Expect(setCORS(testCORSConfig)).Should(Succeed())
+		hdrs := respond("https://evil.example.com")
+		Expect(hdrs.Get("Access-Control-Allow-Origin")).Should(BeEmpty())
+		Expect(hdrs.Get("Vary")).Should(Equal("Origin"))
+	})
+
+	It("Any origin", func() {
+		Expect(setCORS(`{"allowOrigins": ["*"]}`)).Should(Succeed())
+		hdrs := respond("https://anywhere.example.com")
+		Expect(hdrs.Get("Access-Control-Allow-Origin")).Should(Equal("*"))
+		Expect(hdrs.Get("Access-Control-Allow-Credentials")).Should(BeEmpty())
+	})
+
+	It("Off", func() {
+		Expect(setCORS(testCORSConfig)).Should(Succeed())
+		Expect(setCORS("")).Should(Succeed())
+		hdrs := makeRequestHeaders("OPTIONS", "/pass", "", 0)
+		hdrs = addRequestHeader(hdrs, "Origin", "https://app.example.com")
+		hdrs = addRequestHeader(hdrs, "Access-Control-Request-Method", "PUT")
+		Expect(beginRequest(id, hdrs)).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Invalid", func() {
+		Expect(setCORS(`{"allowOrigins": [`)).ShouldNot(Succeed())
+		Expect(setCORS(`{"allowMethods": ["GET"]}`)).ShouldNot(Succeed())
+		Expect(setCORS(`{"allowOrigins": ["app.example.com"]}`)).ShouldNot(Succeed())
+		Expect(setCORS(`{"allowOrigins": ["*"], "maxAge": -1}`)).ShouldNot(Succeed())
+		Expect(setCORS(`{"allowOrigins": ["*"], "allowHeaders": ["Bad Header"]}`)).ShouldNot(Succeed())
+		Expect(setCORS(`{"allowOrigins": ["*"], "allowOrigin": ["*"]}`)).ShouldNot(Succeed())
+		Expect(setCORS(`{"allowOrigins": ["*"], "allowCredentials": true}`)).ShouldNot(Succeed())
+		Expect(setCORS(`{"allowOrigins": ["https://app.example.com", "*"],
+			"allowCredentials": true}`)).ShouldNot(Succeed())
+		Expect(getSettings().cors).Should(BeNil())
+	})
+})
@@ -171,6 +171,29 @@ static void test_replace_response_body_chunks(void) {
   cleanRequest();
 }
 
+static void test_custom_command(void) {
+  initRequest();
+  createHeader("GET", "/emit", 0, NULL);
+  GoBeginRequest(id, hdrBuf);
+  char* cmd = GoPollRequest(id, 1);
+  CU_ASSERT_TRUE(strncmp("XCMDtrace.span ", cmd, 15) == 0);
+  unsigned int chunkID = strtoul(cmd + 15, NULL, 16);
+  free(cmd);
+  char* chunk = (char*)GoGetChunk(chunkID);
+  CU_ASSERT_PTR_NOT_NULL(chunk);
+  unsigned int chunkLen = GoGetChunkLength(chunkID);
+  CU_ASSERT_EQUAL(chunkLen, 4);
+  CU_ASSERT_TRUE(memcmp("\0\1\2x", chunk, chunkLen) == 0);
+  free(chunk);
+  GoReleaseChunk(chunkID);
+
+  cmd = GoPollRequest(id, 1);
+  CU_ASSERT_STRING_EQUAL(cmd, "DONE");
+  free(cmd);
+
+  cleanRequest();
+}
+
 static int seqChar(int last) {
   int ch = last;
   for (;;) {
@@ -343,6 +366,7 @@ int addMainTests(CU_pSuite s) {
   CU_ADD_TEST(s, test_replace_request_body);
   CU_ADD_TEST(s, test_replace_response_body);
   CU_ADD_TEST(s, test_replace_response_body_chunks);
+  CU_ADD_TEST(s, test_custom_command);
   CU_ADD_TEST(s, test_replace_response_body_binary);
   CU_ADD_TEST(s, test_replace_response_body_binary_multi);
   CU_ADD_TEST(s, test_replace_response_body_binary_larger);
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"log"
+)
+
+/*
+ * Debug messages describe things that happen as a matter of course, so they
+ * are only logged if the caller asks for them.
+ */
+
+func setDebugLogging(enabled bool) {
+	updateSettings(func(s *settings) {
+		s.debugLogging = enabled
+	})
+}
+
+func (r *request) debugf(format string, args ...interface{}) {
+	if r.settings.debugLogging || r.settings.developmentMode {
+		log.Printf("DEBUG: "+format, args...)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"net/http/httputil"
+)
+
+/*
+ * Development mode turns on everything that helps while working on a
+ * handler, all at once:
+ *
+ * - Debug messages are logged.
+ * - The headers of every request are dumped to the log.
+ * - The profiler is served at /debug/pprof/ and expvar at /debug/vars,
+ *   unless they were given other paths.
+ * - Upstream requests have no timeouts, and neither does waiting for a
+ *   slot under an upstream concurrency limit, so that a target can sit in
+ *   a debugger. Requests have no maximum duration either, so that a
+ *   handler can.
+ * - Upstream TLS certificates aren't verified.
+ *
+ * None of this is safe in production. The log gets credentials and cookies,
+ * anyone who can reach weaver from loopback, or from the profiler's
+ * allowlist, can read its memory and variables, a stuck target holds on to
+ * its requests forever, and anyone in the path to a target can pose as it.
+ * The mode is layered over the other settings rather than changing them, so
+ * turning it off puts everything back the way it was configured. If the
+ * transport can't be rebuilt, the mode is left as it was.
+ */
+
+const (
+	developmentPprofPath  = "/debug/pprof"
+	developmentExpvarPath = "/debug/vars"
+)
+
+func setDevelopmentMode(enabled bool) error {
+	was := getSettings().developmentMode
+	updateSettings(func(s *settings) {
+		s.developmentMode = enabled
+	})
+	// Rebuild the transport, so that its timeouts and TLS verification
+	// follow the mode.
+	if err := ConfigureTransport(getTransportOptions()); err != nil {
+		updateSettings(func(s *settings) {
+			s.developmentMode = was
+		})
+		return err
+	}
+	if enabled {
+		log.Printf("WARNING: development mode is on. Do not use it in production.")
+	}
+	return nil
+}
+
+func (r *request) dumpRequest() {
+	if !r.settings.developmentMode {
+		return
+	}
+	dump, err := httputil.DumpRequest(r.req, false)
+	if err != nil {
+		return
+	}
+	log.Printf("Request %d:\n%s", r.id, dump)
+}
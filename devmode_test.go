@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Development mode", func() {
+	AfterEach(func() {
+		Expect(setDevelopmentMode(false)).Should(Succeed())
+		Expect(ConfigureTransport(TransportOptions{})).Should(Succeed())
+		resetSettings()
+	})
+
+	// Return the status of a GET from loopback.
+	fetch := func(path string) string {
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		Expect(setRemoteAddr(id, "127.0.0.1:1234")).Should(Succeed())
+		Expect(beginRequest(id, makeRequestHeaders("GET", path, "", 0))).Should(Succeed())
+		status := ""
+		for cmd := pollRequest(id, true); cmd != "DONE"; cmd = pollRequest(id, true) {
+			if cmd[:4] == "SWCH" {
+				status = cmd[4:]
+			}
+		}
+		return status
+	}
+
+	transport := func() *http.Transport {
+		transportLock.Lock()
+		defer transportLock.Unlock()
+		return currentTransport.transport
+	}
+
+	It("Diagnostic endpoints", func() {
+		Expect(fetch("/debug/vars")).ShouldNot(Equal("200"))
+		Expect(setDevelopmentMode(true)).Should(Succeed())
+		Expect(fetch("/debug/vars")).Should(Equal("200"))
+		Expect(fetch("/debug/pprof/")).Should(Equal("200"))
+		Expect(fetch("/debug/pprof/cmdline")).Should(Equal("200"))
+
+		Expect(setDevelopmentMode(false)).Should(Succeed())
+		Expect(fetch("/debug/vars")).ShouldNot(Equal("200"))
+		Expect(fetch("/debug/pprof/")).ShouldNot(Equal("200"))
+	})
+
+	It("Configured paths win", func() {
+		Expect(setPprofEndpoint("/admin/pprof")).Should(Succeed())
+		Expect(setDevelopmentMode(true)).Should(Succeed())
+		Expect(fetch("/admin/pprof/")).Should(Equal("200"))
+		Expect(fetch("/debug/pprof/")).ShouldNot(Equal("200"))
+
+		Expect(setDevelopmentMode(false)).Should(Succeed())
+		Expect(fetch("/admin/pprof/")).Should(Equal("200"))
+	})
+
+	It("Request dump", func() {
+		logged := &bytes.Buffer{}
+		log.SetOutput(logged)
+		defer log.SetOutput(os.Stderr)
+
+		Expect(fetch("/pass?before=1")).Should(BeEmpty())
+		Expect(logged.String()).ShouldNot(ContainSubstring("before=1"))
+		Expect(setDevelopmentMode(true)).Should(Succeed())
+		Expect(fetch("/pass?during=1")).Should(BeEmpty())
+		Expect(logged.String()).Should(ContainSubstring("GET /pass?during=1 HTTP/1.1"))
+		Expect(logged.String()).Should(ContainSubstring("development mode"))
+	})
+
+	It("Transport", func() {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Secure"))
+		}))
+		defer server.Close()
+		Expect(ConfigureTransport(TransportOptions{MaxConnsPerHost: 3})).Should(Succeed())
+		_, err := (&http.Client{Transport: transport()}).Get(server.URL)
+		Expect(err).ShouldNot(Succeed())
+
+		Expect(setDevelopmentMode(true)).Should(Succeed())
+		t := transport()
+		Expect(t.MaxConnsPerHost).Should(Equal(3))
+		Expect(t.TLSHandshakeTimeout).Should(BeZero())
+		Expect(t.IdleConnTimeout).Should(BeZero())
+		resp, err := (&http.Client{Transport: t}).Get(server.URL)
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+
+		Expect(setDevelopmentMode(false)).Should(Succeed())
+		t = transport()
+		Expect(t.MaxConnsPerHost).Should(Equal(3))
+		Expect(t.TLSHandshakeTimeout).ShouldNot(BeZero())
+		Expect(t.TLSClientConfig == nil || !t.TLSClientConfig.InsecureSkipVerify).Should(BeTrue())
+	})
+
+	It("No maximum duration", func() {
+		setMaxRequestDuration(time.Hour)
+		Expect(setDevelopmentMode(true)).Should(Succeed())
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))).Should(Succeed())
+		Expect(getRequest(id).deadline).Should(BeNil())
+
+		Expect(setDevelopmentMode(false)).Should(Succeed())
+		id2 := createRequest(testHandler)
+		defer freeRequest(id2)
+		Expect(beginRequest(id2, makeRequestHeaders("GET", "/pass", "", 0))).Should(Succeed())
+		Expect(getRequest(id2).deadline).ShouldNot(BeNil())
+	})
+
+	It("Failed enable", func() {
+		setOptions := func(opts TransportOptions) {
+			transportLock.Lock()
+			transportOptions = opts
+			transportLock.Unlock()
+		}
+		defer setOptions(getTransportOptions())
+		setOptions(TransportOptions{MaxConnsPerHost: -1})
+		Expect(setDevelopmentMode(true)).ShouldNot(Succeed())
+		Expect(getSettings().developmentMode).Should(BeFalse())
+		Expect(fetch("/debug/vars")).ShouldNot(Equal("200"))
+	})
+
+	It("No upstream queue timeout", func() {
+		Expect(SetUpstreamConcurrencyLimit("localhost:*", 1, time.Millisecond)).Should(Succeed())
+		req, _ := http.NewRequest("GET", "http://localhost:1234/", nil)
+		release, err := acquireUpstream(req)
+		Expect(err).Should(Succeed())
+		defer release()
+		_, err = acquireUpstream(req)
+		Expect(isUpstreamBusy(err)).Should(BeTrue())
+
+		Expect(setDevelopmentMode(true)).Should(Succeed())
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err = acquireUpstream(req.WithContext(ctx))
+		Expect(err).Should(Equal(context.DeadlineExceeded))
+	})
+})
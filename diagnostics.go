@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ * A snapshot of the requests that are currently registered, for diagnosing
+ * requests that are stuck. The manager lock is only held long enough to
+ * copy the table, and each request is then described using its own lock.
+ */
+
+type activeRequest struct {
+	ID     uint32 `json:"id"`
+	State  string `json:"state"`
+	AgeMs  int64  `json:"ageMs"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+}
+
+type activeRequests []activeRequest
+
+func (a activeRequests) Len() int {
+	return len(a)
+}
+
+func (a activeRequests) Less(i, j int) bool {
+	return a[i].ID < a[j].ID
+}
+
+func (a activeRequests) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+func listActiveRequests() []activeRequest {
+	managerLatch.Lock()
+	reqs := make([]*request, 0, len(requests))
+	for _, req := range requests {
+		reqs = append(reqs, req)
+	}
+	managerLatch.Unlock()
+
+	list := make([]activeRequest, len(reqs))
+	for i, req := range reqs {
+		method, uri := req.getTarget()
+		if q := strings.IndexByte(uri, '?'); q >= 0 {
+			uri = uri[:q]
+		}
+		list[i] = activeRequest{
+			ID:     req.id,
+			State:  req.getState().String(),
+			AgeMs:  int64(req.age() / time.Millisecond),
+			Method: method,
+			Path:   uri,
+		}
+	}
+	sort.Sort(activeRequests(list))
+	return list
+}
+
+func getActiveRequestsJSON() string {
+	buf, err := json.Marshal(listActiveRequests())
+	if err != nil {
+		return "[]"
+	}
+	return string(buf)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Diagnostics", func() {
+	findRequest := func(id uint32) *activeRequest {
+		var list []activeRequest
+		Expect(json.Unmarshal([]byte(getActiveRequestsJSON()), &list)).Should(Succeed())
+		for i := range list {
+			if list[i].ID == id {
+				return &list[i]
+			}
+		}
+		return nil
+	}
+
+	It("List active requests", func() {
+		idle := createRequest(testHandler)
+		defer freeRequest(idle)
+		slow := createRequest(testHandler)
+		defer freeRequest(slow)
+
+		err := beginRequest(slow, makeRequestHeaders("GET", "/slowpass?x=1", "", 0))
+		Expect(err).Should(Succeed())
+		time.Sleep(50 * time.Millisecond)
+
+		info := findRequest(idle)
+		Expect(info).ShouldNot(BeNil())
+		Expect(info.State).Should(Equal("new"))
+		Expect(info.AgeMs).Should(BeZero())
+
+		info = findRequest(slow)
+		Expect(info).ShouldNot(BeNil())
+		Expect(info.State).Should(Equal("request"))
+		Expect(info.Method).Should(Equal("GET"))
+		Expect(info.Path).Should(Equal("/slowpass"))
+		Expect(info.AgeMs).Should(BeNumerically(">=", 50))
+
+		Expect(pollRequest(slow, true)).Should(Equal("DONE"))
+		Expect(findRequest(slow).State).Should(Equal("proxying"))
+
+		freeRequest(slow)
+		Expect(findRequest(slow)).Should(BeNil())
+	})
+})
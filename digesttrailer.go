@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+/*
+ * Let a response handler add an RFC 3230 Digest trailer to the response, so
+ * that clients can check a large download without the body being buffered.
+ * The body is hashed a chunk at a time as it is sent, and the trailer comes
+ * in a WTRL command after the last chunk. The Trailer header announces it,
+ * and the Content-Length is removed, since trailers need chunked encoding.
+ */
+
+var errNoTrailer = errors.New("Only a response handler can add a trailer")
+
+// The Digest algorithm names, and the hashes that they use
+var digestAlgorithms = map[string]string{
+	"md5":     "md5",
+	"sha":     "sha1",
+	"sha-256": "sha256",
+	"sha-512": "sha512",
+}
+
+type digestTrailer struct {
+	name string
+	hash hash.Hash
+}
+
+/*
+ * AddStreamingDigestTrailer hashes the response body as it is sent, using
+ * an algorithm such as "SHA-256," and sends the result as a Digest trailer.
+ * It must be called before the response headers are sent.
+ */
+func (h *httpResponse) AddStreamingDigestTrailer(algorithm string) error {
+	r, ok := h.handler.(*response)
+	if !ok {
+		return errNoTrailer
+	}
+	if r.headersSent {
+		return errResponseStarted
+	}
+	name := strings.ToLower(strings.TrimSpace(algorithm))
+	alg, ok := digestAlgorithms[name]
+	if !ok {
+		return fmt.Errorf("Unsupported digest algorithm: %s", algorithm)
+	}
+	r.trailer = &digestTrailer{
+		name: name,
+		hash: bodyHashes[alg](),
+	}
+	return nil
+}
+
+/*
+ * This comes after the hop-by-hop headers are removed, since Trailer is
+ * one of them.
+ */
+func (r *response) declareTrailer() {
+	if r.trailer == nil {
+		return
+	}
+	r.request.setOwnHeader(r.resp.Header, "Trailer", "Digest")
+	r.resp.Header.Del("Content-Length")
+}
+
+func (r *response) sendTrailer() {
+	if r.trailer == nil {
+		return
+	}
+	value := r.trailer.name + "=" + base64.StdEncoding.EncodeToString(r.trailer.hash.Sum(nil))
+	r.cmds <- command{
+		id:  WTRL,
+		msg: "Digest: " + value + "\n",
+	}
+}
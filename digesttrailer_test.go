@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Digest trailer", func() {
+	var id, rid uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		rid = createResponse(testHandler)
+		Expect(rid).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		freeResponse(rid)
+	})
+
+	It("Digest of the streamed body", func() {
+		chunks := [][]byte{
+			bytes.Repeat([]byte("first chunk "), 1000),
+			bytes.Repeat([]byte("second chunk "), 1000),
+		}
+		body := bytes.Join(chunks, nil)
+
+		err := beginRequest(id, makeRequestHeaders("GET", "/digesttrailer", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		err = beginResponse(rid, id, 200,
+			makeResponseHeaders("application/octet-stream", len(body)))
+		Expect(err).Should(Succeed())
+
+		cmd := pollResponse(rid, true)
+		Expect(cmd).Should(HavePrefix("WHDR"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("Trailer")).Should(Equal("Digest"))
+		Expect(hdrs.Get("Content-Length")).Should(BeEmpty())
+
+		Expect(pollResponse(rid, true)).Should(Equal("RBOD"))
+		sendResponseBodyChunk(rid, false, chunks[0])
+		sendResponseBodyChunk(rid, true, chunks[1])
+
+		sent := &bytes.Buffer{}
+		for cmd = pollResponse(rid, true); cmd[:4] == "WBOD"; cmd = pollResponse(rid, true) {
+			sent.Write(readBodyData(cmd))
+		}
+		Expect(sent.Bytes()).Should(Equal(body))
+
+		sum := sha256.Sum256(body)
+		Expect(cmd).Should(Equal("WTRLDigest: sha-256=" +
+			base64.StdEncoding.EncodeToString(sum[:]) + "\n"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Only for responses", func() {
+		h := &httpResponse{handler: &request{}}
+		Expect(h.AddStreamingDigestTrailer("sha-256")).Should(Equal(errNoTrailer))
+		h = &httpResponse{handler: &response{}}
+		Expect(h.AddStreamingDigestTrailer("crc32")).ShouldNot(Succeed())
+	})
+
+	It("Parse command", func() {
+		cmd, err := parseCommand("WTRLDigest: md5=abc")
+		Expect(err).Should(Succeed())
+		Expect(cmd.id).Should(Equal(WTRL))
+		Expect(cmd.msg).Should(Equal("Digest: md5=abc"))
+	})
+})
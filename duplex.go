@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/*
+ * Some requests, such as bidirectional gRPC streams, keep sending their
+ * body for as long as the response is streaming back. The request and
+ * response already run in separate goroutines, so all that is needed is
+ * to keep reading the request body after the response begins.
+ */
+
+/*
+ * Mark a request as full duplex. Requests that look like gRPC are marked
+ * automatically.
+ */
+func setFullDuplex(id uint32) error {
+	req := getRequest(id)
+	if req == nil {
+		return fmt.Errorf("Unknown request: %d", id)
+	}
+	req.setFullDuplex()
+	return nil
+}
+
+func (r *request) setFullDuplex() {
+	r.bodyLock.Lock()
+	r.fullDuplex = true
+	r.bodyLock.Unlock()
+}
+
+func isGRPC(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
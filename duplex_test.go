@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Full Duplex", func() {
+	var id uint32
+	var rid uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		rid = createResponse(testHandler)
+		Expect(rid).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		freeResponse(rid)
+	})
+
+	It("Early response stops the request body", func() {
+		err := beginRequest(id, makeRequestHeaders("POST", "/streambody", "application/octet-stream", 100<<20))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("RBOD"))
+
+		first := bytes.Repeat([]byte{'x'}, 1024)
+		sendRequestBodyChunk(id, false, first)
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+		Expect(readBodyData(cmd)).Should(Equal(first))
+
+		// The target has read 1KB and has had enough.
+		err = beginResponse(rid, id, 413, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("SBOD"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		// The rest of a 100MB upload that was already on the way
+		chunk := make([]byte, 1<<20)
+		for i := 0; i < 99; i++ {
+			sendRequestBodyChunk(id, false, chunk)
+		}
+		sendRequestBodyChunk(id, true, chunk[:1023<<10])
+		Expect(getRequest(id).getState()).Should(Equal(stateDone))
+	})
+
+	It("Response after the whole body", func() {
+		err := beginRequest(id, makeRequestHeaders("POST", "/streambody", "text/plain", 5))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("RBOD"))
+		sendRequestBodyChunk(id, true, []byte("Hello"))
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+		Expect(string(readBodyData(cmd))).Should(Equal("Hello"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		err = beginResponse(rid, id, 413, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Interim response", func() {
+		err := beginRequest(id, makeRequestHeaders("POST", "/streambody", "text/plain", 10))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("RBOD"))
+		sendRequestBodyChunk(id, false, []byte("Hello"))
+		Expect(pollRequest(id, true)).Should(MatchRegexp("^WBOD.*"))
+
+		err = beginResponse(rid, id, 100, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+
+		sendRequestBodyChunk(id, true, []byte("World"))
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+		Expect(string(readBodyData(cmd))).Should(Equal("World"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Bidirectional stream", func() {
+		err := beginRequest(id, makeRequestHeaders("POST", "/echostream", "application/grpc", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("RBOD"))
+
+		sendRequestBodyChunk(id, false, []byte("ping 1"))
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+		Expect(string(readBodyData(cmd))).Should(Equal("ping 1"))
+
+		// The target answers while the client is still sending.
+		err = beginResponse(rid, id, 200, makeResponseHeaders("application/grpc", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("RBOD"))
+
+		for i := 1; i <= 3; i++ {
+			sendResponseBodyChunk(rid, false, []byte(fmt.Sprintf("pong %d", i)))
+			cmd = pollResponse(rid, true)
+			Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+			Expect(string(readBodyData(cmd))).Should(Equal(fmt.Sprintf("pong %d", i)))
+
+			sendRequestBodyChunk(id, false, []byte(fmt.Sprintf("ping %d", i+1)))
+			cmd = pollRequest(id, true)
+			Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+			Expect(string(readBodyData(cmd))).Should(Equal(fmt.Sprintf("ping %d", i+1)))
+		}
+
+		sendRequestBodyChunk(id, true, nil)
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		sendResponseBodyChunk(rid, true, nil)
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Full duplex set by caller", func() {
+		Expect(setFullDuplex(id)).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("POST", "/streambody", "text/plain", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("RBOD"))
+		sendRequestBodyChunk(id, false, []byte("Hello"))
+		Expect(pollRequest(id, true)).Should(MatchRegexp("^WBOD.*"))
+
+		err = beginResponse(rid, id, 200, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+
+		sendRequestBodyChunk(id, true, []byte("World"))
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+		Expect(string(readBodyData(cmd))).Should(Equal("World"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+})
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+/*
+ * A cap on how long a request may take, from when it begins until DONE,
+ * whatever it is doing. A client that uploads slowly but steadily never
+ * looks idle, so without this it could hold on to the request, and any
+ * body that a handler is buffering, for as long as it liked. When the cap
+ * runs out, the request's context is cancelled and its body is abandoned,
+ * and unless a handler has already started a response, the request is
+ * answered with a 408. The time that the target takes comes after DONE, so
+ * it doesn't count. Development mode lifts the cap.
+ */
+
+const requestTimeoutMessage = "Request took too long"
+
+func setMaxRequestDuration(max time.Duration) {
+	updateSettings(func(s *settings) {
+		s.maxRequestDuration = max
+	})
+}
+
+func (r *request) startDurationTimer() {
+	if r.settings.maxRequestDuration <= 0 || r.settings.developmentMode {
+		return
+	}
+	r.deadline = time.AfterFunc(r.settings.maxRequestDuration, r.expire)
+}
+
+/*
+ * Return false if the timer may have fired, in which case it may still be
+ * looking at the request.
+ */
+func (r *request) stopDurationTimer() bool {
+	return r.deadline == nil || r.deadline.Stop()
+}
+
+func (r *request) expire() {
+	if r.getState() != stateRequest {
+		return
+	}
+	r.bodyLock.Lock()
+	r.expired = true
+	r.bodyLock.Unlock()
+	r.cancel()
+	r.discardBody()
+}
+
+func (r *request) durationExceeded() bool {
+	r.bodyLock.Lock()
+	defer r.bodyLock.Unlock()
+	return r.expired
+}
+
+/*
+ * Answer with a 408 instead of whatever the request was going to do, if it
+ * ran out of time and no response was started.
+ */
+func (r *request) checkDuration() bool {
+	if !r.durationExceeded() || r.resp.headersFlushed {
+		return true
+	}
+	r.proxying = false
+	r.reject(http.StatusRequestTimeout, requestTimeoutMessage)
+	return false
+}
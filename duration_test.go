@@ -0,0 +1,89 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Request duration limit", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		resetSettings()
+	})
+
+	// Send up to "chunks" chunks of the body, one every 10 milliseconds,
+	// and return the commands that were polled before DONE.
+	slowUpload := func(path string, chunks int) []string {
+		hdrs := makeRequestHeaders("POST", path, "text/plain", chunks)
+		Expect(beginRequest(id, hdrs)).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("RBOD"))
+		stop := make(chan bool)
+		sent := make(chan bool)
+		go func() {
+			defer close(sent)
+			for i := 0; i < chunks; i++ {
+				select {
+				case <-stop:
+					return
+				case <-time.After(10 * time.Millisecond):
+				}
+				sendRequestBodyChunk(id, i == chunks-1, []byte("x"))
+			}
+		}()
+		var cmds []string
+		for cmd := pollRequest(id, true); cmd != "DONE"; cmd = pollRequest(id, true) {
+			cmds = append(cmds, cmd)
+		}
+		close(stop)
+		<-sent
+		return cmds
+	}
+
+	It("Slow but steady upload", func() {
+		setMaxRequestDuration(100 * time.Millisecond)
+		started := time.Now()
+		cmds := slowUpload("/readbody", 100)
+		Expect(time.Since(started)).Should(BeNumerically("<", 500*time.Millisecond))
+		Expect(cmds).ShouldNot(BeEmpty())
+		Expect(cmds[0]).Should(Equal("SWCH408"))
+		Expect(string(readBodyData(cmds[len(cmds)-1]))).Should(Equal(requestTimeoutMessage))
+		Expect(getRequest(id).ctx.Err()).ShouldNot(Succeed())
+	})
+
+	It("Buffered upload", func() {
+		setMaxRequestDuration(100 * time.Millisecond)
+		setRequestBuffering(true)
+		cmds := slowUpload("/pass", 100)
+		Expect(cmds).ShouldNot(BeEmpty())
+		Expect(cmds[0]).Should(Equal("SWCH408"))
+	})
+
+	It("Under the limit", func() {
+		setMaxRequestDuration(time.Second)
+		cmds := slowUpload("/readbody", 5)
+		Expect(cmds).Should(BeEmpty())
+		Expect(string(lastTestBody)).Should(Equal("xxxxx"))
+	})
+
+	It("Target time doesn't count", func() {
+		setMaxRequestDuration(50 * time.Millisecond)
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		time.Sleep(100 * time.Millisecond)
+		Expect(getRequest(id).ctx.Err()).Should(Succeed())
+
+		rid := createResponse(testHandler)
+		defer freeResponse(rid)
+		Expect(beginResponse(rid, id, 200, makeResponseHeaders("", 0))).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+})
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Management of the Accept-Encoding header that is sent to the target.
+ * If the response body is going to be read or transformed, then it's
+ * easier for everyone if the target doesn't compress it. The policy
+ * decides what to send unless the caller has overridden it for a
+ * particular request. If the target then uses an encoding that the client
+ * didn't ask for, the response body is decoded on the way back.
+ *
+ * Negotiation is for targets that only support some encodings. The
+ * client's header is cut down to the encodings that the target supports,
+ * and if the client prefers an encoding that the target didn't use, the
+ * body is recompressed using transcoding.
+ */
+
+func setAcceptEncodingPolicy(policy string) error {
+	switch policy {
+	case AcceptEncodingPassthrough, AcceptEncodingIdentity, AcceptEncodingNormalize:
+	default:
+		return fmt.Errorf("Invalid Accept-Encoding policy: \"%s\"", policy)
+	}
+	updateSettings(func(s *settings) {
+		s.acceptEncodingPolicy = policy
+	})
+	return nil
+}
+
+func setAcceptEncoding(id uint32, values string) error {
+	req := getRequest(id)
+	if req == nil {
+		return fmt.Errorf("Unknown request: %d", id)
+	}
+	var encodings []string
+	for _, v := range strings.Split(values, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			encodings = append(encodings, v)
+		}
+	}
+	req.acceptEncoding = encodings
+	return nil
+}
+
+func setAcceptEncodingNegotiation(enabled bool) {
+	updateSettings(func(s *settings) {
+		s.negotiateEncoding = enabled
+	})
+}
+
+/*
+ * Set the encodings that the target supports, separated by commas.
+ */
+func setBackendEncodings(values string) error {
+	var encodings []string
+	for _, v := range strings.Split(values, ",") {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if v == "" {
+			continue
+		}
+		if v == "*" || strings.ContainsAny(v, "; ") {
+			return fmt.Errorf("Invalid encoding: \"%s\"", v)
+		}
+		encodings = append(encodings, v)
+	}
+	updateSettings(func(s *settings) {
+		s.backendEncodings = encodings
+	})
+	return nil
+}
+
+/*
+ * Set the Accept-Encoding header on the request that we will forward
+ * to the target. The policy only applies when a global setting may rewrite
+ * the response body; otherwise the target sees what the client sent.
+ */
+func (r *request) rewriteAcceptEncoding() {
+	if len(r.acceptEncoding) > 0 {
+		r.req.Header.Set("Accept-Encoding", strings.Join(r.acceptEncoding, ", "))
+		return
+	}
+
+	if r.settings.negotiateEncoding {
+		if value := r.req.Header.Get("Accept-Encoding"); value != "" {
+			r.req.Header.Set("Accept-Encoding",
+				negotiateAcceptEncoding(value, r.settings.backendEncodings))
+		}
+		return
+	}
+
+	if !r.settings.rewritesBodies() {
+		return
+	}
+	switch r.settings.acceptEncodingPolicy {
+	case AcceptEncodingIdentity:
+		r.req.Header.Set("Accept-Encoding", AcceptEncodingIdentity)
+	case AcceptEncodingNormalize:
+		r.req.Header.Set("Accept-Encoding",
+			normalizeAcceptEncoding(r.req.Header.Get("Accept-Encoding")))
+	}
+}
+
+/*
+ * Report whether minification, substitution or snippet injection is turned
+ * on, any of which need a response body they can read.
+ */
+func (s *settings) rewritesBodies() bool {
+	return len(s.minifyTypes) > 0 || s.imageQuality > 0 ||
+		len(s.substitutions) > 0 || len(s.htmlSnippets) > 0
+}
+
+/*
+ * Collapse an Accept-Encoding header to the one encoding that we are willing
+ * to decode if we have to.
+ */
+func normalizeAcceptEncoding(value string) string {
+	if acceptsEncoding(value, "gzip") {
+		return "gzip"
+	}
+	return AcceptEncodingIdentity
+}
+
+/*
+ * Remove the encodings that the target doesn't support from an
+ * Accept-Encoding header, keeping their "q" values, and replace "*" with
+ * the supported encodings that weren't named.
+ */
+func negotiateAcceptEncoding(value string, supported []string) string {
+	var kept []string
+	named := make(map[string]bool)
+	wildcard := ""
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		name := strings.ToLower(strings.TrimSpace(strings.SplitN(part, ";", 2)[0]))
+		named[name] = true
+		switch {
+		case name == "*":
+			wildcard = part
+		case name == AcceptEncodingIdentity || containsString(supported, name):
+			kept = append(kept, part)
+		}
+	}
+	if wildcard != "" {
+		params := strings.TrimPrefix(wildcard, "*")
+		for _, enc := range supported {
+			if !named[enc] {
+				kept = append(kept, enc+params)
+			}
+		}
+	}
+	if len(kept) == 0 {
+		return AcceptEncodingIdentity
+	}
+	return strings.Join(kept, ", ")
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Return whether an Accept-Encoding header allows "coding."
+ */
+func acceptsEncoding(value, coding string) bool {
+	return encodingQuality(value, coding) > 0
+}
+
+/*
+ * Return the "q" value that an Accept-Encoding header gives "coding." A
+ * coding given by name takes precedence over "*," and a "q" of zero means
+ * "no." To be safe, a missing header only allows "identity."
+ */
+func encodingQuality(value, coding string) float64 {
+	if strings.TrimSpace(value) == "" {
+		if coding == AcceptEncodingIdentity {
+			return 1
+		}
+		return 0
+	}
+	named, wildcard := -1.0, -1.0
+	for _, part := range strings.Split(value, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		quality := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if q, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		switch name {
+		case coding:
+			named = quality
+		case "*":
+			wildcard = quality
+		}
+	}
+	if named >= 0 {
+		return named
+	}
+	if wildcard >= 0 {
+		return wildcard
+	}
+	if coding == AcceptEncodingIdentity {
+		return 1
+	}
+	return 0
+}
+
+/*
+ * If the target sent a gzipped body to a client that didn't ask for one,
+ * which can happen when the Accept-Encoding header was changed, decode it
+ * before any handler sees it. A client that sent no Accept-Encoding at all
+ * accepts anything, and a response without a body is left alone.
+ */
+func (r *response) decodeForClient() {
+	if !strings.EqualFold(r.resp.Header.Get("Content-Encoding"), "gzip") ||
+		!bodyAllowed(r.request.req, r.resp.StatusCode) {
+		return
+	}
+	accept := r.request.origHeaders["Accept-Encoding"]
+	if len(accept) == 0 || acceptsEncoding(strings.Join(accept, ","), "gzip") {
+		return
+	}
+	addVary(r.resp.Header, "Accept-Encoding")
+	r.resp.Header.Del("Content-Encoding")
+	r.resp.Header.Del("Content-Length")
+	r.resp.ContentLength = -1
+	r.resp.Body = newDecodedBody(r.resp.Body, "gzip")
+}
+
+var bodyDecoders = map[string]func(io.Reader) (io.Reader, error){
+	"gzip": func(r io.Reader) (io.Reader, error) {
+		return gzip.NewReader(r)
+	},
+	// As HTTP uses the name, "deflate" means the zlib format
+	"deflate": func(r io.Reader) (io.Reader, error) {
+		return zlib.NewReader(r)
+	},
+}
+
+/*
+ * This doesn't read anything until the handler does, so that the headers
+ * can still be changed until then.
+ */
+type decodedBody struct {
+	body    io.ReadCloser
+	decoder func(io.Reader) (io.Reader, error)
+	decoded io.Reader
+	err     error
+}
+
+func newDecodedBody(body io.ReadCloser, encoding string) *decodedBody {
+	return &decodedBody{
+		body:    body,
+		decoder: bodyDecoders[encoding],
+	}
+}
+
+func (b *decodedBody) Read(p []byte) (int, error) {
+	if b.decoded == nil && b.err == nil {
+		b.decoded, b.err = b.decoder(b.body)
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.decoded.Read(p)
+}
+
+func (b *decodedBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Accept-Encoding", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		resetSettings()
+	})
+
+	It("Passthrough by default", func() {
+		hdrs := addRequestHeader(makeRequestHeaders("GET", "/pass", "", 0), "Accept-Encoding", "br")
+		err := beginRequest(id, hdrs)
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Identity policy", func() {
+		Expect(setAcceptEncodingPolicy(AcceptEncodingIdentity)).Should(Succeed())
+		Expect(setResponseMinification("text/html", true)).Should(Succeed())
+		hdrs := addRequestHeader(makeRequestHeaders("GET", "/pass", "", 0), "Accept-Encoding", "br")
+		err := beginRequest(id, hdrs)
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		rh := http.Header{}
+		parseHeaders(rh, cmd[4:])
+		Expect(rh.Get("Accept-Encoding")).Should(Equal("identity"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Identity policy without a body filter", func() {
+		Expect(setAcceptEncodingPolicy(AcceptEncodingIdentity)).Should(Succeed())
+		hdrs := addRequestHeader(makeRequestHeaders("GET", "/pass", "", 0), "Accept-Encoding", "br")
+		err := beginRequest(id, hdrs)
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Override for one request", func() {
+		Expect(setAcceptEncodingPolicy(AcceptEncodingIdentity)).Should(Succeed())
+		Expect(setAcceptEncoding(id, "gzip")).Should(Succeed())
+		hdrs := addRequestHeader(makeRequestHeaders("GET", "/pass", "", 0), "Accept-Encoding", "br")
+		err := beginRequest(id, hdrs)
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		rh := http.Header{}
+		parseHeaders(rh, cmd[4:])
+		Expect(rh.Get("Accept-Encoding")).Should(Equal("gzip"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Normalize", func() {
+		Expect(normalizeAcceptEncoding("br;q=1.0, gzip;q=0.8, deflate, *;q=0.1")).Should(Equal("gzip"))
+		Expect(normalizeAcceptEncoding("GZIP")).Should(Equal("gzip"))
+		Expect(normalizeAcceptEncoding("br, *")).Should(Equal("gzip"))
+		Expect(normalizeAcceptEncoding("*, gzip;q=0")).Should(Equal("identity"))
+		Expect(normalizeAcceptEncoding("br, deflate")).Should(Equal("identity"))
+		Expect(normalizeAcceptEncoding("")).Should(Equal("identity"))
+	})
+
+	It("Normalize policy", func() {
+		Expect(setAcceptEncodingPolicy(AcceptEncodingNormalize)).Should(Succeed())
+		Expect(setHTMLSnippet("head-end", "<script></script>")).Should(Succeed())
+		hdrs := addRequestHeader(makeRequestHeaders("GET", "/pass", "", 0),
+			"Accept-Encoding", "br;q=1.0, gzip;q=0.8, deflate;q=0.5")
+		err := beginRequest(id, hdrs)
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		rh := http.Header{}
+		parseHeaders(rh, cmd[4:])
+		Expect(rh.Get("Accept-Encoding")).Should(Equal("gzip"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Decode response", func() {
+		rid := createResponse(testHandler)
+		defer freeResponse(rid)
+		Expect(setAcceptEncoding(id, "gzip")).Should(Succeed())
+		hdrs := addRequestHeader(makeRequestHeaders("GET", "/pass", "", 0), "Accept-Encoding", "br")
+		err := beginRequest(id, hdrs)
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(MatchRegexp("^WHDR.*"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		msg := []byte("Hello, gzipped world!")
+		buf := &bytes.Buffer{}
+		gz := gzip.NewWriter(buf)
+		gz.Write(msg)
+		gz.Close()
+
+		err = beginResponse(rid, id, 200,
+			"Content-Encoding: gzip\n"+makeResponseHeaders("text/plain", buf.Len()))
+		Expect(err).Should(Succeed())
+
+		cmd := pollResponse(rid, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		rh := http.Header{}
+		parseHeaders(rh, cmd[4:])
+		Expect(rh.Get("Content-Encoding")).Should(BeEmpty())
+		Expect(rh.Get("Content-Length")).Should(BeEmpty())
+		Expect(rh.Get("Content-Type")).Should(Equal("text/plain"))
+		Expect(rh.Get("Vary")).Should(Equal("Accept-Encoding"))
+
+		Expect(pollResponse(rid, true)).Should(Equal("RBOD"))
+		sendResponseBodyChunk(rid, true, buf.Bytes())
+		Expect(readBodyData(pollResponse(rid, true))).Should(Equal(msg))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Keep encoding the client accepts", func() {
+		rid := createResponse(testHandler)
+		defer freeResponse(rid)
+		hdrs := addRequestHeader(makeRequestHeaders("GET", "/pass", "", 0), "Accept-Encoding", "gzip")
+		err := beginRequest(id, hdrs)
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		err = beginResponse(rid, id, 200,
+			"Content-Encoding: gzip\n"+makeResponseHeaders("text/plain", 10))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	// Change Accept-Encoding to gzip for a client that sent "clientAE," or
+	// nothing if it is empty, and return the first response command.
+	gzipResponse := func(method, clientAE string, status uint32) string {
+		rid := createResponse(testHandler)
+		defer freeResponse(rid)
+		Expect(setAcceptEncoding(id, "gzip")).Should(Succeed())
+		hdrs := makeRequestHeaders(method, "/pass", "", 0)
+		if clientAE != "" {
+			hdrs = addRequestHeader(hdrs, "Accept-Encoding", clientAE)
+		}
+		Expect(beginRequest(id, hdrs)).Should(Succeed())
+		for cmd := pollRequest(id, true); cmd != "DONE"; cmd = pollRequest(id, true) {
+		}
+		err := beginResponse(rid, id, status,
+			"Content-Encoding: gzip\n"+makeResponseHeaders("text/plain", 10))
+		Expect(err).Should(Succeed())
+		return pollResponse(rid, true)
+	}
+
+	It("Keep encoding when the client sent no Accept-Encoding", func() {
+		Expect(gzipResponse("GET", "", 200)).Should(Equal("DONE"))
+	})
+
+	It("Keep encoding of responses without a body", func() {
+		Expect(gzipResponse("HEAD", "br", 200)).Should(Equal("DONE"))
+		freeRequest(id)
+		id = createRequest(testHandler)
+		Expect(gzipResponse("GET", "br", 304)).Should(Equal("DONE"))
+	})
+
+	It("Negotiate", func() {
+		gzipOnly := []string{"gzip"}
+		Expect(negotiateAcceptEncoding("br, gzip, deflate", gzipOnly)).Should(Equal("gzip"))
+		Expect(negotiateAcceptEncoding("br;q=1, gzip;q=0.5, identity;q=0.1", gzipOnly)).
+			Should(Equal("gzip;q=0.5, identity;q=0.1"))
+		Expect(negotiateAcceptEncoding("br, *;q=0.2", []string{"gzip", "deflate"})).
+			Should(Equal("gzip;q=0.2, deflate;q=0.2"))
+		Expect(negotiateAcceptEncoding("deflate, *", []string{"gzip", "deflate"})).
+			Should(Equal("deflate, gzip"))
+		Expect(negotiateAcceptEncoding("br", gzipOnly)).Should(Equal("identity"))
+		Expect(negotiateAcceptEncoding("gzip", nil)).Should(Equal("identity"))
+	})
+
+	It("Negotiation", func() {
+		setAcceptEncodingNegotiation(true)
+		Expect(setBackendEncodings("GZIP")).Should(Succeed())
+		// Negotiation takes precedence over the policy
+		Expect(setAcceptEncodingPolicy(AcceptEncodingIdentity)).Should(Succeed())
+		hdrs := addRequestHeader(makeRequestHeaders("GET", "/pass", "", 0),
+			"Accept-Encoding", "br, gzip, deflate")
+		err := beginRequest(id, hdrs)
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		rh := http.Header{}
+		parseHeaders(rh, cmd[4:])
+		Expect(rh["Accept-Encoding"]).Should(Equal([]string{"gzip"}))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Invalid backend encodings", func() {
+		Expect(setBackendEncodings("gzip, *")).ShouldNot(Succeed())
+		Expect(setBackendEncodings("gzip;q=1")).ShouldNot(Succeed())
+		Expect(setBackendEncodings("")).Should(Succeed())
+	})
+
+	It("Invalid policy", func() {
+		Expect(setAcceptEncodingPolicy("compress-everything")).ShouldNot(Succeed())
+		Expect(getSettings().acceptEncodingPolicy).Should(Equal(AcceptEncodingPassthrough))
+	})
+})
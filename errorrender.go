@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Errors that weaver sends itself, such as a 429 from a rate limit or a
+ * 502 when no upstream succeeded, normally have a plain text body. An error
+ * renderer can replace it with something structured, such as RFC 9457
+ * problem details, for every one of them, as well as for errors that
+ * handlers send using SendError.
+ */
+
+// An ErrorRenderer produces the body of an error response. It returns the
+// content type and body, or an empty content type to send plain text
+// instead, for instance because the client won't accept anything else.
+type ErrorRenderer interface {
+	Render(req *http.Request, requestID string, p ProblemDetails) (string, []byte)
+}
+
+// ProblemJSONRenderer renders errors as application/problem+json for
+// clients that accept it
+type ProblemJSONRenderer struct {
+	// BaseType is the start of the "type" URI. The status text, such as
+	// "too-many-requests," is added to it. If it is empty, the type is
+	// "about:blank."
+	BaseType string
+	// IncludeRequestID adds weaver's ID for the request as "requestId"
+	IncludeRequestID bool
+}
+
+// ProblemError is an error that a handler can pass to SendError to
+// control the problem details. Any field that is empty is filled in.
+type ProblemError struct {
+	Status   int
+	Type     string
+	Title    string
+	Detail   string
+	Instance string
+}
+
+func (e *ProblemError) Error() string {
+	if e.Detail != "" {
+		return e.Detail
+	}
+	if e.Title != "" {
+		return e.Title
+	}
+	return http.StatusText(e.Status)
+}
+
+/*
+ * SetErrorRenderer sets how error responses are rendered. A nil renderer
+ * goes back to plain text.
+ */
+func SetErrorRenderer(renderer ErrorRenderer) {
+	updateSettings(func(s *settings) {
+		s.errorRenderer = renderer
+	})
+}
+
+func setProblemJSONErrors(enabled bool, baseType string, includeRequestID bool) {
+	if !enabled {
+		SetErrorRenderer(nil)
+		return
+	}
+	SetErrorRenderer(ProblemJSONRenderer{
+		BaseType:         baseType,
+		IncludeRequestID: includeRequestID,
+	})
+}
+
+// Render implements ErrorRenderer
+func (pr ProblemJSONRenderer) Render(req *http.Request, requestID string, p ProblemDetails) (string, []byte) {
+	if !acceptsProblemJSON(req.Header.Get("Accept")) {
+		return "", nil
+	}
+	if p.Type == "" && pr.BaseType != "" {
+		slug := strings.ToLower(strings.Replace(http.StatusText(p.Status), " ", "-", -1))
+		p.Type = strings.TrimSuffix(pr.BaseType, "/") + "/" + slug
+	}
+	if p.Instance == "" {
+		p.Instance = req.URL.RequestURI()
+	}
+	fields := map[string]interface{}{}
+	buf, err := json.Marshal(p.complete(p.Status))
+	if err != nil || json.Unmarshal(buf, &fields) != nil {
+		return "", nil
+	}
+	if pr.IncludeRequestID && requestID != "" {
+		fields["requestId"] = requestID
+	}
+	buf, err = json.Marshal(fields)
+	if err != nil {
+		return "", nil
+	}
+	return problemContentType, buf
+}
+
+/*
+ * Return true unless the Accept header rules out JSON. A missing header
+ * accepts anything.
+ */
+func acceptsProblemJSON(accept string) bool {
+	if strings.TrimSpace(accept) == "" {
+		return true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q <= 0 {
+			continue
+		}
+		switch mediaType {
+		case problemContentType, "application/json", "application/*", "*/*":
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Render an error using the current renderer, or as plain text.
+ */
+func (r *request) renderError(p ProblemDetails) (string, []byte) {
+	if renderer := r.settings.errorRenderer; renderer != nil && r.req != nil {
+		if contentType, body := renderer.Render(r.req, r.msgID, p); contentType != "" {
+			return contentType, body
+		}
+	}
+	msg := p.Detail
+	if msg == "" {
+		msg = p.complete(p.Status).Title
+	}
+	return "text/plain", []byte(msg)
+}
+
+/*
+ * SendError sends an error response with the given status instead of
+ * proxying the request or returning the response from the target. If "err"
+ * is a *ProblemError, its fields are used, including its status if it has
+ * one. Otherwise, the message of "err" is the detail. The body is rendered
+ * like the errors that weaver sends itself.
+ */
+func (h *httpResponse) SendError(status int, err error) error {
+	p := ProblemDetails{Status: status}
+	if pe, ok := err.(*ProblemError); ok {
+		if pe.Status != 0 {
+			p.Status = pe.Status
+		}
+		p.Type = pe.Type
+		p.Title = pe.Title
+		p.Detail = pe.Detail
+		p.Instance = pe.Instance
+	} else if err != nil {
+		p.Detail = err.Error()
+	}
+	r := h.owner()
+	if r == nil {
+		return errResponseStarted
+	}
+	contentType, body := r.renderError(p)
+	return h.writeBody(p.Status, contentType, body)
+}
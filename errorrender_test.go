@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Error renderer", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		resetSettings()
+	})
+
+	// Read an error response and return its status, headers, and body.
+	readError := func() (string, http.Header, []byte) {
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("SWCH"))
+		status := cmd[4:]
+		cmd = pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("WHDR"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		cmd = pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("WBOD"))
+		body := readBodyData(cmd)
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		return status, hdrs, body
+	}
+
+	readProblem := func() (string, map[string]interface{}) {
+		status, hdrs, body := readError()
+		Expect(hdrs.Get("Content-Type")).Should(Equal(problemContentType))
+		var p map[string]interface{}
+		Expect(json.Unmarshal(body, &p)).Should(Succeed())
+		return status, p
+	}
+
+	enable := func() {
+		SetErrorRenderer(ProblemJSONRenderer{
+			BaseType:         "https://errors.example.com/",
+			IncludeRequestID: true,
+		})
+	}
+
+	It("Rate limit", func() {
+		enable()
+		Expect(setRateLimit(1, 1)).Should(Succeed())
+		other := createRequest(testHandler)
+		Expect(setRemoteAddr(other, "10.0.0.1:1234")).Should(Succeed())
+		Expect(beginRequest(other, makeRequestHeaders("GET", "/pass", "", 0))).Should(Succeed())
+		Expect(pollRequest(other, true)).Should(Equal("DONE"))
+		freeRequest(other)
+
+		Expect(setRemoteAddr(id, "10.0.0.1:1235")).Should(Succeed())
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/pass?x=1", "", 0))).Should(Succeed())
+		status, p := readProblem()
+		Expect(status).Should(Equal("429"))
+		Expect(p["status"]).Should(BeEquivalentTo(429))
+		Expect(p["title"]).Should(Equal("Too Many Requests"))
+		Expect(p["type"]).Should(Equal("https://errors.example.com/too-many-requests"))
+		Expect(p["instance"]).Should(Equal("/pass?x=1"))
+		Expect(p["detail"]).ShouldNot(BeEmpty())
+		Expect(p["requestId"]).ShouldNot(BeEmpty())
+	})
+
+	It("Header line too long", func() {
+		enable()
+		setMaxHeaderLineSize(64)
+		hdrs := makeRequestHeaders("GET", "/pass", "", 0)
+		hdrs = addRequestHeader(hdrs, "X-Huge", strings.Repeat("x", 100))
+		Expect(beginRequest(id, hdrs)).Should(Succeed())
+		status, p := readProblem()
+		Expect(status).Should(Equal("431"))
+		Expect(p["detail"]).Should(Equal(headerLineTooLongMessage))
+		Expect(p["type"]).Should(Equal(
+			"https://errors.example.com/request-header-fields-too-large"))
+	})
+
+	It("No upstream succeeded", func() {
+		broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer broken.Close()
+
+		enable()
+		Expect(setConcatResponses(id, broken.URL, true)).Should(Succeed())
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))).Should(Succeed())
+		status, p := readProblem()
+		Expect(status).Should(Equal("502"))
+		Expect(p["detail"]).Should(Equal("No upstream succeeded"))
+	})
+
+	It("Handler error", func() {
+		enable()
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/senderror", "", 0))).Should(Succeed())
+		status, p := readProblem()
+		Expect(status).Should(Equal("409"))
+		Expect(p["title"]).Should(Equal("Version conflict"))
+		Expect(p["detail"]).Should(Equal("The resource was changed by someone else"))
+		Expect(p["type"]).Should(Equal("https://errors.example.com/conflict"))
+		Expect(p["instance"]).Should(Equal("/senderror"))
+	})
+
+	It("Content negotiation", func() {
+		enable()
+		hdrs := makeRequestHeaders("GET", "/senderror", "", 0)
+		hdrs = addRequestHeader(hdrs, "Accept", "text/html, application/json;q=0")
+		Expect(beginRequest(id, hdrs)).Should(Succeed())
+		status, rh, body := readError()
+		Expect(status).Should(Equal("409"))
+		Expect(rh.Get("Content-Type")).Should(Equal("text/plain"))
+		Expect(string(body)).Should(Equal("The resource was changed by someone else"))
+	})
+
+	It("Accept", func() {
+		Expect(acceptsProblemJSON("")).Should(BeTrue())
+		Expect(acceptsProblemJSON("*/*")).Should(BeTrue())
+		Expect(acceptsProblemJSON("text/html, application/*;q=0.1")).Should(BeTrue())
+		Expect(acceptsProblemJSON("application/problem+json")).Should(BeTrue())
+		Expect(acceptsProblemJSON("text/html")).Should(BeFalse())
+		Expect(acceptsProblemJSON("application/json;q=0")).Should(BeFalse())
+	})
+
+	It("Disabled", func() {
+		setMaxHeaderLineSize(64)
+		hdrs := makeRequestHeaders("GET", "/pass", "", 0)
+		hdrs = addRequestHeader(hdrs, "X-Huge", strings.Repeat("x", 100))
+		Expect(beginRequest(id, hdrs)).Should(Succeed())
+		status, rh, body := readError()
+		Expect(status).Should(Equal("431"))
+		Expect(rh.Get("Content-Type")).Should(Equal("text/plain"))
+		Expect(string(body)).Should(Equal(headerLineTooLongMessage))
+	})
+
+	It("Plain error", func() {
+		Expect((&ProblemError{Status: 404}).Error()).Should(Equal("Not Found"))
+		Expect((&ProblemError{Title: "Gone fishing"}).Error()).Should(Equal("Gone fishing"))
+	})
+})
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+)
+
+/*
+ * Once a handler or a setting has changed the response body, the ETag and
+ * Last-Modified headers from the target describe a body that the client
+ * will never see, so they are removed, along with any "no-transform" in
+ * Cache-Control. A body was changed if it isn't the one that weaver gave the
+ * handler. Like hop-by-hop stripping, the setting is "keep" so that the zero
+ * value is the default.
+ */
+
+func setETagStripping(strip bool) {
+	updateSettings(func(s *settings) {
+		s.keepValidators = !strip
+	})
+}
+
+func (r *response) stripValidators() {
+	if r.request.settings.keepValidators || r.resp.Body == r.origBody ||
+		(r.sniffedBody != nil && r.resp.Body == r.sniffedBody) {
+		return
+	}
+	r.resp.Header.Del("ETag")
+	r.resp.Header.Del("Last-Modified")
+	removeNoTransform(r.resp.Header)
+}
+
+/*
+ * Remove the "no-transform" directive from Cache-Control and leave the
+ * rest. If nothing is left, remove the header.
+ */
+func removeNoTransform(h http.Header) {
+	cc := ParseCacheControl(h)
+	if !cc.Has("no-transform") {
+		return
+	}
+	cc.Del("no-transform")
+	cc.Apply(h)
+}
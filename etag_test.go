@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ETag stripping", func() {
+	var id, rid uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		rid = createResponse(testHandler)
+		Expect(rid).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		freeResponse(rid)
+		resetSettings()
+	})
+
+	responseHeaders := "ETag: \"abc\"\n" +
+		"Last-Modified: Wed, 01 Jan 2025 00:00:00 GMT\n" +
+		"Cache-Control: public, no-transform, max-age=60\n" +
+		makeResponseHeaders("text/plain", 10)
+
+	cacheControl := func(hdrs http.Header) []string {
+		var directives []string
+		for _, d := range hdrs["Cache-Control"] {
+			directives = append(directives, strings.TrimSpace(d))
+		}
+		return directives
+	}
+
+	// Return the headers that were sent, or nil if they weren't changed.
+	run := func(path string) http.Header {
+		err := beginRequest(id, makeRequestHeaders("GET", path, "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		err = beginResponse(rid, id, 200, responseHeaders)
+		Expect(err).Should(Succeed())
+
+		var hdrs http.Header
+		for cmd := pollResponse(rid, true); cmd != "DONE"; cmd = pollResponse(rid, true) {
+			if cmd[:4] == "WHDR" {
+				hdrs = http.Header{}
+				parseHeaders(hdrs, cmd[4:])
+			}
+		}
+		return hdrs
+	}
+
+	It("Transformed", func() {
+		hdrs := run("/transformbody")
+		Expect(hdrs).ShouldNot(BeNil())
+		Expect(hdrs.Get("ETag")).Should(BeEmpty())
+		Expect(hdrs.Get("Last-Modified")).Should(BeEmpty())
+		Expect(cacheControl(hdrs)).Should(Equal([]string{"public", "max-age=60"}))
+	})
+
+	It("Untouched", func() {
+		Expect(run("/pass")).Should(BeNil())
+	})
+
+	It("Disabled", func() {
+		setETagStripping(false)
+		Expect(run("/transformbody")).Should(BeNil())
+	})
+
+	It("Only no-transform", func() {
+		h := http.Header{}
+		h.Set("Cache-Control", "No-Transform")
+		removeNoTransform(h)
+		Expect(h).ShouldNot(HaveKey("Cache-Control"))
+		h.Set("Cache-Control", "no-cache")
+		removeNoTransform(h)
+		Expect(h.Get("Cache-Control")).Should(Equal("no-cache"))
+	})
+})
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+ * Give responses an expiration time, for targets such as static asset
+ * servers that don't set one. Both an Expires header and a max-age
+ * directive in Cache-Control are set, replacing any that the target sent,
+ * and other Cache-Control directives are kept. By default this applies to
+ * every 2xx response, but each status can be turned on or off. Responses
+ * that say they must not be cached are left alone.
+ */
+
+// So that tests can control the time
+var expiresClock = time.Now
+
+func setResponseExpires(maxAge uint32) {
+	updateSettings(func(s *settings) {
+		s.expiresMaxAge = maxAge
+	})
+}
+
+func setResponseExpiresForStatus(status int, enabled bool) {
+	updateSettings(func(s *settings) {
+		statuses := make(map[int]bool)
+		for k, v := range s.expiresStatuses {
+			statuses[k] = v
+		}
+		statuses[status] = enabled
+		s.expiresStatuses = statuses
+	})
+}
+
+func expiresApplies(statuses map[int]bool, status int) bool {
+	if enabled, ok := statuses[status]; ok {
+		return enabled
+	}
+	return status >= 200 && status <= 299
+}
+
+func (r *response) setExpires() {
+	s := r.request.settings
+	if s.expiresMaxAge == 0 || !expiresApplies(s.expiresStatuses, r.resp.StatusCode) {
+		return
+	}
+	cc := ParseCacheControl(r.resp.Header)
+	if cc.Has("no-store") || cc.Has("no-cache") || cc.Has("private") {
+		return
+	}
+	maxAge := time.Duration(s.expiresMaxAge) * time.Second
+	cc.Del("max-age")
+	cc.Set("max-age", strconv.FormatUint(uint64(s.expiresMaxAge), 10))
+	cc.Apply(r.resp.Header)
+	r.resp.Header.Set("Expires", expiresClock().Add(maxAge).UTC().Format(http.TimeFormat))
+}
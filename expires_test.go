@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Expires header", func() {
+	var id, rid uint32
+	now := time.Date(2026, 3, 1, 8, 0, 0, 0, time.FixedZone("EST", -5*3600))
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		rid = createResponse(testHandler)
+		Expect(rid).ShouldNot(BeZero())
+		expiresClock = func() time.Time {
+			return now
+		}
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		freeResponse(rid)
+		expiresClock = time.Now
+		resetSettings()
+	})
+
+	// Return the new response headers, or nil if they didn't change.
+	run := func(status uint32, extraHeaders string) http.Header {
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		err = beginResponse(rid, id, status, extraHeaders+makeResponseHeaders("text/css", 0))
+		Expect(err).Should(Succeed())
+
+		cmd := pollResponse(rid, true)
+		if cmd == "DONE" {
+			return nil
+		}
+		Expect(cmd).Should(HavePrefix("WHDR"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+		return hdrs
+	}
+
+	// The test parser splits values on commas, so put them back together.
+	get := func(hdrs http.Header, name string) string {
+		return strings.Join(hdrs[name], ",")
+	}
+
+	It("Sets both headers", func() {
+		GoSetResponseExpiresHeader(3600)
+		hdrs := run(200, "")
+		Expect(get(hdrs, "Expires")).Should(Equal("Sun, 01 Mar 2026 14:00:00 GMT"))
+		Expect(get(hdrs, "Cache-Control")).Should(Equal("max-age=3600"))
+	})
+
+	It("Replaces max-age and keeps other directives", func() {
+		GoSetResponseExpiresHeader(60)
+		hdrs := run(200, "Cache-Control: public, max-age=5, immutable\nExpires: 0\n")
+		Expect(get(hdrs, "Cache-Control")).Should(Equal("public, immutable, max-age=60"))
+		Expect(get(hdrs, "Expires")).Should(Equal("Sun, 01 Mar 2026 13:01:00 GMT"))
+	})
+
+	It("Leaves uncacheable responses alone", func() {
+		GoSetResponseExpiresHeader(60)
+		Expect(run(200, "Cache-Control: no-store\n")).Should(BeNil())
+	})
+
+	It("Only 2xx by default", func() {
+		GoSetResponseExpiresHeader(60)
+		Expect(run(404, "")).Should(BeNil())
+	})
+
+	It("Configured statuses", func() {
+		GoSetResponseExpiresHeader(60)
+		GoSetResponseExpiresHeaderForStatus(301, 1)
+		GoSetResponseExpiresHeaderForStatus(200, 0)
+		Expect(run(200, "")).Should(BeNil())
+	})
+
+	It("Configured redirect", func() {
+		GoSetResponseExpiresHeader(60)
+		GoSetResponseExpiresHeaderForStatus(301, 1)
+		hdrs := run(301, "Location: /new\n")
+		Expect(hdrs.Get("Expires")).ShouldNot(BeEmpty())
+	})
+
+	It("Disabled", func() {
+		Expect(run(200, "")).Should(BeNil())
+	})
+})
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+/*
+ * Serve weaver's own variables, named "weaver.*", and the memory statistics
+ * that the expvar package publishes, as one JSON object, under a path of the
+ * caller's choosing. The rest of what expvar publishes is left out, because
+ * "cmdline" has the process's arguments, and those may hold secrets. Like
+ * the profiler, this tells a lot about the process, so it uses the
+ * profiler's allowlist. It is off by default.
+ */
+
+func init() {
+	expvar.Publish("weaver.activeRequests", expvar.Func(func() interface{} {
+		managerLatch.Lock()
+		defer managerLatch.Unlock()
+		return len(requests)
+	}))
+	expvar.Publish("weaver.chunkTableSize", expvar.Func(func() interface{} {
+		chunkLock.Lock()
+		defer chunkLock.Unlock()
+		return len(chunks)
+	}))
+	expvar.Publish("weaver.requestsTotal", expvar.Func(func() interface{} {
+		return getStats().Requests
+	}))
+	expvar.Publish("weaver.errorsTotal", expvar.Func(func() interface{} {
+		return getStats().Errors
+	}))
+}
+
+/*
+ * Serve the variables at "path." An empty path turns it off.
+ */
+func setExpvarEndpoint(path string) error {
+	path = strings.TrimSpace(path)
+	if path != "" && !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("Invalid expvar path \"%s\"", path)
+	}
+	updateSettings(func(s *settings) {
+		s.expvarPath = path
+	})
+	return nil
+}
+
+func (r *request) serveExpvar() bool {
+	path := r.settings.expvarPath
+	if path == "" && r.settings.developmentMode {
+		path = developmentExpvarPath
+	}
+	if path == "" || r.req.URL.Path != path {
+		return false
+	}
+	if !r.checkPprofClient() {
+		return true
+	}
+	r.resp.headers = &http.Header{}
+	r.resp.Header().Set("Cache-Control", "no-store")
+	r.resp.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writeExpvars(r.resp)
+	return true
+}
+
+/*
+ * Write the variables in the same format as expvar.Handler.
+ */
+func writeExpvars(w io.Writer) {
+	fmt.Fprintf(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key != "memstats" && !strings.HasPrefix(kv.Key, "weaver.") {
+			return
+		}
+		if !first {
+			fmt.Fprintf(w, ",\n")
+		}
+		first = false
+		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprintf(w, "\n}\n")
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Expvar endpoint", func() {
+	AfterEach(func() {
+		resetSettings()
+	})
+
+	// Return the status, headers, and body for a request from "addr."
+	fetch := func(path, addr string) (string, http.Header, string) {
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		Expect(setRemoteAddr(id, addr)).Should(Succeed())
+		Expect(beginRequest(id, makeRequestHeaders("GET", path, "", 0))).Should(Succeed())
+		cmd := pollRequest(id, true)
+		if cmd == "DONE" {
+			return "", nil, ""
+		}
+		Expect(cmd).Should(HavePrefix("SWCH"))
+		status := cmd[4:]
+		respHdrs := http.Header{}
+		body := ""
+		for cmd = pollRequest(id, true); cmd != "DONE"; cmd = pollRequest(id, true) {
+			switch cmd[:4] {
+			case "WHDR":
+				parseHeaders(respHdrs, cmd[4:])
+			case "WBOD":
+				body += string(readBodyData(cmd))
+			}
+		}
+		return status, respHdrs, body
+	}
+
+	readVars := func() map[string]interface{} {
+		status, hdrs, body := fetch("/debug/vars", "127.0.0.1:1234")
+		Expect(status).Should(Equal("200"))
+		Expect(hdrs.Get("Content-Type")).Should(HavePrefix("application/json"))
+		vars := map[string]interface{}{}
+		Expect(json.Unmarshal([]byte(body), &vars)).Should(Succeed())
+		return vars
+	}
+
+	It("Off by default", func() {
+		status, _, _ := fetch("/debug/vars", "127.0.0.1:1234")
+		Expect(status).ShouldNot(Equal("200"))
+	})
+
+	It("Weaver variables", func() {
+		Expect(setExpvarEndpoint("/debug/vars")).Should(Succeed())
+		vars := readVars()
+		Expect(vars).Should(HaveKey("memstats"))
+		Expect(vars).ShouldNot(HaveKey("cmdline"))
+		Expect(vars["weaver.activeRequests"]).Should(BeNumerically(">=", 1))
+		Expect(vars).Should(HaveKey("weaver.chunkTableSize"))
+		requests := vars["weaver.requestsTotal"].(float64)
+		errs := vars["weaver.errorsTotal"].(float64)
+
+		id := createRequest(testHandler)
+		Expect(beginRequest(id, "Not a request line\r\n\r\n")).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(HavePrefix("ERRR"))
+		freeRequest(id)
+
+		vars = readVars()
+		// Counting the request for the variables themselves
+		Expect(vars["weaver.requestsTotal"]).Should(BeNumerically(">=", requests+2))
+		Expect(vars["weaver.errorsTotal"]).Should(BeNumerically(">=", errs+1))
+	})
+
+	It("Allowlist", func() {
+		Expect(setExpvarEndpoint("/debug/vars")).Should(Succeed())
+		status, _, _ := fetch("/debug/vars", "10.1.2.3:1234")
+		Expect(status).Should(Equal("403"))
+
+		Expect(setPprofAllowedCIDRs("10.0.0.0/8")).Should(Succeed())
+		status, _, _ = fetch("/debug/vars", "10.1.2.3:1234")
+		Expect(status).Should(Equal("200"))
+	})
+
+	It("Other paths", func() {
+		Expect(setExpvarEndpoint("/debug/vars")).Should(Succeed())
+		status, _, _ := fetch("/pass", "127.0.0.1:1234")
+		Expect(status).Should(BeEmpty())
+	})
+
+	It("Invalid", func() {
+		Expect(setExpvarEndpoint("debug/vars")).ShouldNot(Succeed())
+	})
+})
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+ * Let handlers send commands of their own to the caller, so that a host can
+ * build features without changing weaver. Each one is an XCMD command, so it
+ * can't be mistaken for a built-in, with a name that the handler and the
+ * host agree on. The payload goes in a chunk, like a WBOD, so it may be
+ * binary. Handlers find EmitCommand using a type assertion on the
+ * http.ResponseWriter.
+ */
+
+const maxCommandNameLength = 64
+
+var errNoCommandName = errors.New("Command name is empty")
+
+/*
+ * EmitCommand sends command "name" with "payload," which may be empty. The
+ * name is up to 64 letters, digits, and ".", "-", or "_". The caller gets the
+ * command from GoPollRequest or GoPollResponse in order with the others.
+ */
+func (h *httpResponse) EmitCommand(name string, payload []byte) error {
+	if name == "" {
+		return errNoCommandName
+	}
+	if len(name) > maxCommandNameLength {
+		return fmt.Errorf("Command name is longer than %d bytes", maxCommandNameLength)
+	}
+	for _, c := range name {
+		if !isCommandNameChar(c) {
+			return fmt.Errorf("Invalid character in command name: %q", c)
+		}
+	}
+
+	h.handler.SafePoint()
+	cmd := command{
+		id:  XCMD,
+		msg: name,
+	}
+	if len(payload) > 0 {
+		cmd.msg += fmt.Sprintf(" %x", allocateChunk(payload))
+	}
+	h.handler.Commands() <- cmd
+	return nil
+}
+
+func isCommandNameChar(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9') || c == '.' || c == '-' || c == '_'
+}
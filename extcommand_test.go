@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Custom commands", func() {
+	It("Round trip", func() {
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/emit", "", 0))).Should(Succeed())
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("XCMDtrace.span "))
+		chunkID, err := strconv.ParseInt(strings.TrimPrefix(cmd, "XCMDtrace.span "), 16, 32)
+		Expect(err).Should(Succeed())
+		Expect(getChunkDataByID(int32(chunkID))).Should(Equal([]byte{0, 1, 2, 'x'}))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		parsed, err := parseCommand(cmd)
+		Expect(err).Should(Succeed())
+		Expect(parsed.id).Should(Equal(XCMD))
+	})
+
+	It("Freed before polling", func() {
+		chunkCount := func() int {
+			chunkLock.Lock()
+			defer chunkLock.Unlock()
+			return len(chunks)
+		}
+		before := chunkCount()
+		id := createRequest(testHandler)
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/emit", "", 0))).Should(Succeed())
+		cmds := getRequest(id).cmds
+		// The XCMD and the DONE after it
+		Eventually(func() int { return len(cmds) }).Should(Equal(2))
+		Expect(chunkCount()).Should(Equal(before + 1))
+		freeRequest(id)
+		Expect(chunkCount()).Should(Equal(before))
+	})
+
+	It("No payload", func() {
+		cmds := make(chan command, 1)
+		h := &httpResponse{handler: &request{cmds: cmds}}
+		Expect(h.EmitCommand("ping", nil)).Should(Succeed())
+		Expect((<-cmds).String()).Should(Equal("XCMDping"))
+	})
+
+	It("Invalid names", func() {
+		h := &httpResponse{handler: &request{}}
+		Expect(h.EmitCommand("", nil)).Should(Equal(errNoCommandName))
+		Expect(h.EmitCommand("has space", nil)).ShouldNot(Succeed())
+		Expect(h.EmitCommand(strings.Repeat("x", 65), nil)).ShouldNot(Succeed())
+	})
+})
@@ -0,0 +1,23 @@
+package main
+
+/*
+ * RFC 3986 says that the fragment of a URI is never sent to the server, but
+ * some clients send it anyway. Unless told otherwise, we drop it before the
+ * request is forwarded. The setting is "keep" so that the zero value is the
+ * standard behavior.
+ */
+
+func setFragmentDrop(drop bool) {
+	updateSettings(func(s *settings) {
+		s.keepFragments = !drop
+	})
+}
+
+func (r *request) dropFragment() {
+	if r.settings.keepFragments || r.req.URL.Fragment == "" {
+		return
+	}
+	newURL := *r.req.URL
+	newURL.Fragment = ""
+	r.req.URL = &newURL
+}
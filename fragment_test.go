@@ -0,0 +1,47 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Fragment Drop", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		resetSettings()
+	})
+
+	It("Drop by default", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass?x=1#section-2", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("WURI/pass?x=1"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("No fragment", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Keep", func() {
+		setFragmentDrop(false)
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass#top", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Parse", func() {
+		req, err := parseHTTPHeaders("GET /pass/a%20b#top%20part HTTP/1.1\r\n\r\n", true)
+		Expect(err).Should(Succeed())
+		Expect(req.URL.Path).Should(Equal("/pass/a b"))
+		Expect(req.URL.Fragment).Should(Equal("top part"))
+	})
+})
@@ -2,6 +2,7 @@ package main
 
 import (
 	"sync"
+	"time"
 	"unsafe"
 )
 
@@ -30,9 +31,11 @@ const (
 // A global, thread-safe chunk table.
 
 type chunk struct {
-	id   int32
-	len  uint32
-	data unsafe.Pointer
+	id     int32
+	len    uint32
+	data   unsafe.Pointer
+	shared bool
+	refs   int32
 }
 
 var lastChunkID int32 = 1
@@ -142,10 +145,24 @@ func GoStoreChunk(data unsafe.Pointer, len uint32) int32 {
 	return lastChunkID
 }
 
+/*
+GoStoreSharedChunk stores a chunk of data that many requests may send at
+once, such as a canned error page. As with GoStoreChunk, the data must have
+been allocated using "malloc," but weaver owns it from now on, and frees it
+once the caller, and every request that sent it, has released it using
+GoReleaseChunk. Shared chunks are sent using the WSHR command rather
+than WBOD. A chunk ID will be returned.
+*/
+//export GoStoreSharedChunk
+func GoStoreSharedChunk(data unsafe.Pointer, len uint32) int32 {
+	return storeSharedChunk(data, len)
+}
+
 /*
 GoReleaseChunk frees a chunk of data that was stored using GoStoreChunk. This only frees
 the data used to track the chunk -- the caller is responsible for
-actually calling "free".
+actually calling "free". For a chunk stored using GoStoreSharedChunk, this
+releases one reference, and weaver frees the data when none are left.
 */
 //export GoReleaseChunk
 func GoReleaseChunk(id int32) {
@@ -176,8 +193,19 @@ func getChunk(id int32) chunk {
 
 func releaseChunk(id int32) {
 	chunkLock.Lock()
-	defer chunkLock.Unlock()
+	c, found := chunks[id]
+	if found && c.refs > 1 {
+		c.refs--
+		chunks[id] = c
+		chunkLock.Unlock()
+		return
+	}
 	delete(chunks, id)
+	chunkLock.Unlock()
+
+	if found && c.shared {
+		C.free(c.data)
+	}
 }
 
 /*
@@ -186,7 +214,8 @@ request ID returned by "GoCreateRequest."
 
 The second parameter must be a string that
 represents the HTTP request line and headers, separated by CRLF pairs,
-exactly as described in the HTTP spec.
+exactly as described in the HTTP spec. If it is NULL, then the headers
+are the ones that were passed to "GoAppendRequestHeaders."
 
 Once this function has been called, the request is already running.
 The caller MUST periodically call "GoPollRequest" in order to get updates
@@ -195,9 +224,38 @@ the request is done.
 */
 //export GoBeginRequest
 func GoBeginRequest(id uint32, rawHeaders *C.char) {
+	if rawHeaders == nil {
+		beginStreamedRequest(id)
+		return
+	}
 	beginRequest(id, C.GoString(rawHeaders))
 }
 
+/*
+GoAppendRequestHeaders adds a fragment to the request line and headers of
+a request that hasn't begun yet, for callers that receive them a piece at
+a time. Fragments may be split anywhere, even in the middle of a CRLF.
+Once all of them have been added, call "GoBeginRequest" with NULL headers.
+
+It returns 0 if the fragment was added. It returns 1 if the headers are now
+too long, either because a line is longer than the limit set by
+"GoSetMaxHeaderLineSize" or because the whole block is over a megabyte. In
+that case further fragments are ignored, and the request will be rejected
+with a 431 when it begins. It returns -1 if the request is unknown or has
+already begun.
+*/
+//export GoAppendRequestHeaders
+func GoAppendRequestHeaders(id uint32, fragment *C.char) int32 {
+	ok, err := appendRequestHeaders(id, C.GoString(fragment))
+	if err != nil {
+		return -1
+	}
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
 /*
 GoPollRequest polls for updates from the running request. Each update is returned as
 a null-terminated string. The format of each command string is
@@ -217,7 +275,7 @@ The caller is responsible for calling "free" on the returned command string.
 */
 //export GoPollRequest
 func GoPollRequest(id uint32, block int32) *C.char {
-	cmd := pollRequest(id, block != 0)
+	cmd := pollPayload(id, pollRequest(id, block != 0))
 	if cmd == "" {
 		return nil
 	}
@@ -253,17 +311,21 @@ The first parameter is the response ID as created by GoCreateResponse. The secon
 is the request ID that was previously used for the request side of this interaction.
 The third is the current HTTP status code of the response, while the last is a
 set of headers encoded in the same format used by the WHDR command: "name: value"
-lines separated by a single newline (not a CRLF as in HTTP).
+lines separated by a single newline (not a CRLF as in HTTP). The headers
+may start with an HTTP status line, as described for GoSetStatusInHeaders,
+and then that status is used instead.
 */
 //export GoBeginResponse
 func GoBeginResponse(responseID, requestID, status uint32, hdrs *C.char) {
 	beginResponse(responseID, requestID, status, C.GoString(hdrs))
 }
 
-// GoPollResponse returns response commands just like request commands.
+// GoPollResponse returns response commands just like request commands. The
+// last one may be "DONEclose," which means that the client connection must be
+// closed once the response has been sent.
 //export GoPollResponse
 func GoPollResponse(id uint32, block int32) *C.char {
-	cmd := pollResponse(id, block != 0)
+	cmd := pollPayload(id, pollResponse(id, block != 0))
 	if cmd == "" {
 		return nil
 	}
@@ -278,6 +340,1631 @@ func GoSendResponseBodyChunk(id uint32, l int32, data unsafe.Pointer, len uint32
 	sendResponseBodyChunk(id, last, buf)
 }
 
+/*
+GoSetPriorityQueue turns the priority queue on or off. When it is on, only
+a limited number of requests and responses are processed at once, and
+the rest wait in order of priority, so that important requests do not
+queue up behind less important ones. When it is off (the default), all
+requests are processed as soon as they begin.
+*/
+//export GoSetPriorityQueue
+func GoSetPriorityQueue(enabled int32) {
+	scheduler.setEnabled(enabled != 0)
+}
+
+/*
+GoSetRequestPriority sets the priority of a request. Zero is normal
+priority, and higher values are more important. It must be called after
+GoCreateRequest and before GoBeginRequest, and it has no effect unless
+the priority queue is enabled.
+*/
+//export GoSetRequestPriority
+func GoSetRequestPriority(id uint32, priority int32) {
+	setRequestPriority(id, priority)
+}
+
+/*
+GoSetPriorityQueueLimit limits the number of new requests that may wait
+in the priority queue. When the limit is reached, new requests are turned
+away with a 503 response instead of waiting. The number of waiting
+requests, rejections, and the total time spent waiting are reported by
+GoGetStats. Zero, the default, means there is no limit.
+*/
+//export GoSetPriorityQueueLimit
+func GoSetPriorityQueueLimit(maxWaiting uint32) {
+	scheduler.setMaxWaiting(int(maxWaiting))
+}
+
+/*
+GoPauseRequest suspends processing of a request at the next safe point.
+Safe points are before the request starts, between chunks of the request
+or response body, and before "DONE" is delivered. Commands that were
+already queued may still be polled, but no new ones will be produced
+until GoResumeRequest is called. Pausing a request also pauses the
+response that goes with it.
+*/
+//export GoPauseRequest
+func GoPauseRequest(id uint32) {
+	pauseRequest(id)
+}
+
+/*
+GoResumeRequest resumes a request that was suspended using GoPauseRequest.
+*/
+//export GoResumeRequest
+func GoResumeRequest(id uint32) {
+	resumeRequest(id)
+}
+
+/*
+GoResetStream tells weaver that the client reset the stream of a request,
+as with an HTTP/2 RST_STREAM or a client disconnect. The context of that
+request, and no other, is cancelled, and its body is abandoned. The request
+must still be freed.
+*/
+//export GoResetStream
+func GoResetStream(id uint32) {
+	resetStream(id)
+}
+
+/*
+GoSetAcceptEncodingPolicy decides what Accept-Encoding header is sent to
+the target. "passthrough" (the default) forwards whatever the client sent.
+"identity" replaces it with "identity" so that the target returns
+a plain response body that handlers can read and transform without
+decoding it first. "normalize" replaces it with "gzip" if the client
+accepts gzip, or "identity" otherwise, so that a cache in front of the
+target stores fewer variants. The policy only applies while minification,
+substitution or HTML snippets are turned on; otherwise the client's header
+is forwarded unchanged. A handler that installs its own body filter may use
+GoSetAcceptEncoding instead. Whatever is sent, a gzipped response body is
+decoded if the client did not accept gzip. If the policy is invalid, an
+error string is returned that the caller must free. Otherwise, return NULL.
+*/
+//export GoSetAcceptEncodingPolicy
+func GoSetAcceptEncodingPolicy(policy *C.char) *C.char {
+	err := setAcceptEncodingPolicy(C.GoString(policy))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetResponseTranscoding controls whether compressed response bodies are
+transcoded. When it is enabled, a gzip or deflate body from the target is
+decoded before handlers see it, and the body that is sent to the client is
+compressed again using whichever of gzip and deflate the client prefers,
+or sent plain if it accepts neither. Bodies that are hashed using
+GoSetBodyHashHeader or stored in the negative cache are not transcoded.
+*/
+//export GoSetResponseTranscoding
+func GoSetResponseTranscoding(enabled int32) {
+	setResponseTranscoding(enabled != 0)
+}
+
+/*
+GoSetAcceptEncodingNegotiation controls whether the Accept-Encoding header
+that is sent to the target is cut down to the encodings that the target
+supports, as set using GoSetBackendSupportedEncodings, instead of following
+the policy. If the target then sends a gzip or deflate body that the client
+does not accept, the body is recompressed using the encoding that the client
+prefers, or sent plain if it accepts neither.
+*/
+//export GoSetAcceptEncodingNegotiation
+func GoSetAcceptEncodingNegotiation(enabled int32) {
+	setAcceptEncodingNegotiation(enabled != 0)
+}
+
+/*
+GoSetBackendSupportedEncodings sets the encodings that the target supports,
+as a comma-separated list such as "gzip". "identity" is always supported.
+If the list is invalid, an error string is returned that the caller must
+free. Otherwise, return NULL.
+*/
+//export GoSetBackendSupportedEncodings
+func GoSetBackendSupportedEncodings(encodings *C.char) *C.char {
+	err := setBackendEncodings(C.GoString(encodings))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetVaryHeader adds a comma-separated list of request header names, such as
+"Accept-Language, Cookie," to the Vary header of every response, so that
+caches keep the responses apart. Names that are already in Vary are not
+added again. Transcoded responses get "Accept-Encoding" the same way. An
+empty list adds nothing. If a name is invalid, an error string is returned
+that the caller must free. Otherwise, return NULL.
+*/
+//export GoSetVaryHeader
+func GoSetVaryHeader(headers *C.char) *C.char {
+	err := setVaryHeader(C.GoString(headers))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetAcceptEncoding overrides the Accept-Encoding header that is sent to
+the target for a single request, regardless of the policy. The value is
+a comma-separated list of encodings, such as "gzip, identity". An empty
+string removes the override. It must be called before GoBeginRequest.
+*/
+//export GoSetAcceptEncoding
+func GoSetAcceptEncoding(id uint32, values *C.char) {
+	setAcceptEncoding(id, C.GoString(values))
+}
+
+/*
+GoAddExactPathRewrite adds a rule that replaces the path of any request
+that exactly matches "path" with "replacement" before it is forwarded to
+the target. Exact rules take precedence over regular expression rules.
+If the rule is invalid, an error string is returned that the caller
+must free. Otherwise, return NULL.
+*/
+//export GoAddExactPathRewrite
+func GoAddExactPathRewrite(path, replacement *C.char) *C.char {
+	err := addExactPathRewrite(C.GoString(path), C.GoString(replacement))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoAddRegexpPathRewrite adds a rule that rewrites the path of any request
+that matches the regular expression "pattern" before it is forwarded to
+the target. The replacement may refer to capture groups using "$1" or
+"${name}" for named groups, and handlers can read the named groups using
+PathParam. Rules are tried in the order that they were added. If the
+pattern is invalid, an error string is returned that the caller must free.
+Otherwise, return NULL.
+*/
+//export GoAddRegexpPathRewrite
+func GoAddRegexpPathRewrite(pattern, replacement *C.char) *C.char {
+	err := addRegexpPathRewrite(C.GoString(pattern), C.GoString(replacement))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoClearPathRewrites removes all the rules added by GoAddExactPathRewrite
+and GoAddRegexpPathRewrite.
+*/
+//export GoClearPathRewrites
+func GoClearPathRewrites() {
+	clearPathRewrites()
+}
+
+/*
+GoEnableABTesting sends a fraction of requests to an alternate target.
+"fraction" is the probability, between 0 and 1, that a new client is
+placed in the "test" group. Requests in the test group are sent to
+"alternateTarget", which must be an absolute URL, using a WURI command
+with an absolute URI. The group is remembered in the "X-AB-Group" cookie
+so that the same client keeps going to the same target. An empty
+alternate target turns A/B testing off. If the parameters are invalid,
+an error string is returned that the caller must free. Otherwise,
+return NULL.
+*/
+//export GoEnableABTesting
+func GoEnableABTesting(fraction C.double, alternateTarget *C.char) *C.char {
+	err := enableABTesting(float64(fraction), C.GoString(alternateTarget))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoGetABGroup returns the A/B testing group of a request, which is either
+"control" or "test", once the request is done. If A/B testing is not
+enabled, it returns an empty string. The caller must free the result.
+*/
+//export GoGetABGroup
+func GoGetABGroup(id uint32) *C.char {
+	return C.CString(getABGroup(id))
+}
+
+/*
+GoGetRequestVerdict returns the verdict that the request or response
+handler last set using SetVerdict, or an empty string if neither did. It
+can be called at any time until the request is freed, including after an
+ERRR command. The caller must free the result.
+*/
+//export GoGetRequestVerdict
+func GoGetRequestVerdict(id uint32) *C.char {
+	return C.CString(getVerdict(id))
+}
+
+/*
+GoSetQueryParamOverride adds a query parameter to every request that is
+forwarded to the target, replacing any values that the client sent for
+it, for instance to add an API key. The name and value are encoded as
+necessary. If the name is empty, an error string is returned that the
+caller must free. Otherwise, return NULL.
+*/
+//export GoSetQueryParamOverride
+func GoSetQueryParamOverride(name, value *C.char) *C.char {
+	err := setQueryParamOverride(C.GoString(name), C.GoString(value))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoClearQueryParamOverrides removes all the overrides set by
+GoSetQueryParamOverride.
+*/
+//export GoClearQueryParamOverrides
+func GoClearQueryParamOverrides() {
+	clearQueryParamOverrides()
+}
+
+/*
+GoDeleteQueryParam removes a query parameter from a single request before it
+is forwarded to the target. It must be called before GoBeginRequest. If the
+request does not exist, an error string is returned that the caller must
+free. Otherwise, return NULL.
+*/
+//export GoDeleteQueryParam
+func GoDeleteQueryParam(id uint32, name *C.char) *C.char {
+	err := deleteQueryParam(id, C.GoString(name))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetStripPathPrefix removes a prefix, such as "/api/v1", from the path of
+each request before it is forwarded to the target, after any other path
+rewrites. The prefix only matches whole path segments, and the part that
+was removed is added to the X-Forwarded-Prefix header. Requests whose path
+does not start with the prefix are forwarded unchanged unless strict mode
+is on. An empty prefix turns this off.
+*/
+//export GoSetStripPathPrefix
+func GoSetStripPathPrefix(prefix *C.char) {
+	setStripPathPrefix(C.GoString(prefix))
+}
+
+/*
+GoSetStripPathPrefixStrict controls what happens to requests whose path
+does not start with the prefix set by GoSetStripPathPrefix, after any other
+path rewrites. When it is on, they are rejected with a 404 instead of being
+forwarded unchanged.
+*/
+//export GoSetStripPathPrefixStrict
+func GoSetStripPathPrefixStrict(enabled int32) {
+	setStripPathPrefixStrict(enabled != 0)
+}
+
+/*
+GoSetAddPathPrefix adds a prefix, such as "/v2", to the path of each request
+before it is forwarded to the target. This happens after the prefix set
+by GoSetStripPathPrefix is removed. The prefix must start with "/" and must
+not contain "..". An empty prefix turns this off. If the prefix is invalid,
+an error string is returned that the caller must free. Otherwise, return NULL.
+*/
+//export GoSetAddPathPrefix
+func GoSetAddPathPrefix(prefix *C.char) *C.char {
+	err := setAddPathPrefix(C.GoString(prefix))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetHeaderCase makes weaver send the named request header to the target
+using exactly the casing in "name," such as "SOAPAction," rather than the
+canonical form, for targets that care. The new name appears in the WHDR
+command, and the caller must send it as is. Other headers keep their
+canonical names. This applies to every request. Handlers may do the same
+for a single request using SetHeaderCase.
+*/
+//export GoSetHeaderCase
+func GoSetHeaderCase(name *C.char) {
+	addHeaderCase(C.GoString(name))
+}
+
+/*
+GoClearHeaderCases undoes everything set by GoSetHeaderCase.
+*/
+//export GoClearHeaderCases
+func GoClearHeaderCases() {
+	clearHeaderCases()
+}
+
+/*
+GoSetFragmentDrop controls whether the fragment of the request URI, the part
+after "#," is removed before the request is forwarded. Clients shouldn't
+send one, and RFC 3986 says that servers never see it, so this is enabled
+by default. When a fragment is dropped, the new URI is sent using WURI.
+*/
+//export GoSetFragmentDrop
+func GoSetFragmentDrop(enabled int32) {
+	setFragmentDrop(enabled != 0)
+}
+
+/*
+GoSetRejectSplitHeaders controls what happens when a handler sets a response
+header whose name or value contains a CR or LF, usually because it copied
+something from the request. A header line can never be split, so by default
+the newlines are turned into spaces. If this is enabled, the whole response
+is replaced with a 500 instead, and the attempt is logged and counted in
+the statistics returned by GoGetStats.
+*/
+//export GoSetRejectSplitHeaders
+func GoSetRejectSplitHeaders(enabled int32) {
+	setRejectSplitHeaders(enabled != 0)
+}
+
+/*
+GoSetNormalizeURL controls whether the request URL is put in a canonical
+form before handlers see it and before it is forwarded. The scheme and host
+are lowercased, unnecessary percent-encoding is decoded and the rest uses
+upper case, and "." and ".." path segments are removed. If this changes the
+URL, the new one is sent using WURI. It is disabled by default.
+*/
+//export GoSetNormalizeURL
+func GoSetNormalizeURL(enabled int32) {
+	setNormalizeURL(enabled != 0)
+}
+
+/*
+GoSetDebugLogging controls whether debug messages, such as a description of
+each URL that is normalized, are logged. It is disabled by default.
+*/
+//export GoSetDebugLogging
+func GoSetDebugLogging(enabled int32) {
+	setDebugLogging(enabled != 0)
+}
+
+/*
+GoSetDevelopmentMode turns development mode on if "enabled" is non-zero,
+and off otherwise. It is off by default. Development mode logs debug
+messages and the headers of every request, serves the profiler at
+"/debug/pprof/" and expvar at "/debug/vars" unless they were given other
+paths, removes the timeouts on upstream requests and on waiting under
+upstream concurrency limits, lifts the maximum request duration, and stops
+verifying upstream TLS certificates.
+
+It must never be used in production. The log will contain credentials and
+cookies. Loopback clients, or those allowed by GoSetPprofAllowedCIDRs, can
+read the process's memory and variables. A target that stops responding
+holds its requests forever. Anyone between weaver and a target can pose as
+the target. Turning it off restores the previous configuration.
+
+If the upstream transport can't be rebuilt for the new mode, the mode is
+left unchanged, and an error string is returned that the caller must free.
+Otherwise, return NULL.
+*/
+//export GoSetDevelopmentMode
+func GoSetDevelopmentMode(enabled int32) *C.char {
+	err := setDevelopmentMode(enabled != 0)
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetCommandPayloadStreaming controls how GoPollRequest and GoPollResponse
+return commands. When it is enabled, they only return the four-letter name
+of each command, such as "WHDR," and the rest of the command, its payload,
+is read using GoGetCommandPayloadLength and GoReadCommandPayload. That way,
+a big payload is only copied once, into a buffer that the caller owns. The
+payload is released the next time that the request or response is polled.
+*/
+//export GoSetCommandPayloadStreaming
+func GoSetCommandPayloadStreaming(enabled int32) {
+	setPayloadStreaming(enabled != 0)
+}
+
+/*
+GoGetCommandPayloadLength returns the length of the payload of the command
+that was last polled for the request or response "id," when payload
+streaming is enabled, or zero if there is none.
+*/
+//export GoGetCommandPayloadLength
+func GoGetCommandPayloadLength(id uint32) uint32 {
+	return payloadLength(id)
+}
+
+/*
+GoReadCommandPayload copies up to "maxLen" bytes of the payload of the
+command that was last polled for the request or response "id," starting at
+"offset," into "dst." It returns how many bytes were copied, which is zero
+once the end of the payload is reached.
+*/
+//export GoReadCommandPayload
+func GoReadCommandPayload(id uint32, offset uint32, dst unsafe.Pointer, maxLen uint32) uint32 {
+	if dst == nil || maxLen == 0 {
+		return 0
+	}
+	return readPayload(id, offset, unsafe.Slice((*byte)(dst), maxLen))
+}
+
+/*
+GoSetStatusInHeaders controls whether WHDR commands on the response path
+start with an HTTP status line, such as "HTTP/1.1 404 Not Found." When it is
+enabled, a change to the status is sent that way instead of using WSTA, so
+the status and the headers always arrive together. GoBeginResponse accepts
+headers that start with a status line either way.
+*/
+//export GoSetStatusInHeaders
+func GoSetStatusInHeaders(enabled int32) {
+	setStatusInHeaders(enabled != 0)
+}
+
+/*
+GoSetAsyncFilterWindow sets how many chunks of a response body may be waiting
+for a handler's asynchronous body filter at once. Once that many are waiting,
+weaver stops reading the body until the filter finishes the oldest one. Zero
+restores the default, which is 4.
+*/
+//export GoSetAsyncFilterWindow
+func GoSetAsyncFilterWindow(window uint32) {
+	setAsyncFilterWindow(int(window))
+}
+
+/*
+GoSetHopByHopHeaderStripping controls whether the hop-by-hop headers that
+RFC 7230 lists, such as Connection, Keep-Alive, Transfer-Encoding, and Upgrade,
+are removed from the request before it is forwarded and from the response
+before it is returned, along with any header that the Connection header
+names. It is enabled by default.
+*/
+//export GoSetHopByHopHeaderStripping
+func GoSetHopByHopHeaderStripping(enabled int32) {
+	setHopByHopStripping(enabled != 0)
+}
+
+/*
+GoSetETagStripping controls whether the ETag and Last-Modified headers are
+removed from a response whose body was changed, for instance by a handler
+that replaced it, or by minification. The "no-transform" directive is removed
+from the Cache-Control header as well. A response whose body was left alone
+keeps them. It is enabled by default.
+*/
+//export GoSetETagStripping
+func GoSetETagStripping(enabled int32) {
+	setETagStripping(enabled != 0)
+}
+
+/*
+GoEnableHTTP10Support controls what happens when the client spoke HTTP/1.0
+and the response has no Content-Length, for instance because the target
+used chunked encoding, which HTTP/1.0 doesn't have, or because a handler or a
+body filter changed the body. When it is enabled, weaver reads the whole
+response body before sending anything, and sends the headers with a
+Content-Length and without Transfer-Encoding. It is disabled by default.
+*/
+//export GoEnableHTTP10Support
+func GoEnableHTTP10Support(enabled int32) {
+	enableHTTP10Support(enabled != 0)
+}
+
+/*
+GoSetMaxHeaderLineSize limits the length, in bytes, of each request header
+line, not counting the CRLF. A request with a longer header line is rejected
+with a 431 before its headers are parsed. The limit doesn't apply to the
+request line. Zero, the default, means there is no limit.
+*/
+//export GoSetMaxHeaderLineSize
+func GoSetMaxHeaderLineSize(max uint32) {
+	setMaxHeaderLineSize(int(max))
+}
+
+/*
+GoSetMaxURILength limits the length, in bytes, of the request target, which
+is the path and query. A request with a longer one is rejected with a 414.
+The default is 8192, and zero means there is no limit.
+*/
+//export GoSetMaxURILength
+func GoSetMaxURILength(max uint32) {
+	setMaxURILength(int(max))
+}
+
+/*
+GoSetAllowedAuthorities sets the hosts that weaver serves, separated by commas
+or newlines, such as "example.com, api.example.com:8443." A host without a
+port matches any port. A request for any other authority, which can happen
+when an HTTP/2 client reuses a connection for another host, is rejected with
+a 421 so that the client tries again on a new connection. An empty list, the
+default, turns this off. If the list is invalid, an error string is returned
+that the caller must free. Otherwise, return NULL.
+*/
+//export GoSetAllowedAuthorities
+func GoSetAllowedAuthorities(list *C.char) *C.char {
+	err := setAllowedAuthorities(C.GoString(list))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetResponseHeaderAllowlist controls allowlist mode for response headers.
+When it is enabled, only the headers named in "names," separated by commas
+or newlines, reach the client, and the rest are dropped after every handler
+has run. If "names" is empty, a default list of standard headers such as
+Content-Type, Content-Length, and Cache-Control is used. Set-Cookie is not on
+the default list. Handlers may let other headers through for a single request.
+The CORS, Server-Timing, and Trailer headers that weaver adds always get
+through. The number of headers that were dropped is counted in the statistics returned
+by GoGetStats, and their names are logged if debug logging is enabled. It is
+disabled by default.
+*/
+//export GoSetResponseHeaderAllowlist
+func GoSetResponseHeaderAllowlist(enabled int32, names *C.char) {
+	setResponseHeaderAllowlist(enabled != 0, C.GoString(names))
+}
+
+/*
+GoSetResponseMinification controls whether response bodies of a content type,
+such as "text/html," are minified before they are sent to the client. Weaver
+can minify HTML by collapsing whitespace, and GoRegisterMinifier adds others.
+The whole body is read before it is minified, and the Content-Length header
+is removed. Bodies that are compressed are left alone. If there is no
+minifier for the content type, an error string is returned that the caller
+must free. Otherwise, return NULL.
+*/
+//export GoSetResponseMinification
+func GoSetResponseMinification(contentType *C.char, enabled int32) *C.char {
+	err := setResponseMinification(C.GoString(contentType), enabled != 0)
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoRegisterMinifier adds or replaces the minifier for a content type. "fn"
+is a C function declared as:
+
+  char* minify(const char* data, size_t len, size_t* outLen)
+
+It returns the minified body in memory allocated using malloc, which weaver
+frees, and sets "outLen" to its length. If it returns NULL, the body is sent
+unchanged. It may be called from many threads at once. If "fn" is NULL, an
+error string is returned that the caller must free. Otherwise, return NULL.
+*/
+//export GoRegisterMinifier
+func GoRegisterMinifier(contentType *C.char, fn unsafe.Pointer) *C.char {
+	err := registerCMinifier(C.GoString(contentType), fn)
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoGetMinificationStats returns a JSON object that contains the number of
+response bodies that were minified, their total size before and after, and
+the number of bytes saved. The caller must free the result.
+*/
+//export GoGetMinificationStats
+func GoGetMinificationStats() *C.char {
+	return C.CString(getMinificationStatsJSON())
+}
+
+/*
+GoSetResponseSubstitution adds a rule that rewrites response bodies of a
+content type, such as "text/html," before they are sent to the client. Every
+match of the regular expression "pattern" is replaced with "replacement,"
+which may refer to groups in the pattern using "$1" and so on. Rules run in
+the order they were added, and before the body is minified. The whole body is
+read before it is rewritten, and the Content-Length header is removed. Bodies
+that are compressed are left alone. An empty "pattern" removes every rule for
+the content type. If "pattern" is invalid, an error string is returned that
+the caller must free. Otherwise, return NULL.
+*/
+//export GoSetResponseSubstitution
+func GoSetResponseSubstitution(contentType, pattern, replacement *C.char) *C.char {
+	err := setResponseSubstitution(C.GoString(contentType),
+		C.GoString(pattern), C.GoString(replacement))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoInjectHTMLSnippet inserts "html" into every text/html response body, at
+"position," which is "head-start," "head-end," "body-start," or "body-end."
+The snippet goes right after the opening tag, or right before the closing tag,
+and is only inserted if that tag is in the document. The body is not read in
+full first, but the Content-Length header is removed. Bodies that are
+compressed are left alone. Calling this again for a position replaces its
+snippet, and an empty "html" removes it. If "position" is invalid, an error
+string is returned that the caller must free. Otherwise, return NULL.
+*/
+//export GoInjectHTMLSnippet
+func GoInjectHTMLSnippet(position, html *C.char) *C.char {
+	err := setHTMLSnippet(C.GoString(position), C.GoString(html))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetProblemJSONErrors controls whether the error responses that weaver sends
+itself, such as the 429 from a rate limit, the 431 for a header line that is
+too long, or the 502 when no upstream succeeded, and those that handlers send
+using SendError, have an RFC 9457 application/problem+json body. Clients
+whose Accept header rules out JSON still get plain text. The "type" of each
+problem is "baseType" followed by the status text, such as
+"too-many-requests," or "about:blank" if "baseType" is empty. If
+"includeRequestID" is non-zero, the ID that weaver gave the request is added
+as "requestId." It is disabled by default.
+*/
+//export GoSetProblemJSONErrors
+func GoSetProblemJSONErrors(enabled int32, baseType *C.char, includeRequestID int32) {
+	setProblemJSONErrors(enabled != 0, C.GoString(baseType), includeRequestID != 0)
+}
+
+/*
+GoSetUpstreamConcurrencyLimit caps the requests in flight at once to upstream
+hosts that match "hostPattern," such as "billing.internal" or
+"*.legacy.example.com:8080." That covers requests that weaver makes itself,
+for instance when it concatenates responses, and requests that the caller
+proxies, which count from the DONE that hands them back until the response
+is done or the request is freed. Requests over the cap wait up to
+"queueTimeoutMillis" for another to finish, and then fail with a 503. A "max" of zero removes the
+limit for that pattern. If the pattern is invalid, an error string is
+returned that the caller must free. Otherwise, return NULL.
+*/
+//export GoSetUpstreamConcurrencyLimit
+func GoSetUpstreamConcurrencyLimit(hostPattern *C.char, max uint32, queueTimeoutMillis uint32) *C.char {
+	err := SetUpstreamConcurrencyLimit(C.GoString(hostPattern), int(max),
+		time.Duration(queueTimeoutMillis)*time.Millisecond)
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetHealthCheck makes weaver answer GET and HEAD requests for "path," such
+as "/healthz," itself, before the handler runs, with a JSON report of the
+active requests, the Go runtime, the settings version, and the server error
+rate over the last "windowMillis," or one minute if it is zero, of each of
+the targets in "upstreams," a comma-separated list of "host:port" pairs.
+Responses from other hosts aren't counted. The status is 503 instead of 200 if more than "maxActive" requests
+are active, or if a host that sent at least "minResponses" responses has an
+error rate over "maxErrorRate," which is between 0 and 1. A limit of zero is
+no limit. An empty path turns the health check off. If anything is invalid,
+an error string is returned that the caller must free. Otherwise, return
+NULL.
+*/
+//export GoSetHealthCheck
+func GoSetHealthCheck(path *C.char, maxErrorRate C.double, minResponses uint32,
+	maxActive uint32, windowMillis uint32, upstreams *C.char) *C.char {
+	hosts, err := parseUpstreamList(C.GoString(upstreams))
+	if err == nil {
+		err = setHealthCheck(C.GoString(path), HealthOptions{
+			Window:       time.Duration(windowMillis) * time.Millisecond,
+			MaxErrorRate: float64(maxErrorRate),
+			MinResponses: int(minResponses),
+			MaxActive:    int(maxActive),
+			Upstreams:    hosts,
+		})
+	}
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetHARSampler records a fraction, "rate," between 0 and 1, of requests as
+HTTP Archive (HAR 1.2) documents, which are appended to "fileName" one per
+line. If the file is created, only its owner may read it. Credentials and
+query parameter values are replaced. Bodies are only recorded if
+"maxBodyBytes" isn't zero, and then at most that much of each request and
+response body is kept. Those bodies stream through weaver, so the caller
+sees RBOD and WBOD commands for them that it wouldn't otherwise. Each
+document is written when its response is done, unless "flushMillis" is
+non-zero, in which case the entries are collected and written together
+that often. A rate of zero, or an empty file name, stops sampling. If the
+file can't be opened, an error string is returned that the caller must
+free. Otherwise, return NULL.
+*/
+//export GoSetHARSampler
+func GoSetHARSampler(rate C.double, maxBodyBytes uint32, fileName *C.char, flushMillis uint32) *C.char {
+	SetHARFlushInterval(time.Duration(flushMillis) * time.Millisecond)
+	err := setHARFile(float64(rate), int(maxBodyBytes), C.GoString(fileName))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetHARRedactedHeaders sets the headers whose values GoSetHARSampler
+replaces, as a comma-separated list of names. It replaces the default list,
+which is Authorization, Proxy-Authorization, Cookie, and Set-Cookie, and an
+empty list goes back to it. If a name is invalid, an error string is
+returned that the caller must free. Otherwise, return NULL.
+*/
+//export GoSetHARRedactedHeaders
+func GoSetHARRedactedHeaders(names *C.char) *C.char {
+	err := setHARRedactedHeaderList(C.GoString(names))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetCORS makes weaver handle CORS using the policy in "config," a JSON
+object such as:
+
+	{
+	  "allowOrigins": ["https://app.example.com"],
+	  "allowMethods": ["GET", "POST"],
+	  "allowHeaders": ["Content-Type", "Authorization"],
+	  "exposeHeaders": ["X-Request-Id"],
+	  "allowCredentials": true,
+	  "maxAge": 600
+	}
+
+"allowOrigins" is required, and may include "*" for any origin, but not
+together with "allowCredentials," since then any site could read responses
+made with the user's credentials. The methods default to GET, HEAD, and
+POST. Preflight requests are answered by weaver, with a 204 if the origin is
+allowed and a 403 if it isn't, and responses to allowed origins get the CORS
+headers. An empty string turns CORS handling off. If the JSON is invalid, an
+error string is returned that the caller must free. Otherwise, return NULL.
+*/
+//export GoSetCORS
+func GoSetCORS(config *C.char) *C.char {
+	err := setCORS(C.GoString(config))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoDisableForwardingForPath makes requests whose path starts with
+"pathPrefix," such as "/metrics," be served by the handler without ever
+going to the target. The prefix matches whole path segments, and more than
+one may be registered. It is matched against the path that would be
+forwarded, after normalization and any rewrites. The handler must write the
+whole response, and if it doesn't, weaver answers with a 404. If the prefix doesn't start with "/,"
+an error string is returned that the caller must free. Otherwise, return
+NULL.
+*/
+//export GoDisableForwardingForPath
+func GoDisableForwardingForPath(pathPrefix *C.char) *C.char {
+	err := disableForwardingForPath(C.GoString(pathPrefix))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoServeDirectory makes requests whose path starts with "pathPrefix" be
+answered with files from the local directory "dirPath," without running the
+handler or going to the target. The rest of the path names the file. The
+response has Last-Modified and ETag headers, and conditional requests get a
+304. The longest matching prefix wins. Directories without an index.html,
+names with a segment that starts with ".," and symlinks that lead outside
+"dirPath" are answered with a 404. An empty "dirPath" stops serving the
+prefix. If the prefix doesn't start with "/," or the directory can't be
+found, an error string is returned that the caller must free. Otherwise,
+return NULL.
+*/
+//export GoServeDirectory
+func GoServeDirectory(pathPrefix, dirPath *C.char) *C.char {
+	err := serveDirectory(C.GoString(pathPrefix), C.GoString(dirPath))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoConfigureTransport changes the transport that weaver uses when it talks to
+upstreams itself, without disturbing requests that are already going. The
+configuration is a JSON object with any of "maxIdleConns,"
+"maxIdleConnsPerHost," "maxConnsPerHost," "idleTimeoutMillis," "caFile" (a
+PEM file of root CAs to trust), "proxyURL," and "drainTimeoutMillis." New
+requests use the new transport right away. The old one is closed once its
+requests finish, or when the drain timeout, 30 seconds by default, runs
+out. If the configuration is invalid, an error string is returned that the
+caller must free, and nothing changes. Otherwise, return NULL.
+*/
+//export GoConfigureTransport
+func GoConfigureTransport(config *C.char) *C.char {
+	err := configureTransportJSON(C.GoString(config))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetHealthCheckEndpoint makes weaver answer "GET path" itself with a 200 and
+the JSON object "response," to which it adds "status" and "upstreams"
+fields. They say whether a connection could be made to each of the targets
+in "upstreams," a comma-separated list of "host:port" pairs, which are
+dialed in the background every five seconds. No other host is ever dialed.
+An empty path turns it off. If the path doesn't start with "/," the
+response isn't a JSON object, or a target has no port, an error string is
+returned that the caller must free. Otherwise, return NULL.
+*/
+//export GoSetHealthCheckEndpoint
+func GoSetHealthCheckEndpoint(path, response, upstreams *C.char) *C.char {
+	err := setHealthCheckEndpoint(C.GoString(path), C.GoString(response),
+		C.GoString(upstreams))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSendRequestTrailers sends the trailers that came after a chunked request
+body, in the same format as the headers of a WHDR command. It must be called
+after the last chunk has been sent with GoSendRequestBodyChunk, and before
+the response begins. It returns a command that the caller must free: WTRL
+with the trailers to send to the target once the body is done, which may be
+fewer than were sent, or ERRR if the trailers came at the wrong time or the
+request body wasn't chunked.
+*/
+//export GoSendRequestTrailers
+func GoSendRequestTrailers(id uint32, trailers *C.char) *C.char {
+	cmd := sendRequestTrailers(id, C.GoString(trailers))
+	return C.CString(cmd.String())
+}
+
+/*
+GoSetReadinessEndpoint makes weaver answer GET and HEAD requests for "path"
+itself, for a readiness probe such as Kubernetes uses. The answer is a 503
+until GoMarkReady is called, and a 200 after that. An empty path turns it
+off. If the path doesn't start with "/," an error string is returned that
+the caller must free. Otherwise, return NULL.
+*/
+//export GoSetReadinessEndpoint
+func GoSetReadinessEndpoint(path *C.char) *C.char {
+	err := setReadinessEndpoint(C.GoString(path))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetLivenessEndpoint is like GoSetReadinessEndpoint, but for a liveness
+probe, which is always answered with a 200.
+*/
+//export GoSetLivenessEndpoint
+func GoSetLivenessEndpoint(path *C.char) *C.char {
+	err := setLivenessEndpoint(C.GoString(path))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoMarkReady makes the readiness probe answer with a 200, for instance once
+the handlers are set up.
+*/
+//export GoMarkReady
+func GoMarkReady() {
+	markReady(true)
+}
+
+/*
+GoMarkNotReady makes the readiness probe answer with a 503 again, so that
+no more traffic is sent this way.
+*/
+//export GoMarkNotReady
+func GoMarkNotReady() {
+	markReady(false)
+}
+
+/*
+GoSignalMemoryPressure tells weaver how close the process is to running out
+of memory: 0 for not at all, 1 for moderate, and 2 for critical. Above 0,
+weaver frees what it can, starting with the negative cache and the HAR
+entries that are waiting to be written, and the bytes freed are counted in
+the stats. While the pressure is critical, nothing new is cached or
+sampled. If the level is invalid, an error string is returned that the
+caller must free. Otherwise, return NULL.
+*/
+//export GoSignalMemoryPressure
+func GoSignalMemoryPressure(level int32) *C.char {
+	_, err := signalMemoryPressure(int(level))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetMemoryLimit makes weaver check the size of its heap every
+"checkMillis" and signal memory pressure itself: moderate at 75% of
+"limitBytes," and critical at 90%. A limit of zero stops the checks. If the
+interval is zero with a limit, an error string is returned that the caller
+must free. Otherwise, return NULL.
+*/
+//export GoSetMemoryLimit
+func GoSetMemoryLimit(limitBytes uint64, checkMillis uint32) *C.char {
+	err := setMemoryLimit(limitBytes, time.Duration(checkMillis)*time.Millisecond)
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetPprofEndpoint serves the Go profiler, as in net/http/pprof, under
+"path," such as "/debug/pprof/," without running the handler or going to
+the target. Only clients allowed by GoSetPprofAllowedCIDRs, or loopback
+addresses until that is called, may use it. Their address must be reported
+using GoSetRemoteAddr or GoSetProxyProtocolInfo, and others get a 403. An
+empty path, the default, turns it off. If the path doesn't start with "/,"
+an error string is returned that the caller must free. Otherwise, return
+NULL.
+*/
+//export GoSetPprofEndpoint
+func GoSetPprofEndpoint(path *C.char) *C.char {
+	err := setPprofEndpoint(C.GoString(path))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetPprofAllowedCIDRs sets the networks, such as "10.0.0.0/8," that may use
+the profiler and the expvar endpoint, separated by commas or newlines. An
+empty list goes back to loopback addresses only. If one is invalid, an error
+string is returned that the caller must free, and nothing changes.
+Otherwise, return NULL.
+*/
+//export GoSetPprofAllowedCIDRs
+func GoSetPprofAllowedCIDRs(cidrs *C.char) *C.char {
+	err := setPprofAllowedCIDRs(C.GoString(cidrs))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoEnableExpvarEndpoint serves weaver's variables, weaver.activeRequests,
+weaver.chunkTableSize, weaver.requestsTotal and weaver.errorsTotal, along
+with the "memstats" variable of the expvar package, as a JSON object, at
+"path," without running the handler or going to the target. Other expvar
+variables, such as "cmdline," aren't served. The same clients as for
+GoSetPprofEndpoint may use it. An empty path, the default, turns it off. If
+the path doesn't start with "/," an error string is returned that the
+caller must free. Otherwise, return NULL.
+*/
+//export GoEnableExpvarEndpoint
+func GoEnableExpvarEndpoint(path *C.char) *C.char {
+	err := setExpvarEndpoint(C.GoString(path))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetBuiltinRoutes sets up routes that weaver answers itself, without
+running the handler, from a JSON object that gives the path of each one:
+"healthz" answers with a 200 and "ok," and "favicon" answers with a 204. For
+example, {"healthz": "/healthz", "favicon": "/favicon.ico"}. A route that
+isn't given is turned off, so an empty string turns them all off. If the
+configuration is invalid, an error string is returned that the caller must
+free, and nothing changes. Otherwise, return NULL.
+*/
+//export GoSetBuiltinRoutes
+func GoSetBuiltinRoutes(config *C.char) *C.char {
+	err := setBuiltinRoutes(C.GoString(config))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetRateLimit limits how fast each client may send requests, using a token
+bucket for each one that holds up to "burst" requests and refills at
+"requestsPerSecond." A request that finds its bucket empty gets a 429
+response with a Retry-After header. Clients are told apart by address, as
+reported by GoSetRemoteAddr or GoSetProxyProtocolInfo, unless
+GoSetRateLimitHeader says otherwise. A rate of zero turns the limit off. If
+the rate is invalid, an error string is returned that the caller must free.
+Otherwise, return NULL.
+*/
+//export GoSetRateLimit
+func GoSetRateLimit(requestsPerSecond float64, burst uint32) *C.char {
+	err := setRateLimit(requestsPerSecond, burst)
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetRateLimitHeader makes GoSetRateLimit tell clients apart by the value of
+the request header "name," such as an API key, instead of by address.
+Requests without the header aren't limited. An empty name goes back to
+telling them apart by address.
+*/
+//export GoSetRateLimitHeader
+func GoSetRateLimitHeader(name *C.char) {
+	setRateLimitHeader(C.GoString(name))
+}
+
+/*
+GoSetQuotaPolicy limits the requests of each tenant, where the tenant is the
+value of the request header "header." Requests without it aren't limited. A
+tenant may send "requestsPerMinute" requests a minute, and receive
+"bytesPerDay" bytes of response bodies a day. Either may be zero for no limit.
+A request that goes over a limit gets a 429 response with the
+X-RateLimit-Limit and X-RateLimit-Remaining headers. The bytes of a response
+are counted when it is done, so a response is never cut short. The counts are
+kept in memory, over sliding windows, and start again from zero every time
+this is called. An empty "header" turns quotas off. If a limit is negative, an
+error string is returned that the caller must free. Otherwise, return NULL.
+*/
+//export GoSetQuotaPolicy
+func GoSetQuotaPolicy(header *C.char, requestsPerMinute, bytesPerDay int64) *C.char {
+	err := setHeaderQuota(C.GoString(header), requestsPerMinute, bytesPerDay)
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetResponseImageOptimization controls whether JPEG and PNG response bodies
+are decoded and encoded again before they are sent to the client. JPEG images
+are encoded using "quality," from 1 to 100, and PNG images using the best
+compression. An image is only replaced if the result is smaller. The sizes
+before and after are counted in the statistics returned by GoGetStats. This
+is only available if weaver was built with the "imageopt" tag. If it isn't,
+or "quality" is invalid, an error string is returned that the caller must
+free. Otherwise, return NULL.
+*/
+//export GoSetResponseImageOptimization
+func GoSetResponseImageOptimization(enabled, quality int32) *C.char {
+	err := setImageOptimization(enabled != 0, int(quality))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetStrictHostCheck controls what happens when the request line contains
+an absolute URI whose authority doesn't match the Host header. By default,
+the authority in the URI wins, as RFC 7230 requires, and the Host header
+that is sent to the target is rewritten to match. If strict checking
+is enabled, the request is rejected with a 400 instead. Either way,
+the mismatch is counted in the statistics returned by GoGetStats.
+*/
+//export GoSetStrictHostCheck
+func GoSetStrictHostCheck(enabled int32) {
+	setStrictHostCheck(enabled != 0)
+}
+
+/*
+GoSetTLSInfo tells weaver that the request arrived over TLS. "version" is
+the protocol version, using the same numbers as TLS itself (for instance,
+0x0303 for TLS 1.2), and "serverName" is the name that the client sent
+using SNI, or an empty string. Handlers see this in the "TLS" field of the
+request. It must be called before GoBeginRequest. If the request does not
+exist, an error string is returned that the caller must free. Otherwise,
+return NULL.
+*/
+//export GoSetTLSInfo
+func GoSetTLSInfo(id uint32, version uint16, serverName *C.char) *C.char {
+	err := setTLSInfo(id, version, C.GoString(serverName))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetRemoteAddr sets the address, as "host:port," of whoever connected to
+the caller for a particular request. Handlers see it as the RemoteAddr of
+the http.Request, and it is where the search for the real client in the
+X-Forwarded-For or Forwarded header starts. It must be called before
+GoBeginRequest. If the request does not exist or the address is invalid,
+an error string is returned that the caller must free. Otherwise,
+return NULL.
+*/
+//export GoSetRemoteAddr
+func GoSetRemoteAddr(id uint32, addr *C.char) *C.char {
+	err := setRemoteAddr(id, C.GoString(addr))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetContentTypeOverride replaces the Content-Type header of the response to
+a particular request, for a target that gets it wrong. This happens before
+any handler or setting that depends on the content type sees the response.
+It must be called before GoBeginRequest. If the request does not exist or
+the content type is invalid, an error string is returned that the caller
+must free. Otherwise, return NULL.
+*/
+//export GoSetContentTypeOverride
+func GoSetContentTypeOverride(id uint32, contentType *C.char) *C.char {
+	err := setContentTypeOverride(id, C.GoString(contentType))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetResponseCharset sets the charset parameter of the Content-Type header of
+every textual response, such as text/html or application/json, replacing the
+one that the target or handler set, if any. Responses without a Content-Type
+are left alone. An empty charset turns this off. If the charset is invalid,
+an error string is returned that the caller must free. Otherwise, return NULL.
+*/
+//export GoSetResponseCharset
+func GoSetResponseCharset(charset *C.char) *C.char {
+	err := setResponseCharset(C.GoString(charset))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoInferContentType makes weaver replace the Content-Type header of the
+response to a particular request with one that it guesses from the start of
+the body, as net/http.DetectContentType does, except that JSON is recognized
+too. Weaver has to read the body to do this. Compressed bodies are left alone,
+and GoSetContentTypeOverride takes precedence. It must be called before
+GoBeginRequest. If the request does not exist, an error string is returned
+that the caller must free. Otherwise, return NULL.
+*/
+//export GoInferContentType
+func GoInferContentType(id uint32) *C.char {
+	err := setContentTypeInference(id)
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetProxyProtocolInfo passes along what the caller found in the PROXY
+protocol header of the connection. "version" is 1 or 2, "clientAddr" is
+the address of the real client, and "proxyAddr" is the address that it
+connected to, both as "host:port." Handlers can find these separately
+from the address of the load balancer itself. It must be called before
+GoBeginRequest. If the request does not exist or the values are invalid,
+an error string is returned that the caller must free. Otherwise,
+return NULL.
+*/
+//export GoSetProxyProtocolInfo
+func GoSetProxyProtocolInfo(id uint32, version int32, clientAddr, proxyAddr *C.char) *C.char {
+	err := setProxyProtocolInfo(id, int(version), C.GoString(clientAddr), C.GoString(proxyAddr))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetMinTLSVersion rejects, with a 403, requests that arrived over a
+version of TLS older than "version." It only applies to requests for which
+GoSetTLSInfo was called. Set it to zero (the default) to allow any version.
+*/
+//export GoSetMinTLSVersion
+func GoSetMinTLSVersion(version uint16) {
+	setMinTLSVersion(version)
+}
+
+/*
+GoSetBodyHashHeader adds a hash of each response body to the response
+headers, using the named header, as a hex string. "algorithm" may be
+"md5," "sha1," "sha256," or "sha512." The hash covers the body as it is
+sent to the client, after any handler has changed it.
+
+This is expensive: because the headers must be sent before the body, the
+whole body is read into memory and hashed before any of it is sent.
+After RBOD, no WHDR or WSTA is sent until the last of the body has been
+received. Responses that a handler writes itself are not hashed. Pass an
+empty header name to turn this off. If the algorithm is not supported,
+an error string is returned that the caller must free. Otherwise, return NULL.
+*/
+//export GoSetBodyHashHeader
+func GoSetBodyHashHeader(headerName *C.char, algorithm *C.char) *C.char {
+	err := setBodyHashHeader(C.GoString(headerName), C.GoString(algorithm))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoEnableRequestBuffering controls whether weaver reads the whole request
+body into memory before sending it to the target. When it is on, any
+request that has a body results in an RBOD command, followed, once the
+caller has sent the last chunk, by a WHDR command that sets Content-Length
+and removes Transfer-Encoding, and then the body in WBOD commands. This
+costs memory in proportion to the size of the body, and the target sees
+nothing until the whole body has arrived. Turning it off also turns off
+GoSetRequestBodyHashHeader.
+*/
+//export GoEnableRequestBuffering
+func GoEnableRequestBuffering(enabled int32) {
+	setRequestBuffering(enabled != 0)
+}
+
+/*
+GoSetRequestBodyHashHeader adds a hash of each request body to the headers
+that are sent to the target, using the named header, as a hex string.
+"algorithm" is one of those supported by GoSetBodyHashHeader. The hash
+covers the body as it is sent to the target, after any handler has changed
+it. GoEnableRequestBuffering must be called first. Pass an empty header name
+to turn this off. If buffering is not enabled or the algorithm is not
+supported, an error string is returned that the caller must free.
+Otherwise, return NULL.
+*/
+//export GoSetRequestBodyHashHeader
+func GoSetRequestBodyHashHeader(headerName *C.char, algorithm *C.char) *C.char {
+	err := setRequestBodyHashHeader(C.GoString(headerName), C.GoString(algorithm))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetRequestBodyHashing turns on a SHA-256 hash of each request body that
+weaver sends to the target in WBOD commands. The hash is computed as the
+body streams, without buffering it. Retrieve it using GoGetRequestBodyHash.
+*/
+//export GoSetRequestBodyHashing
+func GoSetRequestBodyHashing(enabled int32) {
+	setRequestBodyHashing(enabled != 0)
+}
+
+/*
+GoGetRequestBodyHash returns the SHA-256 hash of the request body that
+weaver sent to the target, as a hex string. It is empty until the last
+WBOD command has been returned, and if hashing is off, or if weaver did not
+send the body itself. The caller must free the result.
+*/
+//export GoGetRequestBodyHash
+func GoGetRequestBodyHash(id uint32) *C.char {
+	hash, _ := getRequestBodyHash(id)
+	return C.CString(hash)
+}
+
+/*
+GoSetFullDuplex marks a request as full duplex, like a bidirectional
+stream, so that the caller keeps sending the request body after the
+response begins. Otherwise, once a response with a final status begins,
+weaver stops reading the request body and sends SBOD. Requests with a
+gRPC Content-Type are full duplex automatically. It must be called before
+GoBeginRequest. If the request does not exist, an error string is returned
+that the caller must free. Otherwise, return NULL.
+*/
+//export GoSetFullDuplex
+func GoSetFullDuplex(id uint32) *C.char {
+	err := setFullDuplex(id)
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoEnableChaosMode injects faults into the commands returned by
+GoPollRequest and GoPollResponse. It is meant only for testing code that
+embeds weaver, and does nothing unless it is called. The spec is a list
+of settings like "match=/test;reorder=3;duplicate=WHDR;delaydone=50"
+that is described in chaos.go. DONE or ERRR is still returned exactly
+once, at the end. An empty spec turns chaos mode off. It only affects
+requests that begin afterwards. If the spec is invalid, an error string is
+returned that the caller must free. Otherwise, return NULL.
+*/
+//export GoEnableChaosMode
+func GoEnableChaosMode(spec *C.char) *C.char {
+	err := enableChaosMode(C.GoString(spec))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetResponseExpiresHeader makes responses expire "maxAgeSeconds" from now.
+Both an Expires header and a max-age directive in Cache-Control are set,
+replacing any that the target or handler set. Other Cache-Control
+directives are kept, and responses marked no-store, no-cache, or private
+are left alone. By default, this applies to 2xx responses. A value of zero
+turns it off.
+*/
+//export GoSetResponseExpiresHeader
+func GoSetResponseExpiresHeader(maxAgeSeconds uint32) {
+	setResponseExpires(maxAgeSeconds)
+}
+
+/*
+GoSetResponseExpiresHeaderForStatus decides whether responses with the
+specified status get expiration headers from GoSetResponseExpiresHeader,
+instead of the default of every 2xx status.
+*/
+//export GoSetResponseExpiresHeaderForStatus
+func GoSetResponseExpiresHeaderForStatus(status uint32, enabled int32) {
+	setResponseExpiresForStatus(int(status), enabled != 0)
+}
+
+/*
+GoSetNegativeCacheTTL caches responses from the target with the specified
+status, such as 404, for "ttl" milliseconds. Until then, GET and HEAD
+requests that go to the same target URI are answered by weaver, without
+going to the target, using a SWCH command. The target URI is the one
+after the handler and the path, prefix, A/B and port rules have run, so
+the handler still runs for every request. Bodies over 64K are not cached.
+A TTL of zero stops caching that status.
+*/
+//export GoSetNegativeCacheTTL
+func GoSetNegativeCacheTTL(status uint32, ttl uint32) {
+	setNegativeCacheTTL(int(status), time.Duration(ttl)*time.Millisecond)
+}
+
+/*
+GoSetCacheCompression decides how response bodies are stored in the negative
+cache. "none," the default, stores them as they are, and "gzip" compresses
+them. Bodies under 256 bytes, bodies with a Content-Encoding, types such as
+images that are usually compressed already, and anything that doesn't get
+smaller are always stored as they are. The sizes before and after are
+counted in the statistics returned by GoGetStats. If the algorithm is
+invalid, an error string is returned that the caller must free. Otherwise,
+return NULL.
+*/
+//export GoSetCacheCompression
+func GoSetCacheCompression(algorithm *C.char) *C.char {
+	err := setCacheCompression(C.GoString(algorithm))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoListActiveRequests returns a JSON array that describes every request that
+has been created and not yet freed, with its "id," "state," "ageMs,"
+"method," and "path." It is meant for finding requests that are stuck, and
+does not hold up the requests themselves. The caller must free the result.
+*/
+//export GoListActiveRequests
+func GoListActiveRequests() *C.char {
+	return C.CString(getActiveRequestsJSON())
+}
+
+/*
+GoShutdown frees every request and response in order, so that responses
+that are already finished still reach the client. First, GoBeginRequest and
+GoBeginResponse start to fail. Then, for up to "drainMillis" milliseconds, the
+caller may keep polling requests and responses that have reached DONE or ERRR
+until it has read every command. Once it has, or the time is up, everything
+is freed, including requests that are still waiting for the target. It
+returns a JSON object with the number of requests and responses that were
+"active" when it began, the number that were "drained," meaning that they
+ended normally, the number that were "cancelled," and the "drainMillis" it
+waited. The caller must free the result. The library can't be used again.
+*/
+//export GoShutdown
+func GoShutdown(drainMillis uint32) *C.char {
+	return C.CString(getShutdownJSON(time.Duration(drainMillis) * time.Millisecond))
+}
+
+/*
+GoGetStats returns a JSON object that contains counters describing what
+has happened since the library was loaded. The caller must free the result.
+*/
+//export GoGetStats
+func GoGetStats() *C.char {
+	return C.CString(getStatsJSON())
+}
+
+/*
+GoSetMaxRequestDuration limits how long a request may take, in
+milliseconds, from GoBeginRequest until GoPollRequest returns DONE, no
+matter how steadily the client is sending the body. When it runs out, the
+request's context is cancelled and its body is abandoned. Unless a handler
+has already started a response, the request is answered with a 408. The
+time that the target takes after DONE doesn't count. Zero, the default,
+means there is no limit.
+*/
+//export GoSetMaxRequestDuration
+func GoSetMaxRequestDuration(milliseconds uint32) {
+	setMaxRequestDuration(time.Duration(milliseconds) * time.Millisecond)
+}
+
+/*
+GoSetSlowRequestThreshold sets up detection of slow requests. If a request
+is still active "milliseconds" after GoBeginRequest was called, then it
+is logged, and the function "fn" is called from a separate thread. "fn"
+must be a pointer to a C function with the signature:
+
+	void handler(unsigned int id, unsigned int elapsedMs)
+
+"fn" may be NULL, in which case slow requests are only logged. A request
+is no longer active once it is done or has been freed using GoFreeRequest.
+A threshold of zero turns off slow request detection.
+*/
+//export GoSetSlowRequestThreshold
+func GoSetSlowRequestThreshold(milliseconds uint32, fn unsafe.Pointer) {
+	setSlowRequestThreshold(
+		time.Duration(milliseconds)*time.Millisecond, cSlowRequestHandler(fn))
+}
+
+/*
+GoSetSchemeOverride changes the scheme, "http" or "https," that is used to
+reach the target for a single request. The request is forwarded using an
+absolute URI in a WURI command, and the caller must change how it
+connects to the target to match, including whether it uses TLS. A warning
+is logged if this means that a request that would have used TLS will not.
+It must be called before GoBeginRequest. If the request does not exist or
+the scheme is invalid, an error string is returned that the caller must
+free. Otherwise, return NULL.
+*/
+//export GoSetSchemeOverride
+func GoSetSchemeOverride(id uint32, scheme *C.char) *C.char {
+	err := setSchemeOverride(id, C.GoString(scheme))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetPortOverride changes the port that is used to reach the target for a
+single request. The request is forwarded using an absolute URI in a WURI
+command, and the Host header is changed to match. It must be called before
+GoBeginRequest. If the request does not exist or the port is not between 1
+and 65535, an error string is returned that the caller must free.
+Otherwise, return NULL.
+*/
+//export GoSetPortOverride
+func GoSetPortOverride(id uint32, port int32) *C.char {
+	err := setPortOverride(id, port)
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoEnableServerTiming adds a Server-Timing header to the response for a
+single request, such as "upstream;dur=52.140, filter;dur=0.310". "upstream"
+is the time in milliseconds from the DONE at the end of the request until
+GoBeginResponse, and "filter" is the time spent in handlers before the
+response headers were sent. It must be called before GoBeginRequest. If the
+request does not exist, an error string is returned that the caller must
+free. Otherwise, return NULL.
+*/
+//export GoEnableServerTiming
+func GoEnableServerTiming(id uint32) *C.char {
+	err := enableServerTiming(id)
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoObserveResponseBody computes digests of the response body for a single
+request, as it is sent to the client after any handler has changed it.
+"algorithms" is a comma-separated list of the algorithms supported by
+GoSetBodyHashHeader, and they are all computed in one pass without copying
+the body. If no handler changes the body, weaver reads it and sends it on
+using WBOD in order to see it. The results are available from
+GoGetResponseBodyDigests once the response is done. It must be called before
+GoBeginResponse. If the request does not exist or an algorithm is not
+supported, an error string is returned that the caller must free.
+Otherwise, return NULL.
+*/
+//export GoObserveResponseBody
+func GoObserveResponseBody(id uint32, algorithms *C.char) *C.char {
+	err := observeResponseBody(id, C.GoString(algorithms))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoGetResponseBodyDigests returns a JSON object that maps each algorithm
+passed to GoObserveResponseBody to the hex digest of the response body. It
+is empty until the response is done. The caller must free the result.
+*/
+//export GoGetResponseBodyDigests
+func GoGetResponseBodyDigests(id uint32) *C.char {
+	return C.CString(getResponseDigestsJSON(id))
+}
+
+/*
+GoSetHedging hedges the requests that weaver sends to an upstream itself for
+a single request, such as the ones made for GoConcatResponses. If the
+upstream has not answered after "delay" milliseconds, the same request is
+sent to the first backup, and after the same delay again to the next one.
+"backups" is a list of base URLs, such as "http://backup:8080," separated
+by newlines, whose scheme and host replace those of the original URL. The
+first to answer wins and the others are canceled. Only GET and HEAD
+requests are hedged. It must be called before GoBeginRequest. If the
+request does not exist or a backup is not an absolute URL, an error string
+is returned that the caller must free. Otherwise, return NULL.
+*/
+//export GoSetHedging
+func GoSetHedging(id uint32, delay uint32, backups *C.char) *C.char {
+	err := setHedging(id, time.Duration(delay)*time.Millisecond, C.GoString(backups))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoGetParsedURL returns the URL that the request will be forwarded to, after
+any changes, as a JSON object with the "scheme," "host," "port," "path,"
+"query," and "fragment." The path and query are still percent-encoded. If
+the URL has no port, the standard port for the scheme is returned. The
+object is empty until the DONE command has been returned for the request.
+The caller must free the result.
+*/
+//export GoGetParsedURL
+func GoGetParsedURL(id uint32) *C.char {
+	return C.CString(getParsedURLJSON(id))
+}
+
+/*
+GoConcatResponses turns a request into an aggregation. Instead of running
+the handler and proxying to the target, weaver fetches each of the URLs,
+which are separated by newlines, one after the other, and streams their
+bodies back as a single response, starting with a SWCH command. The
+status and Content-Type come from the first URL that succeeds.
+
+If "skipFailures" is non-zero, URLs that fail are left out. Otherwise,
+a failure before any data was sent results in a 502 response, and a
+failure after that results in an ERRR command. It must be called before
+GoBeginRequest. If there are no URLs, an error string is returned that
+the caller must free. Otherwise, return NULL.
+*/
+//export GoConcatResponses
+func GoConcatResponses(id uint32, urls *C.char, skipFailures int32) *C.char {
+	err := setConcatResponses(id, C.GoString(urls), skipFailures != 0)
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
 func copyPointer(l int32, data unsafe.Pointer, len uint32) ([]byte, bool) {
 	buf := C.GoBytes(data, C.int(len))
 	var last bool
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+ * Record a sample of the traffic that goes through weaver as HTTP Archive
+ * (HAR 1.2) documents, which browsers and other tools can open. The choice
+ * is made when a request begins, and only the sampled requests are changed
+ * at all: their bodies have to stream through weaver so that the start of
+ * each one can be copied, while everyone else's are left alone. Each entry
+ * is written out when its response is done, as a HAR document of its own,
+ * unless a flush interval is set, in which case the entries are collected
+ * and written as one document at that interval. Each document is written
+ * as a single line, by a goroutine of its own, so that a slow disk holds up
+ * no request. Values of headers that carry credentials, or of any other
+ * headers that the caller names, and every query parameter value, are
+ * replaced. Bodies are only recorded when the caller asks for them.
+ */
+
+const (
+	harVersion  = "1.2"
+	harRedacted = "REDACTED"
+	// Documents waiting for the writer. More than that are dropped.
+	harWriteQueueSize = 64
+)
+
+var defaultHARRedactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+type harSampler struct {
+	rate         float64
+	maxBodyBytes int
+	sink         io.Writer
+	lock         sync.Mutex
+	pending      []*harEntry
+	flushTimer   *time.Timer
+	// Protected by lock. Once stopped, writes is closed.
+	writes  chan []*harEntry
+	stopped bool
+	done    chan bool
+}
+
+/*
+ * SetHARSampler records a fraction, "rate," between 0 and 1, of requests and
+ * writes them to "sink." At most "maxBodyBytes" of each body is kept, and
+ * if it is zero, no bodies are recorded at all. A rate of zero, or a nil
+ * sink, stops sampling. Once this returns, the old sampler has written
+ * everything that it is going to.
+ */
+func SetHARSampler(rate float64, maxBodyBytes int, sink io.Writer) error {
+	if rate < 0 || rate > 1 || maxBodyBytes < 0 {
+		return fmt.Errorf("Invalid HAR sample rate %g", rate)
+	}
+	var sampler *harSampler
+	if rate > 0 && sink != nil {
+		if isMemoryCritical() {
+			return errMemoryPressure
+		}
+		sampler = &harSampler{
+			rate:         rate,
+			maxBodyBytes: maxBodyBytes,
+			sink:         sink,
+			writes:       make(chan []*harEntry, harWriteQueueSize),
+			done:         make(chan bool),
+		}
+		go sampler.write()
+	}
+	var old *harSampler
+	updateSettings(func(s *settings) {
+		old = s.harSampler
+		s.harSampler = sampler
+	})
+	if old != nil {
+		old.stop()
+	}
+	return nil
+}
+
+/*
+ * SetHARRedactedHeaders replaces the values of the named headers in the
+ * archives. They replace the default list, which is Authorization,
+ * Proxy-Authorization, Cookie, and Set-Cookie. No names at all go back to
+ * the default.
+ */
+func SetHARRedactedHeaders(names []string) error {
+	var redact map[string]bool
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if strings.ContainsAny(name, " \t:;,\"") {
+			return fmt.Errorf("Invalid header name: \"%s\"", name)
+		}
+		if redact == nil {
+			redact = make(map[string]bool)
+		}
+		redact[http.CanonicalHeaderKey(name)] = true
+	}
+	updateSettings(func(s *settings) {
+		s.harRedact = redact
+	})
+	return nil
+}
+
+/*
+ * SetHARFlushInterval collects the sampled entries and writes them together
+ * every "interval." Zero, the default, writes each one when it is done.
+ */
+func SetHARFlushInterval(interval time.Duration) {
+	updateSettings(func(s *settings) {
+		s.harInterval = interval
+	})
+	if interval <= 0 {
+		flushHAR()
+	}
+}
+
+func setHARRedactedHeaderList(list string) error {
+	return SetHARRedactedHeaders(strings.Split(list, ","))
+}
+
+// The file that the C API opened, which is closed when it is replaced
+var harFile *os.File
+var harFileLock = sync.Mutex{}
+
+/*
+ * Append the archives to a file, for the C API.
+ */
+func setHARFile(rate float64, maxBodyBytes int, fileName string) error {
+	harFileLock.Lock()
+	defer harFileLock.Unlock()
+	var f *os.File
+	if fileName != "" && rate != 0 {
+		var err error
+		// The archives hold what clients sent, so only weaver may read them.
+		f, err = os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	var err error
+	if f == nil {
+		err = SetHARSampler(0, 0, nil)
+	} else {
+		err = SetHARSampler(rate, maxBodyBytes, f)
+	}
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return err
+	}
+	// The old sampler has stopped writing, and drops the entries for
+	// requests that began before this, which still have the old settings.
+	if harFile != nil {
+		harFile.Close()
+	}
+	harFile = f
+	return nil
+}
+
+/*
+ * Write out anything that is waiting for the flush interval.
+ */
+func flushHAR() {
+	if sampler := getSettings().harSampler; sampler != nil {
+		sampler.flush()
+	}
+}
+
+func (s *harSampler) add(e *harEntry, interval time.Duration) {
+	s.lock.Lock()
+	s.pending = append(s.pending, e)
+	if interval > 0 && s.flushTimer == nil {
+		s.flushTimer = time.AfterFunc(interval, s.flush)
+	}
+	s.lock.Unlock()
+	if interval <= 0 {
+		s.flush()
+	}
+}
+
+/*
+ * Flush, and return about how much memory the entries held.
+ */
+func (s *harSampler) reclaim() int64 {
+	s.lock.Lock()
+	var size int64
+	for _, e := range s.pending {
+		size += int64(len(e.requestBody.data) + len(e.responseBody.data))
+	}
+	s.lock.Unlock()
+	s.flush()
+	return size
+}
+
+/*
+ * Hand the pending entries to the writer. If it is too far behind, they are
+ * dropped rather than kept waiting.
+ */
+func (s *harSampler) flush() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+		s.flushTimer = nil
+	}
+	if len(s.pending) == 0 {
+		return
+	}
+	entries := s.pending
+	s.pending = nil
+	if s.stopped {
+		return
+	}
+	select {
+	case s.writes <- entries:
+	default:
+		log.Printf("Can't write HAR entries: the writer is %d documents behind", harWriteQueueSize)
+	}
+}
+
+/*
+ * Write out what is pending, and wait for the writer to finish.
+ */
+func (s *harSampler) stop() {
+	s.flush()
+	s.lock.Lock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.writes)
+	}
+	s.lock.Unlock()
+	<-s.done
+}
+
+func (s *harSampler) write() {
+	defer close(s.done)
+	for entries := range s.writes {
+		buf, err := json.Marshal(&harDocument{Log: harLog{
+			Version: harVersion,
+			Creator: harCreator{Name: "weaver", Version: harVersion},
+			Entries: entries,
+		}})
+		if err == nil {
+			_, err = s.sink.Write(append(buf, '\n'))
+		}
+		if err != nil {
+			log.Printf("Can't write HAR entries: %v", err)
+		}
+	}
+}
+
+type harDocument struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string      `json:"version"`
+	Creator harCreator  `json:"creator"`
+	Entries []*harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+
+	maxBody      int
+	redact       map[string]bool
+	requestBody  harBody
+	responseBody harBody
+	responseAt   time.Time
+	// Set when a handler answers in place of the target
+	status  int
+	headers http.Header
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string         `json:"mimeType"`
+	Params   []harNameValue `json:"params"`
+	Text     string         `json:"text"`
+	Comment  string         `json:"comment,omitempty"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// Times are in milliseconds, and -1 means that it doesn't apply
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// The start of a body, and how big the whole thing was
+type harBody struct {
+	data []byte
+	size int
+}
+
+func (b *harBody) capture(chunk []byte, max int) {
+	b.size += len(chunk)
+	if room := max - len(b.data); room > 0 {
+		b.data = append(b.data, chunk[:minInt(room, len(chunk))]...)
+	}
+}
+
+func (b *harBody) truncated() bool {
+	return len(b.data) < b.size
+}
+
+/*
+ * Return the body as text, or in base64 if it isn't. A character that was
+ * cut in half at the end doesn't count.
+ */
+func (b *harBody) text() (string, string) {
+	data := b.data
+	for i := 0; i < utf8.UTFMax-1 && b.truncated() && len(data) > 0 &&
+		!utf8.Valid(data); i++ {
+		data = data[:len(data)-1]
+	}
+	if utf8.Valid(data) {
+		return string(data), ""
+	}
+	return base64.StdEncoding.EncodeToString(b.data), "base64"
+}
+
+func (b *harBody) comment(encoding string) string {
+	var notes []string
+	if encoding != "" {
+		notes = append(notes, encoding)
+	}
+	if b.truncated() {
+		notes = append(notes, "truncated")
+	}
+	return strings.Join(notes, ", ")
+}
+
+/*
+ * Decide whether to sample a request when it begins.
+ */
+func (r *request) sampleHAR() {
+	s := r.settings.harSampler
+	if s == nil || isMemoryCritical() || rand.Float64() >= s.rate {
+		return
+	}
+	redact := r.settings.harRedact
+	if redact == nil {
+		redact = defaultHARRedactedHeaders
+	}
+	r.har = &harEntry{maxBody: s.maxBodyBytes, redact: redact}
+}
+
+/*
+ * Return true if the body has to go through weaver to be recorded. A
+ * request without one is left alone, so that we don't ask for it, and so
+ * is every body unless bodies are recorded.
+ */
+func (r *request) capturingRequestBody() bool {
+	return r.capturingBodies() && r.req.ContentLength != 0
+}
+
+func (r *request) capturingBodies() bool {
+	return r.har != nil && r.har.maxBody > 0
+}
+
+/*
+ * Record the request as it goes to the target, or as the handler saw it if
+ * it was answered without one.
+ */
+func (r *request) recordHARRequest() {
+	e := r.har
+	if e == nil {
+		return
+	}
+	req := r.req
+	u := *req.URL
+	if u.Host == "" {
+		u.Host = req.Host
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+		if req.TLS != nil {
+			u.Scheme = "https"
+		}
+	}
+	query := u.Query()
+	u.RawQuery = harRedactQuery(query)
+	e.StartedDateTime = r.started.Format(time.RFC3339Nano)
+	e.Request = harRequest{
+		Method:      req.Method,
+		URL:         u.String(),
+		HTTPVersion: req.Proto,
+		Cookies:     harCookies(req.Cookies()),
+		Headers:     harHeaders(req.Header, e.redact),
+		QueryString: harQuery(query),
+		HeadersSize: -1,
+		BodySize:    e.requestBody.size,
+	}
+	if e.requestBody.size > 0 {
+		// There is no encoding for post data, so a comment has to do.
+		text, encoding := e.requestBody.text()
+		e.Request.PostData = &harPostData{
+			MimeType: req.Header.Get("Content-Type"),
+			Params:   []harNameValue{},
+			Text:     text,
+			Comment:  e.requestBody.comment(encoding),
+		}
+	}
+}
+
+/*
+ * Note the response from a handler that answered in place of the target.
+ */
+func (r *request) recordHARResponse(status int, hdrs *http.Header) {
+	if r.har == nil {
+		return
+	}
+	r.har.status = status
+	if hdrs != nil {
+		r.har.headers = copyHeaders(*hdrs)
+	}
+}
+
+/*
+ * Finish the entry with the response, and hand it to the sampler.
+ */
+func (r *request) finishHAR(status int, proto string, hdrs http.Header) {
+	e := r.har
+	s := r.settings.harSampler
+	if e == nil || s == nil {
+		return
+	}
+	r.har = nil
+	if e.status != 0 {
+		status = e.status
+		hdrs = e.headers
+	}
+	if hdrs == nil {
+		hdrs = http.Header{}
+	}
+	now := time.Now()
+	cookies := (&http.Response{Header: hdrs}).Cookies()
+	text, encoding := e.responseBody.text()
+	e.Response = harResponse{
+		Status:      status,
+		StatusText:  http.StatusText(status),
+		HTTPVersion: proto,
+		Cookies:     harCookies(cookies),
+		Headers:     harHeaders(hdrs, e.redact),
+		Content: harContent{
+			Size:     e.responseBody.size,
+			MimeType: hdrs.Get("Content-Type"),
+			Text:     text,
+			Encoding: encoding,
+		},
+		HeadersSize: -1,
+		BodySize:    e.responseBody.size,
+	}
+	if e.responseBody.truncated() {
+		e.Response.Content.Comment = "truncated"
+	}
+
+	e.Timings = harTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1}
+	if queued, queueWait := r.queueTiming(); queued {
+		// Time parked in the priority queue
+		e.Timings.Blocked = harMillis(queueWait)
+	}
+	filterTime, proxiedAt := r.timings()
+	e.Timings.Send = harMillis(filterTime)
+	if !proxiedAt.IsZero() && !e.responseAt.IsZero() {
+		e.Timings.Wait = harMillis(e.responseAt.Sub(proxiedAt))
+		e.Timings.Receive = harMillis(now.Sub(e.responseAt))
+	}
+	e.Time = harMillis(now.Sub(r.started))
+	s.add(e, r.settings.harInterval)
+}
+
+func harMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func harHeaders(hdrs http.Header, redact map[string]bool) []harNameValue {
+	names := make([]string, 0, len(hdrs))
+	for name := range hdrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	nvs := []harNameValue{}
+	for _, name := range names {
+		for _, v := range hdrs[name] {
+			if redact[http.CanonicalHeaderKey(name)] {
+				v = harRedacted
+			}
+			nvs = append(nvs, harNameValue{Name: name, Value: v})
+		}
+	}
+	return nvs
+}
+
+func harCookies(cookies []*http.Cookie) []harNameValue {
+	nvs := []harNameValue{}
+	for _, c := range cookies {
+		nvs = append(nvs, harNameValue{Name: c.Name, Value: harRedacted})
+	}
+	return nvs
+}
+
+func harQuery(q url.Values) []harNameValue {
+	names := make([]string, 0, len(q))
+	for name := range q {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	nvs := []harNameValue{}
+	for _, name := range names {
+		for range q[name] {
+			nvs = append(nvs, harNameValue{Name: name, Value: harRedacted})
+		}
+	}
+	return nvs
+}
+
+/*
+ * Return the query string with the values replaced. Query strings often
+ * carry tokens and personal data, so only the names are kept.
+ */
+func harRedactQuery(q url.Values) string {
+	redacted := make(url.Values, len(q))
+	for name, values := range q {
+		for range values {
+			redacted.Add(name, harRedacted)
+		}
+	}
+	return redacted.Encode()
+}
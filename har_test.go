@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HAR sampling", func() {
+	var sink *bytes.Buffer
+
+	BeforeEach(func() {
+		sink = &bytes.Buffer{}
+	})
+
+	AfterEach(func() {
+		resetSettings()
+	})
+
+	// Return the HAR documents written so far, checking that each one has
+	// the fields that HAR 1.2 requires.
+	readDocuments := func() []map[string]interface{} {
+		// Wait for the writer to finish.
+		Expect(SetHARSampler(0, 0, nil)).Should(Succeed())
+		var docs []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(sink.String()), "\n") {
+			if line == "" {
+				continue
+			}
+			var doc map[string]interface{}
+			Expect(json.Unmarshal([]byte(line), &doc)).Should(Succeed())
+			harLog := doc["log"].(map[string]interface{})
+			Expect(harLog["version"]).Should(Equal("1.2"))
+			Expect(harLog["creator"]).Should(HaveKey("name"))
+			Expect(harLog["creator"]).Should(HaveKey("version"))
+			for _, e := range harLog["entries"].([]interface{}) {
+				entry := e.(map[string]interface{})
+				for _, key := range []string{"startedDateTime", "time", "request",
+					"response", "cache", "timings"} {
+					Expect(entry).Should(HaveKey(key))
+				}
+				_, err := time.Parse(time.RFC3339Nano, entry["startedDateTime"].(string))
+				Expect(err).Should(Succeed())
+				for _, key := range []string{"method", "url", "httpVersion", "cookies",
+					"headers", "queryString", "headersSize", "bodySize"} {
+					Expect(entry["request"]).Should(HaveKey(key))
+				}
+				for _, key := range []string{"status", "statusText", "httpVersion", "cookies",
+					"headers", "content", "redirectURL", "headersSize", "bodySize"} {
+					Expect(entry["response"]).Should(HaveKey(key))
+				}
+				content := entry["response"].(map[string]interface{})["content"]
+				Expect(content).Should(HaveKey("size"))
+				Expect(content).Should(HaveKey("mimeType"))
+				for _, key := range []string{"send", "wait", "receive"} {
+					Expect(entry["timings"]).Should(HaveKey(key))
+				}
+			}
+			docs = append(docs, doc)
+		}
+		return docs
+	}
+
+	entriesOf := func(doc map[string]interface{}) []interface{} {
+		return doc["log"].(map[string]interface{})["entries"].([]interface{})
+	}
+
+	It("Proxied request", func() {
+		Expect(SetHARSampler(1, 1024, sink)).Should(Succeed())
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		hdrs := makeRequestHeaders("POST", "/pass?a=1&b=2", "text/plain", 13)
+		hdrs = addRequestHeader(hdrs, "Authorization", "Bearer secret")
+		Expect(beginRequest(id, hdrs)).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("RBOD"))
+		sendRequestBodyChunk(id, true, []byte("Hello, World!"))
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("WBOD"))
+		Expect(string(readBodyData(cmd))).Should(Equal("Hello, World!"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(sink.Len()).Should(BeZero())
+
+		rid := createResponse(testHandler)
+		defer freeResponse(rid)
+		Expect(beginResponse(rid, id, 201, makeResponseHeaders("text/plain", 6))).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("RBOD"))
+		sendResponseBodyChunk(rid, true, []byte("Thanks"))
+		Expect(pollResponse(rid, true)).Should(HavePrefix("WBOD"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+
+		docs := readDocuments()
+		Expect(docs).Should(HaveLen(1))
+		entries := entriesOf(docs[0])
+		Expect(entries).Should(HaveLen(1))
+		entry := entries[0].(map[string]interface{})
+
+		req := entry["request"].(map[string]interface{})
+		Expect(req["method"]).Should(Equal("POST"))
+		Expect(req["url"]).Should(Equal("http://localhost:1234/pass?a=REDACTED&b=REDACTED"))
+		Expect(req["queryString"]).Should(ConsistOf(
+			map[string]interface{}{"name": "a", "value": harRedacted},
+			map[string]interface{}{"name": "b", "value": harRedacted},
+		))
+		Expect(req["headers"]).Should(ContainElement(map[string]interface{}{
+			"name": "Authorization", "value": harRedacted,
+		}))
+		Expect(req["postData"]).Should(HaveKeyWithValue("text", "Hello, World!"))
+		Expect(req["bodySize"]).Should(BeEquivalentTo(13))
+
+		resp := entry["response"].(map[string]interface{})
+		Expect(resp["status"]).Should(BeEquivalentTo(201))
+		Expect(resp["content"]).Should(HaveKeyWithValue("text", "Thanks"))
+		Expect(resp["content"]).Should(HaveKeyWithValue("mimeType", "text/plain"))
+		Expect(entry["timings"]).Should(HaveKeyWithValue("blocked", BeEquivalentTo(-1)))
+	})
+
+	It("Truncated binary body", func() {
+		Expect(SetHARSampler(1, 4, sink)).Should(Succeed())
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		body := []byte{0xff, 0xfe, 0x00, 0x01, 0x02, 0x03}
+		rid := createResponse(testHandler)
+		defer freeResponse(rid)
+		Expect(beginResponse(rid, id, 200, makeResponseHeaders("application/octet-stream",
+			len(body)))).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("RBOD"))
+		sendResponseBodyChunk(rid, true, body)
+		Expect(pollResponse(rid, true)).Should(HavePrefix("WBOD"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+
+		entry := entriesOf(readDocuments()[0])[0].(map[string]interface{})
+		content := entry["response"].(map[string]interface{})["content"].(map[string]interface{})
+		Expect(content["encoding"]).Should(Equal("base64"))
+		Expect(content["text"]).Should(Equal(base64.StdEncoding.EncodeToString(body[:4])))
+		Expect(content["size"]).Should(BeEquivalentTo(len(body)))
+		Expect(content["comment"]).Should(Equal("truncated"))
+	})
+
+	It("Answered by the handler", func() {
+		Expect(SetHARSampler(1, 1024, sink)).Should(Succeed())
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/senderror", "", 0))).Should(Succeed())
+		for cmd := pollRequest(id, true); cmd != "DONE"; cmd = pollRequest(id, true) {
+		}
+
+		entry := entriesOf(readDocuments()[0])[0].(map[string]interface{})
+		resp := entry["response"].(map[string]interface{})
+		Expect(resp["status"]).ShouldNot(BeEquivalentTo(200))
+		Expect(resp["content"]).Should(HaveKey("text"))
+	})
+
+	It("Time in the priority queue", func() {
+		Expect(SetHARSampler(1, 1024, sink)).Should(Succeed())
+		GoSetPriorityQueue(1)
+		scheduler.setSlots(1)
+		defer func() {
+			GoSetPriorityQueue(0)
+			scheduler.setSlots(runtime.GOMAXPROCS(0))
+		}()
+		slowID := createRequest(testHandler)
+		defer freeRequest(slowID)
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+
+		Expect(beginRequest(slowID, makeRequestHeaders("GET", "/slowpass", "", 0))).Should(Succeed())
+		Eventually(func() int {
+			scheduler.lock.Lock()
+			defer scheduler.lock.Unlock()
+			return scheduler.running
+		}).Should(Equal(1))
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/senderror", "", 0))).Should(Succeed())
+		Eventually(scheduler.waitingCount).Should(Equal(1))
+		Expect(pollRequest(slowID, true)).Should(Equal("DONE"))
+		for cmd := pollRequest(id, true); cmd != "DONE"; cmd = pollRequest(id, true) {
+		}
+
+		entry := entriesOf(readDocuments()[0])[0].(map[string]interface{})
+		Expect(entry["timings"]).Should(HaveKeyWithValue("blocked", BeNumerically(">", 0)))
+	})
+
+	It("Flush interval", func() {
+		Expect(SetHARSampler(1, 1024, sink)).Should(Succeed())
+		SetHARFlushInterval(time.Hour)
+		for i := 0; i < 3; i++ {
+			id := createRequest(testHandler)
+			Expect(beginRequest(id, makeRequestHeaders("GET", "/senderror", "", 0))).Should(Succeed())
+			for cmd := pollRequest(id, true); cmd != "DONE"; cmd = pollRequest(id, true) {
+			}
+			freeRequest(id)
+		}
+		Expect(sink.Len()).Should(BeZero())
+		flushHAR()
+		docs := readDocuments()
+		Expect(docs).Should(HaveLen(1))
+		Expect(entriesOf(docs[0])).Should(HaveLen(3))
+	})
+
+	It("Not sampled", func() {
+		Expect(SetHARSampler(0.000000001, 1024, sink)).Should(Succeed())
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		Expect(beginRequest(id, makeRequestHeaders("POST", "/pass", "text/plain", 13))).Should(Succeed())
+		// The body isn't asked for, so it isn't copied.
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		rid := createResponse(testHandler)
+		defer freeResponse(rid)
+		Expect(beginResponse(rid, id, 200, makeResponseHeaders("text/plain", 6))).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+		Expect(sink.Len()).Should(BeZero())
+	})
+
+	It("Bodies only if asked for", func() {
+		Expect(SetHARSampler(1, 0, sink)).Should(Succeed())
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		Expect(beginRequest(id, makeRequestHeaders("POST", "/pass", "text/plain", 13))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		rid := createResponse(testHandler)
+		defer freeResponse(rid)
+		Expect(beginResponse(rid, id, 200, makeResponseHeaders("text/plain", 6))).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+
+		entry := entriesOf(readDocuments()[0])[0].(map[string]interface{})
+		Expect(entry["request"]).ShouldNot(HaveKey("postData"))
+		content := entry["response"].(map[string]interface{})["content"]
+		Expect(content).ShouldNot(HaveKey("text"))
+	})
+
+	It("Redacted headers", func() {
+		Expect(SetHARRedactedHeaders([]string{"x-api-key"})).Should(Succeed())
+		Expect(SetHARSampler(1, 0, sink)).Should(Succeed())
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		hdrs := makeRequestHeaders("GET", "/senderror", "", 0)
+		hdrs = addRequestHeader(hdrs, "X-Api-Key", "secret")
+		hdrs = addRequestHeader(hdrs, "Authorization", "Bearer visible")
+		Expect(beginRequest(id, hdrs)).Should(Succeed())
+		for cmd := pollRequest(id, true); cmd != "DONE"; cmd = pollRequest(id, true) {
+		}
+
+		entry := entriesOf(readDocuments()[0])[0].(map[string]interface{})
+		headers := entry["request"].(map[string]interface{})["headers"]
+		Expect(headers).Should(ContainElement(map[string]interface{}{
+			"name": "X-Api-Key", "value": harRedacted,
+		}))
+		Expect(headers).Should(ContainElement(map[string]interface{}{
+			"name": "Authorization", "value": "Bearer visible",
+		}))
+		Expect(SetHARRedactedHeaders([]string{"Bad Name"})).ShouldNot(Succeed())
+	})
+
+	It("File only readable by its owner", func() {
+		dir, err := ioutil.TempDir("", "har")
+		Expect(err).Should(Succeed())
+		defer os.RemoveAll(dir)
+		name := filepath.Join(dir, "sample.har")
+		Expect(setHARFile(1, 0, name)).Should(Succeed())
+		defer setHARFile(0, 0, "")
+		info, err := os.Stat(name)
+		Expect(err).Should(Succeed())
+		Expect(info.Mode().Perm()).Should(Equal(os.FileMode(0600)))
+	})
+
+	It("Invalid", func() {
+		Expect(SetHARSampler(2, 1024, sink)).ShouldNot(Succeed())
+		Expect(SetHARSampler(0.5, -1, sink)).ShouldNot(Succeed())
+	})
+})
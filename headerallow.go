@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+/*
+ * In allowlist mode, only the response headers on a list reach the client,
+ * and the rest are dropped after every handler and rule has had its turn.
+ * Handlers can allow more headers for a single request by calling
+ * AllowResponseHeader on the http.ResponseWriter. Set-Cookie is never on the
+ * default list, so cookies only get through if someone asks for them. The
+ * headers that weaver adds itself, for CORS, Server-Timing, and Trailer,
+ * always get through.
+ */
+
+var defaultResponseHeaders = []string{
+	"Accept-Ranges",
+	"Age",
+	"Allow",
+	"Cache-Control",
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Language",
+	"Content-Length",
+	"Content-Range",
+	"Content-Type",
+	"Date",
+	"ETag",
+	"Expires",
+	"Last-Modified",
+	"Location",
+	"Proxy-Authenticate",
+	"Retry-After",
+	"Strict-Transport-Security",
+	"Trailer",
+	"Vary",
+	"WWW-Authenticate",
+}
+
+/*
+ * Turn allowlist mode on or off. If "names," which are separated by commas
+ * or newlines, is empty, the default list is used.
+ */
+func setResponseHeaderAllowlist(enabled bool, names string) {
+	var allowed map[string]bool
+	if enabled {
+		allowed = make(map[string]bool)
+		list := strings.FieldsFunc(names, func(c rune) bool {
+			return c == ',' || c == '\n'
+		})
+		if len(list) == 0 {
+			list = defaultResponseHeaders
+		}
+		for _, name := range list {
+			if name = strings.TrimSpace(name); name != "" {
+				allowed[http.CanonicalHeaderKey(name)] = true
+			}
+		}
+	}
+	updateSettings(func(s *settings) {
+		s.allowedHeaders = allowed
+	})
+}
+
+/*
+ * AllowResponseHeader lets "name" through to the client for this request,
+ * even though it isn't on the list.
+ */
+func (h *httpResponse) AllowResponseHeader(name string) {
+	if r := h.owner(); r != nil {
+		r.allowResponseHeader(name)
+	}
+}
+
+func (r *request) allowResponseHeader(name string) {
+	if r.extraHeaders == nil {
+		r.extraHeaders = make(map[string]bool)
+	}
+	r.extraHeaders[http.CanonicalHeaderKey(name)] = true
+}
+
+/*
+ * Set a header that weaver adds itself, and let it through.
+ */
+func (r *request) setOwnHeader(h http.Header, name, value string) {
+	h.Set(name, value)
+	if r.settings.allowedHeaders != nil {
+		r.allowResponseHeader(name)
+	}
+}
+
+/*
+ * Remove every header that isn't allowed.
+ */
+func (r *request) dropResponseHeaders(h http.Header) {
+	allowed := r.settings.allowedHeaders
+	if allowed == nil {
+		return
+	}
+	dropped := 0
+	for name := range h {
+		key := http.CanonicalHeaderKey(name)
+		if allowed[key] || r.extraHeaders[key] {
+			continue
+		}
+		r.debugf("Dropped response header %s", name)
+		delete(h, name)
+		dropped++
+	}
+	if dropped > 0 {
+		updateStats(func(s *stats) {
+			s.DroppedHeaders += int64(dropped)
+		})
+	}
+}
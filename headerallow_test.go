@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Response header allowlist", func() {
+	var id, rid uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		rid = createResponse(testHandler)
+		Expect(rid).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		freeResponse(rid)
+		resetSettings()
+	})
+
+	respHeaders := "X-Custom: yes\nSet-Cookie: session=1\nCache-Control: no-cache\n" +
+		makeResponseHeaders("text/plain", 5)
+
+	// Run a response and return the headers that were sent, or nil if
+	// they were not changed.
+	run := func(path string) http.Header {
+		err := beginRequest(id, makeRequestHeaders("GET", path, "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		err = beginResponse(rid, id, 200, respHeaders)
+		Expect(err).Should(Succeed())
+		cmd := pollResponse(rid, true)
+		if cmd == "DONE" {
+			return nil
+		}
+		Expect(cmd).Should(HavePrefix("WHDR"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		return hdrs
+	}
+
+	It("Off", func() {
+		Expect(run("/pass")).Should(BeNil())
+	})
+
+	It("Default list", func() {
+		setResponseHeaderAllowlist(true, "")
+		before := getStats().DroppedHeaders
+		hdrs := run("/pass")
+		Expect(hdrs).Should(Equal(http.Header{
+			"Content-Type":   []string{"text/plain"},
+			"Content-Length": []string{"5"},
+			"Cache-Control":  []string{"no-cache"},
+		}))
+		Expect(getStats().DroppedHeaders).Should(Equal(before + 3))
+	})
+
+	It("Allowed by handler", func() {
+		setResponseHeaderAllowlist(true, "")
+		hdrs := run("/allowheader")
+		Expect(hdrs.Get("X-Custom")).Should(Equal("yes"))
+		Expect(hdrs.Get("Server")).Should(BeEmpty())
+		Expect(hdrs.Get("Set-Cookie")).Should(BeEmpty())
+	})
+
+	It("Custom list", func() {
+		setResponseHeaderAllowlist(true, "content-type,\nSet-Cookie")
+		hdrs := run("/pass")
+		Expect(hdrs).Should(Equal(http.Header{
+			"Content-Type": []string{"text/plain"},
+			"Set-Cookie":   []string{"session=1"},
+		}))
+	})
+
+	It("Headers that weaver adds", func() {
+		setResponseHeaderAllowlist(true, "")
+		Expect(setCORS(testCORSConfig)).Should(Succeed())
+		Expect(enableServerTiming(id)).Should(Succeed())
+		hdrs := makeRequestHeaders("GET", "/pass", "", 0)
+		hdrs = addRequestHeader(hdrs, "Origin", "https://app.example.com")
+		Expect(beginRequest(id, hdrs)).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		err := beginResponse(rid, id, 200, "Server-Timing: db;dur=5\n"+
+			"WWW-Authenticate: Basic\n"+respHeaders)
+		Expect(err).Should(Succeed())
+		cmd := pollResponse(rid, true)
+		Expect(cmd).Should(HavePrefix("WHDR"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+		sent := http.Header{}
+		parseHeaders(sent, cmd[4:])
+		Expect(sent.Get("Access-Control-Allow-Origin")).Should(Equal("https://app.example.com"))
+		Expect(sent.Get("Access-Control-Expose-Headers")).ShouldNot(BeEmpty())
+		Expect(sent["WWW-Authenticate"]).Should(Equal([]string{"Basic"}))
+		Expect(sent.Get("Server-Timing")).Should(HavePrefix("upstream;"))
+		Expect(sent.Get("Server-Timing")).ShouldNot(ContainSubstring("db"))
+		Expect(sent.Get("X-Custom")).Should(BeEmpty())
+	})
+
+	It("Generated response", func() {
+		setResponseHeaderAllowlist(true, "")
+		err := beginRequest(id, makeRequestHeaders("GET", "/responseerror2", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		err = beginResponse(rid, id, 200, respHeaders)
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("SWCH504"))
+		cmd := pollResponse(rid, true)
+		Expect(cmd).Should(HavePrefix("WHDR"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("X-Apigee-Response")).Should(BeEmpty())
+		Expect(hdrs.Get("Content-Type")).Should(Equal("text/plain"))
+	})
+})
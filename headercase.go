@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+/*
+ * Some targets insist on exact header names, like "SOAPAction," even though
+ * HTTP header names are not case sensitive. http.Header canonicalizes names,
+ * but WHDR uses whatever key is in the map, so the way to send a name with
+ * different casing is to move its values to a key with that exact casing.
+ * Headers that aren't mentioned keep their canonical names. Handlers find
+ * SetHeaderCase and SetHeaderCases, which work on a single request, using a
+ * type assertion on the http.ResponseWriter.
+ */
+
+var errNoHeaderCase = errors.New("Only a request handler can set the case of header names")
+
+/*
+ * Send the named header to the target with exactly this casing. This applies
+ * to every request.
+ */
+func addHeaderCase(exactCase string) {
+	updateSettings(func(s *settings) {
+		cases := make(map[string]string)
+		for k, v := range s.headerCases {
+			cases[k] = v
+		}
+		cases[http.CanonicalHeaderKey(exactCase)] = exactCase
+		s.headerCases = cases
+	})
+}
+
+func clearHeaderCases() {
+	updateSettings(func(s *settings) {
+		s.headerCases = nil
+	})
+}
+
+/*
+ * SetHeaderCase sends the named header to the target with exactly this
+ * casing, for this request only. It is applied once the handler returns, so
+ * the handler may keep using Get and Set until then. It must be called
+ * before the handler returns.
+ */
+func (h *httpResponse) SetHeaderCase(exactCase string) error {
+	return h.setHeaderCases("SetHeaderCase", exactCase)
+}
+
+/*
+ * SetHeaderCases is like SetHeaderCase, for several headers at once.
+ */
+func (h *httpResponse) SetHeaderCases(exactCases ...string) error {
+	return h.setHeaderCases("SetHeaderCases", exactCases...)
+}
+
+func (h *httpResponse) setHeaderCases(what string, exactCases ...string) error {
+	r, ok := h.handler.(*request)
+	if !ok {
+		return errNoHeaderCase
+	}
+	if !r.phase.whileOpen(func() {
+		r.headerCases = append(r.headerCases, exactCases...)
+	}) {
+		return tooLate(r, what)
+	}
+	return nil
+}
+
+/*
+ * Change the name of a header in "h" to "exactCase," which must be the same
+ * name apart from case. After this, the header must be read and changed
+ * using its exact name rather than using Get and Set.
+ */
+func setHeaderCase(h http.Header, exactCase string) {
+	canonical := http.CanonicalHeaderKey(exactCase)
+	if canonical == exactCase {
+		return
+	}
+	if values, found := h[canonical]; found {
+		h[exactCase] = append(h[exactCase], values...)
+		delete(h, canonical)
+	}
+}
+
+func (r *request) applyHeaderCases() {
+	for _, exactCase := range r.settings.headerCases {
+		setHeaderCase(r.req.Header, exactCase)
+	}
+	for _, exactCase := range r.headerCases {
+		setHeaderCase(r.req.Header, exactCase)
+	}
+}
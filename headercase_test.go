@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Header Case", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		resetSettings()
+	})
+
+	// Return the exact header lines from a WHDR command
+	headerLines := func(cmd string) []string {
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		return strings.Split(strings.TrimSpace(cmd[4:]), "\n")
+	}
+
+	It("Move values", func() {
+		h := http.Header{}
+		h.Add("Soapaction", "one")
+		h["SOAPAction"] = []string{"two"}
+		setHeaderCase(h, "SOAPAction")
+		Expect(h).Should(Equal(http.Header{"SOAPAction": {"two", "one"}}))
+
+		// Canonical names are left alone
+		setHeaderCase(h, "Content-Type")
+		Expect(h).Should(HaveLen(1))
+	})
+
+	It("Global", func() {
+		addHeaderCase("SOAPAction")
+		hdrs := addRequestHeader(makeRequestHeaders("POST", "/pass", "text/xml", 0),
+			"soapaction", "urn:GetQuote")
+		err := beginRequest(id, hdrs)
+		Expect(err).Should(Succeed())
+
+		lines := headerLines(pollRequest(id, true))
+		Expect(lines).Should(ContainElement("SOAPAction: urn:GetQuote"))
+		Expect(lines).Should(ContainElement("Content-Type: text/xml"))
+		Expect(lines).ShouldNot(ContainElement(HavePrefix("Soapaction")))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Not present", func() {
+		addHeaderCase("SOAPAction")
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Clear", func() {
+		addHeaderCase("SOAPAction")
+		clearHeaderCases()
+		hdrs := addRequestHeader(makeRequestHeaders("POST", "/pass", "text/xml", 0),
+			"SOAPAction", "urn:GetQuote")
+		err := beginRequest(id, hdrs)
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Handler", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/soapaction", "", 0))
+		Expect(err).Should(Succeed())
+		lines := headerLines(pollRequest(id, true))
+		Expect(lines).Should(ContainElement("X-API-KEY: secret"))
+		Expect(lines).Should(ContainElement("SOAPAction: urn:GetQuote"))
+		Expect(lines).ShouldNot(ContainElement(HavePrefix("X-Api-Key")))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		// Only that request is affected.
+		id2 := createRequest(testHandler)
+		defer freeRequest(id2)
+		hdrs := addRequestHeader(makeRequestHeaders("GET", "/pass", "", 0),
+			"SOAPAction", "urn:GetQuote")
+		Expect(beginRequest(id2, hdrs)).Should(Succeed())
+		Expect(pollRequest(id2, true)).Should(Equal("DONE"))
+	})
+
+	It("Response handler", func() {
+		h := &httpResponse{handler: &response{}}
+		Expect(h.SetHeaderCase("SOAPAction")).Should(Equal(errNoHeaderCase))
+	})
+})
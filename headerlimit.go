@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+/*
+ * A single enormous header line takes a lot of memory to parse, so the caller
+ * may set a limit on the length of each one. If a header line is longer than
+ * that, we only parse the request line, and reject the request with a 431.
+ * The limit doesn't apply to the request line.
+ */
+
+const headerLineTooLongMessage = "Request header line too long"
+
+func setMaxHeaderLineSize(max int) {
+	updateSettings(func(s *settings) {
+		s.maxHeaderLine = max
+	})
+}
+
+/*
+ * Return the raw headers that should be parsed, and false if a header line
+ * was too long, in which case that is only the request line.
+ */
+func (r *request) checkHeaderLines(rawHeaders string) (string, bool) {
+	max := r.settings.maxHeaderLine
+	if max <= 0 {
+		return rawHeaders, true
+	}
+	end := strings.Index(rawHeaders, "\r\n")
+	if end < 0 {
+		return rawHeaders, true
+	}
+	requestLine := rawHeaders[:end+2]
+	for rest := rawHeaders[end+2:]; rest != ""; {
+		n := strings.Index(rest, "\r\n")
+		if n < 0 {
+			n = len(rest)
+		}
+		if n > max {
+			return requestLine, false
+		}
+		rest = strings.TrimPrefix(rest[n:], "\r\n")
+	}
+	return rawHeaders, true
+}
+
+func (r *request) rejectHeaderLine() {
+	r.reject(http.StatusRequestHeaderFieldsTooLarge, headerLineTooLongMessage)
+}
+
+/*
+ * Very long request targets are also rejected, with a 414, since they can
+ * break the targets and anything that logs them. Only the method and the
+ * rest of the headers are parsed, so that the rejection can still be
+ * rendered the way the client asked for.
+ */
+
+const (
+	defaultMaxURILength = 8192
+	uriTooLongMessage   = "Request URI too long"
+)
+
+func setMaxURILength(max int) {
+	updateSettings(func(s *settings) {
+		s.maxURILength = max
+	})
+}
+
+/*
+ * Return the raw headers that should be parsed, and false if the request
+ * target was too long, in which case it is replaced with "/".
+ */
+func (r *request) checkRequestTarget(rawHeaders string) (string, bool) {
+	max := r.settings.maxURILength
+	if max <= 0 {
+		return rawHeaders, true
+	}
+	end := strings.Index(rawHeaders, "\r\n")
+	if end < 0 {
+		end = len(rawHeaders)
+	}
+	parts := strings.SplitN(rawHeaders[:end], " ", 3)
+	if len(parts) != 3 || len(parts[1]) <= max {
+		return rawHeaders, true
+	}
+	return parts[0] + " / " + parts[2] + rawHeaders[end:], false
+}
+
+func (r *request) rejectURITooLong() {
+	r.reject(http.StatusRequestURITooLong, uriTooLongMessage)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Header line limit", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		resetSettings()
+	})
+
+	hugeHeaders := func() string {
+		hdrs := makeRequestHeaders("GET", "/pass", "", 0)
+		hdrs = addRequestHeader(hdrs, "X-Small", "ok")
+		return addRequestHeader(hdrs, "X-Huge", strings.Repeat("x", 4<<20))
+	}
+
+	It("Too long", func() {
+		setMaxHeaderLineSize(8192)
+		err := beginRequest(id, hugeHeaders())
+		Expect(err).Should(Succeed())
+
+		Expect(pollRequest(id, true)).Should(Equal("SWCH431"))
+		Expect(pollRequest(id, true)).Should(MatchRegexp("^WHDR.*"))
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+		Expect(string(readBodyData(cmd))).Should(Equal(headerLineTooLongMessage))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Last line too long", func() {
+		setMaxHeaderLineSize(8192)
+		hdrs := strings.TrimSuffix(hugeHeaders(), "\r\n\r\n")
+		err := beginRequest(id, hdrs)
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("SWCH431"))
+	})
+
+	It("Under the limit", func() {
+		setMaxHeaderLineSize(8192)
+		hdrs := makeRequestHeaders("GET", "/pass", "", 0)
+		hdrs = addRequestHeader(hdrs, "X-Big", strings.Repeat("x", 8000))
+		err := beginRequest(id, hdrs)
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Long request line", func() {
+		setMaxHeaderLineSize(64)
+		uri := "/pass?q=" + strings.Repeat("x", 100)
+		err := beginRequest(id, makeRequestHeaders("GET", uri, "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("No limit", func() {
+		err := beginRequest(id, hugeHeaders())
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+})
+
+var _ = Describe("URI length limit", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		resetSettings()
+	})
+
+	It("Too long", func() {
+		uri := "/pass?q=" + strings.Repeat("x", 9000)
+		err := beginRequest(id, makeRequestHeaders("GET", uri, "", 0))
+		Expect(err).Should(Succeed())
+
+		Expect(pollRequest(id, true)).Should(Equal("SWCH414"))
+		Expect(pollRequest(id, true)).Should(MatchRegexp("^WHDR.*"))
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+		Expect(string(readBodyData(cmd))).Should(Equal(uriTooLongMessage))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Under the limit", func() {
+		uri := "/pass?q=" + strings.Repeat("x", 8000)
+		err := beginRequest(id, makeRequestHeaders("GET", uri, "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Lower limit", func() {
+		setMaxURILength(64)
+		uri := "/pass?q=" + strings.Repeat("x", 100)
+		err := beginRequest(id, makeRequestHeaders("GET", uri, "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("SWCH414"))
+	})
+
+	It("No limit", func() {
+		setMaxURILength(0)
+		uri := "/pass?q=" + strings.Repeat("x", 20000)
+		err := beginRequest(id, makeRequestHeaders("GET", uri, "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+})
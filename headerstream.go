@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+/*
+ * Some callers get the headers a piece at a time, and would rather hand
+ * them over that way than assemble one big string. They append fragments,
+ * which may split lines anywhere, even between CR and LF, and then begin
+ * the request with no headers, which parses the block that was built up.
+ *
+ * The header line limit is checked as the lines come in, so an enormous
+ * line is refused before all of it has been buffered. So is the block as a
+ * whole, since no one else would bound it. Once either is too long, only
+ * the request line is kept, and the request is rejected with a 431 when it
+ * begins.
+ */
+
+const (
+	maxStreamedHeaderSize  = 1 << 20
+	headersTooLargeMessage = "Request headers too large"
+)
+
+var errHeadersStarted = errors.New("The request has already begun")
+
+type headerStream struct {
+	buf []byte
+	// Where the line that isn't finished yet starts, or -1 while that is
+	// still the request line
+	lineStart int
+	overflow  string
+}
+
+/*
+ * Add a fragment to the headers of a request that hasn't begun. It returns
+ * false once the headers are too large, after which fragments are ignored.
+ */
+func appendRequestHeaders(id uint32, fragment string) (bool, error) {
+	req := getRequest(id)
+	if req == nil {
+		return false, fmt.Errorf("Unknown request: %d", id)
+	}
+	if req.getState() != stateNew {
+		return false, errHeadersStarted
+	}
+	if req.headerStream == nil {
+		req.headerStream = &headerStream{lineStart: -1}
+	}
+	return req.headerStream.append(fragment, getSettings().maxHeaderLine), nil
+}
+
+func (s *headerStream) append(fragment string, maxLine int) bool {
+	if s.overflow != "" {
+		return false
+	}
+	// Look again at the last byte, in case it was the CR of a CRLF
+	scan := len(s.buf) - 1
+	if scan < 0 {
+		scan = 0
+	}
+	s.buf = append(s.buf, fragment...)
+	for {
+		n := bytes.Index(s.buf[scan:], []byte("\r\n"))
+		if n < 0 {
+			break
+		}
+		end := scan + n
+		if s.lineStart >= 0 && !s.lineFits(end, maxLine) {
+			return false
+		}
+		scan = end + 2
+		s.lineStart = scan
+	}
+	// The line that isn't finished can't get any shorter. A trailing CR
+	// may be the start of its CRLF.
+	end := len(s.buf)
+	if end > 0 && s.buf[end-1] == '\r' {
+		end--
+	}
+	if s.lineStart >= 0 && !s.lineFits(end, maxLine) {
+		return false
+	}
+	if len(s.buf) > maxStreamedHeaderSize {
+		s.setOverflow(headersTooLargeMessage)
+		return false
+	}
+	return true
+}
+
+func (s *headerStream) lineFits(end, maxLine int) bool {
+	if maxLine > 0 && end-s.lineStart > maxLine {
+		s.setOverflow(headerLineTooLongMessage)
+		return false
+	}
+	return true
+}
+
+/*
+ * Throw away everything but the request line, if there is one, so that the
+ * rejection can still be logged against the right target.
+ */
+func (s *headerStream) setOverflow(msg string) {
+	s.overflow = msg
+	if n := bytes.Index(s.buf, []byte("\r\n")); n >= 0 {
+		s.buf = s.buf[:n+2]
+	} else if len(s.buf) > maxStreamedHeaderSize {
+		s.buf = s.buf[:maxStreamedHeaderSize]
+	}
+}
+
+/*
+ * Begin a request using the headers that were appended to it.
+ */
+func beginStreamedRequest(id uint32) error {
+	req := getRequest(id)
+	if req == nil {
+		return fmt.Errorf("Unknown request: %d", id)
+	}
+	var rawHeaders string
+	if req.headerStream != nil {
+		rawHeaders = string(req.headerStream.buf)
+		req.headerStream.buf = nil
+	}
+	return beginRequest(id, rawHeaders)
+}
+
+func (r *request) rejectHeaderStream() {
+	r.reject(http.StatusRequestHeaderFieldsTooLarge, r.headerStream.overflow)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Streamed headers", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		resetSettings()
+	})
+
+	testHeaders := func() string {
+		hdrs := makeRequestHeaders("GET", "/pass?a=1", "", 0)
+		hdrs = addRequestHeader(hdrs, "X-Forwarded-For", "10.1.2.3")
+		return addRequestHeader(hdrs, "Accept", "text/plain")
+	}
+
+	// Append the headers in pieces, cut after each of the given offsets.
+	appendAt := func(id uint32, hdrs string, cuts ...int) bool {
+		last := 0
+		for _, cut := range append(cuts, len(hdrs)) {
+			ok, err := appendRequestHeaders(id, hdrs[last:cut])
+			Expect(err).Should(Succeed())
+			if !ok {
+				return false
+			}
+			last = cut
+		}
+		return true
+	}
+
+	It("Same as one string", func() {
+		hdrs := testHeaders()
+		whole := createRequest(testHandler)
+		defer freeRequest(whole)
+		Expect(beginRequest(whole, hdrs)).Should(Succeed())
+		Expect(pollRequest(whole, true)).Should(Equal("DONE"))
+
+		crlf := strings.Index(hdrs, "\r\n")
+		name := strings.Index(hdrs, "X-Forwarded-For")
+		Expect(appendAt(id, hdrs, 3, crlf+1, name+4, name+5)).Should(BeTrue())
+		Expect(beginStreamedRequest(id)).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		streamed := getRequest(id)
+		Expect(streamed.origHeaders).Should(Equal(getRequest(whole).origHeaders))
+		Expect(streamed.origURL).Should(Equal(getRequest(whole).origURL))
+		Expect(streamed.origHeaders.Get("X-Forwarded-For")).Should(Equal("10.1.2.3"))
+	})
+
+	It("One byte at a time", func() {
+		hdrs := testHeaders()
+		cuts := make([]int, len(hdrs)-1)
+		for i := range cuts {
+			cuts[i] = i + 1
+		}
+		Expect(appendAt(id, hdrs, cuts...)).Should(BeTrue())
+		Expect(beginStreamedRequest(id)).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(getRequest(id).origHeaders.Get("Accept")).Should(Equal("text/plain"))
+	})
+
+	It("Line too long", func() {
+		setMaxHeaderLineSize(64)
+		hdrs := makeRequestHeaders("GET", "/pass", "", 0)
+		hdrs = addRequestHeader(hdrs, "X-Huge", strings.Repeat("x", 100))
+		huge := strings.Index(hdrs, "X-Huge")
+		// Refused before the end of the line has arrived
+		Expect(appendAt(id, hdrs[:huge+70])).Should(BeFalse())
+		ok, err := appendRequestHeaders(id, hdrs[huge+70:])
+		Expect(err).Should(Succeed())
+		Expect(ok).Should(BeFalse())
+
+		Expect(beginStreamedRequest(id)).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("SWCH431"))
+		Expect(pollRequest(id, true)).Should(HavePrefix("WHDR"))
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("WBOD"))
+		Expect(string(readBodyData(cmd))).Should(Equal(headerLineTooLongMessage))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Line at the limit split before its LF", func() {
+		setMaxHeaderLineSize(64)
+		hdrs := makeRequestHeaders("GET", "/pass", "", 0)
+		hdrs = addRequestHeader(hdrs, "X-Big", strings.Repeat("x", 64-len("X-Big: ")))
+		end := strings.Index(hdrs, "X-Big") + 64
+		Expect(appendAt(id, hdrs, end+1)).Should(BeTrue())
+		Expect(beginStreamedRequest(id)).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Long request line", func() {
+		setMaxHeaderLineSize(64)
+		hdrs := makeRequestHeaders("GET", "/pass?q="+strings.Repeat("x", 100), "", 0)
+		Expect(appendAt(id, hdrs, 50)).Should(BeTrue())
+		Expect(beginStreamedRequest(id)).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Block too large", func() {
+		hdrs := makeRequestHeaders("GET", "/pass", "", 0)
+		line := "X-Filler: " + strings.Repeat("x", 1000) + "\r\n"
+		Expect(appendAt(id, strings.TrimSuffix(hdrs, "\r\n"))).Should(BeTrue())
+		accepted := 0
+		for {
+			ok, err := appendRequestHeaders(id, line)
+			Expect(err).Should(Succeed())
+			if !ok {
+				break
+			}
+			accepted++
+		}
+		Expect(accepted).Should(BeNumerically("<", maxStreamedHeaderSize/len(line)+1))
+
+		Expect(beginStreamedRequest(id)).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("SWCH431"))
+		Expect(pollRequest(id, true)).Should(HavePrefix("WHDR"))
+		cmd := pollRequest(id, true)
+		Expect(string(readBodyData(cmd))).Should(Equal(headersTooLargeMessage))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Already begun", func() {
+		Expect(beginRequest(id, testHeaders())).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		_, err := appendRequestHeaders(id, "X-Late: 1\r\n")
+		Expect(err).Should(Equal(errHeadersStarted))
+	})
+
+	It("Unknown request", func() {
+		_, err := appendRequestHeaders(0, "GET / HTTP/1.1\r\n")
+		Expect(err).ShouldNot(Succeed())
+		Expect(beginStreamedRequest(0)).ShouldNot(Succeed())
+	})
+})
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Answer a health check path, such as "/healthz," from weaver itself with a
+ * JSON report of how weaver and the targets behind it are doing. Weaver
+ * doesn't call the targets itself, so a target counts as failing when it
+ * returns a server error. Those are counted for each of the hosts that the
+ * check lists over a sliding window. The report has a 200 status if everything is within the limits in
+ * HealthOptions, and a 503 otherwise, so that a load balancer takes weaver
+ * out of service. Go handlers can use HealthHandler, and the C API turns
+ * the same thing on for every request using GoSetHealthCheck.
+ */
+
+const (
+	defaultHealthWindow = time.Minute
+	healthBuckets       = 10
+)
+
+// HealthOptions decides when the health check reports a problem
+type HealthOptions struct {
+	// Window is how far back target responses are counted. It defaults to
+	// one minute.
+	Window time.Duration
+	// MaxErrorRate is the fraction, between 0 and 1, of the responses from
+	// any one host that may be server errors. Zero means no limit.
+	MaxErrorRate float64
+	// MinResponses is how many responses a host must have sent within the
+	// window before its error rate counts, so that one error doesn't fail
+	// the check
+	MinResponses int
+	// MaxActive is the most requests that may be active at once. Zero means
+	// no limit.
+	MaxActive int
+	// Upstreams lists the targets, as "host:port," whose responses are
+	// counted. Responses from any other host are ignored.
+	Upstreams []string
+}
+
+type healthCheck struct {
+	path string
+	opts HealthOptions
+}
+
+type healthReport struct {
+	Status               string                    `json:"status"`
+	ActiveRequests       int                       `json:"activeRequests"`
+	Goroutines           int                       `json:"goroutines"`
+	HeapBytes            uint64                    `json:"heapBytes"`
+	ConfigVersion        uint64                    `json:"configVersion"`
+	TransportGenerations int                       `json:"transportGenerations"`
+	Upstreams            map[string]upstreamHealth `json:"upstreams"`
+	Problems             []string                  `json:"problems,omitempty"`
+}
+
+type upstreamHealth struct {
+	Responses int     `json:"responses"`
+	Errors    int     `json:"errors"`
+	ErrorRate float64 `json:"errorRate"`
+	Healthy   bool    `json:"healthy"`
+}
+
+// The responses from one host in one part of the window
+type outcomeBucket struct {
+	start     time.Time
+	responses int
+	errors    int
+}
+
+// The responses from one of the configured hosts
+type hostOutcomes struct {
+	lock    sync.Mutex
+	buckets []outcomeBucket
+}
+
+/*
+ * Only the hosts that a health check lists are counted, so that clients
+ * can't fill the map, or fail the check, by sending requests for hosts
+ * that they made up. The map only changes with the configuration, so it is
+ * replaced rather than changed, and counting a response only locks the
+ * host that sent it. When no check lists any hosts, it is empty and
+ * nothing is counted at all.
+ */
+var trackedUpstreams atomic.Value // map[string]*hostOutcomes
+
+// Protected by trackedUpstreamsLock
+var checkUpstreams []string
+var handlerUpstreams []string
+var trackedUpstreamsLock = sync.Mutex{}
+
+// Outcomes are kept for the longest window that any health check uses.
+// Accessed atomically.
+var outcomeRetention = int64(defaultHealthWindow)
+
+// Replaced in tests
+var healthClock = time.Now
+
+/*
+ * HealthHandler returns a request handler that answers requests for "path"
+ * with the health report. Requests for any other path are left alone.
+ */
+func HealthHandler(path string, opts HealthOptions) func(http.ResponseWriter, *http.Request) {
+	check := &healthCheck{path: path, opts: opts}
+	hosts, err := normalizeUpstreams(opts.Upstreams)
+	if err != nil {
+		log.Printf("WARNING: Health check for %s counts no hosts: %s", path, err)
+	}
+	retainOutcomes(healthWindow(opts))
+	trackedUpstreamsLock.Lock()
+	handlerUpstreams = append(handlerUpstreams, hosts...)
+	trackUpstreams()
+	trackedUpstreamsLock.Unlock()
+	return func(w http.ResponseWriter, req *http.Request) {
+		if check.matches(req) {
+			check.serve(w)
+		}
+	}
+}
+
+func setHealthCheck(path string, opts HealthOptions) error {
+	path = strings.TrimSpace(path)
+	if path != "" && !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("Invalid health check path \"%s\"", path)
+	}
+	if opts.MaxErrorRate < 0 || opts.MaxErrorRate > 1 || opts.MinResponses < 0 ||
+		opts.MaxActive < 0 || opts.Window < 0 {
+		return fmt.Errorf("Invalid health check limits for %s", path)
+	}
+	hosts, err := normalizeUpstreams(opts.Upstreams)
+	if err != nil {
+		return err
+	}
+	opts.Upstreams = hosts
+	retainOutcomes(healthWindow(opts))
+	trackedUpstreamsLock.Lock()
+	if path == "" {
+		checkUpstreams = nil
+	} else {
+		checkUpstreams = hosts
+	}
+	trackUpstreams()
+	trackedUpstreamsLock.Unlock()
+	updateSettings(func(s *settings) {
+		if path == "" {
+			s.healthCheck = nil
+		} else {
+			s.healthCheck = &healthCheck{path: path, opts: opts}
+		}
+	})
+	return nil
+}
+
+/*
+ * Split a comma-separated list of "host:port" targets.
+ */
+func parseUpstreamList(list string) ([]string, error) {
+	return normalizeUpstreams(strings.Split(list, ","))
+}
+
+/*
+ * Check that each target is a "host:port," and make the host lower case to
+ * match the requests. Empty ones are dropped.
+ */
+func normalizeUpstreams(hosts []string) ([]string, error) {
+	var result []string
+	for _, h := range hosts {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(h); err != nil || port == "" {
+			return nil, fmt.Errorf("Invalid upstream \"%s\": it must be host:port", h)
+		}
+		result = append(result, strings.ToLower(h))
+	}
+	return result, nil
+}
+
+/*
+ * Replace the map of counted hosts, keeping the counts of the hosts that
+ * are still in it. trackedUpstreamsLock must be held.
+ */
+func trackUpstreams() {
+	old, _ := trackedUpstreams.Load().(map[string]*hostOutcomes)
+	tracked := make(map[string]*hostOutcomes)
+	for _, hosts := range [][]string{checkUpstreams, handlerUpstreams} {
+		for _, host := range hosts {
+			if h := old[host]; h != nil {
+				tracked[host] = h
+			} else {
+				tracked[host] = &hostOutcomes{}
+			}
+		}
+	}
+	trackedUpstreams.Store(tracked)
+}
+
+/*
+ * Answer the health check before the handler runs, if it is turned on for
+ * every request.
+ */
+func (r *request) serveHealth() bool {
+	check := r.settings.healthCheck
+	if check == nil || !check.matches(r.req) {
+		return false
+	}
+	check.serve(r.resp)
+	return true
+}
+
+func (c *healthCheck) matches(req *http.Request) bool {
+	return req.URL.Path == c.path && (req.Method == "GET" || req.Method == "HEAD")
+}
+
+func (c *healthCheck) serve(w http.ResponseWriter) {
+	report := buildHealthReport(c.opts)
+	body, err := json.Marshal(report)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status == "ok" {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(body)
+}
+
+func buildHealthReport(opts HealthOptions) *healthReport {
+	managerLatch.Lock()
+	active := len(requests)
+	managerLatch.Unlock()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	report := &healthReport{
+		Status:               "ok",
+		ActiveRequests:       active,
+		Goroutines:           runtime.NumGoroutine(),
+		HeapBytes:            mem.HeapAlloc,
+		ConfigVersion:        getConfigVersion(),
+		TransportGenerations: transportGenerations(),
+		Upstreams:            make(map[string]upstreamHealth),
+	}
+	if opts.MaxActive > 0 && active > opts.MaxActive {
+		report.Problems = append(report.Problems,
+			fmt.Sprintf("%d active requests is over the limit of %d", active, opts.MaxActive))
+	}
+	for host, h := range upstreamHealthSince(healthWindow(opts)) {
+		h.Healthy = opts.MaxErrorRate == 0 || h.Responses < opts.MinResponses ||
+			h.ErrorRate <= opts.MaxErrorRate
+		if !h.Healthy {
+			report.Problems = append(report.Problems,
+				fmt.Sprintf("%s has an error rate of %.2f", host, h.ErrorRate))
+		}
+		report.Upstreams[host] = h
+	}
+	if len(report.Problems) > 0 {
+		report.Status = "degraded"
+	}
+	return report
+}
+
+func healthWindow(opts HealthOptions) time.Duration {
+	if opts.Window <= 0 {
+		return defaultHealthWindow
+	}
+	return opts.Window
+}
+
+func retainOutcomes(window time.Duration) {
+	for {
+		old := atomic.LoadInt64(&outcomeRetention)
+		if int64(window) <= old ||
+			atomic.CompareAndSwapInt64(&outcomeRetention, old, int64(window)) {
+			return
+		}
+	}
+}
+
+/*
+ * Count a response from a target, if it is one that a health check lists.
+ * Buckets are a tenth of the longest window, so the counts are never off by
+ * more than that.
+ */
+func recordUpstreamOutcome(host string, status int) {
+	tracked, _ := trackedUpstreams.Load().(map[string]*hostOutcomes)
+	h := tracked[host]
+	if h == nil {
+		return
+	}
+	now := healthClock()
+	retention := time.Duration(atomic.LoadInt64(&outcomeRetention))
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	buckets := trimOutcomes(h.buckets, now.Add(-retention))
+	if len(buckets) == 0 || now.Sub(buckets[len(buckets)-1].start) >= retention/healthBuckets {
+		buckets = append(buckets, outcomeBucket{start: now})
+	}
+	b := &buckets[len(buckets)-1]
+	b.responses++
+	if status >= 500 {
+		b.errors++
+	}
+	h.buckets = buckets
+}
+
+/*
+ * Return the host and port that the request went to, in the form that
+ * health checks list them.
+ */
+func upstreamHost(req *http.Request) string {
+	if req == nil {
+		return ""
+	}
+	host := req.URL.Host
+	if host == "" {
+		host = req.Host
+	}
+	if host == "" {
+		return ""
+	}
+	host = strings.ToLower(host)
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	if req.URL.Scheme == "https" {
+		return net.JoinHostPort(host, "443")
+	}
+	return net.JoinHostPort(host, "80")
+}
+
+func upstreamHealthSince(window time.Duration) map[string]upstreamHealth {
+	since := healthClock().Add(-window)
+	tracked, _ := trackedUpstreams.Load().(map[string]*hostOutcomes)
+	result := make(map[string]upstreamHealth)
+	for host, outcomes := range tracked {
+		var h upstreamHealth
+		outcomes.lock.Lock()
+		for _, b := range trimOutcomes(outcomes.buckets, since) {
+			h.Responses += b.responses
+			h.Errors += b.errors
+		}
+		outcomes.lock.Unlock()
+		if h.Responses == 0 {
+			continue
+		}
+		h.ErrorRate = float64(h.Errors) / float64(h.Responses)
+		result[host] = h
+	}
+	return result
+}
+
+func trimOutcomes(buckets []outcomeBucket, since time.Time) []outcomeBucket {
+	for len(buckets) > 0 && buckets[0].start.Before(since) {
+		buckets = buckets[1:]
+	}
+	return buckets
+}
+
+func resetUpstreamOutcomes() {
+	trackedUpstreamsLock.Lock()
+	defer trackedUpstreamsLock.Unlock()
+	checkUpstreams = nil
+	handlerUpstreams = nil
+	trackedUpstreams.Store(make(map[string]*hostOutcomes))
+	atomic.StoreInt64(&outcomeRetention, int64(defaultHealthWindow))
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Health check", func() {
+	var now time.Time
+
+	BeforeEach(func() {
+		resetUpstreamOutcomes()
+		now = time.Now()
+		healthClock = func() time.Time {
+			return now
+		}
+	})
+
+	AfterEach(func() {
+		healthClock = time.Now
+		resetUpstreamOutcomes()
+		resetSettings()
+	})
+
+	// Ask for the health report and return its status and contents.
+	checkHealth := func(path string) (string, *healthReport) {
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		Expect(beginRequest(id, makeRequestHeaders("GET", path, "", 0))).Should(Succeed())
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("SWCH"))
+		status := cmd[4:]
+		cmd = pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("WHDR"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("Content-Type")).Should(Equal("application/json"))
+		cmd = pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("WBOD"))
+		var report healthReport
+		Expect(json.Unmarshal(readBodyData(cmd), &report)).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		return status, &report
+	}
+
+	It("Healthy", func() {
+		Expect(setHealthCheck("/healthz", HealthOptions{
+			MaxErrorRate: 0.5,
+			Upstreams:    []string{"LocalHost:1234"},
+		})).Should(Succeed())
+
+		id := createRequest(testHandler)
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		rid := createResponse(testHandler)
+		Expect(beginResponse(rid, id, 200, makeResponseHeaders("", 0))).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+		freeResponse(rid)
+		freeRequest(id)
+
+		status, report := checkHealth("/healthz")
+		Expect(status).Should(Equal("200"))
+		Expect(report.Status).Should(Equal("ok"))
+		Expect(report.ActiveRequests).Should(BeNumerically(">=", 1))
+		Expect(report.Goroutines).Should(BeNumerically(">", 0))
+		Expect(report.ConfigVersion).Should(Equal(getConfigVersion()))
+		Expect(report.Upstreams["localhost:1234"]).Should(Equal(upstreamHealth{
+			Responses: 1,
+			Healthy:   true,
+		}))
+	})
+
+	It("Degraded", func() {
+		Expect(setHealthCheck("/healthz", HealthOptions{
+			Window:       10 * time.Second,
+			MaxErrorRate: 0.25,
+			MinResponses: 4,
+			Upstreams:    []string{"billing:8080", "orders:8080"},
+		})).Should(Succeed())
+
+		// Too few responses to count
+		recordUpstreamOutcome("billing:8080", 503)
+		status, _ := checkHealth("/healthz")
+		Expect(status).Should(Equal("200"))
+
+		for i := 0; i < 3; i++ {
+			recordUpstreamOutcome("billing:8080", 200)
+			recordUpstreamOutcome("orders:8080", 200)
+		}
+		recordUpstreamOutcome("billing:8080", 500)
+		status, report := checkHealth("/healthz")
+		Expect(status).Should(Equal("503"))
+		Expect(report.Status).Should(Equal("degraded"))
+		Expect(report.Upstreams["billing:8080"].Errors).Should(Equal(2))
+		Expect(report.Upstreams["billing:8080"].Healthy).Should(BeFalse())
+		Expect(report.Upstreams["orders:8080"].Healthy).Should(BeTrue())
+		Expect(report.Problems).Should(HaveLen(1))
+
+		// The errors fall out of the window.
+		now = now.Add(11 * time.Second)
+		recordUpstreamOutcome("billing:8080", 200)
+		status, report = checkHealth("/healthz")
+		Expect(status).Should(Equal("200"))
+		Expect(report.Upstreams["billing:8080"].Responses).Should(Equal(1))
+	})
+
+	It("Hosts that aren't listed", func() {
+		Expect(setHealthCheck("/healthz", HealthOptions{
+			MaxErrorRate: 0.25,
+			Upstreams:    []string{"billing:8080"},
+		})).Should(Succeed())
+		for i := 0; i < 10; i++ {
+			recordUpstreamOutcome("made-up.example.com:80", 503)
+		}
+		status, report := checkHealth("/healthz")
+		Expect(status).Should(Equal("200"))
+		Expect(report.Upstreams).Should(BeEmpty())
+	})
+
+	It("Off", func() {
+		recordUpstreamOutcome("billing:8080", 503)
+		Expect(upstreamHealthSince(time.Minute)).Should(BeEmpty())
+
+		Expect(setHealthCheck("/healthz", HealthOptions{
+			Upstreams: []string{"billing:8080"},
+		})).Should(Succeed())
+		Expect(setHealthCheck("", HealthOptions{})).Should(Succeed())
+		recordUpstreamOutcome("billing:8080", 503)
+		Expect(upstreamHealthSince(time.Minute)).Should(BeEmpty())
+	})
+
+	It("Default port", func() {
+		req, _ := http.NewRequest("GET", "https://Billing.example.com/ping", nil)
+		Expect(upstreamHost(req)).Should(Equal("billing.example.com:443"))
+		req, _ = http.NewRequest("GET", "http://billing.example.com/ping", nil)
+		Expect(upstreamHost(req)).Should(Equal("billing.example.com:80"))
+	})
+
+	It("Too many active requests", func() {
+		Expect(setHealthCheck("/healthz", HealthOptions{MaxActive: 2})).Should(Succeed())
+		ids := []uint32{createRequest(testHandler), createRequest(testHandler)}
+		status, report := checkHealth("/healthz")
+		Expect(status).Should(Equal("503"))
+		Expect(report.ActiveRequests).Should(BeNumerically(">=", 3))
+		for _, id := range ids {
+			freeRequest(id)
+		}
+	})
+
+	It("Other paths", func() {
+		Expect(setHealthCheck("/healthz", HealthOptions{})).Should(Succeed())
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Invalid", func() {
+		Expect(setHealthCheck("healthz", HealthOptions{})).ShouldNot(Succeed())
+		Expect(setHealthCheck("/healthz", HealthOptions{MaxErrorRate: 2})).ShouldNot(Succeed())
+		Expect(setHealthCheck("/healthz", HealthOptions{
+			Upstreams: []string{"billing"},
+		})).ShouldNot(Succeed())
+	})
+
+	It("Handler", func() {
+		handler := HealthHandler("/healthz", HealthOptions{})
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/healthz", nil))
+		Expect(w.Code).Should(Equal(http.StatusOK))
+		Expect(w.Header().Get("Cache-Control")).Should(Equal("no-store"))
+
+		w = httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/orders", nil))
+		Expect(w.Body.Len()).Should(BeZero())
+	})
+})
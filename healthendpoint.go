@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * A simpler health check than the one in healthcheck.go: it answers a GET
+ * of one path with a fixed JSON object, to which it adds whether a TCP
+ * connection could be made to each of the targets that the operator listed.
+ * Only those are ever dialed, never a host taken from a request, and they
+ * are dialed in the background every few seconds, so that the endpoint
+ * itself only reads the last answer and a busy load balancer can't make it
+ * open connections. The status is always 200, since weaver itself is up,
+ * and "status" in the body says whether the targets are.
+ */
+
+// Replaced in tests
+var upstreamProbeInterval = 5 * time.Second
+
+const upstreamDialTimeout = 2 * time.Second
+
+type healthEndpoint struct {
+	path      string
+	fields    map[string]json.RawMessage
+	upstreams []string
+}
+
+// Replaced as a whole after each round of probes. Protected by upstreamDialsLock.
+var upstreamDials = make(map[string]bool)
+var upstreamDialsLock = sync.Mutex{}
+
+// Protected by upstreamProberLock
+var upstreamProberStop chan bool
+var upstreamProberDone chan bool
+var upstreamProberLock = sync.Mutex{}
+
+// Replaced in tests
+var dialUpstream = func(host string) error {
+	conn, err := net.DialTimeout("tcp", host, upstreamDialTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+/*
+ * Turn on the endpoint at "path," and start probing "upstreams," a
+ * comma-separated list of "host:port" pairs. An empty path turns it off and
+ * stops the probes.
+ */
+func setHealthCheckEndpoint(path, response, upstreams string) error {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		updateSettings(func(s *settings) {
+			s.healthEndpoint = nil
+		})
+		startUpstreamProber(nil)
+		return nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("Invalid health check path \"%s\"", path)
+	}
+	fields := make(map[string]json.RawMessage)
+	if strings.TrimSpace(response) != "" {
+		if err := json.Unmarshal([]byte(response), &fields); err != nil {
+			return fmt.Errorf("Health check response must be a JSON object: %v", err)
+		}
+	}
+	hosts, err := parseUpstreamList(upstreams)
+	if err != nil {
+		return err
+	}
+	updateSettings(func(s *settings) {
+		s.healthEndpoint = &healthEndpoint{path: path, fields: fields, upstreams: hosts}
+	})
+	startUpstreamProber(hosts)
+	return nil
+}
+
+/*
+ * Replace the goroutine that probes the targets. Like the memory monitor,
+ * wait for the old one, so that its results can't land after this returns.
+ */
+func startUpstreamProber(hosts []string) {
+	upstreamProberLock.Lock()
+	defer upstreamProberLock.Unlock()
+	if upstreamProberStop != nil {
+		close(upstreamProberStop)
+		<-upstreamProberDone
+		upstreamProberStop = nil
+	}
+	resetUpstreamDials()
+	if len(hosts) > 0 {
+		upstreamProberStop = make(chan bool)
+		upstreamProberDone = make(chan bool)
+		go probeUpstreams(hosts, upstreamProberStop, upstreamProberDone)
+	}
+}
+
+func probeUpstreams(hosts []string, stop, done chan bool) {
+	defer close(done)
+	ticker := time.NewTicker(upstreamProbeInterval)
+	defer ticker.Stop()
+	for {
+		results := dialUpstreams(hosts)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		upstreamDialsLock.Lock()
+		upstreamDials = results
+		upstreamDialsLock.Unlock()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+/*
+ * Dial all the targets at once, so that one that doesn't answer doesn't
+ * hold up the others.
+ */
+func dialUpstreams(hosts []string) map[string]bool {
+	results := make(map[string]bool, len(hosts))
+	resultsLock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			ok := dialUpstream(host) == nil
+			resultsLock.Lock()
+			results[host] = ok
+			resultsLock.Unlock()
+		}(host)
+	}
+	wg.Wait()
+	return results
+}
+
+func (r *request) serveHealthEndpoint() bool {
+	e := r.settings.healthEndpoint
+	if e == nil || r.req.URL.Path != e.path || r.req.Method != "GET" {
+		return false
+	}
+	body := make(map[string]interface{}, len(e.fields)+3)
+	for k, v := range e.fields {
+		body[k] = v
+	}
+	body["status"] = "ok"
+	if len(e.upstreams) > 0 {
+		body["upstream"] = "reachable"
+		hosts := make(map[string]string, len(e.upstreams))
+		for _, host := range e.upstreams {
+			reachable, checked := lastUpstreamDial(host)
+			switch {
+			case !checked:
+				// The first round of probes hasn't finished
+				hosts[host] = "unknown"
+			case reachable:
+				hosts[host] = "reachable"
+			default:
+				hosts[host] = "unreachable"
+				body["status"] = "degraded"
+				body["upstream"] = "unreachable"
+			}
+		}
+		body["upstreams"] = hosts
+	}
+	buf, err := json.Marshal(body)
+	if err != nil {
+		r.reject(http.StatusInternalServerError, err.Error())
+		return true
+	}
+	hdrs := http.Header{}
+	hdrs.Set("Content-Type", "application/json")
+	hdrs.Set("Cache-Control", "no-store")
+	r.resp.headers = &hdrs
+	r.resp.WriteHeader(http.StatusOK)
+	r.resp.Write(buf)
+	return true
+}
+
+func lastUpstreamDial(host string) (reachable, checked bool) {
+	upstreamDialsLock.Lock()
+	defer upstreamDialsLock.Unlock()
+	reachable, checked = upstreamDials[host]
+	return
+}
+
+func resetUpstreamDials() {
+	upstreamDialsLock.Lock()
+	upstreamDials = make(map[string]bool)
+	upstreamDialsLock.Unlock()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Health check endpoint", func() {
+	var dialed []string
+	var dialErrs map[string]error
+	var dialLock sync.Mutex
+	realDial := dialUpstream
+	realInterval := upstreamProbeInterval
+
+	BeforeEach(func() {
+		dialLock.Lock()
+		dialed = nil
+		dialErrs = make(map[string]error)
+		dialLock.Unlock()
+		dialUpstream = func(host string) error {
+			dialLock.Lock()
+			defer dialLock.Unlock()
+			dialed = append(dialed, host)
+			return dialErrs[host]
+		}
+	})
+
+	AfterEach(func() {
+		Expect(setHealthCheckEndpoint("", "", "")).Should(Succeed())
+		dialUpstream = realDial
+		upstreamProbeInterval = realInterval
+		resetSettings()
+	})
+
+	dialCount := func() int {
+		dialLock.Lock()
+		defer dialLock.Unlock()
+		return len(dialed)
+	}
+
+	setDialErr := func(host string, err error) {
+		dialLock.Lock()
+		defer dialLock.Unlock()
+		dialErrs[host] = err
+	}
+
+	check := func(path string) map[string]interface{} {
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		Expect(beginRequest(id, makeRequestHeaders("GET", path, "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("SWCH200"))
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("WHDR"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("Content-Type")).Should(Equal("application/json"))
+		cmd = pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("WBOD"))
+		var body map[string]interface{}
+		Expect(json.Unmarshal(readBodyData(cmd), &body)).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		return body
+	}
+
+	It("No upstreams", func() {
+		Expect(setHealthCheckEndpoint("/ping", `{"service": "orders"}`, "")).Should(Succeed())
+		Expect(check("/ping")).Should(Equal(map[string]interface{}{
+			"service": "orders",
+			"status":  "ok",
+		}))
+		Expect(dialCount()).Should(BeZero())
+	})
+
+	It("Reachable", func() {
+		Expect(setHealthCheckEndpoint("/ping", `{"service": "orders"}`,
+			"billing:8080, stock:80")).Should(Succeed())
+		Eventually(func() interface{} {
+			return check("/ping")
+		}).Should(Equal(map[string]interface{}{
+			"service":  "orders",
+			"status":   "ok",
+			"upstream": "reachable",
+			"upstreams": map[string]interface{}{
+				"billing:8080": "reachable",
+				"stock:80":     "reachable",
+			},
+		}))
+	})
+
+	It("Unreachable", func() {
+		setDialErr("stock:80", errors.New("Connection refused"))
+		Expect(setHealthCheckEndpoint("/ping", "", "billing:8080,stock:80")).Should(Succeed())
+		Eventually(func() interface{} {
+			return check("/ping")["upstreams"]
+		}).Should(Equal(map[string]interface{}{
+			"billing:8080": "reachable",
+			"stock:80":     "unreachable",
+		}))
+		body := check("/ping")
+		Expect(body["status"]).Should(Equal("degraded"))
+		Expect(body["upstream"]).Should(Equal("unreachable"))
+	})
+
+	It("Never dials from a request", func() {
+		Expect(setHealthCheckEndpoint("/ping", "{}", "billing:8080")).Should(Succeed())
+		Eventually(dialCount).Should(Equal(1))
+		for i := 0; i < 5; i++ {
+			check("/ping")
+		}
+		Expect(dialCount()).Should(Equal(1))
+		dialLock.Lock()
+		Expect(dialed).Should(Equal([]string{"billing:8080"}))
+		dialLock.Unlock()
+	})
+
+	It("Refreshed in the background", func() {
+		upstreamProbeInterval = 10 * time.Millisecond
+		Expect(setHealthCheckEndpoint("/ping", "{}", "billing:8080")).Should(Succeed())
+		Eventually(func() interface{} {
+			return check("/ping")["upstream"]
+		}).Should(Equal("reachable"))
+		setDialErr("billing:8080", errors.New("Connection refused"))
+		Eventually(func() interface{} {
+			return check("/ping")["upstream"]
+		}).Should(Equal("unreachable"))
+	})
+
+	It("Stopped when turned off", func() {
+		upstreamProbeInterval = 10 * time.Millisecond
+		Expect(setHealthCheckEndpoint("/ping", "{}", "billing:8080")).Should(Succeed())
+		Eventually(dialCount).Should(BeNumerically(">", 0))
+		Expect(setHealthCheckEndpoint("", "", "")).Should(Succeed())
+		count := dialCount()
+		Consistently(dialCount, 50*time.Millisecond).Should(Equal(count))
+	})
+
+	It("Other paths", func() {
+		Expect(setHealthCheckEndpoint("/ping", "{}", "")).Should(Succeed())
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Invalid", func() {
+		Expect(setHealthCheckEndpoint("ping", "{}", "")).ShouldNot(Succeed())
+		Expect(setHealthCheckEndpoint("/ping", "[1, 2]", "")).ShouldNot(Succeed())
+		Expect(setHealthCheckEndpoint("/ping", "{", "")).ShouldNot(Succeed())
+		Expect(setHealthCheckEndpoint("/ping", "{}", "billing")).ShouldNot(Succeed())
+		Expect(setHealthCheckEndpoint("/ping", "{}", "billing:")).ShouldNot(Succeed())
+		Expect(getSettings().healthEndpoint).Should(BeNil())
+	})
+})
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/*
+ * Hedging cuts the tail latency of the requests that weaver makes to an
+ * upstream itself, such as for GoConcatResponses. If the upstream hasn't
+ * answered within the delay, the same request is sent to the next backup,
+ * and so on. Whichever answers first wins, and the others are canceled.
+ * Only GET and HEAD are hedged, since they are safe to repeat.
+ */
+
+type hedging struct {
+	delay   time.Duration
+	backups []*url.URL
+}
+
+func setHedging(id uint32, delay time.Duration, backups string) error {
+	req := getRequest(id)
+	if req == nil {
+		return fmt.Errorf("Unknown request: %d", id)
+	}
+	h := &hedging{delay: delay}
+	for _, b := range strings.Split(backups, "\n") {
+		b = strings.TrimSpace(b)
+		if b == "" {
+			continue
+		}
+		u, err := url.Parse(b)
+		if err != nil {
+			return err
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("Backup must be an absolute URL: \"%s\"", b)
+		}
+		h.backups = append(h.backups, u)
+	}
+	if len(h.backups) == 0 || delay <= 0 {
+		h = nil
+	}
+	req.hedging = h
+	return nil
+}
+
+/*
+ * Send a request to the upstream, hedging it if it was set up that way.
+ */
+func (r *request) fetch(method, u string) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Give up on the upstream along with the request.
+	req = req.WithContext(r.ctx)
+	if r.hedging == nil || (method != "GET" && method != "HEAD") {
+		return upstreamClient.Do(req)
+	}
+	return r.hedging.do(req)
+}
+
+type hedgeResult struct {
+	resp    *http.Response
+	err     error
+	attempt int
+}
+
+func (h *hedging) do(req *http.Request) (*http.Response, error) {
+	results := make(chan hedgeResult, len(h.backups)+1)
+	var cancels []context.CancelFunc
+
+	send := func(target *url.URL) {
+		attempt := *req.URL
+		if target != nil {
+			attempt.Scheme = target.Scheme
+			attempt.Host = target.Host
+		}
+		ctx, cancel := context.WithCancel(req.Context())
+		n := len(cancels)
+		cancels = append(cancels, cancel)
+		areq := req.WithContext(ctx)
+		areq.URL = &attempt
+		areq.Host = ""
+		go func() {
+			resp, err := upstreamClient.Do(areq)
+			results <- hedgeResult{resp: resp, err: err, attempt: n}
+		}()
+	}
+
+	send(nil)
+	timer := time.NewTimer(h.delay)
+	defer timer.Stop()
+	next := 0
+	pending := 1
+	var lastErr error
+
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if next < len(h.backups) {
+				updateStats(func(s *stats) {
+					s.HedgedRequests++
+				})
+				send(h.backups[next])
+				next++
+				pending++
+				timer.Reset(h.delay)
+			}
+
+		case result := <-results:
+			pending--
+			if result.err != nil {
+				lastErr = result.err
+				// Don't wait for the timer if everything so far has failed
+				if pending == 0 && next < len(h.backups) {
+					send(h.backups[next])
+					next++
+					pending++
+				}
+				continue
+			}
+			if result.attempt > 0 {
+				updateStats(func(s *stats) {
+					s.HedgeWins++
+				})
+			}
+			for i, cancel := range cancels {
+				if i != result.attempt {
+					cancel()
+				}
+			}
+			go drainHedges(results, pending)
+			result.resp.Body = &hedgedBody{
+				ReadCloser: result.resp.Body,
+				cancel:     cancels[result.attempt],
+			}
+			return result.resp, nil
+		}
+	}
+	for _, cancel := range cancels {
+		cancel()
+	}
+	return nil, lastErr
+}
+
+/*
+ * Close the bodies of any losers that answered after all.
+ */
+func drainHedges(results chan hedgeResult, pending int) {
+	for ; pending > 0; pending-- {
+		result := <-results
+		if result.resp != nil {
+			result.resp.Body.Close()
+		}
+	}
+}
+
+/*
+ * The winner's context must stay alive until its body has been read.
+ */
+type hedgedBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *hedgedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
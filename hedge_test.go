@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Hedging", func() {
+	var id uint32
+	var slow, fast, down *httptest.Server
+	var arrived, canceled chan bool
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		arrived = make(chan bool, 1)
+		canceled = make(chan bool, 1)
+
+		slow = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case arrived <- true:
+			default:
+			}
+			select {
+			case <-r.Context().Done():
+				canceled <- true
+			case <-time.After(5 * time.Second):
+				w.Write([]byte("Slow " + r.URL.Path))
+			}
+		}))
+		fast = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Fast " + r.URL.Path))
+		}))
+		down = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		down.Close()
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		slow.Close()
+		fast.Close()
+	})
+
+	// Run the request and return the body that was sent back.
+	run := func(primary string) []byte {
+		Expect(setConcatResponses(id, primary+"/data", false)).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("SWCH200"))
+		body := &bytes.Buffer{}
+		for cmd := pollRequest(id, true); cmd != "DONE"; cmd = pollRequest(id, true) {
+			if cmd[:4] == cmdWbod {
+				body.Write(readBodyData(cmd))
+			}
+		}
+		return body.Bytes()
+	}
+
+	It("Invalid", func() {
+		Expect(setHedging(id, time.Millisecond, "backup:8080")).ShouldNot(Succeed())
+		Expect(setHedging(0, time.Millisecond, "http://backup:8080")).ShouldNot(Succeed())
+	})
+
+	It("Hedge wins", func() {
+		before := getStats()
+		Expect(setHedging(id, 20*time.Millisecond, fast.URL)).Should(Succeed())
+		Expect(string(run(slow.URL))).Should(Equal("Fast /data"))
+		Eventually(canceled).Should(Receive())
+		after := getStats()
+		Expect(after.HedgedRequests).Should(Equal(before.HedgedRequests + 1))
+		Expect(after.HedgeWins).Should(Equal(before.HedgeWins + 1))
+	})
+
+	It("Canceled with the request", func() {
+		Expect(setHedging(id, 5*time.Second, fast.URL)).Should(Succeed())
+		Expect(setConcatResponses(id, slow.URL+"/data", false)).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Eventually(arrived).Should(Receive())
+		freeRequest(id)
+		Eventually(canceled).Should(Receive())
+	})
+
+	It("Primary wins", func() {
+		before := getStats()
+		Expect(setHedging(id, time.Second, slow.URL)).Should(Succeed())
+		Expect(string(run(fast.URL))).Should(Equal("Fast /data"))
+		Expect(getStats().HedgedRequests).Should(Equal(before.HedgedRequests))
+	})
+
+	It("Primary fails", func() {
+		Expect(setHedging(id, time.Minute, fast.URL)).Should(Succeed())
+		Expect(string(run(down.URL))).Should(Equal("Fast /data"))
+	})
+})
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+/*
+ * RFC 7230, section 6.1, says that a proxy must remove the hop-by-hop
+ * headers, which only apply to a single connection, before it forwards a
+ * message. That includes any header that the Connection header names. We do
+ * this for the request and the response unless told otherwise. The setting
+ * is "keep" so that the zero value is the standard behavior.
+ */
+
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func setHopByHopStripping(strip bool) {
+	updateSettings(func(s *settings) {
+		s.keepHopByHop = !strip
+	})
+}
+
+func stripHopByHopHeaders(h http.Header) {
+	for _, value := range h["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+func (r *request) stripHopByHop() {
+	if !r.settings.keepHopByHop {
+		stripHopByHopHeaders(r.req.Header)
+	}
+}
+
+func (r *response) stripHopByHop() {
+	if !r.request.settings.keepHopByHop {
+		stripHopByHopHeaders(r.resp.Header)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Hop-by-hop headers", func() {
+	var id, rid uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		rid = createResponse(testHandler)
+		Expect(rid).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		freeResponse(rid)
+		resetSettings()
+	})
+
+	hopHeaders := func() string {
+		hdrs := makeRequestHeaders("GET", "/pass", "", 0)
+		hdrs = addRequestHeader(hdrs, "Connection", "keep-alive, X-Private")
+		hdrs = addRequestHeader(hdrs, "Keep-Alive", "timeout=5")
+		hdrs = addRequestHeader(hdrs, "Upgrade", "h2c")
+		return addRequestHeader(hdrs, "X-Private", "secret")
+	}
+
+	It("Strip request", func() {
+		err := beginRequest(id, hopHeaders())
+		Expect(err).Should(Succeed())
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("WHDR"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs).Should(Equal(http.Header{"Host": []string{"localhost:1234"}}))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Strip response", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		rawHdrs := "Connection: X-Trace\nX-Trace: abc\nTransfer-Encoding: chunked\n" +
+			makeResponseHeaders("text/plain", 0)
+		err = beginResponse(rid, id, 200, rawHdrs)
+		Expect(err).Should(Succeed())
+		cmd := pollResponse(rid, true)
+		Expect(cmd).Should(HavePrefix("WHDR"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs).Should(HaveLen(2))
+		Expect(hdrs.Get("Content-Type")).Should(Equal("text/plain"))
+		Expect(hdrs.Get("Server")).Should(Equal("Some test thing"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Nothing to strip", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Disabled", func() {
+		setHopByHopStripping(false)
+		err := beginRequest(id, hopHeaders())
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+})
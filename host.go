@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/*
+ * RFC 7230 section 5.4 says that when the request line contains an
+ * absolute URI, its authority wins over the Host header. In that case we
+ * rewrite the Host header so that the target sees the same thing. In
+ * strict mode, we reject the request instead.
+ */
+
+func setStrictHostCheck(strict bool) {
+	updateSettings(func(s *settings) {
+		s.strictHostCheck = strict
+	})
+}
+
+/*
+ * Check the Host header, and return false if the request was rejected.
+ */
+func (r *request) checkHost() bool {
+	if !r.req.URL.IsAbs() || r.req.URL.Host == "" {
+		return true
+	}
+
+	authority := r.req.URL.Host
+	host := r.req.Header.Get("Host")
+	if host != "" && !strings.EqualFold(host, authority) {
+		updateStats(func(s *stats) {
+			s.HostMismatches++
+		})
+		if r.settings.strictHostCheck {
+			r.reject(http.StatusBadRequest,
+				fmt.Sprintf("Host header \"%s\" does not match request URI", host))
+			return false
+		}
+	}
+
+	if host != authority {
+		r.req.Host = authority
+		r.req.Header.Set("Host", authority)
+	}
+	return true
+}
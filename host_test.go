@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	absoluteRequestMatch = "GET http://localhost:1234/pass HTTP/1.1\r\n" +
+		"Host: localhost:1234\r\n" +
+		"\r\n"
+	absoluteRequestMismatch = "GET http://localhost:1234/pass HTTP/1.1\r\n" +
+		"Host: evil.example.com\r\n" +
+		"\r\n"
+	absoluteRequestNoHost = "GET http://localhost:1234/pass HTTP/1.1\r\n" +
+		"User-Agent: Myself\r\n" +
+		"\r\n"
+)
+
+var _ = Describe("Host Header", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		resetSettings()
+	})
+
+	It("Match", func() {
+		before := getStats().HostMismatches
+		err := beginRequest(id, absoluteRequestMatch)
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(getStats().HostMismatches).Should(Equal(before))
+	})
+
+	It("Mismatch", func() {
+		before := getStats().HostMismatches
+		err := beginRequest(id, absoluteRequestMismatch)
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("Host")).Should(Equal("localhost:1234"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(getStats().HostMismatches).Should(Equal(before + 1))
+	})
+
+	It("Mismatch strict", func() {
+		setStrictHostCheck(true)
+		before := getStats().HostMismatches
+		err := beginRequest(id, absoluteRequestMismatch)
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^SWCH.*"))
+		Expect(cmd[4:]).Should(Equal("400"))
+		Expect(pollRequest(id, true)).Should(MatchRegexp("^WHDR.*"))
+		cmd = pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+		Expect(string(readBodyData(cmd))).Should(ContainSubstring("evil.example.com"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(getStats().HostMismatches).Should(Equal(before + 1))
+	})
+
+	It("No Host header", func() {
+		setStrictHostCheck(true)
+		err := beginRequest(id, absoluteRequestNoHost)
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("Host")).Should(Equal("localhost:1234"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+})
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+)
+
+/*
+ * Insert HTML snippets, such as an analytics script or a banner, into HTML
+ * responses as they stream past. A small tokenizer finds the head and body
+ * tags without reading the whole document. It skips comments, quoted
+ * attributes, and the contents of elements like script, where something
+ * that looks like a tag isn't one. Only an incomplete tag at the end of a
+ * chunk is held back. A snippet is only inserted if its tag is found, and
+ * only once.
+ */
+
+var snippetPositions = []string{"head-start", "head-end", "body-start", "body-end"}
+
+// Elements whose contents are not parsed as HTML
+var rawTextElements = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"textarea": true,
+	"title":    true,
+}
+
+// An unfinished tag longer than this is passed through as text
+const maxHeldTag = 8192
+
+func setHTMLSnippet(position, html string) error {
+	position = strings.ToLower(strings.TrimSpace(position))
+	valid := false
+	for _, p := range snippetPositions {
+		valid = valid || p == position
+	}
+	if !valid {
+		return fmt.Errorf("Invalid snippet position: \"%s\"", position)
+	}
+	updateSettings(func(s *settings) {
+		snippets := make(map[string]string)
+		for p, h := range s.htmlSnippets {
+			snippets[p] = h
+		}
+		if html == "" {
+			delete(snippets, position)
+		} else {
+			snippets[position] = html
+		}
+		s.htmlSnippets = snippets
+	})
+	return nil
+}
+
+/*
+ * Decide, before the handler runs, whether snippets go in the body. A body
+ * that is still compressed is left alone.
+ */
+func (r *response) findSnippets() map[string]string {
+	snippets := r.request.settings.htmlSnippets
+	if len(snippets) == 0 || r.resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(r.resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "text/html" {
+		return nil
+	}
+	return snippets
+}
+
+func (r *response) startInjection() {
+	if len(r.snippets) == 0 || r.written || r.headersSent {
+		return
+	}
+	r.resp.Header.Del("Content-Length")
+	r.resp.ContentLength = -1
+	r.resp.Body = &injectedBody{
+		body:     r.resp.Body,
+		injector: newHTMLInjector(r.snippets),
+	}
+}
+
+type injectedBody struct {
+	body     io.ReadCloser
+	injector *htmlInjector
+	out      []byte
+	err      error
+}
+
+func (b *injectedBody) Read(p []byte) (int, error) {
+	for len(b.out) == 0 && b.err == nil {
+		buf := make([]byte, bodyBufSize)
+		n, err := b.body.Read(buf)
+		b.out = b.injector.write(buf[:n])
+		if err == io.EOF {
+			b.out = append(b.out, b.injector.flush()...)
+		}
+		b.err = err
+	}
+	if len(b.out) == 0 {
+		return 0, b.err
+	}
+	n := copy(p, b.out)
+	b.out = b.out[n:]
+	return n, nil
+}
+
+func (b *injectedBody) Close() error {
+	return b.body.Close()
+}
+
+type htmlInjector struct {
+	snippets map[string]string
+	held     []byte
+	// Set while inside a comment, or to the closing tag of a raw element
+	until []byte
+}
+
+func newHTMLInjector(snippets map[string]string) *htmlInjector {
+	copied := make(map[string]string, len(snippets))
+	for p, h := range snippets {
+		copied[p] = h
+	}
+	return &htmlInjector{snippets: copied}
+}
+
+/*
+ * Return the part of the document up to "chunk" that can be sent now, with
+ * any snippets inserted.
+ */
+func (h *htmlInjector) write(chunk []byte) []byte {
+	buf := append(h.held, chunk...)
+	h.held = nil
+	out := make([]byte, 0, len(buf))
+	i := 0
+	for i < len(buf) {
+		if h.until != nil {
+			end := indexFold(buf[i:], h.until)
+			if end < 0 {
+				// Hold back enough to find the end if it is split.
+				keep := minInt(len(h.until)-1, len(buf)-i)
+				out = append(out, buf[i:len(buf)-keep]...)
+				h.held = append(h.held, buf[len(buf)-keep:]...)
+				return out
+			}
+			if bytes.Equal(h.until, []byte("-->")) {
+				end += len(h.until)
+			}
+			out = append(out, buf[i:i+end]...)
+			i += end
+			h.until = nil
+			continue
+		}
+
+		lt := bytes.IndexByte(buf[i:], '<')
+		if lt < 0 {
+			return append(out, buf[i:]...)
+		}
+		out = append(out, buf[i:i+lt]...)
+		i += lt
+		rest := buf[i:]
+
+		if bytes.HasPrefix(rest, []byte("<!--")) {
+			out = append(out, rest[:4]...)
+			i += 4
+			h.until = []byte("-->")
+			continue
+		}
+		gt := htmlTagEnd(rest)
+		if gt < 0 {
+			if len(rest) < maxHeldTag {
+				h.held = append(h.held, rest...)
+				return out
+			}
+			return append(out, rest...)
+		}
+		tag := rest[:gt+1]
+		i += len(tag)
+		name, closing := htmlTagName(tag)
+		switch {
+		case name == "head" && !closing:
+			out = append(append(out, tag...), h.take("head-start")...)
+		case name == "head" && closing:
+			out = append(append(out, h.take("head-end")...), tag...)
+		case name == "body" && !closing:
+			out = append(append(out, tag...), h.take("body-start")...)
+		case name == "body" && closing:
+			out = append(append(out, h.take("body-end")...), tag...)
+		default:
+			out = append(out, tag...)
+			if !closing && rawTextElements[name] {
+				h.until = []byte("</" + name)
+			}
+		}
+	}
+	return out
+}
+
+/*
+ * Return whatever was held back at the end of the document.
+ */
+func (h *htmlInjector) flush() []byte {
+	held := h.held
+	h.held = nil
+	return held
+}
+
+func (h *htmlInjector) take(position string) []byte {
+	snippet := h.snippets[position]
+	delete(h.snippets, position)
+	return []byte(snippet)
+}
+
+/*
+ * Return the index of the ">" that ends the tag at the start of "tag,"
+ * skipping any in quoted attribute values, or -1 if it isn't there yet.
+ */
+func htmlTagEnd(tag []byte) int {
+	var quote byte
+	for i := 1; i < len(tag); i++ {
+		c := tag[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+ * Return the lower-case name of a tag, and whether it is a closing tag.
+ */
+func htmlTagName(tag []byte) (string, bool) {
+	name := tag[1:]
+	closing := len(name) > 0 && name[0] == '/'
+	if closing {
+		name = name[1:]
+	}
+	end := 0
+	for end < len(name) && (isASCIILetter(name[end]) || (end > 0 && name[end] >= '0' && name[end] <= '9')) {
+		end++
+	}
+	return strings.ToLower(string(name[:end])), closing
+}
+
+func isASCIILetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+/*
+ * Find "sep," which is in lower case and doesn't start with a letter, in "s,"
+ * ignoring the case of ASCII letters only, so that the index is the same in
+ * both.
+ */
+func indexFold(s, sep []byte) int {
+	for i := 0; len(s)-i >= len(sep) && len(sep) > 0; i++ {
+		j := bytes.IndexByte(s[i:], sep[0])
+		if j < 0 {
+			return -1
+		}
+		i += j
+		if len(s)-i >= len(sep) && equalFoldASCII(s[i:i+len(sep)], sep) {
+			return i
+		}
+	}
+	if len(sep) == 0 {
+		return 0
+	}
+	return -1
+}
+
+func equalFoldASCII(s, lower []byte) bool {
+	for i, c := range s {
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		if c != lower[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HTML snippets", func() {
+	snippets := map[string]string{
+		"head-start": "[hs]",
+		"head-end":   "[he]",
+		"body-start": "[bs]",
+		"body-end":   "[be]",
+	}
+
+	// Feed the document to an injector "size" bytes at a time.
+	inject := func(doc string, size int) string {
+		h := newHTMLInjector(snippets)
+		out := &bytes.Buffer{}
+		for i := 0; i < len(doc); i += size {
+			out.Write(h.write([]byte(doc[i:minInt(i+size, len(doc))])))
+		}
+		out.Write(h.flush())
+		return out.String()
+	}
+
+	It("Positions", func() {
+		doc := "<!DOCTYPE html><HTML><Head><title>x</title></HEAD>" +
+			"<body class=\"a>b\"><p>Hi</p></body></html>"
+		expected := "<!DOCTYPE html><HTML><Head>[hs]<title>x</title>[he]</HEAD>" +
+			"<body class=\"a>b\">[bs]<p>Hi</p>[be]</body></html>"
+		for size := 1; size <= len(doc); size++ {
+			Expect(inject(doc, size)).Should(Equal(expected), "Chunk size %d", size)
+		}
+	})
+
+	It("Not in comments or scripts", func() {
+		doc := "<html><!-- <body> --><header></header>" +
+			"<script>var s = \"</body>\";</script><BODY></Body>"
+		expected := "<html><!-- <body> --><header></header>" +
+			"<script>var s = \"</body>\";</script><BODY>[bs][be]</Body>"
+		Expect(inject(doc, 3)).Should(Equal(expected))
+		Expect(inject(doc, len(doc))).Should(Equal(expected))
+	})
+
+	It("Only once", func() {
+		Expect(inject("<body></body><body></body>", 5)).
+			Should(Equal("<body>[bs][be]</body><body></body>"))
+	})
+
+	It("Missing tags", func() {
+		Expect(inject("<p>Just a fragment", 4)).Should(Equal("<p>Just a fragment"))
+		Expect(inject("Unfinished <bod", 4)).Should(Equal("Unfinished <bod"))
+	})
+
+	It("Invalid position", func() {
+		Expect(setHTMLSnippet("footer", "x")).ShouldNot(Succeed())
+		Expect(setHTMLSnippet("Head-End", "x")).Should(Succeed())
+		Expect(getSettings().htmlSnippets).Should(HaveKeyWithValue("head-end", "x"))
+		Expect(setHTMLSnippet("head-end", "")).Should(Succeed())
+		Expect(getSettings().htmlSnippets).Should(BeEmpty())
+	})
+
+	Describe("Responses", func() {
+		var id, rid uint32
+
+		BeforeEach(func() {
+			id = createRequest(testHandler)
+			Expect(id).ShouldNot(BeZero())
+			rid = createResponse(testHandler)
+			Expect(rid).ShouldNot(BeZero())
+		})
+
+		AfterEach(func() {
+			freeRequest(id)
+			freeResponse(rid)
+			resetSettings()
+		})
+
+		It("Streams", func() {
+			Expect(setHTMLSnippet("head-end", "<script src=\"a.js\"></script>")).Should(Succeed())
+			Expect(setHTMLSnippet("body-end", "<div>Banner</div>")).Should(Succeed())
+			first := "<html><head><title>Hi</title></he"
+			last := "ad><body>Hello</body></html>"
+
+			err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+			Expect(err).Should(Succeed())
+			Expect(pollRequest(id, true)).Should(Equal("DONE"))
+			err = beginResponse(rid, id, 200,
+				makeResponseHeaders("text/html; charset=utf-8", len(first)+len(last)))
+			Expect(err).Should(Succeed())
+			cmd := pollResponse(rid, true)
+			Expect(cmd).Should(HavePrefix("WHDR"))
+			hdrs := http.Header{}
+			parseHeaders(hdrs, cmd[4:])
+			Expect(hdrs.Get("Content-Length")).Should(BeEmpty())
+			Expect(pollResponse(rid, true)).Should(Equal("RBOD"))
+
+			// The first part comes out before the rest goes in.
+			sendResponseBodyChunk(rid, false, []byte(first))
+			cmd = pollResponse(rid, true)
+			Expect(cmd).Should(HavePrefix("WBOD"))
+			Expect(string(readBodyData(cmd))).Should(Equal("<html><head><title>Hi</title>"))
+
+			sendResponseBodyChunk(rid, true, []byte(last))
+			body := &bytes.Buffer{}
+			for cmd = pollResponse(rid, true); cmd != "DONE"; cmd = pollResponse(rid, true) {
+				Expect(cmd).Should(HavePrefix("WBOD"))
+				body.Write(readBodyData(cmd))
+			}
+			Expect(body.String()).Should(Equal("<script src=\"a.js\"></script></head>" +
+				"<body>Hello<div>Banner</div></body></html>"))
+		})
+
+		It("Other types", func() {
+			Expect(setHTMLSnippet("body-end", "x")).Should(Succeed())
+			err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+			Expect(err).Should(Succeed())
+			Expect(pollRequest(id, true)).Should(Equal("DONE"))
+			err = beginResponse(rid, id, 200, makeResponseHeaders("text/plain", 10))
+			Expect(err).Should(Succeed())
+			Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+		})
+	})
+})
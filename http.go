@@ -63,12 +63,16 @@ func parseHTTPResponse(status uint32, rawHeaders string) (*http.Response, error)
 		ProtoMinor: 1,
 	}
 
+	rawHeaders, err := parseStatusLine(&resp, rawHeaders)
+	if err != nil {
+		return nil, err
+	}
 	parseHeaders(resp.Header, rawHeaders)
 
 	clHeader := resp.Header.Get("Content-Length")
 	if clHeader != "" {
 		cl, err := strconv.ParseInt(clHeader, 10, 64)
-		if err != nil {
+		if err == nil {
 			resp.ContentLength = cl
 		}
 	}
@@ -81,11 +85,25 @@ func parseHTTPResponse(status uint32, rawHeaders string) (*http.Response, error)
 	return &resp, nil
 }
 
+// A newline would start a new header, so no name or value may contain one.
+var headerNewlineToSpace = strings.NewReplacer("\r", " ", "\n", " ")
+
 //serialize the headersMap back to a string
 func serializeHeaders(headerMap http.Header) string {
 	var buffer bytes.Buffer
-	for key := range headerMap {
-		values := headerMap[key]
+	for rawKey := range headerMap {
+		values := headerMap[rawKey]
+		key := headerNewlineToSpace.Replace(rawKey)
+		if key == "Set-Cookie" {
+			// Cookies can't be combined, so each one gets its own line.
+			for _, value := range values {
+				buffer.WriteString(key)
+				buffer.WriteString(": ")
+				buffer.WriteString(headerNewlineToSpace.Replace(value))
+				buffer.WriteString("\n")
+			}
+			continue
+		}
 		var valuesBuffer bytes.Buffer
 		for i := 0; i < len(values); i++ {
 			if values[i] != "" {
@@ -95,7 +113,7 @@ func serializeHeaders(headerMap http.Header) string {
 				valuesBuffer.WriteString(values[i])
 			}
 		}
-		val := valuesBuffer.String()
+		val := headerNewlineToSpace.Replace(valuesBuffer.String())
 		buffer.WriteString(key)
 		buffer.WriteString(": ")
 		buffer.WriteString(val)
@@ -113,18 +131,19 @@ func serializeHeaders(headerMap http.Header) string {
 func parseHeaders(headerMap http.Header, rawHeaders string) {
 	headerValues := strings.Split(rawHeaders, "\n")
 	for _, header := range headerValues {
-		keyValue := strings.Split(header, ": ")
+		keyValue := strings.SplitN(header, ": ", 2)
 		if len(keyValue) == 2 {
 			key := keyValue[0]
 			valueString := keyValue[1]
 			if valueString != "" {
-				values := strings.Split(valueString, ",")
-				if _, ok := headerMap[key]; !ok {
-					headerMap[key] = make([]string, len(values))
-				}
-				for i := 0; i < len(values); i++ {
-					headerMap[key][i] = values[i]
+				var values []string
+				if http.CanonicalHeaderKey(key) == "Set-Cookie" {
+					// The "Expires" attribute has a comma in it
+					values = []string{valueString}
+				} else {
+					values = strings.Split(valueString, ",")
 				}
+				headerMap[key] = append(headerMap[key], values...)
 			}
 		}
 
@@ -137,10 +156,21 @@ func parseRequestLine(line string, req *http.Request) error {
 		return fmt.Errorf("Invalid HTTP request line: \"%s\"", line)
 	}
 
-	url, err := url.ParseRequestURI(matches[2])
+	// ParseRequestURI assumes that there is no fragment, so split it off
+	uri := matches[2]
+	fragment := ""
+	if i := strings.Index(uri, "#"); i >= 0 {
+		fragment = uri[i+1:]
+		uri = uri[:i]
+		if unescaped, err := url.PathUnescape(fragment); err == nil {
+			fragment = unescaped
+		}
+	}
+	url, err := url.ParseRequestURI(uri)
 	if err != nil {
 		return err
 	}
+	url.Fragment = fragment
 
 	major, err := strconv.Atoi(matches[3])
 	if err != nil {
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+/*
+ * An HTTP/1.0 client doesn't understand chunked encoding, so if the target
+ * sent a response without a length, the only way to mark the end of the body
+ * is to close the connection. When this is enabled, we read the whole body
+ * into memory instead, so that it can be sent with a Content-Length. A body
+ * that is too big to hold is sent as it is read, with no length, and the
+ * response ends with "DONEclose" so that the caller closes the connection.
+ */
+
+// The most that is held in order to send a length. This is replaced by tests.
+var maxLengthPrefixedBody int64 = 4 * 1024 * 1024
+
+func enableHTTP10Support(enabled bool) {
+	updateSettings(func(s *settings) {
+		s.http10Support = enabled
+	})
+}
+
+/*
+ * Return true if the body may have to be sent with a length, because the
+ * client speaks HTTP/1.0. This is known before any handler runs, so that
+ * the headers can wait until the handlers and filters are done with them.
+ */
+func (r *response) mayNeedLength() bool {
+	req := r.request.req
+	return r.request.settings.http10Support && req.ProtoMajor == 1 && req.ProtoMinor == 0
+}
+
+/*
+ * Decide whether the body must be sent with a length, once the handlers and
+ * the filters that remove Content-Length have run.
+ */
+func (r *response) needsLength() bool {
+	if !r.http10Client || !bodyAllowed(r.request.req, r.resp.StatusCode) {
+		return false
+	}
+	te := strings.ToLower(r.resp.Header.Get("Transfer-Encoding"))
+	return strings.Contains(te, "chunked") || r.resp.Header.Get("Content-Length") == ""
+}
+
+func (r *response) lengthPrefixing() bool {
+	return r.sendLength && !r.written
+}
+
+func (r *response) setBodyLength(length int) {
+	if !r.lengthPrefixing() {
+		return
+	}
+	r.resp.Header.Del("Transfer-Encoding")
+	r.resp.Header.Set("Content-Length", strconv.Itoa(length))
+	r.resp.ContentLength = int64(length)
+}
+
+/*
+ * Read the whole body, after any handler filtered it, and send it with a
+ * Content-Length.
+ */
+func (r *response) flushLengthPrefixedBody() {
+	buf := &bytes.Buffer{}
+	n, err := io.CopyN(buf, r.resp.Body, maxLengthPrefixedBody+1)
+	if n > maxLengthPrefixedBody {
+		r.flushCloseDelimitedBody(buf)
+		return
+	}
+	r.resp.Body.Close()
+
+	r.setBodyLength(buf.Len())
+	r.flushHeaders()
+	if r.flushSplitBody() {
+		return
+	}
+	// CopyN stops at the end of the body with io.EOF.
+	if err == io.EOF {
+		r.storeNegative(buf.Bytes())
+	}
+	readAndSend(r, ioutil.NopCloser(buf))
+}
+
+/*
+ * Send what was read so far and then the rest of the body, with no length,
+ * and close the connection after it.
+ */
+func (r *response) flushCloseDelimitedBody(start *bytes.Buffer) {
+	r.resp.Header.Del("Transfer-Encoding")
+	r.resp.Header.Del("Content-Length")
+	r.resp.ContentLength = -1
+	r.closeClient = true
+	r.flushHeaders()
+	if r.flushSplitBody() {
+		r.resp.Body.Close()
+		return
+	}
+	readAndSend(r, struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(start, r.resp.Body), r.resp.Body})
+}
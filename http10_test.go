@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HTTP/1.0 support", func() {
+	var id, rid uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		rid = createResponse(testHandler)
+		Expect(rid).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		freeResponse(rid)
+		resetSettings()
+	})
+
+	begin := func(proto, method string, respHdrs string) {
+		hdrs := strings.Replace(makeRequestHeaders(method, "/pass", "", 0),
+			"HTTP/1.1", proto, 1)
+		err := beginRequest(id, hdrs)
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		err = beginResponse(rid, id, 200, respHdrs)
+		Expect(err).Should(Succeed())
+	}
+
+	chunked := "Transfer-Encoding: chunked\n" + makeResponseHeaders("text/plain", 0)
+
+	It("Chunked", func() {
+		enableHTTP10Support(true)
+		begin("HTTP/1.0", "GET", chunked)
+		Expect(pollResponse(rid, true)).Should(Equal("RBOD"))
+		sendResponseBodyChunk(rid, false, []byte("Hello, "))
+		sendResponseBodyChunk(rid, true, []byte("World!"))
+
+		cmd := pollResponse(rid, true)
+		Expect(cmd).Should(HavePrefix("WHDR"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("Content-Length")).Should(Equal("13"))
+		Expect(hdrs.Get("Transfer-Encoding")).Should(BeEmpty())
+		Expect(hdrs.Get("Content-Type")).Should(Equal("text/plain"))
+
+		cmd = pollResponse(rid, true)
+		Expect(cmd).Should(HavePrefix("WBOD"))
+		Expect(readBodyData(cmd)).Should(Equal([]byte("Hello, World!")))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Too big to hold", func() {
+		defer func(max int64) { maxLengthPrefixedBody = max }(maxLengthPrefixedBody)
+		maxLengthPrefixedBody = 8
+		enableHTTP10Support(true)
+		begin("HTTP/1.0", "GET", chunked)
+		Expect(pollResponse(rid, true)).Should(Equal("RBOD"))
+		sendResponseBodyChunk(rid, false, []byte("Hello, "))
+		sendResponseBodyChunk(rid, true, []byte("World!"))
+
+		cmd := pollResponse(rid, true)
+		Expect(cmd).Should(HavePrefix("WHDR"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("Content-Length")).Should(BeEmpty())
+		Expect(hdrs.Get("Transfer-Encoding")).Should(BeEmpty())
+
+		body := ""
+		for cmd = pollResponse(rid, true); cmd[:4] == "WBOD"; cmd = pollResponse(rid, true) {
+			body += string(readBodyData(cmd))
+		}
+		Expect(body).Should(Equal("Hello, World!"))
+		Expect(cmd).Should(Equal("DONEclose"))
+	})
+
+	It("Already has a length", func() {
+		enableHTTP10Support(true)
+		begin("HTTP/1.0", "GET", makeResponseHeaders("text/plain", 13))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Length removed by a filter", func() {
+		enableHTTP10Support(true)
+		Expect(setResponseSubstitution("text/plain", "World", "Weaver")).Should(Succeed())
+		begin("HTTP/1.0", "GET", makeResponseHeaders("text/plain", 13))
+		Expect(pollResponse(rid, true)).Should(Equal("RBOD"))
+		sendResponseBodyChunk(rid, true, []byte("Hello, World!"))
+
+		cmd := pollResponse(rid, true)
+		Expect(cmd).Should(HavePrefix("WHDR"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("Content-Length")).Should(Equal("14"))
+
+		cmd = pollResponse(rid, true)
+		Expect(cmd).Should(HavePrefix("WBOD"))
+		Expect(readBodyData(cmd)).Should(Equal([]byte("Hello, Weaver!")))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("HEAD", func() {
+		enableHTTP10Support(true)
+		begin("HTTP/1.0", "HEAD", chunked)
+		Expect(pollResponse(rid, true)).Should(HavePrefix("WHDR"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("HTTP/1.1", func() {
+		enableHTTP10Support(true)
+		begin("HTTP/1.1", "GET", chunked)
+		Expect(pollResponse(rid, true)).Should(HavePrefix("WHDR"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Disabled", func() {
+		begin("HTTP/1.0", "GET", chunked)
+		Expect(pollResponse(rid, true)).Should(HavePrefix("WHDR"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+})
@@ -0,0 +1,139 @@
+//go:build imageopt
+// +build imageopt
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+)
+
+/*
+ * Recompress JPEG and PNG response bodies, using the minification code to
+ * read the whole body first. Encoding PNG at the best compression is slow,
+ * so this is only built with the "imageopt" tag. Images with too many pixels
+ * are left alone so that a small file can't make us allocate a huge one, and
+ * files bigger than maxMinifiedBody are never read in full. The encoders
+ * drop EXIF and ICC profiles, which would turn or recolor the image, so
+ * images that have them are left alone too.
+ */
+
+const maxOptimizedPixels = 40 * 1000 * 1000
+
+func setImageOptimization(enabled bool, quality int) error {
+	if !enabled {
+		quality = 0
+	} else if quality < 1 || quality > 100 {
+		return fmt.Errorf("Invalid JPEG quality: %d", quality)
+	}
+	updateSettings(func(s *settings) {
+		s.imageQuality = quality
+	})
+	return nil
+}
+
+func findImageOptimizer(mediaType string, quality int) minifier {
+	if quality == 0 {
+		return nil
+	}
+	var encode func(*bytes.Buffer, image.Image) error
+	var hasMetadata func([]byte) bool
+	switch mediaType {
+	case "image/jpeg":
+		hasMetadata = jpegHasMetadata
+		encode = func(buf *bytes.Buffer, img image.Image) error {
+			return jpeg.Encode(buf, img, &jpeg.Options{Quality: quality})
+		}
+	case "image/png":
+		hasMetadata = pngHasMetadata
+		encoder := png.Encoder{CompressionLevel: png.BestCompression}
+		encode = func(buf *bytes.Buffer, img image.Image) error {
+			return encoder.Encode(buf, img)
+		}
+	default:
+		return nil
+	}
+
+	return func(body []byte) []byte {
+		if hasMetadata(body) {
+			return nil
+		}
+		out := smallest(body, optimizeImage(body, encode))
+		updateStats(func(s *stats) {
+			s.OptimizedImages++
+			s.ImageBytesIn += int64(len(body))
+			s.ImageBytesOut += int64(len(out))
+		})
+		return out
+	}
+}
+
+/*
+ * Return the image encoded again, or nil if it couldn't be.
+ */
+func optimizeImage(body []byte, encode func(*bytes.Buffer, image.Image) error) []byte {
+	config, _, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil || config.Width*config.Height > maxOptimizedPixels {
+		return nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(body))
+	if err != nil {
+		return nil
+	}
+	buf := &bytes.Buffer{}
+	if encode(buf, img) != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+/*
+ * Look for an APP1 segment with EXIF data or an APP2 segment with an ICC
+ * profile before the image data starts.
+ */
+func jpegHasMetadata(body []byte) bool {
+	if len(body) < 2 || body[0] != 0xff || body[1] != 0xd8 {
+		return false
+	}
+	for i := 2; i+4 <= len(body) && body[i] == 0xff; {
+		marker := body[i+1]
+		if marker == 0xda || marker == 0xd9 {
+			// Start of scan or end of image
+			return false
+		}
+		length := int(binary.BigEndian.Uint16(body[i+2:]))
+		segment := body[i+4 : minInt(i+2+length, len(body))]
+		if (marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00"))) ||
+			(marker == 0xe2 && bytes.HasPrefix(segment, []byte("ICC_PROFILE\x00"))) {
+			return true
+		}
+		i += 2 + length
+	}
+	return false
+}
+
+/*
+ * Look for an eXIf or iCCP chunk before the image data starts.
+ */
+func pngHasMetadata(body []byte) bool {
+	const signatureLen = 8
+	for i := signatureLen; i+8 <= len(body); {
+		length := int(binary.BigEndian.Uint32(body[i:]))
+		switch string(body[i+4 : i+8]) {
+		case "eXIf", "iCCP":
+			return true
+		case "IDAT":
+			return false
+		}
+		if length > len(body) {
+			return false
+		}
+		// Length, type, data, and CRC
+		i += 12 + length
+	}
+	return false
+}
@@ -0,0 +1,25 @@
+//go:build !imageopt
+// +build !imageopt
+
+package main
+
+import (
+	"errors"
+)
+
+/*
+ * Without the "imageopt" build tag, images are never recompressed.
+ */
+
+var errNoImageOptimization = errors.New("Image optimization requires the \"imageopt\" build tag")
+
+func setImageOptimization(enabled bool, quality int) error {
+	if enabled {
+		return errNoImageOptimization
+	}
+	return nil
+}
+
+func findImageOptimizer(mediaType string, quality int) minifier {
+	return nil
+}
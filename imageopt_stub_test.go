@@ -0,0 +1,16 @@
+//go:build !imageopt
+// +build !imageopt
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Image optimization", func() {
+	It("Not built", func() {
+		Expect(setImageOptimization(true, 80)).Should(Equal(errNoImageOptimization))
+		Expect(setImageOptimization(false, 0)).Should(Succeed())
+	})
+})
@@ -0,0 +1,142 @@
+//go:build imageopt
+// +build imageopt
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Image optimization", func() {
+	var id, rid uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		rid = createResponse(testHandler)
+		Expect(rid).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		freeResponse(rid)
+		resetSettings()
+	})
+
+	testImage := func() image.Image {
+		img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+		for x := 0; x < 64; x++ {
+			for y := 0; y < 64; y++ {
+				img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 4), 128, 255})
+			}
+		}
+		return img
+	}
+
+	// Send the image and return the body that comes back.
+	run := func(contentType string, body []byte) []byte {
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		err = beginResponse(rid, id, 200, makeResponseHeaders(contentType, len(body)))
+		Expect(err).Should(Succeed())
+
+		buf := &bytes.Buffer{}
+		for cmd := pollResponse(rid, true); cmd != "DONE"; cmd = pollResponse(rid, true) {
+			switch cmd[:4] {
+			case "RBOD":
+				sendResponseBodyChunk(rid, true, body)
+			case "WBOD":
+				buf.Write(readBodyData(cmd))
+			}
+		}
+		return buf.Bytes()
+	}
+
+	It("Invalid quality", func() {
+		Expect(setImageOptimization(true, 0)).ShouldNot(Succeed())
+		Expect(setImageOptimization(true, 101)).ShouldNot(Succeed())
+		Expect(setImageOptimization(false, 0)).Should(Succeed())
+	})
+
+	It("JPEG", func() {
+		Expect(setImageOptimization(true, 40)).Should(Succeed())
+		orig := &bytes.Buffer{}
+		Expect(jpeg.Encode(orig, testImage(), &jpeg.Options{Quality: 100})).Should(Succeed())
+
+		before := getStats()
+		body := run("image/jpeg", orig.Bytes())
+		Expect(len(body)).Should(BeNumerically("<", orig.Len()))
+		_, err := jpeg.Decode(bytes.NewReader(body))
+		Expect(err).Should(Succeed())
+
+		after := getStats()
+		Expect(after.OptimizedImages).Should(Equal(before.OptimizedImages + 1))
+		Expect(after.ImageBytesIn - before.ImageBytesIn).Should(BeEquivalentTo(orig.Len()))
+		Expect(after.ImageBytesOut - before.ImageBytesOut).Should(BeEquivalentTo(len(body)))
+	})
+
+	It("PNG", func() {
+		Expect(setImageOptimization(true, 80)).Should(Succeed())
+		orig := &bytes.Buffer{}
+		encoder := png.Encoder{CompressionLevel: png.NoCompression}
+		Expect(encoder.Encode(orig, testImage())).Should(Succeed())
+
+		body := run("image/png", orig.Bytes())
+		Expect(len(body)).Should(BeNumerically("<", orig.Len()))
+		img, err := png.Decode(bytes.NewReader(body))
+		Expect(err).Should(Succeed())
+		Expect(img.Bounds()).Should(Equal(image.Rect(0, 0, 64, 64)))
+	})
+
+	It("JPEG with metadata", func() {
+		Expect(setImageOptimization(true, 40)).Should(Succeed())
+		orig := &bytes.Buffer{}
+		Expect(jpeg.Encode(orig, testImage(), &jpeg.Options{Quality: 100})).Should(Succeed())
+		// Put an EXIF segment right after the start of the image.
+		exif := append([]byte{0xff, 0xe1, 0, 16}, []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08")...)
+		withExif := append(append(append([]byte{}, orig.Bytes()[:2]...), exif...), orig.Bytes()[2:]...)
+		Expect(jpegHasMetadata(withExif)).Should(BeTrue())
+		Expect(jpegHasMetadata(orig.Bytes())).Should(BeFalse())
+		Expect(run("image/jpeg", withExif)).Should(Equal(withExif))
+	})
+
+	It("PNG with metadata", func() {
+		orig := &bytes.Buffer{}
+		Expect(png.Encode(orig, testImage())).Should(Succeed())
+		Expect(pngHasMetadata(orig.Bytes())).Should(BeFalse())
+		// An iCCP chunk goes right after IHDR, which is 25 bytes long.
+		iccp := []byte{0, 0, 0, 4, 'i', 'C', 'C', 'P', 'x', 0, 0, 0, 0, 0, 0, 0}
+		withICC := append(append(append([]byte{}, orig.Bytes()[:33]...), iccp...), orig.Bytes()[33:]...)
+		Expect(pngHasMetadata(withICC)).Should(BeTrue())
+	})
+
+	It("Length of an image left alone", func() {
+		Expect(setImageOptimization(true, 80)).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		err = beginResponse(rid, id, 200, makeResponseHeaders("image/png", 9))
+		Expect(err).Should(Succeed())
+		for cmd := pollResponse(rid, true); cmd != "DONE"; cmd = pollResponse(rid, true) {
+			switch cmd[:4] {
+			case "RBOD":
+				sendResponseBodyChunk(rid, true, []byte("Not a PNG"))
+			case "WHDR":
+				Fail("The headers changed")
+			}
+		}
+	})
+
+	It("Not an image", func() {
+		Expect(setImageOptimization(true, 80)).Should(Succeed())
+		Expect(string(run("image/png", []byte("Not a PNG")))).Should(Equal("Not a PNG"))
+	})
+})
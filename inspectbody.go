@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+/*
+ * Let a request handler, such as a WAF, look at the request body as it
+ * would be after decoding its Content-Encoding, while the target still gets
+ * the original bytes, so that nothing is recompressed and signatures over
+ * the body still match. The body streams to the target as usual, and a copy
+ * of each chunk goes through a decoder on another goroutine, which calls
+ * the inspector. A body that can't be decoded is still forwarded, and the
+ * inspector just stops being called. Handlers find InspectDecodedRequestBody
+ * using a type assertion on the http.ResponseWriter.
+ */
+
+// A BodyInspector is called with each piece of the decoded body, which is
+// only valid until it returns. "last" is true once, at the end. Handlers
+// outside this package see it as a plain func([]byte, bool).
+type BodyInspector = func(decoded []byte, last bool)
+
+var errNoInspectBody = errors.New("Only a request handler can inspect the request body")
+
+/*
+ * InspectDecodedRequestBody calls "inspect" with the decoded request body
+ * as it is forwarded. It must be called before the handler returns.
+ */
+func (h *httpResponse) InspectDecodedRequestBody(inspect BodyInspector) error {
+	r, ok := h.handler.(*request)
+	if !ok {
+		return errNoInspectBody
+	}
+	encoding := strings.ToLower(strings.TrimSpace(r.req.Header.Get("Content-Encoding")))
+	var decoder func(io.Reader) (io.Reader, error)
+	if encoding != "" && encoding != "identity" {
+		decoder = bodyDecoders[encoding]
+		if decoder == nil {
+			return fmt.Errorf("Can't decode a request body with Content-Encoding %s", encoding)
+		}
+	}
+	if !r.phase.whileOpen(func() {
+		body := &inspectedBody{
+			src:     r.req.Body,
+			inspect: inspect,
+		}
+		if decoder != nil {
+			pr, pw := io.Pipe()
+			body.pw = pw
+			body.done = make(chan bool)
+			go body.decode(decoder, pr)
+		}
+		r.req.Body = body
+	}) {
+		return tooLate(r, "InspectDecodedRequestBody")
+	}
+	return nil
+}
+
+type inspectedBody struct {
+	src      io.ReadCloser
+	inspect  BodyInspector
+	pw       *io.PipeWriter
+	done     chan bool
+	finished bool
+}
+
+func (b *inspectedBody) Read(p []byte) (int, error) {
+	n, err := b.src.Read(p)
+	if b.pw == nil {
+		if n > 0 || err == io.EOF {
+			b.inspect(p[:n], err == io.EOF)
+		}
+	} else if n > 0 {
+		// This fails if the decoder gave up, which is fine.
+		b.pw.Write(p[:n])
+	}
+	if err != nil {
+		b.finish(err)
+	}
+	return n, err
+}
+
+func (b *inspectedBody) Close() error {
+	b.finish(errBodyStopped)
+	return b.src.Close()
+}
+
+/*
+ * Tell the decoder that there is no more, and wait for it so that the
+ * inspector has seen everything before the body is done.
+ */
+func (b *inspectedBody) finish(err error) {
+	if b.pw == nil || b.finished {
+		return
+	}
+	b.finished = true
+	if err == io.EOF {
+		b.pw.Close()
+	} else {
+		b.pw.CloseWithError(err)
+	}
+	<-b.done
+}
+
+func (b *inspectedBody) decode(decoder func(io.Reader) (io.Reader, error), pr *io.PipeReader) {
+	defer close(b.done)
+	// Anything that the decoder doesn't want is thrown away, so that the
+	// body never waits for it.
+	defer io.Copy(ioutil.Discard, pr)
+
+	decoded, err := decoder(pr)
+	if err != nil {
+		return
+	}
+	buf := make([]byte, bodyBufSize)
+	for {
+		n, err := decoded.Read(buf)
+		if err == io.EOF {
+			b.inspect(buf[:n], true)
+			return
+		}
+		if err != nil {
+			return
+		}
+		if n > 0 {
+			b.inspect(buf[:n], false)
+		}
+	}
+}
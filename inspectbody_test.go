@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Decoded request body inspection", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+	})
+
+	// Send the body in two chunks and return what was forwarded.
+	send := func(encoding string, body []byte) []byte {
+		hdrs := makeRequestHeaders("POST", "/inspectbody", "text/plain", len(body))
+		if encoding != "" {
+			hdrs = addRequestHeader(hdrs, "Content-Encoding", encoding)
+		}
+		Expect(beginRequest(id, hdrs)).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("RBOD"))
+		half := len(body) / 2
+		sendRequestBodyChunk(id, false, body[:half])
+		sendRequestBodyChunk(id, true, body[half:])
+
+		forwarded := &bytes.Buffer{}
+		cmd := pollRequest(id, true)
+		for ; cmd[:4] == "WBOD"; cmd = pollRequest(id, true) {
+			forwarded.Write(readBodyData(cmd))
+		}
+		Expect(cmd).Should(Equal("DONE"))
+		return forwarded.Bytes()
+	}
+
+	It("Gzip", func() {
+		plain := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 2000)
+		buf := &bytes.Buffer{}
+		zw := gzip.NewWriter(buf)
+		zw.Write(plain)
+		zw.Close()
+		compressed := buf.Bytes()
+
+		Expect(send("gzip", compressed)).Should(Equal(compressed))
+		Expect(lastInspectedBody).Should(Equal(plain))
+		Expect(lastInspectedEnd).Should(BeTrue())
+	})
+
+	It("Not encoded", func() {
+		plain := []byte("Hello, World!")
+		Expect(send("", plain)).Should(Equal(plain))
+		Expect(lastInspectedBody).Should(Equal(plain))
+		Expect(lastInspectedEnd).Should(BeTrue())
+	})
+
+	It("Corrupt", func() {
+		garbage := []byte("This is not gzip at all")
+		Expect(send("gzip", garbage)).Should(Equal(garbage))
+		Expect(lastInspectedEnd).Should(BeFalse())
+	})
+})
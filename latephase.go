@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+)
+
+/*
+ * Most of what handlers set using type assertions on the
+ * http.ResponseWriter only works up to a point: a body filter has to be in
+ * place before the body is read, a trailer filter before the trailers
+ * arrive, and a change to the request before it goes to the target. A
+ * handler that finishes its work on another goroutine can easily miss that
+ * point, and the setting used to apply to part of the message, or to none
+ * of it, without a word. Now a late call changes nothing and returns
+ * errTooLate. Since it is always a bug in the handler, it is also logged
+ * and counted in the stats.
+ */
+
+var errTooLate = errors.New("Too late: that part of the message has already been sent")
+
+/*
+ * Log and count a call that came too late, and return the error for it.
+ */
+func tooLate(r *request, what string) error {
+	var id uint32
+	if r != nil {
+		id = r.id
+	}
+	log.Printf("WARNING: Request %d: %s was called too late and had no effect", id, what)
+	updateStats(func(s *stats) {
+		s.LateRegistrations++
+	})
+	return errTooLate
+}
+
+/*
+ * Whether the handler has returned. After that the message is on its way,
+ * so only settings that apply later may change. The handler's other
+ * goroutines check it and make their change while holding the lock, so
+ * that the change can't land while the message is being sent.
+ */
+type handlerPhase struct {
+	lock sync.RWMutex
+	done bool
+}
+
+/*
+ * Record that the handler returned. Once this returns, nothing changes what
+ * the handler could set any more.
+ */
+func (p *handlerPhase) finish() {
+	p.lock.Lock()
+	p.done = true
+	p.lock.Unlock()
+}
+
+/*
+ * Run "set" unless the handler has returned, and return false if it has.
+ * "set" must be quick, and must not call back into the handler.
+ */
+func (p *handlerPhase) whileOpen(set func()) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.done {
+		return false
+	}
+	set()
+	return true
+}
+
+/*
+ * SetRequestHeader sets a header on the request that goes to the target.
+ * Unlike changing the request directly, it returns an error if the request
+ * has already been sent.
+ */
+func (h *httpResponse) SetRequestHeader(name, value string) error {
+	r, ok := h.handler.(*request)
+	if !ok {
+		// The response handler runs after the request was sent.
+		return tooLate(h.owner(), "SetRequestHeader")
+	}
+	if !r.phase.whileOpen(func() {
+		r.req.Header.Set(http.CanonicalHeaderKey(name), value)
+	}) {
+		return tooLate(r, "SetRequestHeader")
+	}
+	return nil
+}
+
+/*
+ * Keep the handler from being marked as done until leave is called, for
+ * something that takes longer, such as reading part of the body. Return
+ * false, and don't wait, if it is done already.
+ */
+func (p *handlerPhase) enter() bool {
+	p.lock.RLock()
+	if p.done {
+		p.lock.RUnlock()
+		return false
+	}
+	return true
+}
+
+func (p *handlerPhase) leave() {
+	p.lock.RUnlock()
+}
+
+/*
+ * Return the phase of the handler that was given this writer.
+ */
+func (h *httpResponse) phase() *handlerPhase {
+	switch handler := h.handler.(type) {
+	case *request:
+		return &handler.phase
+	case *response:
+		return &handler.phase
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Late handler settings", func() {
+	var id uint32
+	var late int64
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		late = getStats().LateRegistrations
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+	})
+
+	// Run "/late" through the request handler, and return its writer.
+	runRequest := func() http.ResponseWriter {
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/late", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		return <-lateWriters
+	}
+
+	It("Body filter after the handler returned", func() {
+		runRequest()
+		rid := createResponse(testHandler)
+		defer freeResponse(rid)
+		Expect(beginResponse(rid, id, 200, makeResponseHeaders("text/plain", 5))).Should(Succeed())
+		w := <-lateWriters
+		// Nothing asked for the body, so the caller sends it as it is.
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+
+		err := w.(interface {
+			SetBodyFilterAsync(func([]byte, bool, func([]byte), func(error))) error
+		}).SetBodyFilterAsync(testAsyncFilter)
+		Expect(err).Should(Equal(errTooLate))
+		Expect(getResponse(rid).resp.Body).ShouldNot(BeAssignableToTypeOf(&asyncFilterBody{}))
+		Expect(getStats().LateRegistrations).Should(Equal(late + 1))
+	})
+
+	It("Body access after the handler returned", func() {
+		w := runRequest().(*httpResponse)
+		body := getRequest(id).req.Body
+		Expect(w.InspectDecodedRequestBody(func([]byte, bool) {})).Should(Equal(errTooLate))
+		Expect(getRequest(id).req.Body).Should(Equal(body))
+		Expect(w.SetResponseChunkSize(10)).Should(Equal(errTooLate))
+		Expect(w.chunkSize).Should(BeZero())
+
+		rid := createResponse(testHandler)
+		defer freeResponse(rid)
+		Expect(beginResponse(rid, id, 200, makeResponseHeaders("text/plain", 5))).Should(Succeed())
+		w = (<-lateWriters).(*httpResponse)
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+		called := false
+		err := w.PeekResponseBody(5, func([]byte, http.Header, int) PeekAction {
+			called = true
+			return PeekContinue
+		})
+		Expect(err).Should(Equal(errTooLate))
+		Expect(called).Should(BeFalse())
+		Expect(getStats().LateRegistrations).Should(Equal(late + 3))
+	})
+
+	It("Body filter after the body was read", func() {
+		r := &response{request: &request{}, readStarted: true}
+		r.resp = &http.Response{Body: http.NoBody}
+		w := &httpResponse{handler: r}
+		Expect(w.SetBodyFilterAsync(testAsyncFilter)).Should(Equal(errTooLate))
+		Expect(r.resp.Body).Should(Equal(http.NoBody))
+
+		r.readStarted = false
+		Expect(w.SetBodyFilterAsync(testAsyncFilter)).Should(Succeed())
+		Expect(r.resp.Body).Should(BeAssignableToTypeOf(&asyncFilterBody{}))
+	})
+
+	It("Request header after the request was sent", func() {
+		w := runRequest().(*httpResponse)
+		Expect(w.SetRequestHeader("X-Late", "1")).Should(Equal(errTooLate))
+		Expect(getRequest(id).req.Header.Get("X-Late")).Should(BeEmpty())
+
+		r := &request{req: httptest.NewRequest("GET", "/", nil)}
+		w = &httpResponse{handler: r}
+		Expect(w.SetRequestHeader("x-early", "1")).Should(Succeed())
+		Expect(r.req.Header.Get("X-Early")).Should(Equal("1"))
+
+		w = &httpResponse{handler: &response{request: r}}
+		Expect(w.SetRequestHeader("X-Late", "1")).Should(Equal(errTooLate))
+		Expect(r.req.Header.Get("X-Late")).Should(BeEmpty())
+		Expect(getStats().LateRegistrations).Should(Equal(late + 2))
+	})
+
+	It("Request header while the request is sent", func() {
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/late", "", 0))).Should(Succeed())
+		w := (<-lateWriters).(*httpResponse)
+		// Either the header is set before the request goes, or not at all.
+		set := 0
+		for w.SetRequestHeader("X-Late", "1") == nil {
+			set++
+		}
+		cmd := pollRequest(id, true)
+		if set > 0 {
+			Expect(cmd).Should(HavePrefix("WHDR"))
+			Expect(cmd).Should(ContainSubstring("X-Late: 1"))
+			cmd = pollRequest(id, true)
+		}
+		Expect(cmd).Should(Equal("DONE"))
+	})
+
+	It("Trailer filter after the trailers arrived", func() {
+		r := &request{trailersSent: true}
+		w := &httpResponse{handler: r}
+		Expect(w.SetRequestTrailerFilter(func(http.Header) {})).Should(Equal(errTooLate))
+		Expect(r.trailerFilter).Should(BeNil())
+	})
+
+	It("Transparent mode after the handler returned", func() {
+		w := runRequest().(*httpResponse)
+		Expect(w.SetTransparentMode()).Should(Equal(errTooLate))
+		Expect(getRequest(id).transparent).Should(BeFalse())
+	})
+})
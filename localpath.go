@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/*
+ * Some paths, such as "/metrics," are served by the handler and must never
+ * reach the target. The caller registers their prefixes, and a request under
+ * one of them runs the handler as usual, but is never forwarded. The handler
+ * has to write the whole response. If it doesn't, the client gets a 404
+ * rather than whatever the target would have said. The path that is checked
+ * is the one that would be forwarded, after normalization and every rewrite,
+ * so that no spelling of the path can get a local one to the target.
+ */
+
+const noLocalResponseMessage = "Not found"
+
+func disableForwardingForPath(prefix string) error {
+	prefix = strings.TrimSpace(prefix)
+	if !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("Path prefix must start with \"/\": \"%s\"", prefix)
+	}
+	prefix = strings.TrimRight(prefix, "/")
+	updateSettings(func(s *settings) {
+		for _, p := range s.localPaths {
+			if p == prefix {
+				return
+			}
+		}
+		paths := make([]string, len(s.localPaths), len(s.localPaths)+1)
+		copy(paths, s.localPaths)
+		s.localPaths = append(paths, prefix)
+	})
+	return nil
+}
+
+/*
+ * Return true if the path is under a prefix that is served locally. A
+ * prefix only matches whole segments, so "/metrics" doesn't match
+ * "/metricsfoo." The prefix "/" matches everything.
+ */
+func (s *settings) isLocalPath(path string) bool {
+	for _, prefix := range s.localPaths {
+		if prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Answer a request for a local path that the handler left alone.
+ */
+func (r *request) checkLocalResponse() {
+	if r.proxying && !r.failed && r.settings.isLocalPath(r.req.URL.Path) {
+		r.reject(http.StatusNotFound, noLocalResponseMessage)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Local paths", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		resetSettings()
+	})
+
+	It("Handler responds", func() {
+		Expect(disableForwardingForPath("/returnbody")).Should(Succeed())
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/returnbody", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("SWCH200"))
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("WBOD"))
+		Expect(string(readBodyData(cmd))).Should(Equal("Hello! I am the server!"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Handler doesn't respond", func() {
+		Expect(disableForwardingForPath("/metrics")).Should(Succeed())
+		Expect(disableForwardingForPath("/pass/")).Should(Succeed())
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("SWCH404"))
+		Expect(pollRequest(id, true)).Should(HavePrefix("WHDR"))
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("WBOD"))
+		Expect(string(readBodyData(cmd))).Should(Equal(noLocalResponseMessage))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Rewritten to a local path", func() {
+		Expect(disableForwardingForPath("/pass/metrics")).Should(Succeed())
+		Expect(addExactPathRewrite("/pass/stats", "/pass/metrics")).Should(Succeed())
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/pass/stats", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("SWCH404"))
+		Expect(pollRequest(id, true)).Should(HavePrefix("WHDR"))
+		Expect(pollRequest(id, true)).Should(HavePrefix("WBOD"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Normalized to a local path", func() {
+		setNormalizeURL(true)
+		Expect(disableForwardingForPath("/pass/metrics")).Should(Succeed())
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/pass/x/../%6detrics", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("SWCH404"))
+		Expect(pollRequest(id, true)).Should(HavePrefix("WHDR"))
+		Expect(pollRequest(id, true)).Should(HavePrefix("WBOD"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Rewritten away from a local path", func() {
+		Expect(disableForwardingForPath("/pass/metrics")).Should(Succeed())
+		Expect(addExactPathRewrite("/pass/metrics", "/pass/stats")).Should(Succeed())
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/pass/metrics", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(HavePrefix("WURI"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Other paths", func() {
+		Expect(disableForwardingForPath("/pa")).Should(Succeed())
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Matching", func() {
+		s := settings{}
+		s.localPaths = []string{"/metrics", "/admin/status"}
+		Expect(s.isLocalPath("/metrics")).Should(BeTrue())
+		Expect(s.isLocalPath("/metrics/cpu")).Should(BeTrue())
+		Expect(s.isLocalPath("/metricsfoo")).Should(BeFalse())
+		Expect(s.isLocalPath("/admin/status/x")).Should(BeTrue())
+		Expect(s.isLocalPath("/admin")).Should(BeFalse())
+		s.localPaths = []string{""}
+		Expect(s.isLocalPath("/anything")).Should(BeTrue())
+	})
+
+	It("Invalid", func() {
+		Expect(disableForwardingForPath("metrics")).ShouldNot(Succeed())
+		Expect(disableForwardingForPath("")).ShouldNot(Succeed())
+	})
+})
@@ -10,6 +10,7 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"unsafe"
 )
@@ -186,6 +187,20 @@ func (m *weaverHandler) processRequest(
 				}
 				resp.Write(chunk)
 			}
+		case cmdWshr:
+			// Only a response is ever sent this way
+			id, _ := strconv.ParseInt(msg, 16, 32)
+			if !sentHeaders {
+				resp.WriteHeader(responseCode)
+				sentHeaders = true
+			}
+			resp.Write(chunkBytes(int32(id)))
+			GoReleaseChunk(int32(id))
+		case cmdXcmd:
+			// This server has no extensions, but the payload must still be freed.
+			if sp := strings.IndexByte(msg, ' '); sp >= 0 {
+				getChunkData(msg[sp+1:])
+			}
 		case cmdSwch:
 			proxying = false
 			responseCode, _ = strconv.Atoi(msg)
@@ -248,6 +263,8 @@ func (m *weaverHandler) processResponse(
 			responseCode, _ = strconv.Atoi(msg)
 		case cmdWhdr:
 			parseHeaders(resp.Header(), msg)
+		case cmdSbod:
+			// The whole request body has already been sent
 		case cmdRbod:
 			ptr, len := sliceToPtr(requestBody.Bytes())
 			GoSendResponseBodyChunk(rid, 1, ptr, len)
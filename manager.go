@@ -42,6 +42,9 @@ type commandHandler interface {
 	Headers() http.Header
 	ResponseWritten()
 	StartRead()
+	SafePoint()
+	BodyStopped() chan bool
+	ChunkSent(chunk []byte)
 }
 
 /*
@@ -131,20 +134,35 @@ func createResponse(handlerID string) uint32 {
  * Begin the request by sending in a set of headers.
  */
 func beginRequest(id uint32, rawHeaders string) error {
+	if isShuttingDown() {
+		return errShuttingDown
+	}
 	req := getRequest(id)
 	if req == nil {
 		return fmt.Errorf("Unknown request: %d", id)
 	}
 
+	updateStats(func(s *stats) {
+		s.Requests++
+	})
 	return req.begin(rawHeaders)
 }
 
 func beginResponse(responseID, requestID, status uint32, rawHeaders string) error {
+	if isShuttingDown() {
+		return errShuttingDown
+	}
 	r := getResponse(responseID)
 	if r == nil {
 		return fmt.Errorf("Unknown response: %d", responseID)
 	}
-	req := getRequest(requestID)
+	managerLatch.Lock()
+	req := requests[requestID]
+	if req != nil && r.request == nil {
+		// Released when the response is freed
+		req.holds++
+	}
+	managerLatch.Unlock()
 	if req == nil {
 		return fmt.Errorf("Unknown request: %d", requestID)
 	}
@@ -152,6 +170,19 @@ func beginResponse(responseID, requestID, status uint32, rawHeaders string) erro
 	return r.begin(status, rawHeaders, req)
 }
 
+/*
+ * Change the priority of a request. This only matters when the priority
+ * queue is enabled, and it must be done before the request begins.
+ */
+func setRequestPriority(id uint32, priority int32) error {
+	req := getRequest(id)
+	if req == nil {
+		return fmt.Errorf("Unknown request: %d", id)
+	}
+	req.priority = priority
+	return nil
+}
+
 /*
  * Get status of the request, without blocking. The result will be a single
  * string that represents a command, or an empty string if there is none.
@@ -181,19 +212,76 @@ func pollResponse(id uint32, block bool) string {
 	return resp.pollNB()
 }
 
+/*
+ * Pause a request the next time that it reaches a safe point, and resume it
+ * again later.
+ */
+func pauseRequest(id uint32) error {
+	req := getRequest(id)
+	if req == nil {
+		return fmt.Errorf("Unknown request: %d", id)
+	}
+	req.gate.pause()
+	return nil
+}
+
+func resumeRequest(id uint32) error {
+	req := getRequest(id)
+	if req == nil {
+		return fmt.Errorf("Unknown request: %d", id)
+	}
+	req.gate.resume()
+	return nil
+}
+
 /*
  * Free the slot for a request.
  */
 func freeRequest(id uint32) {
+	removeRequest(id, true)
+}
+
+/*
+ * Free the slot for a request, and put the request back in the pool once
+ * nothing is using it if "reuse" is true.
+ */
+func removeRequest(id uint32, reuse bool) {
 	managerLatch.Lock()
+	req := requests[id]
 	delete(requests, id)
 	managerLatch.Unlock()
+	releasePayload(id)
+
+	if req != nil {
+		stopped := req.stopSlowTimer()
+		stopped = req.stopDurationTimer() && stopped
+		req.cancel()
+		req.releaseUpstream()
+		freePendingChunks(req.cmds)
+		// Don't leave a paused goroutine behind.
+		req.gate.resume()
+
+		managerLatch.Lock()
+		req.freed = reuse
+		req.timerStopped = stopped
+		req.recycle()
+		managerLatch.Unlock()
+	}
 }
 
 func freeResponse(id uint32) {
 	managerLatch.Lock()
+	defer managerLatch.Unlock()
+	resp := responses[id]
 	delete(responses, id)
-	managerLatch.Unlock()
+	releasePayload(id)
+	if resp != nil {
+		freePendingChunks(resp.cmds)
+	}
+	if resp != nil && resp.request != nil {
+		resp.request.holds--
+		resp.request.recycle()
+	}
 }
 
 /*
@@ -201,6 +289,9 @@ func freeResponse(id uint32) {
  */
 func sendRequestBodyChunk(id uint32, last bool, chunk []byte) {
 	req := getRequest(id)
+	if req != nil && last {
+		req.bodyReceived()
+	}
 	sendChunk(req, last, chunk)
 }
 
@@ -237,7 +328,19 @@ func sendChunk(h commandHandler, last bool, chunk []byte) {
 		return
 	}
 	if len(chunk) > 0 {
-		h.Bodies() <- chunk
+		select {
+		case <-h.BodyStopped():
+			// Don't take up space in the queue if nobody will read it.
+			chunk = nil
+		default:
+		}
+	}
+	if len(chunk) > 0 {
+		select {
+		case h.Bodies() <- chunk:
+		case <-h.BodyStopped():
+			// Nobody is going to read it.
+		}
 	}
 	if last {
 		close(h.Bodies())
@@ -571,3 +571,7 @@ func readBodyData(cmd string) []byte {
 	Expect(err).Should(Succeed())
 	return getChunkDataByID(int32(id))
 }
+
+func addRequestHeader(rawHeaders, name, value string) string {
+	return strings.TrimSuffix(rawHeaders, "\r\n") + name + ": " + value + "\r\n\r\n"
+}
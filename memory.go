@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Give memory back before the process runs out of it. Memory pressure has
+ * three levels: none, moderate, and critical. The caller signals it using
+ * GoSignalMemoryPressure, or the monitor does, by comparing the heap to a
+ * limit set with GoSetMemoryLimit. Each signal above none runs the
+ * reclaimers in order of priority, lowest first, and the bytes that they
+ * free are added to the stats. While the pressure is critical, nothing new
+ * goes into the negative cache, no requests are sampled for HAR, and HAR
+ * sampling can't be turned on.
+ */
+
+const (
+	memoryPressureNone = iota
+	memoryPressureModerate
+	memoryPressureCritical
+)
+
+// The share of the limit at which the monitor signals each level
+const (
+	moderateMemoryShare = 0.75
+	criticalMemoryShare = 0.9
+)
+
+var errMemoryPressure = errors.New("Memory pressure is critical")
+
+/*
+ * A Reclaimer frees what it can at memory pressure "level," and returns
+ * about how many bytes that was.
+ */
+type Reclaimer func(level int) int64
+
+type reclaimer struct {
+	name     string
+	priority int
+	reclaim  Reclaimer
+}
+
+var reclaimers = []reclaimer{
+	{name: "negativeCache", priority: 10, reclaim: reclaimNegativeCache},
+	{name: "harCapture", priority: 20, reclaim: reclaimHARCapture},
+	{name: "idleConnections", priority: 30, reclaim: reclaimIdleConnections},
+}
+var reclaimersLock = sync.Mutex{}
+
+// Set with atomic operations
+var memoryPressure int32
+
+type reclaimResult struct {
+	Name  string
+	Bytes int64
+}
+
+/*
+ * RegisterReclaimer adds a reclaimer, or replaces the one with the same
+ * name. Reclaimers with the same priority run in the order they were added.
+ */
+func RegisterReclaimer(name string, priority int, reclaim Reclaimer) {
+	reclaimersLock.Lock()
+	defer reclaimersLock.Unlock()
+	list := make([]reclaimer, 0, len(reclaimers)+1)
+	for _, r := range reclaimers {
+		if r.name != name {
+			list = append(list, r)
+		}
+	}
+	if reclaim != nil {
+		list = append(list, reclaimer{name: name, priority: priority, reclaim: reclaim})
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].priority < list[j].priority
+	})
+	reclaimers = list
+}
+
+/*
+ * Set the level, and run the reclaimers if there is any pressure at all.
+ */
+func signalMemoryPressure(level int) ([]reclaimResult, error) {
+	if level < memoryPressureNone || level > memoryPressureCritical {
+		return nil, fmt.Errorf("Invalid memory pressure level %d", level)
+	}
+	atomic.StoreInt32(&memoryPressure, int32(level))
+	if level == memoryPressureNone {
+		return nil, nil
+	}
+
+	reclaimersLock.Lock()
+	list := reclaimers
+	reclaimersLock.Unlock()
+	results := make([]reclaimResult, len(list))
+	var total int64
+	for i, r := range list {
+		results[i] = reclaimResult{Name: r.name, Bytes: r.reclaim(level)}
+		total += results[i].Bytes
+	}
+	updateStats(func(s *stats) {
+		s.MemoryPressureSignals++
+		s.ReclaimedBytes += total
+	})
+	return results, nil
+}
+
+func isMemoryCritical() bool {
+	return atomic.LoadInt32(&memoryPressure) >= memoryPressureCritical
+}
+
+/*
+ * Drop expired entries, or everything if the pressure is critical.
+ */
+func reclaimNegativeCache(level int) int64 {
+	negativeCacheLock.Lock()
+	defer negativeCacheLock.Unlock()
+	before := negativeCacheBytes
+	now := time.Now()
+	for k, e := range negativeCache {
+		if level >= memoryPressureCritical || now.After(e.expires) {
+			removeNegativeEntry(k)
+		}
+	}
+	return int64(before - negativeCacheBytes)
+}
+
+/*
+ * Write out the HAR entries that are waiting for the flush interval.
+ */
+func reclaimHARCapture(level int) int64 {
+	if sampler := getSettings().harSampler; sampler != nil {
+		return sampler.reclaim()
+	}
+	return 0
+}
+
+/*
+ * Idle connections to upstreams hold buffers, but how big they are isn't
+ * known, so this one reports nothing.
+ */
+func reclaimIdleConnections(level int) int64 {
+	transportLock.Lock()
+	t := currentTransport.transport
+	transportLock.Unlock()
+	t.CloseIdleConnections()
+	return 0
+}
+
+// Protected by memoryMonitorLock
+var memoryMonitorStop chan bool
+var memoryMonitorDone chan bool
+var memoryMonitorLock = sync.Mutex{}
+
+/*
+ * Check the heap against "limit" every "interval," and signal the level
+ * whenever it changes. A limit of zero stops the monitor.
+ */
+func setMemoryLimit(limit uint64, interval time.Duration) error {
+	if limit > 0 && interval <= 0 {
+		return fmt.Errorf("Invalid memory check interval %v", interval)
+	}
+	memoryMonitorLock.Lock()
+	defer memoryMonitorLock.Unlock()
+	if memoryMonitorStop != nil {
+		// Wait, so that the old monitor can't signal after this returns.
+		close(memoryMonitorStop)
+		<-memoryMonitorDone
+		memoryMonitorStop = nil
+	}
+	if limit > 0 {
+		memoryMonitorStop = make(chan bool)
+		memoryMonitorDone = make(chan bool)
+		go monitorMemory(limit, interval, memoryMonitorStop, memoryMonitorDone)
+	}
+	return nil
+}
+
+func monitorMemory(limit uint64, interval time.Duration, stop, done chan bool) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			var mem runtime.MemStats
+			runtime.ReadMemStats(&mem)
+			level := memoryLevel(mem.HeapAlloc, limit)
+			if int32(level) != atomic.LoadInt32(&memoryPressure) {
+				signalMemoryPressure(level)
+			}
+		}
+	}
+}
+
+func memoryLevel(heap, limit uint64) int {
+	switch {
+	case float64(heap) >= float64(limit)*criticalMemoryShare:
+		return memoryPressureCritical
+	case float64(heap) >= float64(limit)*moderateMemoryShare:
+		return memoryPressureModerate
+	default:
+		return memoryPressureNone
+	}
+}
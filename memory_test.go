@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Memory pressure", func() {
+	AfterEach(func() {
+		Expect(setMemoryLimit(0, 0)).Should(Succeed())
+		signalMemoryPressure(memoryPressureNone)
+		clearNegativeCache()
+		resetSettings()
+	})
+
+	names := func(results []reclaimResult) []string {
+		var n []string
+		for _, r := range results {
+			n = append(n, r.Name)
+		}
+		return n
+	}
+
+	It("Reclaimers run in order", func() {
+		var order []string
+		register := func(name string, priority int, size int64) {
+			RegisterReclaimer(name, priority, func(level int) int64 {
+				Expect(level).Should(Equal(memoryPressureModerate))
+				order = append(order, name)
+				return size
+			})
+		}
+		register("third", 25, 300)
+		register("first", 5, 100)
+		register("second", 15, 200)
+		defer func() {
+			for _, name := range []string{"first", "second", "third"} {
+				RegisterReclaimer(name, 0, nil)
+			}
+		}()
+
+		before := getStats()
+		results, err := signalMemoryPressure(memoryPressureModerate)
+		Expect(err).Should(Succeed())
+		Expect(order).Should(Equal([]string{"first", "second", "third"}))
+		Expect(names(results)).Should(Equal([]string{"first", "negativeCache", "second",
+			"harCapture", "third", "idleConnections"}))
+		after := getStats()
+		Expect(after.ReclaimedBytes - before.ReclaimedBytes).Should(BeEquivalentTo(600))
+		Expect(after.MemoryPressureSignals - before.MemoryPressureSignals).Should(BeEquivalentTo(1))
+	})
+
+	It("Negative cache", func() {
+		putNegativeEntry("fresh", &negativeEntry{
+			body:    make([]byte, 100),
+			expires: time.Now().Add(time.Hour),
+		})
+		putNegativeEntry("stale", &negativeEntry{
+			body:    make([]byte, 50),
+			expires: time.Now().Add(-time.Second),
+		})
+		Expect(reclaimNegativeCache(memoryPressureModerate)).Should(BeEquivalentTo(50))
+		Expect(getNegativeCacheBytes()).Should(Equal(100))
+
+		results, err := signalMemoryPressure(memoryPressureCritical)
+		Expect(err).Should(Succeed())
+		Expect(results[0]).Should(Equal(reclaimResult{Name: "negativeCache", Bytes: 100}))
+		Expect(getNegativeCacheBytes()).Should(BeZero())
+
+		// Nothing new goes in until the pressure is gone.
+		putNegativeEntry("fresh", &negativeEntry{body: make([]byte, 10), expires: time.Now().Add(time.Hour)})
+		Expect(getNegativeCacheBytes()).Should(BeZero())
+		signalMemoryPressure(memoryPressureNone)
+		putNegativeEntry("fresh", &negativeEntry{body: make([]byte, 10), expires: time.Now().Add(time.Hour)})
+		Expect(getNegativeCacheBytes()).Should(Equal(10))
+	})
+
+	It("HAR capture", func() {
+		sink := &bytes.Buffer{}
+		Expect(SetHARSampler(1, 1024, sink)).Should(Succeed())
+		SetHARFlushInterval(time.Hour)
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/senderror", "", 0))).Should(Succeed())
+		for cmd := pollRequest(id, true); cmd != "DONE"; cmd = pollRequest(id, true) {
+		}
+		Expect(sink.Len()).Should(BeZero())
+
+		results, err := signalMemoryPressure(memoryPressureModerate)
+		Expect(err).Should(Succeed())
+		Expect(results[1].Name).Should(Equal("harCapture"))
+		Expect(results[1].Bytes).Should(BeNumerically(">", 0))
+		Expect(SetHARSampler(0, 0, nil)).Should(Succeed())
+		Expect(sink.Len()).ShouldNot(BeZero())
+	})
+
+	It("No new captures when critical", func() {
+		_, err := signalMemoryPressure(memoryPressureCritical)
+		Expect(err).Should(Succeed())
+		Expect(SetHARSampler(1, 1024, &bytes.Buffer{})).Should(Equal(errMemoryPressure))
+		// Turning it off is still allowed.
+		Expect(SetHARSampler(0, 0, nil)).Should(Succeed())
+		signalMemoryPressure(memoryPressureNone)
+		Expect(SetHARSampler(1, 1024, &bytes.Buffer{})).Should(Succeed())
+	})
+
+	It("Monitor", func() {
+		Expect(memoryLevel(70, 100)).Should(Equal(memoryPressureNone))
+		Expect(memoryLevel(80, 100)).Should(Equal(memoryPressureModerate))
+		Expect(memoryLevel(95, 100)).Should(Equal(memoryPressureCritical))
+
+		before := getStats().MemoryPressureSignals
+		Expect(setMemoryLimit(1, time.Millisecond)).Should(Succeed())
+		Eventually(func() int32 {
+			return atomic.LoadInt32(&memoryPressure)
+		}).Should(BeEquivalentTo(memoryPressureCritical))
+		Expect(setMemoryLimit(0, 0)).Should(Succeed())
+		Expect(getStats().MemoryPressureSignals).Should(BeNumerically(">", before))
+	})
+
+	It("Invalid", func() {
+		_, err := signalMemoryPressure(3)
+		Expect(err).ShouldNot(Succeed())
+		Expect(setMemoryLimit(1024, 0)).ShouldNot(Succeed())
+	})
+})
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+/*
+#include <stdlib.h>
+
+typedef char* (*weaverMinifier)(const char* data, size_t len, size_t* outLen);
+
+static char* callMinifier(void* fn, const char* data, size_t len, size_t* outLen) {
+	return ((weaverMinifier)fn)(data, len, outLen);
+}
+*/
+import "C"
+
+/*
+ * Minify response bodies of certain content types before they go to the
+ * client. Weaver has an HTML minifier that only collapses whitespace, and
+ * the caller may register its own minifiers written in C. Since the body has
+ * to be read in full first, it is read and minified after the handler
+ * returns, and the Content-Length is removed, unless something else that
+ * buffers the body puts it back. A body that the minifier leaves alone, or
+ * that turns out to be too big to hold, is sent as it is, with its length.
+ */
+
+// The biggest body that is minified. This is replaced by tests.
+var maxMinifiedBody int64 = 4 * 1024 * 1024
+
+// A minifier returns the minified body, or nil to leave it alone
+type minifier func([]byte) []byte
+
+var minifiers = map[string]minifier{
+	"text/html": minifyHTML,
+}
+var minifiersLock = sync.Mutex{}
+
+func registerMinifier(contentType string, m minifier) {
+	minifiersLock.Lock()
+	defer minifiersLock.Unlock()
+	minifiers[strings.ToLower(contentType)] = m
+}
+
+func getMinifier(contentType string) minifier {
+	minifiersLock.Lock()
+	defer minifiersLock.Unlock()
+	return minifiers[contentType]
+}
+
+/*
+ * Register a minifier written in C. It is called with the body and its
+ * length, and returns a new body allocated using malloc, which weaver frees,
+ * and sets "outLen." If it returns NULL, the body is sent as it was.
+ */
+func registerCMinifier(contentType string, fn unsafe.Pointer) error {
+	if fn == nil {
+		return fmt.Errorf("Invalid minifier for %s", contentType)
+	}
+	registerMinifier(contentType, func(body []byte) []byte {
+		if len(body) == 0 {
+			return nil
+		}
+		var outLen C.size_t
+		out := C.callMinifier(fn, (*C.char)(unsafe.Pointer(&body[0])),
+			C.size_t(len(body)), &outLen)
+		if out == nil {
+			return nil
+		}
+		defer C.free(unsafe.Pointer(out))
+		return C.GoBytes(unsafe.Pointer(out), C.int(outLen))
+	})
+	return nil
+}
+
+func setResponseMinification(contentType string, enabled bool) error {
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	if enabled && getMinifier(contentType) == nil {
+		return fmt.Errorf("No minifier for %s", contentType)
+	}
+	updateSettings(func(s *settings) {
+		types := make(map[string]bool)
+		for t := range s.minifyTypes {
+			types[t] = true
+		}
+		if enabled {
+			types[contentType] = true
+		} else {
+			delete(types, contentType)
+		}
+		s.minifyTypes = types
+	})
+	return nil
+}
+
+/*
+ * Decide, before the handler runs, whether the body should be minified.
+ * A body that is still compressed is left alone.
+ */
+func (r *response) findMinifier() minifier {
+	s := r.request.settings
+	if (len(s.minifyTypes) == 0 && s.imageQuality == 0) ||
+		r.resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(r.resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil
+	}
+	if m := findImageOptimizer(mediaType, s.imageQuality); m != nil {
+		return m
+	}
+	if !s.minifyTypes[mediaType] {
+		return nil
+	}
+	return recordMinified(getMinifier(mediaType))
+}
+
+/*
+ * Wrap a minifier so that it always returns a body no bigger than the one
+ * it was given, and count what it did in the statistics.
+ */
+func recordMinified(m minifier) minifier {
+	if m == nil {
+		return nil
+	}
+	return func(body []byte) []byte {
+		out := smallest(body, m(body))
+		updateStats(func(s *stats) {
+			s.MinifiedResponses++
+			s.MinifyBytesIn += int64(len(body))
+			s.MinifyBytesOut += int64(len(out))
+		})
+		return out
+	}
+}
+
+func smallest(body, minified []byte) []byte {
+	if minified == nil || len(minified) > len(body) {
+		return body
+	}
+	return minified
+}
+
+func (r *response) startMinify() {
+	if r.minify == nil || r.written || r.headersSent {
+		return
+	}
+	length := r.resp.Header.Get("Content-Length")
+	body := &minifiedBody{
+		body:   r.resp.Body,
+		minify: r.minify,
+	}
+	r.resp.Body = body
+	// Minify now, so that the headers can say whether the body changed.
+	r.readingAhead = true
+	unchanged := body.fill()
+	r.readingAhead = false
+	r.readStarted = false
+	if unchanged && length != "" {
+		return
+	}
+	r.resp.Header.Del("Content-Length")
+	r.resp.ContentLength = -1
+}
+
+type minifiedBody struct {
+	body   io.ReadCloser
+	minify minifier
+	out    io.Reader
+	err    error
+}
+
+/*
+ * Read and minify the body, and return true if it is sent as it was.
+ */
+func (b *minifiedBody) fill() bool {
+	body, err := ioutil.ReadAll(io.LimitReader(b.body, maxMinifiedBody+1))
+	if err != nil {
+		b.err = err
+		return false
+	}
+	if int64(len(body)) > maxMinifiedBody {
+		b.out = io.MultiReader(bytes.NewReader(body), b.body)
+		return true
+	}
+	out := smallest(body, b.minify(body))
+	b.out = bytes.NewReader(out)
+	return bytes.Equal(out, body)
+}
+
+func (b *minifiedBody) Read(p []byte) (int, error) {
+	if b.out == nil && b.err == nil {
+		b.fill()
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.out.Read(p)
+}
+
+func (b *minifiedBody) Close() error {
+	return b.body.Close()
+}
+
+type minificationStats struct {
+	Responses  int64 `json:"responses"`
+	BytesIn    int64 `json:"bytesIn"`
+	BytesOut   int64 `json:"bytesOut"`
+	BytesSaved int64 `json:"bytesSaved"`
+}
+
+func getMinificationStatsJSON() string {
+	s := getStats()
+	ms := minificationStats{
+		Responses:  s.MinifiedResponses,
+		BytesIn:    s.MinifyBytesIn,
+		BytesOut:   s.MinifyBytesOut,
+		BytesSaved: s.MinifyBytesIn - s.MinifyBytesOut,
+	}
+	buf, err := json.Marshal(&ms)
+	if err != nil {
+		return "{}"
+	}
+	return string(buf)
+}
+
+// The contents of these elements are copied exactly
+var rawHTMLElements = []string{"pre", "textarea", "script", "style"}
+
+/*
+ * Collapse every run of whitespace in an HTML document to a single space,
+ * or a newline if the run had one, except inside comments, attribute
+ * values, and the elements where whitespace matters.
+ */
+func minifyHTML(in []byte) []byte {
+	out := make([]byte, 0, len(in))
+	for i := 0; i < len(in); {
+		if in[i] == '<' {
+			if end := rawHTMLEnd(in, i); end > i {
+				out = append(out, in[i:end]...)
+				i = end
+				continue
+			}
+			if i+1 < len(in) && (in[i+1] == '/' || isASCIILetter(in[i+1])) {
+				end := len(in)
+				if n := htmlTagEnd(in[i:]); n >= 0 {
+					end = i + n + 1
+				}
+				out = appendHTMLTag(out, in[i:end])
+				i = end
+				continue
+			}
+		}
+		if !isHTMLSpace(in[i]) {
+			out = append(out, in[i])
+			i++
+			continue
+		}
+		var sep byte
+		sep, i = skipHTMLSpace(in, i)
+		out = append(out, sep)
+	}
+	return out
+}
+
+/*
+ * Skip the run of whitespace at "i," and return what it collapses to and
+ * the index after it.
+ */
+func skipHTMLSpace(in []byte, i int) (byte, int) {
+	sep := byte(' ')
+	for ; i < len(in) && isHTMLSpace(in[i]); i++ {
+		if in[i] == '\n' {
+			sep = '\n'
+		}
+	}
+	return sep, i
+}
+
+/*
+ * If a comment or raw element starts at "start," return the index just
+ * past its end, or the end of the input if it isn't closed.
+ */
+func rawHTMLEnd(in []byte, start int) int {
+	rest := in[start:]
+	if bytes.HasPrefix(rest, []byte("<!--")) {
+		if end := bytes.Index(rest[4:], []byte("-->")); end >= 0 {
+			return start + 4 + end + 3
+		}
+		return len(in)
+	}
+	for _, name := range rawHTMLElements {
+		tag := []byte("<" + name)
+		if len(rest) <= len(tag) || !bytes.EqualFold(rest[:len(tag)], tag) {
+			continue
+		}
+		if c := rest[len(tag)]; c != '>' && c != '/' && !isHTMLSpace(c) {
+			continue
+		}
+		closeTag := []byte("</" + name)
+		if end := indexFold(rest[len(tag):], closeTag); end >= 0 {
+			return start + len(tag) + end + len(closeTag)
+		}
+		return len(in)
+	}
+	return start
+}
+
+/*
+ * Append a tag, collapsing the whitespace between its attributes but
+ * copying quoted values exactly.
+ */
+func appendHTMLTag(out, tag []byte) []byte {
+	var quote byte
+	for i := 0; i < len(tag); {
+		c := tag[i]
+		if quote == 0 && isHTMLSpace(c) {
+			var sep byte
+			sep, i = skipHTMLSpace(tag, i)
+			out = append(out, sep)
+			continue
+		}
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		}
+		out = append(out, c)
+		i++
+	}
+	return out
+}
+
+func isHTMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Minification", func() {
+	var id, rid uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		rid = createResponse(testHandler)
+		Expect(rid).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		freeResponse(rid)
+		resetSettings()
+	})
+
+	// Send the body in two chunks, and return the new headers and body.
+	run := func(contentType, body string) (http.Header, string) {
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		err = beginResponse(rid, id, 200, makeResponseHeaders(contentType, len(body)))
+		Expect(err).Should(Succeed())
+
+		hdrs := http.Header{}
+		buf := &bytes.Buffer{}
+		for cmd := pollResponse(rid, true); cmd != "DONE"; cmd = pollResponse(rid, true) {
+			switch cmd[:4] {
+			case "RBOD":
+				sendResponseBodyChunk(rid, false, []byte(body[:len(body)/2]))
+				sendResponseBodyChunk(rid, true, []byte(body[len(body)/2:]))
+			case "WHDR":
+				parseHeaders(hdrs, cmd[4:])
+			case "WBOD":
+				buf.Write(readBodyData(cmd))
+			default:
+				Fail("Unexpected command " + cmd)
+			}
+		}
+		return hdrs, buf.String()
+	}
+
+	It("HTML", func() {
+		Expect(minifyHTML([]byte("<p>  Hello,\n\t  World!  </p>"))).
+			Should(Equal([]byte("<p> Hello,\nWorld! </p>")))
+	})
+
+	It("HTML raw elements", func() {
+		html := "<div>\n  <PRE>  keep\n  this </pre>  <!--  and  this -->" +
+			"<script type=\"x\">a  =  1</script>  <p>x</p>"
+		Expect(string(minifyHTML([]byte(html)))).Should(Equal(
+			"<div>\n<PRE>  keep\n  this </pre> <!--  and  this -->" +
+				"<script type=\"x\">a  =  1</script> <p>x</p>"))
+		Expect(string(minifyHTML([]byte("<pre>  open")))).Should(Equal("<pre>  open"))
+		Expect(string(minifyHTML([]byte("<preview>  x")))).Should(Equal("<preview> x"))
+	})
+
+	It("HTML attributes", func() {
+		html := "<p  class=\"a   b\"\n  title='x  >  y'>  z  </p>"
+		Expect(string(minifyHTML([]byte(html)))).Should(Equal(
+			"<p class=\"a   b\"\ntitle='x  >  y'> z </p>"))
+		Expect(string(minifyHTML([]byte("<a  href=\"x  y")))).Should(Equal("<a href=\"x  y"))
+		Expect(string(minifyHTML([]byte("a < b  and  it's")))).Should(Equal("a < b and it's"))
+	})
+
+	It("Raw elements in any case", func() {
+		html := "<Script>a  =  1</SCRIPT>  <p>x</p>"
+		Expect(string(minifyHTML([]byte(html)))).Should(Equal(
+			"<Script>a  =  1</SCRIPT> <p>x</p>"))
+		Expect(indexFold([]byte("ab</ScRiPt"), []byte("</script"))).Should(Equal(2))
+		Expect(indexFold([]byte("ab</scrip"), []byte("</script"))).Should(Equal(-1))
+	})
+
+	It("Too big", func() {
+		defer func(max int64) { maxMinifiedBody = max }(maxMinifiedBody)
+		maxMinifiedBody = 8
+		Expect(setResponseMinification("text/html", true)).Should(Succeed())
+		html := "<p>   Hello,   World!   </p>"
+		hdrs, body := run("text/html", html)
+		Expect(body).Should(Equal(html))
+		// The headers didn't change, so they weren't sent again.
+		Expect(hdrs).Should(BeEmpty())
+	})
+
+	It("Nothing to minify", func() {
+		Expect(setResponseMinification("text/html", true)).Should(Succeed())
+		hdrs, body := run("text/html", "<p>Hello</p>")
+		Expect(body).Should(Equal("<p>Hello</p>"))
+		Expect(hdrs).Should(BeEmpty())
+	})
+
+	It("Enabled", func() {
+		Expect(setResponseMinification("text/html", true)).Should(Succeed())
+		before := getStats()
+		html := "<html>\n\n  <body>   Hi   </body>\n</html>"
+		minified := "<html>\n<body> Hi </body>\n</html>"
+		hdrs, body := run("text/html; charset=utf-8", html)
+		Expect(body).Should(Equal(minified))
+		Expect(hdrs.Get("Content-Length")).Should(BeEmpty())
+		Expect(hdrs.Get("Content-Type")).Should(Equal("text/html; charset=utf-8"))
+
+		after := getStats()
+		Expect(after.MinifiedResponses).Should(Equal(before.MinifiedResponses + 1))
+		Expect(after.MinifyBytesIn - before.MinifyBytesIn).Should(BeEquivalentTo(len(html)))
+		Expect(after.MinifyBytesOut - before.MinifyBytesOut).Should(BeEquivalentTo(len(minified)))
+
+		var ms minificationStats
+		Expect(json.Unmarshal([]byte(getMinificationStatsJSON()), &ms)).Should(Succeed())
+		Expect(ms.BytesSaved).Should(Equal(ms.BytesIn - ms.BytesOut))
+	})
+
+	It("Other type", func() {
+		Expect(setResponseMinification("text/html", true)).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		err = beginResponse(rid, id, 200, makeResponseHeaders("text/plain", 10))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Disabled", func() {
+		Expect(setResponseMinification("text/html", true)).Should(Succeed())
+		Expect(setResponseMinification("text/html", false)).Should(Succeed())
+		Expect(getSettings().minifyTypes).Should(BeEmpty())
+	})
+
+	It("Registered", func() {
+		Expect(setResponseMinification("text/css", true)).ShouldNot(Succeed())
+		registerMinifier("Text/CSS", func(body []byte) []byte {
+			return bytes.Replace(body, []byte(" "), nil, -1)
+		})
+		Expect(setResponseMinification("text/css", true)).Should(Succeed())
+		_, body := run("text/css", "p { color: red; }")
+		Expect(body).Should(Equal("p{color:red;}"))
+	})
+
+	It("Invalid C minifier", func() {
+		Expect(registerCMinifier("text/css", nil)).ShouldNot(Succeed())
+	})
+})
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+/*
+ * An HTTP/2 client may send a request for one host on a connection that it
+ * opened for another, if the certificate covers both. If we don't serve
+ * that host, the answer is a 421, which tells the client to try again on a
+ * new connection. Handlers can send one using MisdirectedRequest on the
+ * http.ResponseWriter, and if the caller sets a list of authorities, we
+ * send one for any request that isn't for one of them.
+ */
+
+const misdirectedMessage = "Misdirected Request"
+
+var errNotRequest = errors.New("Only a request handler can send a 421")
+
+/*
+ * Set the authorities that requests may be for, separated by commas or
+ * newlines. One without a port matches any port. An empty list turns the
+ * check off.
+ */
+func setAllowedAuthorities(list string) error {
+	allowed := make(map[string]bool)
+	for _, a := range strings.FieldsFunc(list, func(c rune) bool {
+		return c == ',' || c == '\n'
+	}) {
+		a = strings.ToLower(strings.TrimSpace(a))
+		if a == "" {
+			continue
+		}
+		if strings.ContainsAny(a, "/ ") {
+			return fmt.Errorf("Invalid authority: \"%s\"", a)
+		}
+		allowed[a] = true
+	}
+	if len(allowed) == 0 {
+		allowed = nil
+	}
+	updateSettings(func(s *settings) {
+		s.allowedAuthorities = allowed
+	})
+	return nil
+}
+
+/*
+ * Check the authority of the request against the list, and return false if
+ * the request was rejected.
+ */
+func (r *request) checkAuthority() bool {
+	allowed := r.settings.allowedAuthorities
+	if allowed == nil {
+		return true
+	}
+	authority := strings.ToLower(r.req.Host)
+	if allowed[authority] {
+		return true
+	}
+	if host, _, err := net.SplitHostPort(authority); err == nil && allowed[host] {
+		return true
+	}
+	r.misdirected()
+	return false
+}
+
+func (r *request) misdirected() {
+	r.reject(http.StatusMisdirectedRequest, misdirectedMessage)
+}
+
+/*
+ * MisdirectedRequest sends a 421 instead of proxying the request. Only a
+ * request handler can do this.
+ */
+func (h *httpResponse) MisdirectedRequest() error {
+	r, ok := h.handler.(*request)
+	if !ok {
+		return errNotRequest
+	}
+	r.misdirected()
+	return nil
+}
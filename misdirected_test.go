@@ -0,0 +1,75 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Misdirected Request", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		resetSettings()
+	})
+
+	expectMisdirected := func() {
+		Expect(pollRequest(id, true)).Should(Equal("SWCH421"))
+		Expect(pollRequest(id, true)).Should(MatchRegexp("^WHDR.*"))
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+		Expect(string(readBodyData(cmd))).Should(Equal(misdirectedMessage))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	}
+
+	It("Manual", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/misdirected", "", 0))
+		Expect(err).Should(Succeed())
+		expectMisdirected()
+	})
+
+	It("Allowed", func() {
+		Expect(setAllowedAuthorities("example.com,\nLocalhost")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Allowed with port", func() {
+		Expect(setAllowedAuthorities("localhost:1234")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Automatic", func() {
+		Expect(setAllowedAuthorities("example.com, localhost:8443")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		expectMisdirected()
+	})
+
+	It("Absolute URI", func() {
+		Expect(setAllowedAuthorities("localhost")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "http://other.example.com/pass", "", 0))
+		Expect(err).Should(Succeed())
+		expectMisdirected()
+	})
+
+	It("Invalid", func() {
+		Expect(setAllowedAuthorities("example.com/foo")).ShouldNot(Succeed())
+	})
+
+	It("Off", func() {
+		Expect(setAllowedAuthorities("example.com")).Should(Succeed())
+		Expect(setAllowedAuthorities("")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+})
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * The negative cache remembers error responses from the target, such as
+ * 404s, for a short time, so that repeated requests for the same thing are
+ * answered right here without bothering the target. Only GET and HEAD
+ * requests are cached, and only for the statuses that have a TTL
+ * configured. They are cached by the URI that they are sent to, once the
+ * handler and the rewriting rules have had their say, because requests for
+ * the same client URI may go to different targets. Responses that belong
+ * to one user, because the request had credentials or the response sets a
+ * cookie, are never cached. When the target lists request headers in Vary,
+ * the entry keeps their values, and only requests with the same values get
+ * it. Bodies larger than maxNegativeCacheBody are not cached, and the
+ * bodies that are stored, which may be compressed, add up to no more than
+ * maxNegativeCacheBytes.
+ */
+
+const (
+	maxNegativeCacheBody    = 65536
+	maxNegativeCacheEntries = 10000
+	maxNegativeCacheBytes   = 16 * 1024 * 1024
+)
+
+type negativeEntry struct {
+	status     int
+	headers    http.Header
+	body       []byte
+	compressed bool
+	expires    time.Time
+	// The request headers named in Vary, and their values
+	vary       []string
+	varyValues string
+}
+
+var negativeCache = make(map[string]*negativeEntry)
+var negativeCacheBytes = 0
+var negativeCacheLock = sync.Mutex{}
+
+/*
+ * Set how long responses with the specified status are cached. Zero stops
+ * caching them.
+ */
+func setNegativeCacheTTL(status int, ttl time.Duration) {
+	updateSettings(func(s *settings) {
+		ttls := make(map[int]time.Duration)
+		for k, v := range s.negativeTTLs {
+			ttls[k] = v
+		}
+		if ttl > 0 {
+			ttls[status] = ttl
+		} else {
+			delete(ttls, status)
+		}
+		s.negativeTTLs = ttls
+	})
+}
+
+func clearNegativeCache() {
+	negativeCacheLock.Lock()
+	negativeCache = make(map[string]*negativeEntry)
+	negativeCacheBytes = 0
+	negativeCacheLock.Unlock()
+}
+
+func getNegativeEntry(key string) *negativeEntry {
+	negativeCacheLock.Lock()
+	defer negativeCacheLock.Unlock()
+	e := negativeCache[key]
+	if e != nil && time.Now().After(e.expires) {
+		removeNegativeEntry(key)
+		return nil
+	}
+	return e
+}
+
+func putNegativeEntry(key string, e *negativeEntry) {
+	if isMemoryCritical() {
+		return
+	}
+	negativeCacheLock.Lock()
+	defer negativeCacheLock.Unlock()
+	removeNegativeEntry(key)
+	if len(negativeCache) >= maxNegativeCacheEntries ||
+		negativeCacheBytes+len(e.body) > maxNegativeCacheBytes {
+		now := time.Now()
+		for k, old := range negativeCache {
+			if now.After(old.expires) {
+				removeNegativeEntry(k)
+			}
+		}
+		if len(negativeCache) >= maxNegativeCacheEntries ||
+			negativeCacheBytes+len(e.body) > maxNegativeCacheBytes {
+			return
+		}
+	}
+	negativeCache[key] = e
+	negativeCacheBytes += len(e.body)
+}
+
+/*
+ * The lock must be held.
+ */
+func removeNegativeEntry(key string) {
+	if old := negativeCache[key]; old != nil {
+		negativeCacheBytes -= len(old.body)
+		delete(negativeCache, key)
+	}
+}
+
+func getNegativeCacheBytes() int {
+	negativeCacheLock.Lock()
+	defer negativeCacheLock.Unlock()
+	return negativeCacheBytes
+}
+
+/*
+ * Return the cache key for the request as it will be sent to the target, or
+ * an empty string if it can't be cached.
+ */
+func negativeCacheKey(req *http.Request) string {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return ""
+	}
+	if req.Header.Get("Authorization") != "" || req.Header.Get("Cookie") != "" {
+		return ""
+	}
+	host := req.URL.Host
+	if host == "" {
+		host = req.Host
+	}
+	return req.Method + " " + req.URL.Scheme + "://" + host + req.URL.RequestURI()
+}
+
+/*
+ * Return the request header names in the Vary header of the response, or
+ * false if it is "*," which matches no other request.
+ */
+func negativeVary(h http.Header) ([]string, bool) {
+	var names []string
+	for _, v := range h["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names, true
+}
+
+func varyValues(h http.Header, names []string) string {
+	buf := &bytes.Buffer{}
+	for _, name := range names {
+		buf.WriteString(strings.Join(h[name], ","))
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+/*
+ * Work out the cache key of the request once it has been rewritten, and send
+ * the cached response, if there is one.
+ */
+func (r *request) serveNegative() bool {
+	r.cacheKey = negativeCacheKey(r.req)
+	if len(r.settings.negativeTTLs) == 0 {
+		return false
+	}
+	key := r.cacheKey
+	if key == "" {
+		return false
+	}
+	e := getNegativeEntry(key)
+	if e == nil || varyValues(r.origHeaders, e.vary) != e.varyValues {
+		return false
+	}
+	body := e.body
+	if e.compressed {
+		var err error
+		body, err = decompressBody(e.body)
+		if err != nil {
+			return false
+		}
+	}
+
+	updateStats(func(s *stats) {
+		s.NegativeCacheHits++
+	})
+	hdrs := copyHeaders(e.headers)
+	r.resp.headers = &hdrs
+	r.resp.WriteHeader(e.status)
+	if r.req.Method != "HEAD" {
+		r.resp.Write(body)
+	}
+	return true
+}
+
+/*
+ * Return true if the response should be read so that it can be cached.
+ */
+func (r *response) cachingNegative() bool {
+	if r.written {
+		return false
+	}
+	return r.request.settings.negativeTTLs[r.resp.StatusCode] > 0 &&
+		r.request.cacheKey != ""
+}
+
+/*
+ * Read enough of the body to tell whether it is small enough to cache, and
+ * send the whole thing on.
+ */
+func (r *response) flushCachedBody() {
+	buf := &bytes.Buffer{}
+	_, err := io.Copy(buf, io.LimitReader(r.resp.Body, maxNegativeCacheBody+1))
+	if err == nil && buf.Len() <= maxNegativeCacheBody {
+		r.storeNegative(buf.Bytes())
+	}
+
+	r.flushHeaders()
+	if r.flushSplitBody() {
+		return
+	}
+	readAndSend(r, ioutil.NopCloser(buf))
+	readAndSend(r, r.resp.Body)
+}
+
+/*
+ * Remember the response, if it is one that should be cached. A body that
+ * couldn't be read to the end is never cached, since it would be replayed
+ * as if it were complete.
+ */
+func (r *response) storeNegative(body []byte) {
+	ttl := r.request.settings.negativeTTLs[r.resp.StatusCode]
+	// The target may ask for less, or for nothing to be kept at all.
+	ttl = ParseCacheControl(r.resp.Header).sharedFreshness(ttl)
+	key := r.request.cacheKey
+	if ttl <= 0 || key == "" || r.written || r.bodyErr != nil ||
+		len(body) > maxNegativeCacheBody {
+		return
+	}
+	if len(r.resp.Header["Set-Cookie"]) > 0 {
+		return
+	}
+	vary, ok := negativeVary(r.resp.Header)
+	if !ok {
+		return
+	}
+	saved, compressed := body, false
+	if r.request.settings.compressCache {
+		saved, compressed = compressBody(r.resp.Header, body)
+	}
+	if !compressed {
+		saved = make([]byte, len(body))
+		copy(saved, body)
+	}
+	putNegativeEntry(key, &negativeEntry{
+		status:     r.resp.StatusCode,
+		headers:    copyHeaders(r.resp.Header),
+		body:       saved,
+		compressed: compressed,
+		expires:    time.Now().Add(ttl),
+		vary:       vary,
+		varyValues: varyValues(r.request.origHeaders, vary),
+	})
+}
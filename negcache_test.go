@@ -0,0 +1,223 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Negative Cache", func() {
+	AfterEach(func() {
+		resetSettings()
+		clearNegativeCache()
+	})
+
+	// Run a request and a 404 response from the target.
+	fetchWith := func(reqHdrs, respHdrs string) {
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		rid := createResponse(testHandler)
+		defer freeResponse(rid)
+
+		err := beginRequest(id, reqHdrs)
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		err = beginResponse(rid, id, 404, respHdrs)
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("RBOD"))
+		sendResponseBodyChunk(rid, true, []byte("Not found"))
+		cmd := pollResponse(rid, true)
+		Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+		Expect(string(readBodyData(cmd))).Should(Equal("Not found"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	}
+
+	fetch := func(uri string) {
+		fetchWith(makeRequestHeaders("GET", uri, "", 0), makeResponseHeaders("text/plain", 9))
+	}
+
+	// Expect a request to be answered from the cache.
+	expectCachedWith := func(reqHdrs string) {
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+
+		err := beginRequest(id, reqHdrs)
+		Expect(err).Should(Succeed())
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(Equal("SWCH404"))
+		cmd = pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("Content-Type")).Should(Equal("text/plain"))
+		cmd = pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+		Expect(string(readBodyData(cmd))).Should(Equal("Not found"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	}
+
+	expectCached := func(uri string) {
+		expectCachedWith(makeRequestHeaders("GET", uri, "", 0))
+	}
+
+	expectNotCachedWith := func(hdrs string) {
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+
+		err := beginRequest(id, hdrs)
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	}
+
+	expectNotCached := func(uri string) {
+		expectNotCachedWith(makeRequestHeaders("GET", uri, "", 0))
+	}
+
+	withResponseHeader := func(hdrs, name, value string) string {
+		return strings.TrimSuffix(hdrs, "\n") + name + ": " + value + "\n\n"
+	}
+
+	It("Status not configured", func() {
+		setNegativeCacheTTL(403, time.Minute)
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		rid := createResponse(testHandler)
+		defer freeResponse(rid)
+
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass/missing", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		err = beginResponse(rid, id, 404, makeResponseHeaders("text/plain", 9))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+
+		expectNotCached("/pass/missing")
+	})
+
+	It("Cached 404", func() {
+		setNegativeCacheTTL(404, time.Minute)
+		before := getStats().NegativeCacheHits
+		fetch("/pass/missing")
+		expectCached("/pass/missing")
+		expectCached("/pass/missing")
+		Expect(getStats().NegativeCacheHits).Should(Equal(before + 2))
+		expectNotCached("/pass/missing?other=true")
+	})
+
+	It("Not when cut short", func() {
+		setNegativeCacheTTL(404, time.Minute)
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		rid := createResponse(testHandler)
+		defer freeResponse(rid)
+
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/pass/missing", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(beginResponse(rid, id, 404, makeResponseHeaders("text/plain", 20))).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("RBOD"))
+		sendResponseBodyChunk(rid, true, []byte("Not found"))
+		cmd := pollResponse(rid, true)
+		for ; cmd[:4] == "WHDR" || cmd[:4] == "WBOD"; cmd = pollResponse(rid, true) {
+		}
+		Expect(cmd).Should(HavePrefix("ERRR"))
+
+		expectNotCached("/pass/missing")
+	})
+
+	It("Per target", func() {
+		setNegativeCacheTTL(404, time.Minute)
+		// Return the first command for a request that goes to "port."
+		first := func(port int32) string {
+			id := createRequest(testHandler)
+			defer freeRequest(id)
+			Expect(setPortOverride(id, port)).Should(Succeed())
+			Expect(beginRequest(id, makeRequestHeaders("GET", "/pass/missing", "", 0))).Should(Succeed())
+			cmd := pollRequest(id, true)
+			if cmd[:4] == "SWCH" {
+				return cmd
+			}
+			for ; cmd != "DONE"; cmd = pollRequest(id, true) {
+			}
+			rid := createResponse(testHandler)
+			defer freeResponse(rid)
+			Expect(beginResponse(rid, id, 404, makeResponseHeaders("text/plain", 9))).Should(Succeed())
+			Expect(pollResponse(rid, true)).Should(Equal("RBOD"))
+			sendResponseBodyChunk(rid, true, []byte("Not found"))
+			for cmd := pollResponse(rid, true); cmd != "DONE"; cmd = pollResponse(rid, true) {
+			}
+			return "proxied"
+		}
+		Expect(first(8081)).Should(Equal("proxied"))
+		Expect(first(8081)).Should(Equal("SWCH404"))
+		Expect(first(8082)).Should(Equal("proxied"))
+	})
+
+	It("Other methods", func() {
+		setNegativeCacheTTL(404, time.Minute)
+		fetch("/pass/missing")
+
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		err := beginRequest(id, makeRequestHeaders("POST", "/pass/missing", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Expiry", func() {
+		setNegativeCacheTTL(404, 50*time.Millisecond)
+		fetch("/pass/missing")
+		expectCached("/pass/missing")
+		time.Sleep(100 * time.Millisecond)
+		expectNotCached("/pass/missing")
+	})
+
+	It("Not with credentials", func() {
+		setNegativeCacheTTL(404, time.Minute)
+		for _, name := range []string{"Authorization", "Cookie"} {
+			hdrs := addRequestHeader(makeRequestHeaders("GET", "/pass/missing", "", 0), name, "secret")
+			id := createRequest(testHandler)
+			rid := createResponse(testHandler)
+			Expect(beginRequest(id, hdrs)).Should(Succeed())
+			Expect(pollRequest(id, true)).Should(Equal("DONE"))
+			// Not read, since it won't be cached
+			Expect(beginResponse(rid, id, 404, makeResponseHeaders("text/plain", 9))).Should(Succeed())
+			Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+			freeResponse(rid)
+			freeRequest(id)
+
+			expectNotCached("/pass/missing")
+			expectNotCachedWith(hdrs)
+		}
+	})
+
+	It("Not with Set-Cookie", func() {
+		setNegativeCacheTTL(404, time.Minute)
+		fetchWith(makeRequestHeaders("GET", "/pass/missing", "", 0),
+			withResponseHeader(makeResponseHeaders("text/plain", 9), "Set-Cookie", "session=1"))
+		expectNotCached("/pass/missing")
+	})
+
+	It("Vary", func() {
+		setNegativeCacheTTL(404, time.Minute)
+		french := addRequestHeader(makeRequestHeaders("GET", "/pass/missing", "", 0),
+			"Accept-Language", "fr")
+		german := addRequestHeader(makeRequestHeaders("GET", "/pass/missing", "", 0),
+			"Accept-Language", "de")
+		fetchWith(french, withResponseHeader(makeResponseHeaders("text/plain", 9),
+			"Vary", "Accept-Language"))
+		expectCachedWith(french)
+		expectNotCachedWith(german)
+		expectNotCached("/pass/missing")
+	})
+
+	It("Vary *", func() {
+		setNegativeCacheTTL(404, time.Minute)
+		fetchWith(makeRequestHeaders("GET", "/pass/missing", "", 0),
+			withResponseHeader(makeResponseHeaders("text/plain", 9), "Vary", "*"))
+		expectNotCached("/pass/missing")
+	})
+})
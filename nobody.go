@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+)
+
+/*
+ * A request handler that answers a request itself, such as from a cache,
+ * has no use for the request body. NoBody tells the caller to stop sending
+ * it using SBOD, the same command that it gets when the target responds
+ * early, and throws away any chunks that were already on the way without
+ * holding on to them. Handlers find NoBody using a type assertion on the
+ * http.ResponseWriter.
+ */
+
+/*
+ * NoBody gives up on the request body. After this, the handler sees an
+ * empty body. It is meant for handlers that send the response themselves,
+ * but if the request is proxied anyway, the target gets an empty body.
+ */
+func (h *httpResponse) NoBody() error {
+	r, ok := h.handler.(*request)
+	if !ok {
+		return errNoRequestBody
+	}
+	if r.discardBody() {
+		r.cmds <- command{id: SBOD}
+	}
+	r.req.Body = ioutil.NopCloser(&bytes.Buffer{})
+	r.req.ContentLength = 0
+	r.req.Header.Del("Transfer-Encoding")
+	r.req.Header.Set("Content-Length", "0")
+	return nil
+}
+
+/*
+ * Stop reading the body, even if the request is full duplex or we never
+ * asked for it, and drop any chunks that are waiting. Return true if the
+ * caller might still be sending it.
+ */
+func (r *request) discardBody() bool {
+	r.bodyLock.Lock()
+	defer r.bodyLock.Unlock()
+	if r.bodyDone || r.bodyStopped {
+		return false
+	}
+	r.bodyStopped = true
+	close(r.bodyStop)
+	for {
+		select {
+		case chunk := <-r.bodies:
+			if chunk == nil {
+				return false
+			}
+		default:
+			return true
+		}
+	}
+}
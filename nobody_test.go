@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("No body", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+	})
+
+	It("Discards the body", func() {
+		err := beginRequest(id, makeRequestHeaders("POST", "/nobody", "application/octet-stream", 10<<20))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("SBOD"))
+		Expect(pollRequest(id, true)).Should(Equal("SWCH200"))
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+		Expect(string(readBodyData(cmd))).Should(Equal("From the cache"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		// Chunks that were already on the way go nowhere.
+		chunk := bytes.Repeat([]byte{'x'}, 1<<20)
+		for i := 0; i < 9; i++ {
+			sendRequestBodyChunk(id, false, chunk)
+			Expect(getRequest(id).bodies).Should(BeEmpty())
+		}
+		sendRequestBodyChunk(id, true, chunk)
+		Expect(getRequest(id).getState()).Should(Equal(stateDone))
+	})
+
+	It("Response handler", func() {
+		h := &httpResponse{handler: &response{}}
+		Expect(h.NoBody()).Should(Equal(errNoRequestBody))
+	})
+})
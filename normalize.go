@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+/*
+ * Put the request URL in a canonical form before anything else looks at it,
+ * so that two spellings of the same URL can't be treated differently, for
+ * instance by a cache. The host is lowercased, percent-encoding is made
+ * consistent as RFC 3986 section 6.2.2 describes, and "." and ".." path
+ * segments are removed. The query is left alone.
+ */
+
+func setNormalizeURL(enabled bool) {
+	updateSettings(func(s *settings) {
+		s.normalizeURL = enabled
+	})
+}
+
+func (r *request) normalizeURL() {
+	if !r.settings.normalizeURL {
+		return
+	}
+	oldURI := r.req.URL.String()
+
+	newURL := *r.req.URL
+	newURL.Scheme = strings.ToLower(newURL.Scheme)
+	newURL.Host = strings.ToLower(newURL.Host)
+	escaped := removeDotSegments(normalizeEscapes(r.req.URL.EscapedPath()))
+	if path, err := url.PathUnescape(escaped); err == nil {
+		newURL.Path = path
+		newURL.RawPath = escaped
+	}
+	r.req.URL = &newURL
+
+	if host := strings.ToLower(r.req.Host); host != r.req.Host {
+		r.req.Host = host
+		if r.req.Header.Get("Host") != "" {
+			r.req.Header.Set("Host", host)
+		}
+	}
+
+	if newURI := newURL.String(); newURI != oldURI {
+		r.debugf("Request %d: normalized \"%s\" to \"%s\"", r.id, oldURI, newURI)
+	}
+}
+
+/*
+ * Decode percent-encoded characters that don't need to be encoded, and use
+ * upper case for the rest.
+ */
+func normalizeEscapes(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+			c := unhex(s[i+1])<<4 | unhex(s[i+2])
+			if isUnreserved(c) {
+				buf = append(buf, c)
+			} else {
+				buf = append(buf, '%', upperHex(s[i+1]), upperHex(s[i+2]))
+			}
+			i += 2
+			continue
+		}
+		buf = append(buf, s[i])
+	}
+	return string(buf)
+}
+
+/*
+ * Remove "." and ".." segments as described in RFC 3986 section 5.2.4. A
+ * ".." at the root has nowhere to go, so it is dropped.
+ */
+func removeDotSegments(path string) string {
+	if !strings.Contains(path, ".") {
+		return path
+	}
+	var out []string
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		last := i == len(segments)-1
+		switch seg {
+		case ".":
+			if last {
+				out = append(out, "")
+			}
+		case "..":
+			if len(out) > 1 {
+				out = out[:len(out)-1]
+			}
+			if last {
+				out = append(out, "")
+			}
+		default:
+			out = append(out, seg)
+		}
+	}
+	return strings.Join(out, "/")
+}
+
+func isUnreserved(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+func upperHex(c byte) byte {
+	if c >= 'a' && c <= 'f' {
+		return c - 'a' + 'A'
+	}
+	return c
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("URL Normalization", func() {
+	var id uint32
+	var logged *bytes.Buffer
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		logged = &bytes.Buffer{}
+		log.SetOutput(logged)
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		resetSettings()
+		log.SetOutput(os.Stderr)
+	})
+
+	It("Escapes", func() {
+		Expect(normalizeEscapes("/a%7eb/%2fc%2F/%41")).Should(Equal("/a~b/%2Fc%2F/A"))
+		Expect(normalizeEscapes("/100%")).Should(Equal("/100%"))
+		Expect(normalizeEscapes("/plain")).Should(Equal("/plain"))
+	})
+
+	It("Dot segments", func() {
+		Expect(removeDotSegments("/a/b/c/./../../g")).Should(Equal("/a/g"))
+		Expect(removeDotSegments("/a/b/..")).Should(Equal("/a/"))
+		Expect(removeDotSegments("/a/.")).Should(Equal("/a/"))
+		Expect(removeDotSegments("/../../etc/passwd")).Should(Equal("/etc/passwd"))
+		Expect(removeDotSegments("/file.txt")).Should(Equal("/file.txt"))
+	})
+
+	It("Disabled by default", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass/a/../b", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Normalize", func() {
+		setNormalizeURL(true)
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass/x/./%7euser/../%2fy%2f?q=%7e", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("WURI/pass/x/%2Fy%2F?q=%7e"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(logged.Len()).Should(BeZero())
+	})
+
+	It("Host", func() {
+		setNormalizeURL(true)
+		setDebugLogging(true)
+		err := beginRequest(id, "GET HTTP://Example.COM/pass/../pass HTTP/1.1\r\nHost: Example.COM\r\n\r\n")
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("WURIhttp://example.com/pass"))
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("Host")).Should(Equal("example.com"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(logged.String()).Should(ContainSubstring("DEBUG"))
+		Expect(logged.String()).Should(ContainSubstring("http://example.com/pass"))
+	})
+
+	It("Already normal", func() {
+		setNormalizeURL(true)
+		setDebugLogging(true)
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass/x?y=1", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(logged.Len()).Should(BeZero())
+	})
+})
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+/*
+ * Compute digests of the response body as it is sent to the caller, after
+ * any handler has changed it. Every algorithm sees the same slices that go
+ * into the WBOD commands, so nothing is copied or buffered. If no handler
+ * changes the body, weaver still has to read it and send it on in order to
+ * see it, but it streams through a chunk at a time.
+ */
+
+type bodyObserver struct {
+	names  []string
+	hashes []hash.Hash
+	writer io.Writer
+}
+
+func observeResponseBody(id uint32, algorithms string) error {
+	req := getRequest(id)
+	if req == nil {
+		return fmt.Errorf("Unknown request: %d", id)
+	}
+	var algs []string
+	for _, alg := range strings.Split(algorithms, ",") {
+		alg = strings.ToLower(strings.TrimSpace(alg))
+		if bodyHashes[alg] == nil {
+			return fmt.Errorf("Unsupported hash algorithm: %s", alg)
+		}
+		algs = append(algs, alg)
+	}
+	req.observeAlgorithms = algs
+	return nil
+}
+
+func newBodyObserver(algorithms []string) *bodyObserver {
+	if len(algorithms) == 0 {
+		return nil
+	}
+	o := &bodyObserver{}
+	writers := make([]io.Writer, len(algorithms))
+	for i, alg := range algorithms {
+		h := bodyHashes[alg]()
+		o.names = append(o.names, alg)
+		o.hashes = append(o.hashes, h)
+		writers[i] = h
+	}
+	o.writer = io.MultiWriter(writers...)
+	return o
+}
+
+func (o *bodyObserver) observe(chunk []byte) {
+	o.writer.Write(chunk)
+}
+
+func (o *bodyObserver) digests() map[string]string {
+	d := make(map[string]string)
+	for i, h := range o.hashes {
+		d[o.names[i]] = hex.EncodeToString(h.Sum(nil))
+	}
+	return d
+}
+
+/*
+ * Return the digests of the response body, which are only there once the
+ * response is done.
+ */
+func (r *request) responseDigests() map[string]string {
+	r.bodyLock.Lock()
+	defer r.bodyLock.Unlock()
+	return r.digests
+}
+
+func (r *request) setResponseDigests(d map[string]string) {
+	r.bodyLock.Lock()
+	r.digests = d
+	r.bodyLock.Unlock()
+}
+
+func getResponseDigestsJSON(id uint32) string {
+	req := getRequest(id)
+	if req == nil {
+		return "{}"
+	}
+	d := req.responseDigests()
+	if d == nil {
+		return "{}"
+	}
+	buf, err := json.Marshal(d)
+	if err != nil {
+		return "{}"
+	}
+	return string(buf)
+}
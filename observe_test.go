@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Observe Response Body", func() {
+	var id uint32
+	var rid uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		rid = createResponse(testHandler)
+		Expect(rid).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		freeResponse(rid)
+	})
+
+	digests := func() map[string]string {
+		d := make(map[string]string)
+		Expect(json.Unmarshal([]byte(getResponseDigestsJSON(id)), &d)).Should(Succeed())
+		return d
+	}
+
+	It("Bad algorithm", func() {
+		Expect(observeResponseBody(id, "sha256,crc32")).ShouldNot(Succeed())
+		Expect(observeResponseBody(0, "sha256")).ShouldNot(Succeed())
+	})
+
+	It("Fixed length body", func() {
+		Expect(observeResponseBody(id, "sha256, MD5")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		msg := []byte("Hello, Response Server!")
+		err = beginResponse(rid, id, 200, makeResponseHeaders("text/plain", len(msg)))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("RBOD"))
+		Expect(digests()).Should(BeEmpty())
+		sendResponseBodyChunk(rid, true, msg)
+
+		cmd := pollResponse(rid, true)
+		Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+		Expect(readBodyData(cmd)).Should(Equal(msg))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+
+		sha := sha256.Sum256(msg)
+		md := md5.Sum(msg)
+		Expect(digests()).Should(Equal(map[string]string{
+			"sha256": hex.EncodeToString(sha[:]),
+			"md5":    hex.EncodeToString(md[:]),
+		}))
+	})
+
+	It("Chunked filtered body", func() {
+		Expect(observeResponseBody(id, "sha256")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/transformbodychunks", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		err = beginResponse(rid, id, 200, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(MatchRegexp("^WHDR.*"))
+		Expect(pollResponse(rid, true)).Should(Equal("RBOD"))
+		sendResponseBodyChunk(rid, false, []byte("Hello, "))
+		sendResponseBodyChunk(rid, true, []byte("World!"))
+
+		var body []byte
+		cmd := pollResponse(rid, true)
+		for cmd != "DONE" {
+			Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+			body = append(body, readBodyData(cmd)...)
+			cmd = pollResponse(rid, true)
+		}
+
+		// The digest covers what was sent, not what the target sent.
+		sha := sha256.Sum256(body)
+		Expect(digests()["sha256"]).Should(Equal(hex.EncodeToString(sha[:])))
+	})
+})
+
+func benchmarkResponseBody(b *testing.B, algorithms string) {
+	createHandler(testHandler, TestHandlerURI)
+	chunk := bytes.Repeat([]byte{'x'}, 32768)
+	b.SetBytes(int64(len(chunk) * 4))
+
+	for i := 0; i < b.N; i++ {
+		id := createRequest(testHandler)
+		rid := createResponse(testHandler)
+		if algorithms != "" {
+			observeResponseBody(id, algorithms)
+		}
+		// This handler reads the body, so it is sent back either way.
+		beginRequest(id, makeRequestHeaders("GET", "/echostream", "", 0))
+		pollRequest(id, true)
+		beginResponse(rid, id, 200, makeResponseHeaders("", 0))
+		pollResponse(rid, true)
+		for c := 0; c < 4; c++ {
+			sendResponseBodyChunk(rid, c == 3, chunk)
+			getChunkData(pollResponse(rid, true)[4:])
+		}
+		pollResponse(rid, true)
+		freeRequest(id)
+		freeResponse(rid)
+	}
+}
+
+func BenchmarkResponseBody(b *testing.B) {
+	benchmarkResponseBody(b, "")
+}
+
+func BenchmarkObservedResponseBody(b *testing.B) {
+	benchmarkResponseBody(b, "sha256")
+}
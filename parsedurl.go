@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+)
+
+/*
+ * The URL that the request will be forwarded to, after every handler and
+ * rule has had its way, broken into pieces so that the caller doesn't have
+ * to parse it again.
+ */
+
+type parsedURL struct {
+	Scheme   string `json:"scheme"`
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	Path     string `json:"path"`
+	Query    string `json:"query"`
+	Fragment string `json:"fragment"`
+}
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+func getParsedURL(id uint32) *parsedURL {
+	req := getRequest(id)
+	if req == nil || req.getState() < stateProxying || req.req == nil {
+		return nil
+	}
+	u := req.req.URL
+
+	p := &parsedURL{
+		Scheme:   req.targetScheme(),
+		Path:     u.EscapedPath(),
+		Query:    u.RawQuery,
+		Fragment: u.Fragment,
+	}
+	authority := u.Host
+	if authority == "" {
+		authority = req.req.Host
+	}
+	if host, port, err := net.SplitHostPort(authority); err == nil {
+		p.Host = host
+		p.Port = port
+	} else {
+		p.Host = strings.TrimSuffix(strings.TrimPrefix(authority, "["), "]")
+	}
+	if p.Port == "" {
+		p.Port = defaultPorts[p.Scheme]
+	}
+	return p
+}
+
+func getParsedURLJSON(id uint32) string {
+	p := getParsedURL(id)
+	if p == nil {
+		return "{}"
+	}
+	buf, err := json.Marshal(p)
+	if err != nil {
+		return "{}"
+	}
+	return string(buf)
+}
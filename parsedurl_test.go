@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Parsed URL", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		resetSettings()
+	})
+
+	parsed := func() map[string]string {
+		p := make(map[string]string)
+		Expect(json.Unmarshal([]byte(getParsedURLJSON(id)), &p)).Should(Succeed())
+		return p
+	}
+
+	It("Not ready", func() {
+		Expect(parsed()).Should(BeEmpty())
+		Expect(getParsedURLJSON(0)).Should(Equal("{}"))
+	})
+
+	It("Relative", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass/a%20b?foo=bar", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(parsed()).Should(Equal(map[string]string{
+			"scheme":   "http",
+			"host":     "localhost",
+			"port":     "1234",
+			"path":     "/pass/a%20b",
+			"query":    "foo=bar",
+			"fragment": "",
+		}))
+	})
+
+	It("Default port", func() {
+		Expect(setSchemeOverride(id, "https")).Should(Succeed())
+		setFragmentDrop(false)
+		err := beginRequest(id, "GET /pass?x=1#top HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(MatchRegexp("^WURI.*"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(parsed()).Should(Equal(map[string]string{
+			"scheme":   "https",
+			"host":     "example.com",
+			"port":     "443",
+			"path":     "/pass",
+			"query":    "x=1",
+			"fragment": "top",
+		}))
+	})
+
+	It("Rewritten", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/writepath", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("WURI/newpath"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(parsed()["path"]).Should(Equal("/newpath"))
+	})
+})
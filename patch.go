@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+/*
+ * Let a response handler overwrite bytes at known offsets in the response
+ * body, such as a version string, without reading the whole thing. Each
+ * chunk is patched as it streams past, so nothing is buffered. Handlers find
+ * PatchResponseAt using a type assertion on the http.ResponseWriter.
+ */
+
+var errPatchTooLate = errors.New("That part of the response body was already sent")
+
+type bodyPatch struct {
+	offset int64
+	data   []byte
+}
+
+type patchedBody struct {
+	io.ReadCloser
+	pos     int64
+	patches []bodyPatch
+}
+
+/*
+ * PatchResponseAt overwrites the response body with "data," starting
+ * "offset" bytes into it. The length of the body doesn't change, so any
+ * part of "data" that is past the end is ignored. Patches may overlap, in
+ * which case the last one wins.
+ */
+func (h *httpResponse) PatchResponseAt(offset int64, data []byte) error {
+	r, ok := h.handler.(*response)
+	if !ok {
+		return errNoResponseBody
+	}
+	body, ok := r.resp.Body.(*patchedBody)
+	if !ok {
+		body = &patchedBody{ReadCloser: r.resp.Body}
+		r.resp.Body = body
+	}
+	if offset < body.pos {
+		return errPatchTooLate
+	}
+	saved := make([]byte, len(data))
+	copy(saved, data)
+	body.patches = append(body.patches, bodyPatch{offset: offset, data: saved})
+	return nil
+}
+
+func (b *patchedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	start, end := b.pos, b.pos+int64(n)
+	for _, patch := range b.patches {
+		from := maxInt64(patch.offset, start)
+		to := minInt64(patch.offset+int64(len(patch.data)), end)
+		if from < to {
+			copy(p[from-start:to-start], patch.data[from-patch.offset:])
+		}
+	}
+	b.pos = end
+	return n, err
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Patch response", func() {
+	var id, rid uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		rid = createResponse(testHandler)
+		Expect(rid).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		freeResponse(rid)
+	})
+
+	It("Straddles chunks", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/patchresponse", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		err = beginResponse(rid, id, 200, makeResponseHeaders("text/plain", 14))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("RBOD"))
+		sendResponseBodyChunk(rid, false, []byte("vers=0.0"))
+		sendResponseBodyChunk(rid, true, []byte(".0 ok!"))
+
+		body := &bytes.Buffer{}
+		for cmd := pollResponse(rid, true); cmd != "DONE"; cmd = pollResponse(rid, true) {
+			Expect(cmd).Should(HavePrefix("WBOD"))
+			body.Write(readBodyData(cmd))
+		}
+		Expect(body.String()).Should(Equal("vers=1.2.3 ok!"))
+	})
+
+	It("Overlapping and past the end", func() {
+		body := &patchedBody{
+			ReadCloser: ioutil.NopCloser(bytes.NewBufferString("0123456789")),
+			patches: []bodyPatch{
+				{offset: 2, data: []byte("aaaa")},
+				{offset: 4, data: []byte("bb")},
+				{offset: 8, data: []byte("cccc")},
+			},
+		}
+		buf := make([]byte, 3)
+		out := &bytes.Buffer{}
+		for n, _ := body.Read(buf); n > 0; n, _ = body.Read(buf) {
+			out.Write(buf[:n])
+		}
+		Expect(out.String()).Should(Equal("01aabb67cc"))
+	})
+
+	It("Too late", func() {
+		r := &response{resp: &http.Response{
+			Body: ioutil.NopCloser(bytes.NewBufferString("0123456789")),
+		}}
+		h := &httpResponse{handler: r}
+		Expect(h.PatchResponseAt(0, []byte("x"))).Should(Succeed())
+		buf := make([]byte, 4)
+		n, _ := r.resp.Body.Read(buf)
+		Expect(string(buf[:n])).Should(Equal("x123"))
+		Expect(h.PatchResponseAt(2, []byte("y"))).Should(Equal(errPatchTooLate))
+		Expect(h.PatchResponseAt(4, []byte("z"))).Should(Succeed())
+		n, _ = r.resp.Body.Read(buf)
+		Expect(string(buf[:n])).Should(Equal("z567"))
+	})
+})
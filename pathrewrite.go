@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+/*
+ * Rules that rewrite the path of the request before it is forwarded to the
+ * target. Exact rules match the whole path and always take precedence.
+ * Otherwise, regular expression rules are tried in the order that they were
+ * added, and the first one that matches wins. The replacement for a regular
+ * expression may refer to capture groups using "$1" or "${name}", just like
+ * regexp.Expand, and handlers may read the named groups using PathParam.
+ * Which handler runs is up to the gozerian pipeline, so these rules route
+ * to paths on the target, not to handlers.
+ */
+
+type regexpRewrite struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+func addExactPathRewrite(path, replacement string) error {
+	if path == "" {
+		return fmt.Errorf("Path must not be empty")
+	}
+	updateSettings(func(s *settings) {
+		rewrites := make(map[string]string)
+		for k, v := range s.exactRewrites {
+			rewrites[k] = v
+		}
+		rewrites[path] = replacement
+		s.exactRewrites = rewrites
+	})
+	return nil
+}
+
+func addRegexpPathRewrite(pattern, replacement string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	updateSettings(func(s *settings) {
+		rewrites := make([]regexpRewrite, len(s.regexpRewrites), len(s.regexpRewrites)+1)
+		copy(rewrites, s.regexpRewrites)
+		s.regexpRewrites = append(rewrites, regexpRewrite{
+			pattern:     re,
+			replacement: replacement,
+		})
+	})
+	return nil
+}
+
+func clearPathRewrites() {
+	updateSettings(func(s *settings) {
+		s.exactRewrites = nil
+		s.regexpRewrites = nil
+	})
+}
+
+/*
+ * Return the rewritten path, and whether any rule matched.
+ */
+func (s *settings) rewritePath(path string) (string, bool) {
+	if replacement, ok := s.exactRewrites[path]; ok {
+		return replacement, true
+	}
+	for _, rw := range s.regexpRewrites {
+		match := rw.pattern.FindStringSubmatchIndex(path)
+		if match != nil {
+			newPath := rw.pattern.ExpandString(nil, rw.replacement, path, match)
+			return string(newPath), true
+		}
+	}
+	return path, false
+}
+
+/*
+ * Return the value of the group called "name" in the regular expression rule
+ * that rewrites "path," or an empty string if there isn't one.
+ */
+func (s *settings) pathParam(path, name string) string {
+	if _, ok := s.exactRewrites[path]; ok {
+		return ""
+	}
+	for _, rw := range s.regexpRewrites {
+		match := rw.pattern.FindStringSubmatch(path)
+		if match == nil {
+			continue
+		}
+		for i, n := range rw.pattern.SubexpNames() {
+			if n == name && n != "" {
+				return match[i]
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+/*
+ * PathParam returns the named capture group "name" from the regular
+ * expression rule that matches the path that the client sent, which is the
+ * rule that will rewrite it, or an empty string. Handlers find PathParam
+ * using a type assertion on the http.ResponseWriter.
+ */
+func (h *httpResponse) PathParam(name string) string {
+	r := h.owner()
+	if r == nil {
+		return ""
+	}
+	return r.settings.pathParam(r.origURL.Path, name)
+}
+
+func (r *request) rewritePath() {
+	newPath, matched := r.settings.rewritePath(r.req.URL.Path)
+	if matched {
+		newURL := *r.req.URL
+		newURL.Path = newPath
+		newURL.RawPath = ""
+		r.req.URL = &newURL
+	}
+}
+
+/*
+ * A prefix, such as the path where weaver is mounted, that is removed from
+ * the path before it is forwarded. The stripped prefix is added to the
+ * X-Forwarded-Prefix header. In strict mode, requests whose path doesn't
+ * start with the prefix are rejected with a 404 rather than forwarded as is.
+ */
+func setStripPathPrefix(prefix string) {
+	updateSettings(func(s *settings) {
+		s.stripPrefix = strings.TrimRight(prefix, "/")
+	})
+}
+
+func setStripPathPrefixStrict(strict bool) {
+	updateSettings(func(s *settings) {
+		s.strictStripPrefix = strict
+	})
+}
+
+/*
+ * Return the path with the prefix removed, and whether it had the prefix.
+ */
+func (s *settings) stripPathPrefix(path string) (string, bool) {
+	if s.stripPrefix == "" {
+		return path, false
+	}
+	if path == s.stripPrefix {
+		return "/", true
+	}
+	if strings.HasPrefix(path, s.stripPrefix+"/") {
+		return path[len(s.stripPrefix):], true
+	}
+	return path, false
+}
+
+/*
+ * Strip the prefix from the path after the handlers and rewrite rules have
+ * changed it, so that the strict check sees the same path that is stripped.
+ */
+func (r *request) stripPathPrefix() {
+	newPath, found := r.settings.stripPathPrefix(r.req.URL.Path)
+	if !found {
+		if r.settings.strictStripPrefix && r.settings.stripPrefix != "" {
+			r.reject(http.StatusNotFound, "Not found")
+		}
+		return
+	}
+	newURL := *r.req.URL
+	newURL.Path = newPath
+	newURL.RawPath = ""
+	r.req.URL = &newURL
+	r.req.Header.Set("X-Forwarded-Prefix",
+		r.req.Header.Get("X-Forwarded-Prefix")+r.settings.stripPrefix)
+}
+
+/*
+ * A prefix that is added to the path before it is forwarded, after any
+ * prefix was stripped. Together, the two can move a whole tree of paths.
+ */
+func setAddPathPrefix(prefix string) error {
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("Path prefix must start with \"/\": \"%s\"", prefix)
+	}
+	if strings.Contains(prefix, "..") {
+		return fmt.Errorf("Path prefix must not contain \"..\": \"%s\"", prefix)
+	}
+	updateSettings(func(s *settings) {
+		s.addPrefix = strings.TrimRight(prefix, "/")
+	})
+	return nil
+}
+
+func (r *request) addPathPrefix() {
+	if r.settings.addPrefix == "" {
+		return
+	}
+	newURL := *r.req.URL
+	newURL.Path = r.settings.addPrefix + r.req.URL.Path
+	newURL.RawPath = ""
+	r.req.URL = &newURL
+}
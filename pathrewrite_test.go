@@ -0,0 +1,255 @@
+package main
+
+import (
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Path Rewriting", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		resetSettings()
+	})
+
+	It("No rules", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass/users/123", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Named captures", func() {
+		err := addRegexpPathRewrite("^/pass/users/(?P<user>[0-9]+)/(?P<item>[a-z]+)$", "/items/${item}/${user}")
+		Expect(err).Should(Succeed())
+		err = beginRequest(id, makeRequestHeaders("GET", "/pass/users/123/books", "", 0))
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WURI.*"))
+		Expect(cmd[4:]).Should(Equal("/items/books/123"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Path parameters", func() {
+		Expect(addRegexpPathRewrite("^/params/(?P<user>[a-z]+)$", "/users/${user}")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/params/alice", "", 0))
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(Equal("WURI/users/alice"))
+		cmd = pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("X-User")).Should(Equal("alice"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		s := getSettings()
+		Expect(s.pathParam("/params/alice", "other")).Should(BeEmpty())
+		Expect(s.pathParam("/params/123", "user")).Should(BeEmpty())
+		Expect(addExactPathRewrite("/params/alice", "/alice")).Should(Succeed())
+		s = getSettings()
+		Expect(s.pathParam("/params/alice", "user")).Should(BeEmpty())
+	})
+
+	It("Keep query", func() {
+		err := addRegexpPathRewrite("^/pass/(.*)$", "/v2/$1")
+		Expect(err).Should(Succeed())
+		err = beginRequest(id, makeRequestHeaders("GET", "/pass/foo?bar=baz", "", 0))
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WURI.*"))
+		Expect(cmd[4:]).Should(Equal("/v2/foo?bar=baz"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("No match", func() {
+		err := addRegexpPathRewrite("^/nothing/(.*)$", "/v2/$1")
+		Expect(err).Should(Succeed())
+		err = beginRequest(id, makeRequestHeaders("GET", "/pass/foo", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Exact before regexp", func() {
+		err := addRegexpPathRewrite("^/pass/(.*)$", "/regexp/$1")
+		Expect(err).Should(Succeed())
+		err = addExactPathRewrite("/pass/exact", "/exact")
+		Expect(err).Should(Succeed())
+		err = beginRequest(id, makeRequestHeaders("GET", "/pass/exact", "", 0))
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WURI.*"))
+		Expect(cmd[4:]).Should(Equal("/exact"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("First regexp wins", func() {
+		Expect(addRegexpPathRewrite("^/pass/(.*)$", "/first/$1")).Should(Succeed())
+		Expect(addRegexpPathRewrite("^/pass/foo$", "/second")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass/foo", "", 0))
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd[4:]).Should(Equal("/first/foo"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Invalid pattern", func() {
+		Expect(addRegexpPathRewrite("^/pass/(.*$", "/")).ShouldNot(Succeed())
+		Expect(addExactPathRewrite("", "/")).ShouldNot(Succeed())
+	})
+
+	It("Clear", func() {
+		Expect(addExactPathRewrite("/pass/foo", "/bar")).Should(Succeed())
+		clearPathRewrites()
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass/foo", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+})
+
+var _ = Describe("Strip Path Prefix", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		resetSettings()
+	})
+
+	It("Match segments", func() {
+		setStripPathPrefix("/api/v1/")
+		s := getSettings()
+		path, found := s.stripPathPrefix("/api/v1/users")
+		Expect(found).Should(BeTrue())
+		Expect(path).Should(Equal("/users"))
+		path, found = s.stripPathPrefix("/api/v1")
+		Expect(found).Should(BeTrue())
+		Expect(path).Should(Equal("/"))
+		path, found = s.stripPathPrefix("/api/v10/users")
+		Expect(found).Should(BeFalse())
+		Expect(path).Should(Equal("/api/v10/users"))
+	})
+
+	It("Strip", func() {
+		setStripPathPrefix("/pass/api/v1/")
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass/api/v1/users?limit=5", "", 0))
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WURI.*"))
+		Expect(cmd[4:]).Should(Equal("/users?limit=5"))
+		cmd = pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("X-Forwarded-Prefix")).Should(Equal("/pass/api/v1"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Append to existing prefix", func() {
+		setStripPathPrefix("/pass/api")
+		hdrs := addRequestHeader(makeRequestHeaders("GET", "/pass/api/users", "", 0),
+			"X-Forwarded-Prefix", "/outer")
+		err := beginRequest(id, hdrs)
+		Expect(err).Should(Succeed())
+
+		Expect(pollRequest(id, true)).Should(MatchRegexp("^WURI.*"))
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		newHdrs := http.Header{}
+		parseHeaders(newHdrs, cmd[4:])
+		Expect(newHdrs.Get("X-Forwarded-Prefix")).Should(Equal("/outer/pass/api"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("No prefix", func() {
+		setStripPathPrefix("/pass/api/v1")
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass/other", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("No prefix strict", func() {
+		setStripPathPrefix("/pass/api/v1")
+		setStripPathPrefixStrict(true)
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass/other", "", 0))
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^SWCH.*"))
+		Expect(cmd[4:]).Should(Equal("404"))
+		Expect(pollRequest(id, true)).Should(MatchRegexp("^WHDR.*"))
+		readBodyData(pollRequest(id, true))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Strict after a rewrite", func() {
+		setStripPathPrefix("/pass/api/v1")
+		setStripPathPrefixStrict(true)
+		Expect(addExactPathRewrite("/pass/old", "/pass/api/v1/new")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass/old", "", 0))
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WURI.*"))
+		Expect(cmd[4:]).Should(Equal("/new"))
+		Expect(pollRequest(id, true)).Should(MatchRegexp("^WHDR.*"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Strict when a rewrite removes the prefix", func() {
+		setStripPathPrefix("/pass/api/v1")
+		setStripPathPrefixStrict(true)
+		Expect(addExactPathRewrite("/pass/api/v1/old", "/pass/new")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass/api/v1/old", "", 0))
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(Equal("SWCH404"))
+		Expect(pollRequest(id, true)).Should(MatchRegexp("^WHDR.*"))
+		readBodyData(pollRequest(id, true))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Add prefix", func() {
+		Expect(setAddPathPrefix("v2")).ShouldNot(Succeed())
+		Expect(setAddPathPrefix("/v2/../admin")).ShouldNot(Succeed())
+		Expect(setAddPathPrefix("/v2/")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass/users/123", "", 0))
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WURI.*"))
+		Expect(cmd[4:]).Should(Equal("/v2/pass/users/123"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Strip and add prefix", func() {
+		setStripPathPrefix("/pass/api/v1")
+		Expect(setAddPathPrefix("/v2")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass/api/v1/users/123", "", 0))
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WURI.*"))
+		Expect(cmd[4:]).Should(Equal("/v2/users/123"))
+		Expect(pollRequest(id, true)).Should(MatchRegexp("^WHDR.*"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+})
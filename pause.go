@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+)
+
+/*
+ * A pauseGate lets the caller suspend a running request at a safe point.
+ * The request goroutine checks the gate before it starts, before it sends
+ * or receives each body chunk, and before it is done. Pausing never holds
+ * a lock while waiting, and a parked request gives up its slot in the
+ * priority scheduler until it is resumed, so other requests are not
+ * affected.
+ */
+type pauseGate struct {
+	lock   sync.Mutex
+	paused chan bool
+}
+
+func (g *pauseGate) pause() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.paused == nil {
+		g.paused = make(chan bool)
+	}
+}
+
+func (g *pauseGate) resume() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.paused != nil {
+		close(g.paused)
+		g.paused = nil
+	}
+}
+
+func (g *pauseGate) isPaused() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.paused != nil
+}
+
+/*
+ * Block as long as the gate is paused.
+ */
+func (g *pauseGate) wait() {
+	g.lock.Lock()
+	ch := g.paused
+	g.lock.Unlock()
+	if ch != nil {
+		<-ch
+	}
+}
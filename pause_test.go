@@ -0,0 +1,127 @@
+package main
+
+import (
+	"runtime"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Pause and Resume", func() {
+	var id uint32
+	var rid uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		rid = createResponse(testHandler)
+		Expect(rid).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		freeResponse(rid)
+	})
+
+	It("Pause before begin", func() {
+		GoPauseRequest(id)
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+
+		Consistently(func() string {
+			return pollRequest(id, false)
+		}, 100*time.Millisecond).Should(BeEmpty())
+
+		GoResumeRequest(id)
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Pause between chunks", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/completeresponse", "", 0))
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(Equal("RBOD"))
+		GoPauseRequest(id)
+		sendRequestBodyChunk(id, true, []byte("Hello!"))
+
+		Consistently(func() string {
+			return pollRequest(id, false)
+		}, 100*time.Millisecond).Should(BeEmpty())
+
+		GoResumeRequest(id)
+		Expect(pollRequest(id, true)).Should(MatchRegexp("^SWCH.*"))
+		Expect(pollRequest(id, true)).Should(MatchRegexp("^WHDR.*"))
+		readBodyData(pollRequest(id, true))
+		readBodyData(pollRequest(id, true))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Pause response", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/transformbody", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		GoPauseRequest(id)
+		err = beginResponse(rid, id, 200, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+
+		Consistently(func() string {
+			return pollResponse(rid, false)
+		}, 100*time.Millisecond).Should(BeEmpty())
+
+		GoResumeRequest(id)
+		cmd := pollResponse(rid, true)
+		Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+		Expect(string(readBodyData(cmd))).Should(Equal("We have transformed the response!"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Other requests keep going", func() {
+		other := createRequest(testHandler)
+		defer freeRequest(other)
+
+		GoPauseRequest(id)
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		err = beginRequest(other, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+
+		Expect(pollRequest(other, true)).Should(Equal("DONE"))
+		Expect(pollRequest(id, false)).Should(BeEmpty())
+		GoResumeRequest(id)
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Paused request gives up its slot", func() {
+		GoSetPriorityQueue(1)
+		scheduler.setSlots(1)
+		defer func() {
+			GoSetPriorityQueue(0)
+			scheduler.setSlots(runtime.GOMAXPROCS(0))
+		}()
+		other := createRequest(testHandler)
+		defer freeRequest(other)
+
+		err := beginRequest(id, makeRequestHeaders("GET", "/completeresponse", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("RBOD"))
+		GoPauseRequest(id)
+		sendRequestBodyChunk(id, true, []byte("Hello!"))
+
+		// The handler is parked while it reads the body.
+		err = beginRequest(other, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Eventually(func() string {
+			return pollRequest(other, false)
+		}).Should(Equal("DONE"))
+
+		GoResumeRequest(id)
+		Expect(pollRequest(id, true)).Should(MatchRegexp("^SWCH.*"))
+		Expect(pollRequest(id, true)).Should(MatchRegexp("^WHDR.*"))
+		readBodyData(pollRequest(id, true))
+		readBodyData(pollRequest(id, true))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+})
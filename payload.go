@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+)
+
+/*
+ * A command such as WHDR for a response with thousands of headers can be
+ * hundreds of kilobytes, and returning it as a string means that it is
+ * copied into C memory as well. When payload streaming is on, polling only
+ * returns the four-letter command name, and the rest of the command stays
+ * here until the caller has copied it into its own buffer, a window at a
+ * time. It is released the next time that the request or response is
+ * polled, or when it is freed.
+ */
+
+var payloads = make(map[uint32]string)
+var payloadsLock = sync.Mutex{}
+
+func setPayloadStreaming(enabled bool) {
+	updateSettings(func(s *settings) {
+		s.streamPayloads = enabled
+	})
+}
+
+/*
+ * Return what a poll of request or response "id" should return, given the
+ * command that it got. Any payload from the last poll is released.
+ */
+func pollPayload(id uint32, cmd string) string {
+	if !getSettings().streamPayloads {
+		return cmd
+	}
+	payloadsLock.Lock()
+	defer payloadsLock.Unlock()
+	delete(payloads, id)
+	if len(cmd) <= 4 {
+		return cmd
+	}
+	payloads[id] = cmd[4:]
+	return cmd[:4]
+}
+
+func payloadLength(id uint32) uint32 {
+	payloadsLock.Lock()
+	defer payloadsLock.Unlock()
+	return uint32(len(payloads[id]))
+}
+
+/*
+ * Copy the payload, starting at "offset," into "dst," and return how much
+ * was copied, which is zero at the end.
+ */
+func readPayload(id uint32, offset uint32, dst []byte) uint32 {
+	payloadsLock.Lock()
+	defer payloadsLock.Unlock()
+	p := payloads[id]
+	if int64(offset) >= int64(len(p)) {
+		return 0
+	}
+	return uint32(copy(dst, p[offset:]))
+}
+
+func releasePayload(id uint32) {
+	payloadsLock.Lock()
+	delete(payloads, id)
+	payloadsLock.Unlock()
+}
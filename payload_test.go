@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Command payload streaming", func() {
+	AfterEach(func() {
+		resetSettings()
+	})
+
+	// A request with thousands of Link headers, whose headers the handler
+	// changes, so that the WHDR command is big.
+	bigRequest := func() uint32 {
+		id := createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		hdrs := makeRequestHeaders("GET", "/writeheaders", "", 0)
+		for i := 0; i < 3000; i++ {
+			hdrs = addRequestHeader(hdrs, "Link",
+				fmt.Sprintf("</static/asset-%d.js>; rel=preload; as=script", i))
+		}
+		Expect(beginRequest(id, hdrs)).Should(Succeed())
+		return id
+	}
+
+	It("Read a large payload in small windows", func() {
+		id := bigRequest()
+		cmd := pollPayload(id, pollRequest(id, true))
+		Expect(cmd).Should(HavePrefix("WHDR"))
+		expected := cmd[4:]
+		Expect(len(expected)).Should(BeNumerically(">", 100000))
+		Expect(pollPayload(id, pollRequest(id, true))).Should(Equal("DONE"))
+		freeRequest(id)
+
+		setPayloadStreaming(true)
+		id = bigRequest()
+		defer freeRequest(id)
+		Expect(pollPayload(id, pollRequest(id, true))).Should(Equal("WHDR"))
+		length := payloadLength(id)
+		Expect(length).Should(BeEquivalentTo(len(expected)))
+
+		buf := &bytes.Buffer{}
+		window := make([]byte, 1000)
+		for offset := uint32(0); ; {
+			n := readPayload(id, offset, window)
+			if n == 0 {
+				break
+			}
+			buf.Write(window[:n])
+			offset += n
+		}
+		Expect(buf.Len()).Should(Equal(len(expected)))
+		// The order of the headers isn't fixed.
+		got, want := http.Header{}, http.Header{}
+		parseHeaders(got, buf.String())
+		parseHeaders(want, expected)
+		Expect(got).Should(Equal(want))
+
+		// The next poll releases it.
+		Expect(pollPayload(id, pollRequest(id, true))).Should(Equal("DONE"))
+		Expect(payloadLength(id)).Should(BeZero())
+		Expect(readPayload(id, 0, window)).Should(BeZero())
+	})
+
+	It("Released when freed", func() {
+		setPayloadStreaming(true)
+		id := bigRequest()
+		Expect(pollPayload(id, pollRequest(id, true))).Should(Equal("WHDR"))
+		Expect(payloadLength(id)).ShouldNot(BeZero())
+		freeRequest(id)
+		Expect(payloadLength(id)).Should(BeZero())
+	})
+
+	It("Offset past the end", func() {
+		setPayloadStreaming(true)
+		Expect(pollPayload(1000000, "ERRRUnknown request")).Should(Equal("ERRR"))
+		defer releasePayload(1000000)
+		Expect(payloadLength(1000000)).Should(BeEquivalentTo(len("Unknown request")))
+		Expect(readPayload(1000000, 100, make([]byte, 10))).Should(BeZero())
+		buf := make([]byte, 10)
+		Expect(readPayload(1000000, 8, buf)).Should(BeEquivalentTo(7))
+		Expect(string(buf[:7])).Should(Equal("request"))
+	})
+})
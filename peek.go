@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+/*
+ * Let a response handler look at the start of the response body without
+ * filtering the whole thing, for instance to spot an error message that
+ * was sent with a 200. Handlers find PeekResponseBody using a type assertion
+ * on the http.ResponseWriter.
+ */
+
+// PeekAction tells PeekResponseBody what to do after the callback has looked
+// at the start of the body. It is only another name for int, so a handler
+// can declare the callback as returning an int, and compare against 0 and 1
+// if it can't use the constants.
+type PeekAction = int
+
+const (
+	// PeekContinue, 0, sends the body on unchanged, starting with the bytes
+	// that were peeked at
+	PeekContinue PeekAction = iota
+	// PeekAbort, 1, discards the body so that the handler can write a
+	// replacement response using its http.ResponseWriter
+	PeekAbort
+)
+
+var errNoResponseBody = errors.New("Only a response handler can peek at the response body")
+
+/*
+ * PeekResponseBody reads up to "maxBytes" of the response body and passes
+ * them to the callback, along with the response headers and status. The
+ * callback may see fewer bytes if the body is shorter. It must be called
+ * before the handler returns.
+ */
+func (h *httpResponse) PeekResponseBody(
+	maxBytes int,
+	cb func(prefix []byte, hdrs http.Header, status int) PeekAction) error {
+
+	r, ok := h.handler.(*response)
+	if !ok {
+		return errNoResponseBody
+	}
+	resp := r.resp
+	// Once the handler returns, the body is on its way to the client.
+	if !r.phase.enter() {
+		return tooLate(r.request, "PeekResponseBody")
+	}
+
+	prefix := make([]byte, maxBytes)
+	n, err := io.ReadFull(resp.Body, prefix)
+	prefix = prefix[:n]
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		r.phase.leave()
+		return err
+	}
+
+	// Replay what we read before the rest of the body. This happens before
+	// the callback, which may call other handler methods.
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: io.MultiReader(bytes.NewReader(prefix), resp.Body),
+		Closer: resp.Body,
+	}
+	r.phase.leave()
+
+	if cb(prefix, resp.Header, resp.StatusCode) == PeekAbort {
+		if !r.phase.whileOpen(func() {
+			resp.Body.Close()
+			resp.Body = ioutil.NopCloser(&bytes.Buffer{})
+		}) {
+			return tooLate(r.request, "PeekResponseBody")
+		}
+	}
+	return nil
+}
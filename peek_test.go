@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Peek Response Body", func() {
+	var id uint32
+	var rid uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		rid = createResponse(testHandler)
+		Expect(rid).ShouldNot(BeZero())
+
+		err := beginRequest(id, makeRequestHeaders("GET", "/peekresponse", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		freeResponse(rid)
+	})
+
+	// Read WBOD commands until DONE and return the whole body
+	readBody := func() string {
+		var body []byte
+		cmd := pollResponse(rid, true)
+		for cmd != "DONE" {
+			Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+			body = append(body, readBodyData(cmd)...)
+			cmd = pollResponse(rid, true)
+		}
+		return string(body)
+	}
+
+	It("Continue", func() {
+		err := beginResponse(rid, id, 200, makeResponseHeaders("application/json", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("RBOD"))
+		sendResponseBodyChunk(rid, false, []byte("{\"message\":"))
+		sendResponseBodyChunk(rid, false, []byte("\"Hello, Response Server!\""))
+		sendResponseBodyChunk(rid, true, []byte("}"))
+		Expect(readBody()).Should(Equal("{\"message\":\"Hello, Response Server!\"}"))
+	})
+
+	It("Shorter than peek", func() {
+		err := beginResponse(rid, id, 200, makeResponseHeaders("text/plain", 2))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("RBOD"))
+		sendResponseBodyChunk(rid, true, []byte("Hi"))
+		Expect(readBody()).Should(Equal("Hi"))
+	})
+
+	It("Abort", func() {
+		err := beginResponse(rid, id, 200, makeResponseHeaders("application/json", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("RBOD"))
+		sendResponseBodyChunk(rid, false, []byte("{\"error\":\"Database is down\""))
+		sendResponseBodyChunk(rid, true, []byte("}"))
+
+		Expect(pollResponse(rid, true)).Should(Equal("SWCH502"))
+		Expect(pollResponse(rid, true)).Should(MatchRegexp("^WHDR.*"))
+		Expect(readBody()).Should(Equal("The target failed"))
+	})
+
+	It("Not on the request path", func() {
+		resp := &httpResponse{handler: getRequest(id)}
+		err := resp.PeekResponseBody(10, func([]byte, http.Header, int) PeekAction {
+			return PeekContinue
+		})
+		Expect(err).Should(Equal(errNoResponseBody))
+	})
+})
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/30x/gozerian/pipeline"
+)
+
+/*
+ * Request objects are big, and under load we create and free a great many
+ * of them, so freed ones are reused. A request is only put back once
+ * nothing can still be using it: it was freed, its goroutine has returned,
+ * no response refers to it, and its timers can't fire. Anything else that
+ * uses the request takes a hold on it until it is finished. Otherwise the
+ * request is left to the garbage collector as before. So is a request whose
+ * locks are still held by something that didn't take a hold, since
+ * clearing it would clear a lock out from under its owner. Every field is
+ * cleared when it goes back, so nothing leaks from one request into the
+ * next.
+ */
+
+var requestPool = sync.Pool{
+	New: func() interface{} {
+		return &request{}
+	},
+}
+
+func newRequest(id uint32, pd pipeline.Definition) *request {
+	r := requestPool.Get().(*request)
+	r.id = id
+	r.proxying = true
+	r.pd = pd
+	r.bodyStop = make(chan bool)
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	return r
+}
+
+func (r *request) hold() {
+	managerLatch.Lock()
+	defer managerLatch.Unlock()
+	r.holds++
+}
+
+func (r *request) release() {
+	managerLatch.Lock()
+	defer managerLatch.Unlock()
+	r.holds--
+	r.recycle()
+}
+
+/*
+ * Put a request back in the pool if it is safe. This must be called with
+ * managerLatch held.
+ */
+func (r *request) recycle() {
+	if !r.freed || r.holds != 0 || !r.timerStopped {
+		return
+	}
+	if !r.bodyLock.TryLock() {
+		return
+	}
+	if !r.stateLock.TryLock() {
+		r.bodyLock.Unlock()
+		return
+	}
+	if !r.phase.lock.TryLock() {
+		r.stateLock.Unlock()
+		r.bodyLock.Unlock()
+		return
+	}
+	// Nobody else can hold the locks now, so clearing them is safe.
+	*r = request{}
+	requestPool.Put(r)
+}
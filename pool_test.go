@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Request pool", func() {
+	It("Reused requests start clean", func() {
+		for i := 0; i < 10; i++ {
+			id := createRequest(testHandler)
+			Expect(id).ShouldNot(BeZero())
+			req := getRequest(id)
+			Expect(req.remoteAddr).Should(BeEmpty())
+			Expect(req.getState()).Should(Equal(stateNew))
+			Expect(req.cmds).Should(BeNil())
+			Expect(setRemoteAddr(id, "10.1.2.3:1234")).Should(Succeed())
+			Expect(beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))).Should(Succeed())
+			Expect(pollRequest(id, true)).Should(Equal("DONE"))
+			freeRequest(id)
+		}
+	})
+
+	It("Kept while a response refers to it", func() {
+		id := createRequest(testHandler)
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		req := getRequest(id)
+
+		rid := createResponse(testHandler)
+		Expect(beginResponse(rid, id, 200, makeResponseHeaders("", 0))).Should(Succeed())
+		freeRequest(id)
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+
+		managerLatch.Lock()
+		Expect(req.id).Should(Equal(id))
+		Expect(req.freed).Should(BeTrue())
+		managerLatch.Unlock()
+		freeResponse(rid)
+	})
+
+	It("Not reused while a lock is held", func() {
+		id := createRequest(testHandler)
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		req := getRequest(id)
+		// Give the request goroutine time to let go.
+		Eventually(func() int {
+			managerLatch.Lock()
+			defer managerLatch.Unlock()
+			return req.holds
+		}).Should(BeZero())
+
+		req.stateLock.Lock()
+		freeRequest(id)
+		managerLatch.Lock()
+		Expect(req.id).Should(Equal(id))
+		managerLatch.Unlock()
+		req.stateLock.Unlock()
+	})
+})
+
+/*
+ * Compare the allocations of a whole request with and without the pool.
+ */
+func benchmarkRequestCycle(b *testing.B, pooled bool) {
+	createHandler(testHandler, TestHandlerURI)
+	hdrs := makeRequestHeaders("GET", "/pass", "", 0)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		id := createRequest(testHandler)
+		if !pooled {
+			// Take a new request out of the pool's reach.
+			managerLatch.Lock()
+			requests[id] = &request{id: id, proxying: true, pd: requests[id].pd,
+				bodyStop: make(chan bool)}
+			managerLatch.Unlock()
+		}
+		beginRequest(id, hdrs)
+		pollRequest(id, true)
+		freeRequest(id)
+	}
+}
+
+func BenchmarkRequest(b *testing.B) {
+	benchmarkRequestCycle(b, true)
+}
+
+func BenchmarkUnpooledRequest(b *testing.B) {
+	benchmarkRequestCycle(b, false)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Change the port used to reach the target for a single request, such as to
+ * send some requests to the "green" side of a blue-green deployment on the
+ * same host. Like a scheme override, this makes the forwarded URI absolute.
+ */
+
+func setPortOverride(id uint32, port int32) error {
+	req := getRequest(id)
+	if req == nil {
+		return fmt.Errorf("Unknown request: %d", id)
+	}
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("Invalid port: %d", port)
+	}
+	req.port = int(port)
+	return nil
+}
+
+func (r *request) overridePort() {
+	if r.port == 0 {
+		return
+	}
+
+	newURL := *r.req.URL
+	if newURL.Scheme == "" {
+		newURL.Scheme = r.targetScheme()
+	}
+	host := newURL.Host
+	if host == "" {
+		host = r.req.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else {
+		// An IPv6 address without a port is still in brackets
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	newURL.Host = net.JoinHostPort(host, strconv.Itoa(r.port))
+	r.req.URL = &newURL
+
+	r.req.Host = newURL.Host
+	if r.req.Header.Get("Host") != "" {
+		r.req.Header.Set("Host", newURL.Host)
+	}
+}
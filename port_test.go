@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Port Override", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+	})
+
+	expectTarget := func(rawHeaders, uri, host string) {
+		err := beginRequest(id, rawHeaders)
+		Expect(err).Should(Succeed())
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WURI.*"))
+		Expect(cmd[4:]).Should(Equal(uri))
+		cmd = pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("Host")).Should(Equal(host))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	}
+
+	It("Invalid", func() {
+		Expect(setPortOverride(id, 0)).ShouldNot(Succeed())
+		Expect(setPortOverride(id, 65536)).ShouldNot(Succeed())
+		Expect(setPortOverride(0, 8080)).ShouldNot(Succeed())
+	})
+
+	It("Replace port", func() {
+		Expect(setPortOverride(id, 8443)).Should(Succeed())
+		expectTarget(makeRequestHeaders("GET", "/pass?x=1", "", 0),
+			"http://localhost:8443/pass?x=1", "localhost:8443")
+	})
+
+	It("Add port", func() {
+		Expect(setPortOverride(id, 9000)).Should(Succeed())
+		expectTarget("GET /pass HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			"http://example.com:9000/pass", "example.com:9000")
+	})
+
+	It("IPv6", func() {
+		Expect(setPortOverride(id, 9000)).Should(Succeed())
+		expectTarget("GET /pass HTTP/1.1\r\nHost: [::1]\r\n\r\n",
+			"http://[::1]:9000/pass", "[::1]:9000")
+	})
+
+	It("With scheme", func() {
+		Expect(setSchemeOverride(id, "https")).Should(Succeed())
+		Expect(setPortOverride(id, 8443)).Should(Succeed())
+		expectTarget(makeRequestHeaders("GET", "/pass", "", 0),
+			"https://localhost:8443/pass", "localhost:8443")
+	})
+})
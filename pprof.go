@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+/*
+ * Serve the Go profiler through weaver itself, under a path of the
+ * caller's choosing, instead of on a port of its own. Profiles say a lot
+ * about the process, so only clients in the allowlist may see them, and
+ * the address is the one that the caller reported, not one from a header.
+ * Until an allowlist is set, only loopback addresses are allowed. It is off
+ * by default.
+ */
+
+var defaultPprofAllowed = []*net.IPNet{
+	{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+	{IP: net.IPv6loopback, Mask: net.CIDRMask(128, 128)},
+}
+
+// pprof.Index only serves profiles under this path.
+const pprofIndexPath = "/debug/pprof/"
+
+/*
+ * Serve the profiler under "prefix." An empty prefix turns it off.
+ */
+func setPprofEndpoint(prefix string) error {
+	prefix = strings.TrimSpace(prefix)
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("Invalid profiler path \"%s\"", prefix)
+	}
+	updateSettings(func(s *settings) {
+		s.pprofEnabled = prefix != ""
+		s.pprofPath = strings.TrimRight(prefix, "/")
+	})
+	return nil
+}
+
+/*
+ * Set the networks that may use the profiler, separated by commas or
+ * newlines. An empty list goes back to loopback only.
+ */
+func setPprofAllowedCIDRs(cidrs string) error {
+	var allowed []*net.IPNet
+	for _, c := range strings.FieldsFunc(cidrs, func(r rune) bool {
+		return r == ',' || r == '\n'
+	}) {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return fmt.Errorf("Invalid CIDR \"%s\"", c)
+		}
+		allowed = append(allowed, n)
+	}
+	updateSettings(func(s *settings) {
+		s.pprofAllowed = allowed
+	})
+	return nil
+}
+
+func (r *request) servePprof() bool {
+	s := &r.settings
+	enabled, prefix := s.pprofEnabled, s.pprofPath
+	if !enabled && s.developmentMode {
+		enabled, prefix = true, developmentPprofPath
+	}
+	path := r.req.URL.Path
+	if !enabled || (path != prefix && !strings.HasPrefix(path, prefix+"/")) {
+		return false
+	}
+	if !r.checkPprofClient() {
+		return true
+	}
+
+	name := strings.TrimPrefix(strings.TrimPrefix(path, prefix), "/")
+	req := *r.req
+	u := *r.req.URL
+	u.Path = pprofIndexPath + name
+	req.URL = &u
+	r.resp.headers = &http.Header{}
+	switch name {
+	case "cmdline":
+		pprof.Cmdline(r.resp, &req)
+	case "profile":
+		pprof.Profile(r.resp, &req)
+	case "symbol":
+		pprof.Symbol(r.resp, &req)
+	case "trace":
+		pprof.Trace(r.resp, &req)
+	default:
+		pprof.Index(r.resp, &req)
+	}
+	return true
+}
+
+/*
+ * Return true if the client is in the profiler's allowlist, and otherwise
+ * reject the request.
+ */
+func (r *request) checkPprofClient() bool {
+	allowed := r.settings.pprofAllowed
+	if allowed == nil {
+		allowed = defaultPprofAllowed
+	}
+	id := r.clientIdentity(nil)
+	// An address from a header alone could be made up.
+	if id.IP == nil || !id.Trusted || !isTrustedProxy(id.IP, allowed) {
+		r.reject(http.StatusForbidden, "Forbidden")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Profiler", func() {
+	AfterEach(func() {
+		resetSettings()
+	})
+
+	// Return the status, headers, and body for a request from "addr."
+	fetch := func(path, addr string, extra ...string) (string, http.Header, string) {
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		if addr != "" {
+			Expect(setRemoteAddr(id, addr)).Should(Succeed())
+		}
+		hdrs := makeRequestHeaders("GET", path, "", 0)
+		for i := 0; i < len(extra); i += 2 {
+			hdrs = addRequestHeader(hdrs, extra[i], extra[i+1])
+		}
+		Expect(beginRequest(id, hdrs)).Should(Succeed())
+		cmd := pollRequest(id, true)
+		if cmd == "DONE" {
+			return "", nil, ""
+		}
+		Expect(cmd).Should(HavePrefix("SWCH"))
+		status := cmd[4:]
+		respHdrs := http.Header{}
+		body := ""
+		for cmd = pollRequest(id, true); cmd != "DONE"; cmd = pollRequest(id, true) {
+			switch cmd[:4] {
+			case "WHDR":
+				parseHeaders(respHdrs, cmd[4:])
+			case "WBOD":
+				body += string(readBodyData(cmd))
+			}
+		}
+		return status, respHdrs, body
+	}
+
+	It("Off by default", func() {
+		status, _, _ := fetch("/debug/pprof/", "127.0.0.1:1234")
+		Expect(status).ShouldNot(Equal("200"))
+	})
+
+	It("Index from loopback", func() {
+		Expect(setPprofEndpoint("/admin/pprof/")).Should(Succeed())
+		status, _, body := fetch("/admin/pprof/", "127.0.0.1:1234")
+		Expect(status).Should(Equal("200"))
+		Expect(body).Should(ContainSubstring("goroutine"))
+	})
+
+	It("Named profile", func() {
+		Expect(setPprofEndpoint("/admin/pprof")).Should(Succeed())
+		status, _, body := fetch("/admin/pprof/goroutine?debug=1", "[::1]:1234")
+		Expect(status).Should(Equal("200"))
+		Expect(body).Should(HavePrefix("goroutine profile:"))
+
+		status, _, body = fetch("/admin/pprof/cmdline", "127.0.0.1:1234")
+		Expect(status).Should(Equal("200"))
+		Expect(body).ShouldNot(BeEmpty())
+	})
+
+	It("Allowlist", func() {
+		Expect(setPprofEndpoint("/debug/pprof/")).Should(Succeed())
+		status, _, _ := fetch("/debug/pprof/", "10.1.2.3:1234")
+		Expect(status).Should(Equal("403"))
+
+		Expect(setPprofAllowedCIDRs("192.168.0.0/16, 10.0.0.0/8")).Should(Succeed())
+		status, _, _ = fetch("/debug/pprof/", "10.1.2.3:1234")
+		Expect(status).Should(Equal("200"))
+		// Loopback isn't in the list any more.
+		status, _, _ = fetch("/debug/pprof/", "127.0.0.1:1234")
+		Expect(status).Should(Equal("403"))
+	})
+
+	It("No address from a header alone", func() {
+		Expect(setPprofEndpoint("/debug/pprof/")).Should(Succeed())
+		status, _, _ := fetch("/debug/pprof/", "", "X-Forwarded-For", "127.0.0.1")
+		Expect(status).Should(Equal("403"))
+		status, _, _ = fetch("/debug/pprof/", "10.1.2.3:1234", "X-Forwarded-For", "127.0.0.1")
+		Expect(status).Should(Equal("403"))
+	})
+
+	It("Other paths", func() {
+		Expect(setPprofEndpoint("/debug/pprof/")).Should(Succeed())
+		status, _, _ := fetch("/pass", "127.0.0.1:1234")
+		Expect(status).Should(BeEmpty())
+		status, _, _ = fetch("/debug/pprofile", "127.0.0.1:1234")
+		Expect(status).ShouldNot(Equal("200"))
+	})
+
+	It("Invalid", func() {
+		Expect(setPprofEndpoint("debug/pprof")).ShouldNot(Succeed())
+		Expect(setPprofAllowedCIDRs("10.0.0.0")).ShouldNot(Succeed())
+		Expect(getSettings().pprofAllowed).Should(BeNil())
+	})
+})
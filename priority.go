@@ -0,0 +1,189 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"runtime"
+	"sync"
+	"time"
+)
+
+/*
+ * This is an optional scheduler that decides which request goroutines get
+ * to run their handlers. When it is disabled (the default) every request
+ * runs as soon as it begins. When it is enabled, only a fixed number of
+ * requests may run at once, and waiting requests are admitted in order of
+ * priority. Requests with the same priority are admitted in the order
+ * that they arrived. The number of requests that may wait can be limited,
+ * in which case new requests are turned away when the queue is full.
+ */
+
+const (
+	// NormalPriority is the priority of a request unless it is changed
+	NormalPriority = 0
+)
+
+var errQueueFull = errors.New("Too many requests are waiting to be processed")
+
+type priorityWaiter struct {
+	priority int32
+	seq      uint64
+	ready    chan bool
+}
+
+type priorityWaiters []*priorityWaiter
+
+func (w priorityWaiters) Len() int {
+	return len(w)
+}
+
+func (w priorityWaiters) Less(i, j int) bool {
+	if w[i].priority == w[j].priority {
+		return w[i].seq < w[j].seq
+	}
+	return w[i].priority > w[j].priority
+}
+
+func (w priorityWaiters) Swap(i, j int) {
+	w[i], w[j] = w[j], w[i]
+}
+
+func (w *priorityWaiters) Push(x interface{}) {
+	*w = append(*w, x.(*priorityWaiter))
+}
+
+func (w *priorityWaiters) Pop() interface{} {
+	old := *w
+	n := len(old)
+	x := old[n-1]
+	*w = old[:n-1]
+	return x
+}
+
+type priorityScheduler struct {
+	lock       sync.Mutex
+	enabled    bool
+	slots      int
+	maxWaiting int
+	running    int
+	lastSeq    uint64
+	waiting    priorityWaiters
+}
+
+var scheduler = &priorityScheduler{
+	slots: runtime.GOMAXPROCS(0),
+}
+
+func (s *priorityScheduler) setEnabled(enabled bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.enabled = enabled
+	if !enabled {
+		// Let everyone who is waiting go now.
+		for s.waiting.Len() > 0 {
+			w := heap.Pop(&s.waiting).(*priorityWaiter)
+			s.running++
+			close(w.ready)
+		}
+	}
+}
+
+func (s *priorityScheduler) setSlots(slots int) {
+	s.lock.Lock()
+	s.slots = slots
+	s.lock.Unlock()
+}
+
+/*
+ * Set the maximum number of requests that may wait. Zero means no limit.
+ */
+func (s *priorityScheduler) setMaxWaiting(max int) {
+	s.lock.Lock()
+	s.maxWaiting = max
+	s.lock.Unlock()
+}
+
+/*
+ * Wait until the request may run. Return true if the caller must call
+ * "release" when it is done, which will be the case only if the scheduler
+ * was enabled.
+ */
+func (s *priorityScheduler) acquire(priority int32) bool {
+	acquired, _, _ := s.wait(priority, false)
+	return acquired
+}
+
+/*
+ * Like "acquire," but for new requests, which are turned away with
+ * errQueueFull if too many are already waiting.
+ */
+func (s *priorityScheduler) admit(priority int32) (bool, error) {
+	acquired, _, err := s.wait(priority, true)
+	return acquired, err
+}
+
+/*
+ * Does the work for "acquire" and "admit," and also returns how long the
+ * caller was parked in the queue, or -1 if it didn't have to wait.
+ */
+func (s *priorityScheduler) wait(priority int32, limited bool) (bool, time.Duration, error) {
+	s.lock.Lock()
+	if !s.enabled {
+		s.lock.Unlock()
+		return false, -1, nil
+	}
+	if s.running < s.slots {
+		s.running++
+		s.lock.Unlock()
+		return true, -1, nil
+	}
+	if limited && s.maxWaiting > 0 && s.waiting.Len() >= s.maxWaiting {
+		s.lock.Unlock()
+		updateStats(func(st *stats) {
+			st.QueueRejections++
+		})
+		return false, -1, errQueueFull
+	}
+
+	s.lastSeq++
+	w := &priorityWaiter{
+		priority: priority,
+		seq:      s.lastSeq,
+		ready:    make(chan bool),
+	}
+	heap.Push(&s.waiting, w)
+	s.lock.Unlock()
+
+	updateStats(func(st *stats) {
+		st.QueuedRequests++
+	})
+	start := time.Now()
+	<-w.ready
+	waited := time.Since(start)
+	updateStats(func(st *stats) {
+		st.QueuedRequests--
+		st.QueueWaitMillis += int64(waited / time.Millisecond)
+	})
+	return true, waited, nil
+}
+
+/*
+ * Give up a slot, and hand it to the most important waiting request if there
+ * is one.
+ */
+func (s *priorityScheduler) release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.waiting.Len() > 0 && s.running <= s.slots {
+		w := heap.Pop(&s.waiting).(*priorityWaiter)
+		close(w.ready)
+		return
+	}
+	s.running--
+}
+
+func (s *priorityScheduler) waitingCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.waiting.Len()
+}
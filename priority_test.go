@@ -0,0 +1,255 @@
+package main
+
+import (
+	"runtime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Priority Queue", func() {
+	It("Disabled", func() {
+		s := &priorityScheduler{slots: 1}
+		Expect(s.acquire(NormalPriority)).Should(BeFalse())
+		Expect(s.acquire(NormalPriority)).Should(BeFalse())
+	})
+
+	It("Admit in priority order", func() {
+		s := &priorityScheduler{slots: 1}
+		s.setEnabled(true)
+		Expect(s.acquire(NormalPriority)).Should(BeTrue())
+
+		order := make(chan int32, 3)
+		wait := func(p int32) {
+			s.acquire(p)
+			order <- p
+			s.release()
+		}
+
+		go wait(NormalPriority)
+		Eventually(s.waitingCount).Should(Equal(1))
+		go wait(1)
+		Eventually(s.waitingCount).Should(Equal(2))
+		go wait(5)
+		Eventually(s.waitingCount).Should(Equal(3))
+
+		s.release()
+		Expect(<-order).Should(BeEquivalentTo(5))
+		Expect(<-order).Should(BeEquivalentTo(1))
+		Expect(<-order).Should(BeEquivalentTo(NormalPriority))
+	})
+
+	It("Disable releases waiters", func() {
+		s := &priorityScheduler{slots: 1}
+		s.setEnabled(true)
+		Expect(s.acquire(NormalPriority)).Should(BeTrue())
+
+		done := make(chan bool, 1)
+		go func() {
+			s.acquire(NormalPriority)
+			done <- true
+		}()
+		Eventually(s.waitingCount).Should(Equal(1))
+		s.setEnabled(false)
+		Eventually(done).Should(Receive())
+	})
+
+	It("Queue limit", func() {
+		s := &priorityScheduler{slots: 1}
+		s.setEnabled(true)
+		s.setMaxWaiting(2)
+		Expect(s.acquire(NormalPriority)).Should(BeTrue())
+
+		before := getStats()
+		for i := 0; i < 2; i++ {
+			go func() {
+				s.admit(NormalPriority)
+				s.release()
+			}()
+		}
+		Eventually(s.waitingCount).Should(Equal(2))
+		Expect(getStats().QueuedRequests).Should(Equal(before.QueuedRequests + 2))
+
+		acquired, err := s.admit(NormalPriority)
+		Expect(acquired).Should(BeFalse())
+		Expect(err).Should(Equal(errQueueFull))
+		Expect(getStats().QueueRejections).Should(Equal(before.QueueRejections + 1))
+
+		// Responses are never turned away
+		done := make(chan bool, 1)
+		go func() {
+			s.acquire(NormalPriority)
+			done <- true
+			s.release()
+		}()
+		Eventually(s.waitingCount).Should(Equal(3))
+
+		s.release()
+		Eventually(done).Should(Receive())
+		Eventually(s.waitingCount).Should(BeZero())
+		Eventually(func() int64 {
+			return getStats().QueuedRequests
+		}).Should(Equal(before.QueuedRequests))
+	})
+
+	It("Reject when queue is full", func() {
+		GoSetPriorityQueue(1)
+		scheduler.setSlots(1)
+		GoSetPriorityQueueLimit(1)
+		defer func() {
+			GoSetPriorityQueue(0)
+			GoSetPriorityQueueLimit(0)
+			scheduler.setSlots(runtime.GOMAXPROCS(0))
+		}()
+
+		slowID := createRequest(testHandler)
+		defer freeRequest(slowID)
+		waitingID := createRequest(testHandler)
+		defer freeRequest(waitingID)
+		rejectedID := createRequest(testHandler)
+		defer freeRequest(rejectedID)
+
+		err := beginRequest(slowID, makeRequestHeaders("GET", "/slowpass", "", 0))
+		Expect(err).Should(Succeed())
+		Eventually(func() int {
+			scheduler.lock.Lock()
+			defer scheduler.lock.Unlock()
+			return scheduler.running
+		}).Should(Equal(1))
+		err = beginRequest(waitingID, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Eventually(scheduler.waitingCount).Should(Equal(1))
+
+		err = beginRequest(rejectedID, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		cmd := pollRequest(rejectedID, true)
+		Expect(cmd).Should(MatchRegexp("^SWCH.*"))
+		Expect(cmd[4:]).Should(Equal("503"))
+		Expect(pollRequest(rejectedID, true)).Should(MatchRegexp("^WHDR.*"))
+		readBodyData(pollRequest(rejectedID, true))
+		Expect(pollRequest(rejectedID, true)).Should(Equal("DONE"))
+
+		Expect(pollRequest(slowID, true)).Should(Equal("DONE"))
+		Expect(pollRequest(waitingID, true)).Should(Equal("DONE"))
+	})
+
+	It("High priority request", func() {
+		GoSetPriorityQueue(1)
+		scheduler.setSlots(1)
+		defer func() {
+			GoSetPriorityQueue(0)
+			scheduler.setSlots(runtime.GOMAXPROCS(0))
+		}()
+
+		slowID := createRequest(testHandler)
+		defer freeRequest(slowID)
+		normalID := createRequest(testHandler)
+		defer freeRequest(normalID)
+		highID := createRequest(testHandler)
+		defer freeRequest(highID)
+		GoSetRequestPriority(highID, 10)
+
+		err := beginRequest(slowID, makeRequestHeaders("GET", "/slowpass", "", 0))
+		Expect(err).Should(Succeed())
+		Eventually(func() int {
+			scheduler.lock.Lock()
+			defer scheduler.lock.Unlock()
+			return scheduler.running
+		}).Should(Equal(1))
+
+		err = beginRequest(normalID, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Eventually(scheduler.waitingCount).Should(Equal(1))
+		err = beginRequest(highID, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Eventually(scheduler.waitingCount).Should(Equal(2))
+
+		Expect(pollRequest(slowID, true)).Should(Equal("DONE"))
+		Expect(pollRequest(highID, true)).Should(Equal("DONE"))
+		Expect(pollRequest(normalID, true)).Should(Equal("DONE"))
+	})
+
+	It("Slot is given up when the handler returns", func() {
+		GoSetPriorityQueue(1)
+		scheduler.setSlots(1)
+		defer func() {
+			GoSetPriorityQueue(0)
+			scheduler.setSlots(runtime.GOMAXPROCS(0))
+			resetSettings()
+		}()
+		// Substitution reads the response body after the handler returns.
+		Expect(setResponseSubstitution("text/plain", "Hello", "Howdy")).Should(Succeed())
+
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		rid := createResponse(testHandler)
+		defer freeResponse(rid)
+		err = beginResponse(rid, id, 200, makeResponseHeaders("text/plain", 6))
+		Expect(err).Should(Succeed())
+		cmd := pollResponse(rid, true)
+		for ; cmd != "RBOD"; cmd = pollResponse(rid, true) {
+			Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		}
+
+		// The response body hasn't arrived yet, but that mustn't hold up
+		// anyone else.
+		other := createRequest(testHandler)
+		defer freeRequest(other)
+		err = beginRequest(other, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(other, true)).Should(Equal("DONE"))
+
+		sendResponseBodyChunk(rid, true, []byte("Hello!"))
+		cmd = pollResponse(rid, true)
+		Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+		Expect(string(readBodyData(cmd))).Should(Equal("Howdy!"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Queue wait per request", func() {
+		GoSetPriorityQueue(1)
+		scheduler.setSlots(1)
+		defer func() {
+			GoSetPriorityQueue(0)
+			scheduler.setSlots(runtime.GOMAXPROCS(0))
+		}()
+
+		slowID := createRequest(testHandler)
+		defer freeRequest(slowID)
+		waitingID := createRequest(testHandler)
+		defer freeRequest(waitingID)
+		Expect(enableServerTiming(waitingID)).Should(Succeed())
+
+		err := beginRequest(slowID, makeRequestHeaders("GET", "/slowpass", "", 0))
+		Expect(err).Should(Succeed())
+		Eventually(func() int {
+			scheduler.lock.Lock()
+			defer scheduler.lock.Unlock()
+			return scheduler.running
+		}).Should(Equal(1))
+		err = beginRequest(waitingID, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Eventually(scheduler.waitingCount).Should(Equal(1))
+		Expect(pollRequest(slowID, true)).Should(Equal("DONE"))
+		Expect(pollRequest(waitingID, true)).Should(Equal("DONE"))
+
+		queued, _ := getRequest(slowID).queueTiming()
+		Expect(queued).Should(BeFalse())
+		queued, waited := getRequest(waitingID).queueTiming()
+		Expect(queued).Should(BeTrue())
+		Expect(waited).Should(BeNumerically(">", 0))
+
+		rid := createResponse(testHandler)
+		defer freeResponse(rid)
+		err = beginResponse(rid, waitingID, 200, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+		cmd := pollResponse(rid, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		Expect(cmd).Should(MatchRegexp("queue;dur=[0-9.]+"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+})
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+ * Kubernetes probes, answered by weaver without running the handler, and
+ * before the priority queue, the request duration limit, or any check of
+ * the client, so that an overloaded or strict weaver doesn't look dead. The
+ * liveness probe says 200 for as long as weaver can answer at all. The
+ * readiness probe says 503 until the caller marks weaver ready, for
+ * instance once the handlers are set up, and the caller can take it back
+ * out of service by marking it not ready again.
+ */
+
+const (
+	probeReadyMessage    = "ready"
+	probeNotReadyMessage = "not ready"
+	probeAliveMessage    = "alive"
+)
+
+// 1 when ready, set with atomic operations
+var processReady int32
+
+func markReady(ready bool) {
+	if ready {
+		atomic.StoreInt32(&processReady, 1)
+	} else {
+		atomic.StoreInt32(&processReady, 0)
+	}
+}
+
+func isReady() bool {
+	return atomic.LoadInt32(&processReady) != 0
+}
+
+func checkProbePath(path string) (string, error) {
+	path = strings.TrimSpace(path)
+	if path != "" && !strings.HasPrefix(path, "/") {
+		return "", fmt.Errorf("Invalid probe path \"%s\"", path)
+	}
+	return path, nil
+}
+
+/*
+ * Set the path of the readiness probe. An empty path turns it off.
+ */
+func setReadinessEndpoint(path string) error {
+	path, err := checkProbePath(path)
+	if err != nil {
+		return err
+	}
+	updateSettings(func(s *settings) {
+		s.readinessPath = path
+	})
+	return nil
+}
+
+/*
+ * Set the path of the liveness probe. An empty path turns it off.
+ */
+func setLivenessEndpoint(path string) error {
+	path, err := checkProbePath(path)
+	if err != nil {
+		return err
+	}
+	updateSettings(func(s *settings) {
+		s.livenessPath = path
+	})
+	return nil
+}
+
+func (r *request) serveProbe() bool {
+	path := r.req.URL.Path
+	if path == "" || (r.req.Method != "GET" && r.req.Method != "HEAD") {
+		return false
+	}
+	switch {
+	case path == r.settings.livenessPath:
+		r.answerProbe(http.StatusOK, probeAliveMessage)
+	case path == r.settings.readinessPath && isReady():
+		r.answerProbe(http.StatusOK, probeReadyMessage)
+	case path == r.settings.readinessPath:
+		r.answerProbe(http.StatusServiceUnavailable, probeNotReadyMessage)
+	default:
+		return false
+	}
+	return true
+}
+
+func (r *request) answerProbe(status int, msg string) {
+	hdrs := http.Header{}
+	hdrs.Set("Content-Type", "text/plain")
+	hdrs.Set("Cache-Control", "no-store")
+	r.resp.headers = &hdrs
+	r.resp.WriteHeader(status)
+	if r.req.Method != "HEAD" {
+		r.resp.Write([]byte(msg))
+	}
+}
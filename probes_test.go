@@ -0,0 +1,100 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Probes", func() {
+	AfterEach(func() {
+		markReady(false)
+		resetSettings()
+	})
+
+	// Return the status and body of the probe.
+	probe := func(method, path string) (string, string) {
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		Expect(beginRequest(id, makeRequestHeaders(method, path, "", 0))).Should(Succeed())
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("SWCH"))
+		status := cmd[4:]
+		Expect(pollRequest(id, true)).Should(HavePrefix("WHDR"))
+		body := ""
+		for cmd = pollRequest(id, true); cmd != "DONE"; cmd = pollRequest(id, true) {
+			Expect(cmd).Should(HavePrefix("WBOD"))
+			body += string(readBodyData(cmd))
+		}
+		return status, body
+	}
+
+	It("Readiness", func() {
+		Expect(setReadinessEndpoint("/ready")).Should(Succeed())
+		status, body := probe("GET", "/ready")
+		Expect(status).Should(Equal("503"))
+		Expect(body).Should(Equal(probeNotReadyMessage))
+
+		markReady(true)
+		status, body = probe("GET", "/ready")
+		Expect(status).Should(Equal("200"))
+		Expect(body).Should(Equal(probeReadyMessage))
+
+		markReady(false)
+		status, _ = probe("GET", "/ready")
+		Expect(status).Should(Equal("503"))
+	})
+
+	It("Liveness", func() {
+		Expect(setLivenessEndpoint("/live")).Should(Succeed())
+		status, body := probe("GET", "/live")
+		Expect(status).Should(Equal("200"))
+		Expect(body).Should(Equal(probeAliveMessage))
+		status, body = probe("HEAD", "/live")
+		Expect(status).Should(Equal("200"))
+		Expect(body).Should(BeEmpty())
+	})
+
+	It("Other paths and methods", func() {
+		Expect(setReadinessEndpoint("/ready")).Should(Succeed())
+		Expect(setLivenessEndpoint("/live")).Should(Succeed())
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		id2 := createRequest(testHandler)
+		defer freeRequest(id2)
+		Expect(beginRequest(id2, makeRequestHeaders("POST", "/live", "", 0))).Should(Succeed())
+		Expect(pollRequest(id2, true)).ShouldNot(Equal("SWCH200"))
+	})
+
+	It("Before the limits", func() {
+		Expect(setLivenessEndpoint("/live")).Should(Succeed())
+		Expect(setRateLimit(0.001, 1)).Should(Succeed())
+		for i := 0; i < 3; i++ {
+			id := createRequest(testHandler)
+			Expect(setRemoteAddr(id, "10.0.0.1:1234")).Should(Succeed())
+			Expect(beginRequest(id, makeRequestHeaders("GET", "/live", "", 0))).Should(Succeed())
+			Expect(pollRequest(id, true)).Should(Equal("SWCH200"))
+			freeRequest(id)
+		}
+
+		// Every other request runs out of time before it is checked.
+		setMaxRequestDuration(time.Nanosecond)
+		status, _ := probe("GET", "/live")
+		Expect(status).Should(Equal("200"))
+	})
+
+	It("Off", func() {
+		Expect(setLivenessEndpoint("/live")).Should(Succeed())
+		Expect(setLivenessEndpoint("")).Should(Succeed())
+		Expect(getSettings().livenessPath).Should(BeEmpty())
+	})
+
+	It("Invalid", func() {
+		Expect(setReadinessEndpoint("ready")).ShouldNot(Succeed())
+		Expect(setLivenessEndpoint("live")).ShouldNot(Succeed())
+	})
+})
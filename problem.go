@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+/*
+ * Let handlers send errors as RFC 7807 "problem details," so that every API
+ * behind weaver reports errors the same way. Handlers find WriteProblem
+ * using a type assertion on the http.ResponseWriter.
+ */
+
+const problemContentType = "application/problem+json"
+
+var errResponseStarted = errors.New("The response was already started")
+
+// ProblemDetails is the body of an RFC 7807 error response
+type ProblemDetails struct {
+	// Type is a URI that identifies the kind of problem. If it is empty,
+	// "about:blank" is used.
+	Type string `json:"type"`
+	// Title is a short summary of the kind of problem. If it is empty, the
+	// text for the status is used.
+	Title string `json:"title"`
+	// Status is the HTTP status. It is set to the status of the response.
+	Status int `json:"status"`
+	// Detail describes this occurrence of the problem.
+	Detail string `json:"detail,omitempty"`
+	// Instance is a URI that identifies this occurrence of the problem.
+	Instance string `json:"instance,omitempty"`
+}
+
+/*
+ * WriteProblem sends a response with the given status and an
+ * application/problem+json body, instead of proxying the request or
+ * returning the response from the target. An empty "typ" means
+ * "about:blank," an empty "title" means the text for the status, and an
+ * empty "detail" is left out. The members of "ext," such as "instance," are
+ * added to the body, but they can't replace the ones above. Any headers that
+ * the handler set are kept. It fails if the response was already started.
+ */
+func (h *httpResponse) WriteProblem(
+	status int, typ, title, detail string, ext map[string]interface{}) error {
+
+	p := ProblemDetails{Type: typ, Title: title, Detail: detail}.complete(status)
+	fields := make(map[string]interface{}, len(ext)+4)
+	for k, v := range ext {
+		fields[k] = v
+	}
+	fields["type"] = p.Type
+	fields["title"] = p.Title
+	fields["status"] = p.Status
+	if p.Detail != "" {
+		fields["detail"] = p.Detail
+	}
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return h.writeBody(status, problemContentType, body)
+}
+
+/*
+ * Fill in the fields that are required.
+ */
+func (p ProblemDetails) complete(status int) *ProblemDetails {
+	if p.Type == "" {
+		p.Type = "about:blank"
+	}
+	if p.Title == "" {
+		p.Title = http.StatusText(status)
+	}
+	p.Status = status
+	return &p
+}
+
+/*
+ * Send a whole response, with none of the request headers that Header
+ * starts with, unless the handler already set some.
+ */
+func (h *httpResponse) writeBody(status int, contentType string, body []byte) error {
+	if h.headersFlushed {
+		return errResponseStarted
+	}
+	if h.headers == nil {
+		h.headers = &http.Header{}
+	}
+	h.Header().Set("Content-Type", contentType)
+	h.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	h.WriteHeader(status)
+	_, err := h.Write(body)
+	return err
+}
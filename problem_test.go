@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Problem details", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+	})
+
+	It("Bad request", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/problem", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("SWCH400"))
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("WHDR"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("Content-Type")).Should(Equal("application/problem+json"))
+		Expect(hdrs.Get("Host")).Should(BeEmpty())
+
+		cmd = pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("WBOD"))
+		body := readBodyData(cmd)
+		Expect(hdrs.Get("Content-Length")).Should(Equal(fmt.Sprint(len(body))))
+		var fields map[string]interface{}
+		Expect(json.Unmarshal(body, &fields)).Should(Succeed())
+		Expect(fields).Should(Equal(map[string]interface{}{
+			"type":     "https://example.com/problems/missing-param",
+			"title":    "Bad Request",
+			"status":   float64(400),
+			"detail":   "The \"id\" parameter is required",
+			"instance": "/problem",
+			"param":    "id",
+		}))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Already started", func() {
+		h := &httpResponse{handler: getRequest(id), headersFlushed: true}
+		Expect(h.WriteProblem(500, "", "", "", nil)).Should(Equal(errResponseStarted))
+	})
+})
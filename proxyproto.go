@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+/*
+ * When weaver runs behind a TCP load balancer that uses the PROXY protocol,
+ * the caller parses the PROXY header and passes along what it found. The
+ * addresses are kept in the context of the http.Request, separately from
+ * RemoteAddr, which is still the address of whoever connected to us.
+ */
+
+// ProxyProtocolInfo describes the connection as the load balancer saw it
+type ProxyProtocolInfo struct {
+	// Version is 1 or 2
+	Version int
+	// ClientAddr is the address of the real client, as "host:port"
+	ClientAddr string
+	// ProxyAddr is the address that the client connected to on the load
+	// balancer, as "host:port"
+	ProxyAddr string
+}
+
+type proxyProtocolKey struct{}
+
+func setProxyProtocolInfo(id uint32, version int, clientAddr, proxyAddr string) error {
+	req := getRequest(id)
+	if req == nil {
+		return fmt.Errorf("Unknown request: %d", id)
+	}
+	if version != 1 && version != 2 {
+		return fmt.Errorf("Invalid PROXY protocol version: %d", version)
+	}
+	for _, addr := range []string{clientAddr, proxyAddr} {
+		if err := checkAddr(addr); err != nil {
+			return err
+		}
+	}
+	req.proxyInfo = &ProxyProtocolInfo{
+		Version:    version,
+		ClientAddr: clientAddr,
+		ProxyAddr:  proxyAddr,
+	}
+	return nil
+}
+
+func checkAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("Invalid IP address: \"%s\"", host)
+	}
+	return nil
+}
+
+/*
+ * Return the PROXY protocol information for a request, or nil if there is
+ * none. This is how handlers find the real client.
+ */
+func getProxyProtocolInfo(req *http.Request) *ProxyProtocolInfo {
+	info, _ := req.Context().Value(proxyProtocolKey{}).(*ProxyProtocolInfo)
+	return info
+}
+
+func withProxyProtocolInfo(req *http.Request, info *ProxyProtocolInfo) *http.Request {
+	if info == nil {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), proxyProtocolKey{}, info))
+}
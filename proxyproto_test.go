@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PROXY Protocol", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+	})
+
+	expectInfo := func(version, clientAddr, proxyAddr string) {
+		err := beginRequest(id, makeRequestHeaders("GET", "/proxyinfo", "", 0))
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("X-Proxy-Version")).Should(Equal(version))
+		Expect(hdrs.Get("X-Client-Addr")).Should(Equal(clientAddr))
+		Expect(hdrs.Get("X-Proxy-Addr")).Should(Equal(proxyAddr))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	}
+
+	It("Invalid", func() {
+		Expect(setProxyProtocolInfo(id, 3, "10.0.0.1:1234", "10.0.0.2:443")).ShouldNot(Succeed())
+		Expect(setProxyProtocolInfo(id, 1, "10.0.0.1", "10.0.0.2:443")).ShouldNot(Succeed())
+		Expect(setProxyProtocolInfo(id, 1, "10.0.0.1:1234", "example.com:443")).ShouldNot(Succeed())
+		Expect(setProxyProtocolInfo(0, 1, "10.0.0.1:1234", "10.0.0.2:443")).ShouldNot(Succeed())
+	})
+
+	It("None", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/proxyinfo", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Version 1", func() {
+		Expect(setProxyProtocolInfo(id, 1, "192.168.0.1:56324", "192.168.0.11:443")).Should(Succeed())
+		expectInfo("1", "192.168.0.1:56324", "192.168.0.11:443")
+	})
+
+	It("Version 2", func() {
+		Expect(setProxyProtocolInfo(id, 2, "[2001:db8::1]:56324", "[2001:db8::11]:443")).Should(Succeed())
+		expectInfo("2", "[2001:db8::1]:56324", "[2001:db8::11]:443")
+	})
+})
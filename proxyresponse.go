@@ -15,6 +15,9 @@ type httpResponse struct {
 	handler        commandHandler
 	headers        *http.Header
 	headersFlushed bool
+	split          bool
+	chunkSize      int
+	pending        []byte
 }
 
 func (h *httpResponse) Header() http.Header {
@@ -35,10 +38,31 @@ func (h *httpResponse) Write(buf []byte) (int, error) {
 	// Flush ensures that headers are written only once and the first time
 	h.handler.ResponseWritten()
 	h.flush(http.StatusOK)
-	sendBodyChunk(h.handler, buf)
+	if h.split {
+		return len(buf), nil
+	}
+	if h.chunkSize > 0 {
+		h.writeChunked(buf)
+	} else {
+		sendBodyChunk(h.handler, buf)
+	}
 	return len(buf), nil
 }
 
+/*
+ * Return the request that the response is for, whether it came from a
+ * request handler or a response handler.
+ */
+func (h *httpResponse) owner() *request {
+	switch handler := h.handler.(type) {
+	case *request:
+		return handler
+	case *response:
+		return handler.request
+	}
+	return nil
+}
+
 func (h *httpResponse) WriteHeader(status int) {
 	h.handler.ResponseWritten()
 	h.flush(status)
@@ -48,6 +72,13 @@ func (h *httpResponse) flush(status int) {
 	if h.headersFlushed {
 		return
 	}
+	if r := h.owner(); r != nil && h.headers != nil {
+		r.dropResponseHeaders(*h.headers)
+	}
+	status = h.checkSplit(status)
+	if r := h.owner(); r != nil {
+		r.recordHARResponse(status, h.headers)
+	}
 	swchCmd := command{
 		id:  SWCH,
 		msg: fmt.Sprintf("%d", status),
@@ -61,6 +92,9 @@ func (h *httpResponse) flush(status int) {
 		}
 		h.handler.Commands() <- whdrCmd
 	}
+	if h.split {
+		sendBodyChunk(h.handler, []byte(splitResponseMessage))
+	}
 
 	h.headersFlushed = true
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+)
+
+/*
+ * Changes to the query string of the request before it is forwarded to the
+ * target. Overrides apply to every request and add or replace a parameter,
+ * for instance to add an API key that the target requires. Deletions are
+ * set for a single request.
+ */
+
+func setQueryParamOverride(name, value string) error {
+	if name == "" {
+		return fmt.Errorf("Query parameter name must not be empty")
+	}
+	updateSettings(func(s *settings) {
+		overrides := make(map[string]string)
+		for k, v := range s.queryOverrides {
+			overrides[k] = v
+		}
+		overrides[name] = value
+		s.queryOverrides = overrides
+	})
+	return nil
+}
+
+func clearQueryParamOverrides() {
+	updateSettings(func(s *settings) {
+		s.queryOverrides = nil
+	})
+}
+
+func deleteQueryParam(id uint32, name string) error {
+	req := getRequest(id)
+	if req == nil {
+		return fmt.Errorf("Unknown request: %d", id)
+	}
+	req.queryDeletes = append(req.queryDeletes, name)
+	return nil
+}
+
+func (r *request) rewriteQuery() {
+	if len(r.settings.queryOverrides) == 0 && len(r.queryDeletes) == 0 {
+		return
+	}
+	q := r.req.URL.Query()
+	for _, name := range r.queryDeletes {
+		q.Del(name)
+	}
+	for name, value := range r.settings.queryOverrides {
+		q.Set(name, value)
+	}
+
+	newURL := *r.req.URL
+	newURL.RawQuery = q.Encode()
+	if newURL.RawQuery != r.req.URL.RawQuery {
+		r.req.URL = &newURL
+	}
+}
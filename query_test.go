@@ -0,0 +1,64 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Query Parameters", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		resetSettings()
+	})
+
+	expectURI := func(uri, expected string) {
+		err := beginRequest(id, makeRequestHeaders("GET", uri, "", 0))
+		Expect(err).Should(Succeed())
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WURI.*"))
+		Expect(cmd[4:]).Should(Equal(expected))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	}
+
+	It("Empty name", func() {
+		Expect(setQueryParamOverride("", "x")).ShouldNot(Succeed())
+	})
+
+	It("Add", func() {
+		Expect(setQueryParamOverride("api_key", "a b&c")).Should(Succeed())
+		expectURI("/pass/users", "/pass/users?api_key=a+b%26c")
+	})
+
+	It("Replace", func() {
+		Expect(setQueryParamOverride("api_key", "secret")).Should(Succeed())
+		expectURI("/pass/users?api_key=guess&api_key=again&limit=5",
+			"/pass/users?api_key=secret&limit=5")
+	})
+
+	It("Delete", func() {
+		Expect(deleteQueryParam(id, "debug")).Should(Succeed())
+		expectURI("/pass/users?debug=true&limit=5", "/pass/users?limit=5")
+	})
+
+	It("Nothing to change", func() {
+		Expect(deleteQueryParam(id, "debug")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass/users?limit=5", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Clear", func() {
+		Expect(setQueryParamOverride("api_key", "secret")).Should(Succeed())
+		clearQueryParamOverrides()
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass/users", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+})
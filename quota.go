@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+ * Enforce a quota for each tenant of a shared API. The tenant is whatever
+ * the key function returns for the request, such as the value of a header.
+ * Both the number of requests per minute and the number of response body
+ * bytes per day are limited. A request is counted when it arrives, and the
+ * bytes of its response are counted once the whole body has been sent, so a
+ * response that goes over the byte quota is still finished, and the next
+ * request is the one that is rejected. Weaver has to send the body itself
+ * in order to count it. The counts live in a QuotaStore, so
+ * that several copies of weaver can share them.
+ */
+
+const (
+	quotaRequests = "requests"
+	quotaBytes    = "bytes"
+	// The number of buckets in each sliding window
+	quotaBuckets = 60
+	// How often the memory store drops windows that have emptied
+	quotaSweepInterval = time.Minute
+)
+
+// QuotaLimits are the limits for each key. A limit of zero means that there
+// is none.
+type QuotaLimits struct {
+	RequestsPerMinute int64
+	BytesPerDay       int64
+}
+
+// A QuotaStore keeps counts for each key within a sliding window
+type QuotaStore interface {
+	// Add adds "n," which may be zero, to the "counter" for "key" at "now,"
+	// and returns the total for the window that ends at "now."
+	Add(counter, key string, n int64, now time.Time, window time.Duration) (int64, error)
+}
+
+// A QuotaLimiter is a QuotaStore that can check a limit and count in one
+// step, so that requests that arrive together can't all get under it.
+type QuotaLimiter interface {
+	QuotaStore
+	// AddBelow adds "n" to the "counter" for "key" at "now" only if the total
+	// for the window is below "limit." It returns the total and whether "n"
+	// was added.
+	AddBelow(counter, key string, n, limit int64, now time.Time, window time.Duration) (int64, bool, error)
+}
+
+type quotaPolicy struct {
+	keyFunc func(*http.Request) string
+	limits  QuotaLimits
+	store   QuotaStore
+}
+
+// This is replaced by tests
+var quotaClock = time.Now
+
+/*
+ * SetQuotaPolicy enforces "limits" for every key that "keyFunc" returns,
+ * keeping the counts in "store." If "store" is nil, they are kept in memory.
+ * Requests for which "keyFunc" returns an empty string aren't limited. A nil
+ * "keyFunc" turns quotas off.
+ */
+func SetQuotaPolicy(keyFunc func(*http.Request) string, limits QuotaLimits, store QuotaStore) {
+	var policy *quotaPolicy
+	if keyFunc != nil {
+		if store == nil {
+			store = NewMemoryQuotaStore()
+		}
+		policy = &quotaPolicy{
+			keyFunc: keyFunc,
+			limits:  limits,
+			store:   store,
+		}
+	}
+	updateSettings(func(s *settings) {
+		s.quota = policy
+	})
+}
+
+/*
+ * Limit requests by the value of a header, keeping the counts in memory. An
+ * empty header name turns quotas off.
+ */
+func setHeaderQuota(header string, requestsPerMinute, bytesPerDay int64) error {
+	if requestsPerMinute < 0 || bytesPerDay < 0 {
+		return fmt.Errorf("Invalid quota: %d requests, %d bytes", requestsPerMinute, bytesPerDay)
+	}
+	if header == "" {
+		SetQuotaPolicy(nil, QuotaLimits{}, nil)
+		return nil
+	}
+	SetQuotaPolicy(func(req *http.Request) string {
+		return req.Header.Get(header)
+	}, QuotaLimits{
+		RequestsPerMinute: requestsPerMinute,
+		BytesPerDay:       bytesPerDay,
+	}, nil)
+	return nil
+}
+
+/*
+ * Check the request against the quota for its key, and count it. Return
+ * false if the request was rejected. If the store fails, the request is let
+ * through.
+ */
+func (r *request) checkQuota() bool {
+	policy := r.settings.quota
+	if policy == nil {
+		return true
+	}
+	key := policy.keyFunc(r.req)
+	if key == "" {
+		return true
+	}
+	r.quotaKey = key
+	now := quotaClock()
+
+	if limit := policy.limits.BytesPerDay; limit > 0 {
+		count, err := policy.store.Add(quotaBytes, key, 0, now, 24*time.Hour)
+		if err != nil {
+			log.Printf("Can't read byte count for quota key \"%s\": %v", key, err)
+		} else if count >= limit {
+			r.rejectQuota(limit, "Byte quota exceeded")
+			return false
+		}
+	}
+	if limit := policy.limits.RequestsPerMinute; limit > 0 {
+		if limiter, ok := policy.store.(QuotaLimiter); ok {
+			_, added, err := limiter.AddBelow(quotaRequests, key, 1, limit, now, time.Minute)
+			if err != nil {
+				log.Printf("Can't count request for quota key \"%s\": %v", key, err)
+			} else if !added {
+				r.rejectQuota(limit, "Request quota exceeded")
+				return false
+			}
+			return true
+		}
+		// Requests that are rejected don't count, so check first.
+		count, err := policy.store.Add(quotaRequests, key, 0, now, time.Minute)
+		if err == nil && count >= limit {
+			r.rejectQuota(limit, "Request quota exceeded")
+			return false
+		}
+		if err == nil {
+			_, err = policy.store.Add(quotaRequests, key, 1, now, time.Minute)
+		}
+		if err != nil {
+			log.Printf("Can't count request for quota key \"%s\": %v", key, err)
+		}
+	}
+	return true
+}
+
+func (r *request) rejectQuota(limit int64, msg string) {
+	hdrs := http.Header{}
+	hdrs.Set("X-RateLimit-Limit", strconv.FormatInt(limit, 10))
+	hdrs.Set("X-RateLimit-Remaining", "0")
+	r.rejectWithHeaders(http.StatusTooManyRequests, msg, hdrs)
+}
+
+func (r *request) countingQuotaBytes() bool {
+	return r.quotaKey != "" && r.settings.quota.limits.BytesPerDay > 0
+}
+
+/*
+ * Count the bytes of the response body that were sent to the client.
+ */
+func (r *request) recordQuotaBytes(n int64) {
+	if !r.countingQuotaBytes() || n == 0 {
+		return
+	}
+	_, err := r.settings.quota.store.Add(quotaBytes, r.quotaKey, n, quotaClock(), 24*time.Hour)
+	if err != nil {
+		log.Printf("Can't count bytes for quota key \"%s\": %v", r.quotaKey, err)
+	}
+}
+
+// MemoryQuotaStore is a QuotaLimiter that keeps the counts for this process
+// only
+type MemoryQuotaStore struct {
+	lock      sync.Mutex
+	windows   map[string]*slidingWindow
+	nextSweep time.Time
+}
+
+/*
+ * A sliding window is split into buckets, and a count is dropped when its
+ * bucket slides out of the window.
+ */
+type slidingWindow struct {
+	width   time.Duration
+	newest  int64
+	counts  [quotaBuckets]int64
+	buckets [quotaBuckets]int64
+}
+
+// NewMemoryQuotaStore returns an empty MemoryQuotaStore
+func NewMemoryQuotaStore() *MemoryQuotaStore {
+	return &MemoryQuotaStore{
+		windows: make(map[string]*slidingWindow),
+	}
+}
+
+// Add implements QuotaStore
+func (s *MemoryQuotaStore) Add(counter, key string, n int64, now time.Time, window time.Duration) (int64, error) {
+	total, _, err := s.add(counter, key, n, 0, now, window)
+	return total, err
+}
+
+// AddBelow implements QuotaLimiter
+func (s *MemoryQuotaStore) AddBelow(counter, key string, n, limit int64, now time.Time, window time.Duration) (int64, bool, error) {
+	return s.add(counter, key, n, limit, now, window)
+}
+
+/*
+ * Add "n" unless the total is already at "limit." A limit of zero means
+ * that there is none.
+ */
+func (s *MemoryQuotaStore) add(counter, key string, n, limit int64, now time.Time, window time.Duration) (int64, bool, error) {
+	width := window / quotaBuckets
+	if width <= 0 {
+		return 0, false, fmt.Errorf("Invalid quota window: %s", window)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if now.After(s.nextSweep) {
+		s.sweep(now)
+	}
+
+	name := counter + "\x00" + key
+	w := s.windows[name]
+	if w == nil || w.width != width {
+		w = &slidingWindow{width: width}
+		s.windows[name] = w
+	}
+	// Bucket numbers start at one so that zero means unused.
+	bucket := w.bucket(now)
+	i := bucket % quotaBuckets
+	if w.buckets[i] != bucket {
+		w.buckets[i] = bucket
+		w.counts[i] = 0
+	}
+	if bucket > w.newest {
+		w.newest = bucket
+	}
+
+	var total int64
+	for i, b := range w.buckets {
+		if b > bucket-quotaBuckets {
+			total += w.counts[i]
+		}
+	}
+	if limit > 0 && total >= limit {
+		return total, false, nil
+	}
+	w.counts[i] += n
+	return total + n, true, nil
+}
+
+/*
+ * Drop the windows that nothing has been counted in for a whole window.
+ */
+func (s *MemoryQuotaStore) sweep(now time.Time) {
+	for name, w := range s.windows {
+		if w.newest <= w.bucket(now)-quotaBuckets {
+			delete(s.windows, name)
+		}
+	}
+	s.nextSweep = now.Add(quotaSweepInterval)
+}
+
+func (w *slidingWindow) bucket(now time.Time) int64 {
+	return now.UnixNano()/int64(w.width) + 1
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Quotas", func() {
+	var now time.Time
+
+	BeforeEach(func() {
+		now = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+		quotaClock = func() time.Time {
+			return now
+		}
+	})
+
+	AfterEach(func() {
+		quotaClock = time.Now
+		resetSettings()
+	})
+
+	// Send a request for "tenant," and return the status it was rejected
+	// with, or zero if it was proxied. A proxied request gets a response
+	// with "body," in two chunks, if weaver reads it.
+	send := func(tenant, body string) int {
+		id := createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		defer freeRequest(id)
+		hdrs := makeRequestHeaders("GET", "/pass", "", 0)
+		if tenant != "" {
+			hdrs = addRequestHeader(hdrs, "X-Tenant", tenant)
+		}
+		Expect(beginRequest(id, hdrs)).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		if cmd != "DONE" {
+			Expect(cmd).Should(Equal("SWCH429"))
+			cmd = pollRequest(id, true)
+			Expect(cmd).Should(HavePrefix("WHDR"))
+			rh := http.Header{}
+			parseHeaders(rh, cmd[4:])
+			Expect(rh.Get("X-RateLimit-Limit")).ShouldNot(BeEmpty())
+			Expect(rh.Get("X-RateLimit-Remaining")).Should(Equal("0"))
+			Expect(pollRequest(id, true)).Should(HavePrefix("WBOD"))
+			Expect(pollRequest(id, true)).Should(Equal("DONE"))
+			return 429
+		}
+
+		rid := createResponse(testHandler)
+		Expect(rid).ShouldNot(BeZero())
+		defer freeResponse(rid)
+		err := beginResponse(rid, id, 200, makeResponseHeaders("text/plain", len(body)))
+		Expect(err).Should(Succeed())
+		buf := &bytes.Buffer{}
+		read := false
+		for cmd := pollResponse(rid, true); cmd != "DONE"; cmd = pollResponse(rid, true) {
+			switch cmd[:4] {
+			case "RBOD":
+				read = true
+				sendResponseBodyChunk(rid, false, []byte(body[:len(body)/2]))
+				sendResponseBodyChunk(rid, true, []byte(body[len(body)/2:]))
+			case "WBOD":
+				buf.Write(readBodyData(cmd))
+			default:
+				Fail("Unexpected command " + cmd)
+			}
+		}
+		if read {
+			Expect(buf.String()).Should(Equal(body))
+		}
+		return 0
+	}
+
+	It("Requests", func() {
+		Expect(setHeaderQuota("X-Tenant", 2, 0)).Should(Succeed())
+		Expect(send("a", "hello")).Should(BeZero())
+		Expect(send("a", "hello")).Should(BeZero())
+		Expect(send("a", "hello")).Should(Equal(429))
+		Expect(send("b", "hello")).Should(BeZero())
+		Expect(send("", "hello")).Should(BeZero())
+	})
+
+	It("Bytes", func() {
+		Expect(setHeaderQuota("X-Tenant", 0, 10)).Should(Succeed())
+		Expect(send("a", "hello")).Should(BeZero())
+		// This one crosses the limit part way through, but still finishes.
+		Expect(send("a", "hello, world")).Should(BeZero())
+		Expect(send("a", "hello")).Should(Equal(429))
+		Expect(send("b", "hello")).Should(BeZero())
+	})
+
+	It("Window", func() {
+		Expect(setHeaderQuota("X-Tenant", 1, 0)).Should(Succeed())
+		Expect(send("a", "hello")).Should(BeZero())
+		now = now.Add(30 * time.Second)
+		Expect(send("a", "hello")).Should(Equal(429))
+		now = now.Add(30 * time.Second)
+		Expect(send("a", "hello")).Should(BeZero())
+	})
+
+	It("Sliding window", func() {
+		store := NewMemoryQuotaStore()
+		count := func(n int64) int64 {
+			total, err := store.Add(quotaBytes, "a", n, now, time.Hour)
+			Expect(err).Should(Succeed())
+			return total
+		}
+		Expect(count(5)).Should(BeEquivalentTo(5))
+		now = now.Add(30 * time.Minute)
+		Expect(count(3)).Should(BeEquivalentTo(8))
+		now = now.Add(30 * time.Minute)
+		Expect(count(0)).Should(BeEquivalentTo(3))
+		now = now.Add(30 * time.Minute)
+		Expect(count(0)).Should(BeZero())
+	})
+
+	It("Check and count together", func() {
+		store := NewMemoryQuotaStore()
+		total, added, err := store.AddBelow(quotaRequests, "a", 1, 2, now, time.Minute)
+		Expect(err).Should(Succeed())
+		Expect(added).Should(BeTrue())
+		Expect(total).Should(BeEquivalentTo(1))
+		_, added, _ = store.AddBelow(quotaRequests, "a", 1, 2, now, time.Minute)
+		Expect(added).Should(BeTrue())
+		total, added, _ = store.AddBelow(quotaRequests, "a", 1, 2, now, time.Minute)
+		Expect(added).Should(BeFalse())
+		Expect(total).Should(BeEquivalentTo(2))
+	})
+
+	It("Concurrent requests", func() {
+		store := NewMemoryQuotaStore()
+		added := make(chan bool, 100)
+		for i := 0; i < 100; i++ {
+			go func() {
+				_, ok, _ := store.AddBelow(quotaRequests, "a", 1, 10, now, time.Minute)
+				added <- ok
+			}()
+		}
+		count := 0
+		for i := 0; i < 100; i++ {
+			if <-added {
+				count++
+			}
+		}
+		Expect(count).Should(Equal(10))
+	})
+
+	It("Expired windows", func() {
+		store := NewMemoryQuotaStore()
+		for _, key := range []string{"a", "b", "c"} {
+			_, err := store.Add(quotaRequests, key, 1, now, time.Minute)
+			Expect(err).Should(Succeed())
+		}
+		Expect(store.windows).Should(HaveLen(3))
+		now = now.Add(2 * time.Minute)
+		_, err := store.Add(quotaRequests, "d", 1, now, time.Minute)
+		Expect(err).Should(Succeed())
+		Expect(store.windows).Should(HaveLen(1))
+		Expect(store.windows).Should(HaveKey(quotaRequests + "\x00d"))
+	})
+
+	It("Custom key", func() {
+		SetQuotaPolicy(func(req *http.Request) string {
+			return req.URL.Path
+		}, QuotaLimits{RequestsPerMinute: 1}, nil)
+		Expect(send("", "hello")).Should(BeZero())
+		Expect(send("", "hello")).Should(Equal(429))
+	})
+
+	It("Off", func() {
+		Expect(setHeaderQuota("X-Tenant", 1, 0)).Should(Succeed())
+		Expect(setHeaderQuota("", 0, 0)).Should(Succeed())
+		Expect(getSettings().quota).Should(BeNil())
+		Expect(setHeaderQuota("X-Tenant", -1, 0)).ShouldNot(Succeed())
+	})
+})
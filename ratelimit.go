@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+ * Limit the rate of requests from each client using a token bucket. By
+ * default, the client is the address from ClientIdentity, with no trusted
+ * proxies, but a key function can group requests by anything else, such as
+ * an API key. Each key has its own bucket, which holds up to "burst" tokens
+ * and gains "rate" tokens a second. A bucket that has filled up again is
+ * the same as a new one, so a goroutine throws those away every so often to
+ * save memory, rather than making requests wait while it does.
+ */
+
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+	stop    chan bool
+	done    chan bool
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// This is replaced by tests
+var rateLimitClock = time.Now
+
+// How often full buckets are thrown away. This is replaced by tests.
+var rateLimitSweepInterval = time.Minute
+
+// The slowest rate for which the wait for a token fits in a time.Duration
+var minRateLimit = float64(time.Second) / math.MaxInt64
+
+func setRateLimit(rate float64, burst uint32) error {
+	if rate < 0 || math.IsNaN(rate) || math.IsInf(rate, 0) ||
+		(rate > 0 && rate < minRateLimit) {
+		return fmt.Errorf("Invalid rate: %v", rate)
+	}
+	var limiter *rateLimiter
+	if rate > 0 {
+		if burst == 0 {
+			burst = 1
+		}
+		limiter = &rateLimiter{
+			rate:    rate,
+			burst:   float64(burst),
+			buckets: make(map[string]*tokenBucket),
+			stop:    make(chan bool),
+			done:    make(chan bool),
+		}
+		go limiter.sweepEvery(rateLimitSweepInterval, rateLimitClock)
+	}
+	var old *rateLimiter
+	updateSettings(func(s *settings) {
+		old = s.rateLimit
+		s.rateLimit = limiter
+	})
+	if old != nil {
+		close(old.stop)
+		<-old.done
+	}
+	return nil
+}
+
+/*
+ * SetRateLimitKey sets the function that decides which bucket a request
+ * is counted in. A request for which it returns an empty string isn't
+ * limited. A nil function goes back to limiting by client address.
+ */
+func SetRateLimitKey(keyFunc func(*http.Request) string) {
+	updateSettings(func(s *settings) {
+		s.rateLimitKey = keyFunc
+	})
+}
+
+/*
+ * Limit by the value of a request header. An empty name goes back to
+ * limiting by client address.
+ */
+func setRateLimitHeader(name string) {
+	if name == "" {
+		SetRateLimitKey(nil)
+		return
+	}
+	SetRateLimitKey(func(req *http.Request) string {
+		return req.Header.Get(name)
+	})
+}
+
+/*
+ * Take a token for the request, and return false if there wasn't one, in
+ * which case the request was rejected.
+ */
+func (r *request) checkRateLimit() bool {
+	limiter := r.settings.rateLimit
+	if limiter == nil {
+		return true
+	}
+	var key string
+	if r.settings.rateLimitKey != nil {
+		key = r.settings.rateLimitKey(r.req)
+	} else if ip := r.clientIdentity(nil).IP; ip != nil {
+		key = ip.String()
+	}
+	if key == "" {
+		return true
+	}
+	ok, wait := limiter.take(key, rateLimitClock())
+	if ok {
+		return true
+	}
+	hdrs := http.Header{}
+	hdrs.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	r.rejectWithHeaders(http.StatusTooManyRequests, "Rate limit exceeded", hdrs)
+	return false
+}
+
+/*
+ * Take a token from the bucket for "key." If there isn't one, return how
+ * long it will be until there is.
+ */
+func (l *rateLimiter) take(key string, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.refill(now, l.rate, l.burst)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+/*
+ * Sweep the buckets until the limiter is stopped or, if the settings were
+ * reset instead, until it is no longer the one in use.
+ */
+func (l *rateLimiter) sweepEvery(interval time.Duration, clock func() time.Time) {
+	defer close(l.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			if getSettings().rateLimit != l {
+				return
+			}
+			l.sweep(clock())
+		}
+	}
+}
+
+/*
+ * Forget the buckets that are full again.
+ */
+func (l *rateLimiter) sweep(now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for key, b := range l.buckets {
+		b.refill(now, l.rate, l.burst)
+		if b.tokens >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed.Seconds()*rate)
+		b.last = now
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rate limit", func() {
+	var now time.Time
+
+	BeforeEach(func() {
+		now = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+		rateLimitClock = func() time.Time {
+			return now
+		}
+	})
+
+	AfterEach(func() {
+		rateLimitClock = time.Now
+		resetSettings()
+	})
+
+	// Send a request and return the status it was rejected with, or zero.
+	send := func(addr, apiKey string) (int, http.Header) {
+		id := createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		defer freeRequest(id)
+		if addr != "" {
+			Expect(setRemoteAddr(id, addr)).Should(Succeed())
+		}
+		hdrs := makeRequestHeaders("GET", "/pass", "", 0)
+		if apiKey != "" {
+			hdrs = addRequestHeader(hdrs, "X-Api-Key", apiKey)
+		}
+		Expect(beginRequest(id, hdrs)).Should(Succeed())
+		cmd := pollRequest(id, true)
+		if cmd == "DONE" {
+			return 0, nil
+		}
+		Expect(cmd).Should(Equal("SWCH429"))
+		cmd = pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("WHDR"))
+		rh := http.Header{}
+		parseHeaders(rh, cmd[4:])
+		Expect(pollRequest(id, true)).Should(HavePrefix("WBOD"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		return 429, rh
+	}
+
+	status := func(addr, apiKey string) int {
+		s, _ := send(addr, apiKey)
+		return s
+	}
+
+	It("By address", func() {
+		Expect(setRateLimit(1, 2)).Should(Succeed())
+		Expect(status("10.0.0.1:1234", "")).Should(BeZero())
+		Expect(status("10.0.0.1:1235", "")).Should(BeZero())
+		s, hdrs := send("10.0.0.1:1236", "")
+		Expect(s).Should(Equal(429))
+		Expect(hdrs.Get("Retry-After")).Should(Equal("1"))
+		Expect(status("10.0.0.2:1234", "")).Should(BeZero())
+		// Nothing to tell them apart by
+		Expect(status("", "")).Should(BeZero())
+
+		now = now.Add(time.Second)
+		Expect(status("10.0.0.1:1234", "")).Should(BeZero())
+		Expect(status("10.0.0.1:1234", "")).Should(Equal(429))
+	})
+
+	It("By header", func() {
+		Expect(setRateLimit(0.5, 1)).Should(Succeed())
+		setRateLimitHeader("X-Api-Key")
+		// Every request comes from the same address.
+		Expect(status("10.0.0.1:1234", "alpha")).Should(BeZero())
+		s, hdrs := send("10.0.0.1:1234", "alpha")
+		Expect(s).Should(Equal(429))
+		Expect(hdrs.Get("Retry-After")).Should(Equal("2"))
+		Expect(status("10.0.0.1:1234", "beta")).Should(BeZero())
+		Expect(status("10.0.0.1:1234", "beta")).Should(Equal(429))
+		Expect(status("10.0.0.1:1234", "")).Should(BeZero())
+		Expect(status("10.0.0.1:1234", "")).Should(BeZero())
+	})
+
+	It("Custom key", func() {
+		Expect(setRateLimit(1, 1)).Should(Succeed())
+		SetRateLimitKey(func(req *http.Request) string {
+			return req.Header.Get("X-Api-Key") + "/" + req.URL.Path
+		})
+		Expect(status("", "alpha")).Should(BeZero())
+		Expect(status("", "alpha")).Should(Equal(429))
+		Expect(status("", "beta")).Should(BeZero())
+	})
+
+	It("Evicts full buckets", func() {
+		Expect(setRateLimit(1, 2)).Should(Succeed())
+		l := getSettings().rateLimit
+		ok, _ := l.take("a", now)
+		Expect(ok).Should(BeTrue())
+		ok, _ = l.take("b", now)
+		Expect(ok).Should(BeTrue())
+		Expect(l.buckets).Should(HaveLen(2))
+
+		// "a" is full again, and "b" just took its last token.
+		now = now.Add(2 * time.Second)
+		l.take("b", now)
+		l.take("b", now)
+		ok, wait := l.take("b", now)
+		Expect(ok).Should(BeFalse())
+		Expect(wait).Should(Equal(time.Second))
+		Expect(l.buckets).Should(HaveLen(2))
+		l.sweep(now)
+		Expect(l.buckets).Should(HaveLen(1))
+		Expect(l.buckets).Should(HaveKey("b"))
+	})
+
+	It("Sweeps in the background", func() {
+		defer func(interval time.Duration) {
+			rateLimitSweepInterval = interval
+		}(rateLimitSweepInterval)
+		rateLimitSweepInterval = time.Millisecond
+		Expect(setRateLimit(1, 1)).Should(Succeed())
+		l := getSettings().rateLimit
+		ok, _ := l.take("a", now.Add(-time.Minute))
+		Expect(ok).Should(BeTrue())
+		Eventually(func() int {
+			l.lock.Lock()
+			defer l.lock.Unlock()
+			return len(l.buckets)
+		}).Should(BeZero())
+
+		Expect(setRateLimit(0, 0)).Should(Succeed())
+		Eventually(l.done).Should(BeClosed())
+	})
+
+	It("Invalid", func() {
+		Expect(setRateLimit(-1, 1)).ShouldNot(Succeed())
+		Expect(setRateLimit(1e-12, 1)).ShouldNot(Succeed())
+		Expect(setRateLimit(1, 1)).Should(Succeed())
+		Expect(setRateLimit(0, 0)).Should(Succeed())
+		Expect(getSettings().rateLimit).Should(BeNil())
+	})
+})
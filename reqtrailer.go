@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+/*
+ * Request trailers, which some clients, such as gRPC, send after a chunked
+ * request body. The caller hands them over using GoSendRequestTrailers once
+ * it has sent the last chunk, if weaver asked for the body, and gets back
+ * the trailers to send to the target in a WTRL command. The body must be
+ * sent to the target chunked for that to work. A request handler may look
+ * at them, or change them, by setting a filter, which runs when they
+ * arrive. Handlers find SetRequestTrailerFilter using a type assertion on
+ * the http.ResponseWriter.
+ */
+
+// A TrailerFilter may change the trailers in place. Any that it deletes
+// aren't sent. Since it is an alias, any func(http.Header) will do.
+type TrailerFilter = func(trailers http.Header)
+
+var errNoTrailerFilter = errors.New("Only a request handler can filter request trailers")
+
+// Fields that frame or route the message can't be sent as trailers.
+var forbiddenTrailers = map[string]bool{
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Trailer":           true,
+	"Host":              true,
+	"Connection":        true,
+	"Te":                true,
+}
+
+/*
+ * SetRequestTrailerFilter sets the function that sees the request trailers.
+ * It returns an error if they have already arrived.
+ */
+func (h *httpResponse) SetRequestTrailerFilter(filter TrailerFilter) error {
+	r, ok := h.handler.(*request)
+	if !ok {
+		return errNoTrailerFilter
+	}
+	r.bodyLock.Lock()
+	defer r.bodyLock.Unlock()
+	if r.trailersSent {
+		return tooLate(r, "SetRequestTrailerFilter")
+	}
+	r.trailerFilter = filter
+	return nil
+}
+
+/*
+ * Take the trailers for request "id" and return the command that tells the
+ * caller what to send to the target: WTRL with the trailers, or ERRR if
+ * they came at the wrong time.
+ */
+func sendRequestTrailers(id uint32, rawTrailers string) command {
+	req := getRequest(id)
+	if req == nil {
+		return createErrorCommand(errors.New("Unknown request"))
+	}
+	trailers, err := req.takeTrailers(rawTrailers)
+	if err != nil {
+		return createErrorCommand(err)
+	}
+	return command{
+		id:  WTRL,
+		msg: serializeHeaders(trailers),
+	}
+}
+
+func (r *request) takeTrailers(rawTrailers string) (http.Header, error) {
+	if r.origHeaders.Get("Content-Length") != "" {
+		return nil, errors.New("Trailers need a chunked request body")
+	}
+	if r.getState() >= stateResponse {
+		return nil, errors.New("Trailers came after the request was complete")
+	}
+	r.bodyLock.Lock()
+	defer r.bodyLock.Unlock()
+	// If the body wasn't asked for, the caller sent it straight to the target.
+	if r.bodyStarted && !r.bodyDone {
+		return nil, errors.New("Trailers came before the last chunk of the body")
+	}
+	if r.trailersSent {
+		return nil, errors.New("Trailers were already sent")
+	}
+	r.trailersSent = true
+
+	raw := http.Header{}
+	parseHeaders(raw, strings.Replace(rawTrailers, "\r", "", -1))
+	trailers := http.Header{}
+	for k, v := range raw {
+		key := http.CanonicalHeaderKey(strings.TrimSpace(k))
+		if !forbiddenTrailers[key] {
+			trailers[key] = append(trailers[key], v...)
+		}
+	}
+	if r.trailerFilter != nil {
+		r.trailerFilter(trailers)
+	}
+	return trailers, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Request trailers", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+	})
+
+	// Begin a request with a chunked body that the handler doesn't read.
+	// Transfer-Encoding is hop-by-hop, so it is removed with a WHDR.
+	beginChunked := func(path string) {
+		hdrs := addRequestHeader(makeRequestHeaders("POST", path, "text/plain", 0),
+			"Transfer-Encoding", "chunked")
+		Expect(beginRequest(id, hdrs)).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(HavePrefix("WHDR"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	}
+
+	// Send "body" and "trailers" to an upstream that echoes the trailers
+	// that it got as headers.
+	forward := func(body string, trailers http.Header) http.Header {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ioutil.ReadAll(r.Body)
+			for k, v := range r.Trailer {
+				w.Header()[k] = v
+			}
+		}))
+		defer server.Close()
+
+		pr, pw := io.Pipe()
+		req, err := http.NewRequest("POST", server.URL, pr)
+		Expect(err).Should(Succeed())
+		req.ContentLength = -1
+		req.Trailer = http.Header{}
+		for k := range trailers {
+			req.Trailer[k] = nil
+		}
+		go func() {
+			io.WriteString(pw, body)
+			for k, v := range trailers {
+				req.Trailer[k] = v
+			}
+			pw.Close()
+		}()
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		return resp.Header
+	}
+
+	It("Forward filtered trailers", func() {
+		beginChunked("/trailers")
+
+		cmd := sendRequestTrailers(id, "Grpc-Status: 0\r\nX-Secret: hunter2\r\nContent-Length: 5\r\n")
+		Expect(cmd.id).Should(Equal(WTRL))
+		trailers := http.Header{}
+		parseHeaders(trailers, cmd.msg)
+		Expect(trailers).Should(Equal(http.Header{
+			"Grpc-Status": []string{"0"},
+			"X-Filtered":  []string{"true"},
+		}))
+
+		echoed := forward("Hello!", trailers)
+		Expect(echoed.Get("Grpc-Status")).Should(Equal("0"))
+		Expect(echoed.Get("X-Filtered")).Should(Equal("true"))
+		Expect(echoed.Get("X-Secret")).Should(BeEmpty())
+	})
+
+	It("No filter", func() {
+		hdrs := addRequestHeader(makeRequestHeaders("POST", "/pass", "text/plain", 0),
+			"Transfer-Encoding", "chunked")
+		Expect(beginRequest(id, hdrs)).Should(Succeed())
+		for cmd := pollRequest(id, true); cmd != "DONE"; cmd = pollRequest(id, true) {
+			if cmd == "RBOD" {
+				sendRequestBodyChunk(id, true, []byte("Hello!"))
+			}
+		}
+		cmd := sendRequestTrailers(id, "X-Checksum: abc\n")
+		Expect(cmd.String()).Should(Equal("WTRLX-Checksum: abc\n"))
+	})
+
+	It("Not chunked", func() {
+		Expect(beginRequest(id, makeRequestHeaders("POST", "/trailers", "text/plain", 6))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(sendRequestTrailers(id, "X-Checksum: abc\n").id).Should(Equal(ERRR))
+	})
+
+	It("Twice", func() {
+		beginChunked("/trailers")
+		Expect(sendRequestTrailers(id, "X-Checksum: abc\n").id).Should(Equal(WTRL))
+		Expect(sendRequestTrailers(id, "X-Checksum: abc\n").id).Should(Equal(ERRR))
+	})
+
+	It("After the response", func() {
+		beginChunked("/trailers")
+		rid := createResponse(testHandler)
+		defer freeResponse(rid)
+		Expect(beginResponse(rid, id, 200, makeResponseHeaders("", 0))).Should(Succeed())
+		for cmd := pollResponse(rid, true); cmd != "DONE"; cmd = pollResponse(rid, true) {
+		}
+		cmd := sendRequestTrailers(id, "X-Checksum: abc\n")
+		Expect(cmd.id).Should(Equal(ERRR))
+		Expect(strings.ToLower(cmd.msg)).Should(ContainSubstring("complete"))
+	})
+
+	It("Unknown request", func() {
+		Expect(sendRequestTrailers(0, "X-Checksum: abc\n").id).Should(Equal(ERRR))
+	})
+
+	It("Filter from a response handler", func() {
+		h := &httpResponse{handler: &response{}}
+		Expect(h.SetRequestTrailerFilter(nil)).Should(Equal(errNoTrailerFilter))
+	})
+})
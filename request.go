@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/30x/gozerian/pipeline"
 )
@@ -44,15 +50,89 @@ type request struct {
 	cmds        chan command
 	bodies      chan []byte
 	proxying    bool
-}
-
-func newRequest(id uint32, pd pipeline.Definition) *request {
-	r := request{
-		id:       id,
-		proxying: true,
-		pd:       pd,
-	}
-	return &r
+	failed      bool
+	priority    int32
+	gate        pauseGate
+	settings    settings
+	abGroup     string
+	abCookie    bool
+	slowTimer   *time.Timer
+	deadline    *time.Timer
+	chaos       *chaosStream
+	cacheKey    string
+	bodyStop    chan bool
+	ctx         context.Context
+	cancel      context.CancelFunc
+	har         *harEntry
+	identity    *identityCache
+	// What the handlers decided, for the caller. Protected by bodyLock.
+	verdict string
+	// A handler asked to be told about the shutdown. Protected by bodyLock.
+	watchingDrain bool
+	// Response headers that a handler let through the allowlist
+	extraHeaders map[string]bool
+	// Header names that a handler wants sent with exactly this casing
+	headerCases []string
+	// Per-request overrides set by the caller before the request begins
+	tls                *tls.ConnectionState
+	proxyInfo          *ProxyProtocolInfo
+	remoteAddr         string
+	queryDeletes       []string
+	scheme             string
+	port               int
+	serverTiming       bool
+	observeAlgorithms  []string
+	acceptEncoding     []string
+	concatURLs         []string
+	concatSkipFailures bool
+	hedging            *hedging
+	quotaKey           string
+	transparent        bool
+	contentType        string
+	inferContentType   bool
+	headerStream       *headerStream
+	// The caller sends the body from its own goroutine, so these are
+	// protected by bodyLock
+	bodyLock    sync.Mutex
+	bodyStarted bool
+	bodyDone    bool
+	bodyStopped bool
+	fullDuplex  bool
+	bodyHash    []byte
+	digests     map[string]string
+	// Set by a handler, and used when the caller sends the trailers
+	trailerFilter TrailerFilter
+	trailersSent  bool
+	// Whether the handler has returned
+	phase handlerPhase
+	// The request ran out of time. Protected by bodyLock.
+	expired bool
+	// How long the request handler took, and when the request went to the
+	// target. A response may begin before the request goroutine finishes,
+	// so these are protected by bodyLock.
+	filterTime time.Duration
+	proxiedAt  time.Time
+	// Gives back the upstream slots that the request holds. Protected by
+	// bodyLock.
+	upstreamRelease func()
+	// Whether the request and response goroutines hold slots in the
+	// priority scheduler. Protected by bodyLock.
+	requestSlot  bool
+	responseSlot bool
+	// Whether the request was ever parked in the priority queue, and for
+	// how long altogether. Protected by bodyLock.
+	queued    bool
+	queueWait time.Duration
+	// For reusing the request, protected by managerLatch
+	freed        bool
+	holds        int
+	timerStopped bool
+	// Other goroutines read these, so they are protected by stateLock
+	stateLock sync.Mutex
+	state     requestState
+	started   time.Time
+	method    string
+	uri       string
 }
 
 func (r *request) Commands() chan command {
@@ -72,16 +152,147 @@ func (r *request) ResponseWritten() {
 }
 
 func (r *request) StartRead() {
+	r.bodyLock.Lock()
+	r.bodyStarted = true
+	r.bodyLock.Unlock()
+}
+
+func (r *request) SafePoint() {
+	r.park(&r.requestSlot)
+}
+
+/*
+ * Wait while the request is paused. A parked goroutine gives up its slot in
+ * the priority scheduler, so that it doesn't hold up anyone else, and waits
+ * its turn for a new one once the request is resumed.
+ */
+func (r *request) park(slot *bool) {
+	if !r.gate.isPaused() {
+		return
+	}
+	held := r.releaseSlot(slot)
+	r.gate.wait()
+	if held {
+		r.takeSlot(slot, false)
+	}
+}
+
+/*
+ * Take a slot in the priority scheduler, and note how long the request had
+ * to wait for it. Only a new request is turned away when the queue is full.
+ */
+func (r *request) takeSlot(slot *bool, limited bool) error {
+	acquired, waited, err := scheduler.wait(r.priority, limited)
+	r.bodyLock.Lock()
+	*slot = acquired
+	if waited >= 0 {
+		r.queued = true
+		r.queueWait += waited
+	}
+	r.bodyLock.Unlock()
+	return err
+}
+
+/*
+ * Return whether the request was parked in the priority queue, and for how
+ * long.
+ */
+func (r *request) queueTiming() (bool, time.Duration) {
+	r.bodyLock.Lock()
+	defer r.bodyLock.Unlock()
+	return r.queued, r.queueWait
+}
+
+/*
+ * Give up a slot in the priority scheduler if one is held, and return
+ * whether it was.
+ */
+func (r *request) releaseSlot(slot *bool) bool {
+	r.bodyLock.Lock()
+	held := *slot
+	*slot = false
+	r.bodyLock.Unlock()
+	if held {
+		scheduler.release()
+	}
+	return held
+}
+
+func (r *request) ChunkSent(chunk []byte) {
+	if !r.capturingBodies() {
+		return
+	}
+	if r.proxying {
+		r.har.requestBody.capture(chunk, r.har.maxBody)
+	} else {
+		r.har.responseBody.capture(chunk, r.har.maxBody)
+	}
+}
+
+func (r *request) BodyStopped() chan bool {
+	return r.bodyStop
+}
+
+/*
+ * Note that the caller sent the last chunk of the body.
+ */
+func (r *request) bodyReceived() {
+	r.bodyLock.Lock()
+	r.bodyDone = true
+	r.bodyLock.Unlock()
+}
+
+/*
+ * The target has started to respond. If we asked the caller for the body and
+ * it is still sending it, then stop reading it, and throw away any more
+ * chunks that arrive. Return true if that happened. Full-duplex requests,
+ * like gRPC streams, keep sending the body while the response streams back.
+ */
+func (r *request) stopBody() bool {
+	r.bodyLock.Lock()
+	defer r.bodyLock.Unlock()
+	if !r.bodyStarted || r.bodyDone || r.bodyStopped || r.fullDuplex {
+		return false
+	}
+	r.bodyStopped = true
+	close(r.bodyStop)
+	return true
+}
+
+/*
+ * Return how long the request handler took, and when the request was sent on
+ * to the target, which is zero if it hasn't been yet.
+ */
+func (r *request) timings() (time.Duration, time.Time) {
+	r.bodyLock.Lock()
+	defer r.bodyLock.Unlock()
+	return r.filterTime, r.proxiedAt
 }
 
 func (r *request) begin(rawHeaders string) error {
+	r.settings = getSettings()
+	r.stateLock.Lock()
+	r.started = time.Now()
+	r.state = stateRequest
+	r.stateLock.Unlock()
+	r.sampleHAR()
 	r.cmds = make(chan command, commandQueueSize)
 	r.bodies = make(chan []byte, bodyQueueSize)
+	// The timers use the channels, so they start once those are made.
+	r.startSlowTimer()
+	r.startDurationTimer()
+	if r.settings.chaos != nil {
+		r.chaos = newChaosStream(r.settings.chaos, r.cmds, r)
+	}
+	r.hold()
 	go r.startRequest(rawHeaders)
 	return nil
 }
 
 func (r *request) pollNB() string {
+	if r.chaos != nil {
+		return r.chaos.poll(false)
+	}
 	select {
 	case cmd := <-r.cmds:
 		return cmd.String()
@@ -91,20 +302,40 @@ func (r *request) pollNB() string {
 }
 
 func (r *request) poll() string {
+	if r.chaos != nil {
+		return r.chaos.poll(true)
+	}
 	cmd := <-r.cmds
 	return cmd.String()
 }
 
 func (r *request) startRequest(rawHeaders string) {
+	defer r.release()
+	r.SafePoint()
+
+	rawHeaders, targetOK := r.checkRequestTarget(rawHeaders)
+	rawHeaders, linesOK := r.checkHeaderLines(rawHeaders)
 	req, err := parseHTTPHeaders(rawHeaders, true)
 	if err != nil {
+		r.setState(stateDone)
+		countError()
 		r.cmds <- createErrorCommand(err)
 		return
 	}
+	r.setTarget(req.Method, req.RequestURI)
+	req.TLS = r.tls
+	req.RemoteAddr = r.remoteAddr
+	req = req.WithContext(r.ctx)
+	req = withProxyProtocolInfo(req, r.proxyInfo)
+	if isGRPC(req) {
+		r.setFullDuplex()
+	}
 	// Save headers for later
 	r.origHeaders = copyHeaders(req.Header)
 	r.origURL = req.URL
 	r.req = req
+	r.normalizeURL()
+	r.dumpRequest()
 
 	resp := &httpResponse{
 		handler: r,
@@ -115,25 +346,142 @@ func (r *request) startRequest(rawHeaders string) {
 		handler: r,
 	}
 	r.origBody = req.Body
+	r.hashOriginalBody()
+
+	// Probes are answered first, so that they get through even when weaver
+	// is overloaded or the client is over its limits.
+	probe := targetOK && linesOK &&
+		(r.headerStream == nil || r.headerStream.overflow == "") && r.serveProbe()
+	var queueErr error
+	if !probe {
+		// The pause above comes before taking a slot in the priority queue,
+		// so that a paused request doesn't hold up anyone else.
+		queueErr = r.takeSlot(&r.requestSlot, true)
+	}
 
 	// Call handlers. They may write the request body or headers, or start
 	// to write out a response.
 	r.msgID = makeMessageID()
 	r.pipe = r.pd.CreatePipe()
 	r.req = r.pipe.PrepareRequest(r.msgID, r.req)
-	r.pipe.RequestHandlerFunc()(resp, req)
+	if queueErr != nil {
+		r.reject(http.StatusServiceUnavailable, queueErr.Error())
+	} else if !targetOK {
+		r.rejectURITooLong()
+	} else if !linesOK {
+		r.rejectHeaderLine()
+	} else if r.headerStream != nil && r.headerStream.overflow != "" {
+		r.rejectHeaderStream()
+	} else if !probe && r.checkDuration() && r.checkRequest() && !r.serveLocal() {
+		filterStarted := time.Now()
+		r.pipe.RequestHandlerFunc()(resp, req)
+		resp.Flush()
+		r.bodyLock.Lock()
+		r.filterTime = time.Since(filterStarted)
+		r.bodyLock.Unlock()
+	}
+	// The slot only covers the handlers. Reading the rest of the body and
+	// waiting for the target happen at the client's pace, so they mustn't
+	// keep anyone else waiting.
+	r.releaseSlot(&r.requestSlot)
+	r.phase.finish()
+
+	if r.proxying && !r.failed {
+		r.rewrite()
+		r.checkLocalResponse()
+	}
+	if r.proxying && !r.failed {
+		r.serveNegative()
+	}
+	if r.proxying && !r.failed {
+		r.bufferBody()
+	}
+	if r.proxying && !r.failed {
+		r.admitUpstream()
+	}
+	if !r.failed {
+		r.checkDuration()
+	}
+
+	if r.failed {
+		// An ERRR command was already sent, so nothing else may follow it.
+		r.setState(stateDone)
+		return
+	}
 
 	// It's possible that not everything was cleaned up here.
 	if r.proxying {
 		r.flush()
+		r.recordHARRequest()
+		r.setState(stateProxying)
 	} else {
 		r.resp.flush(http.StatusOK)
+		r.recordHARRequest()
+		r.finishHAR(http.StatusOK, r.req.Proto, nil)
+		r.setState(stateDone)
 	}
 
 	// This signals that everything is done.
+	r.SafePoint()
+	r.bodyLock.Lock()
+	r.proxiedAt = time.Now()
+	r.bodyLock.Unlock()
 	r.cmds <- command{id: DONE}
 }
 
+/*
+ * Check the request before any handler sees it. Return false if the request
+ * was rejected, in which case the response has already been sent.
+ */
+func (r *request) checkRequest() bool {
+	return r.checkHost() && r.checkAuthority() && r.checkTLS() &&
+		r.checkRateLimit() && r.checkQuota()
+}
+
+/*
+ * Produce the whole response right here, without calling the handler or
+ * proxying to the target, if the request calls for it. Return true if
+ * that happened.
+ */
+func (r *request) serveLocal() bool {
+	if r.serveHealth() || r.serveHealthEndpoint() || r.serveBuiltin() ||
+		r.serveCORSPreflight() || r.serveStatic() || r.servePprof() || r.serveExpvar() {
+		return true
+	}
+	if r.concatURLs != nil {
+		r.concatResponses()
+		return true
+	}
+	return false
+}
+
+/*
+ * Report a fatal error. No more commands will be sent after this one.
+ */
+func (r *request) fail(err error) {
+	r.failed = true
+	countError()
+	r.cmds <- createErrorCommand(err)
+}
+
+/*
+ * Send a short error response instead of proxying the request.
+ */
+func (r *request) reject(status int, msg string) {
+	r.rejectWithHeaders(status, msg, nil)
+}
+
+func (r *request) rejectWithHeaders(status int, msg string, extra http.Header) {
+	// Don't copy the request headers into the response as the handlers do.
+	hdrs := http.Header{}
+	for name, values := range extra {
+		hdrs[name] = values
+	}
+	r.resp.headers = &hdrs
+	contentType, body := r.renderError(ProblemDetails{Status: status, Detail: msg})
+	r.resp.writeBody(status, contentType, body)
+}
+
 func readAndSend(handler commandHandler, body io.ReadCloser) {
 	defer body.Close()
 	buf := make([]byte, bodyBufSize)
@@ -149,6 +497,8 @@ func sendBodyChunk(handler commandHandler, chunk []byte) {
 		return
 	}
 
+	handler.SafePoint()
+	handler.ChunkSent(chunk)
 	chunkID := allocateChunk(chunk)
 
 	cmd := command{
@@ -166,6 +516,61 @@ func allocateChunk(chunk []byte) int32 {
 	return chunkID
 }
 
+/*
+ * Free the chunks of the commands that are still waiting to be polled, which
+ * nobody will poll now that the request or response is being freed.
+ */
+func freePendingChunks(cmds chan command) {
+	for {
+		select {
+		case cmd := <-cmds:
+			freeCommandChunk(cmd)
+		default:
+			return
+		}
+	}
+}
+
+func freeCommandChunk(cmd command) {
+	var hexID string
+	switch cmd.id {
+	case WBOD, WSHR:
+		hexID = cmd.msg
+	case XCMD:
+		if sp := strings.IndexByte(cmd.msg, ' '); sp >= 0 {
+			hexID = cmd.msg[sp+1:]
+		}
+	}
+	chunkID, err := strconv.ParseInt(hexID, 16, 32)
+	if err != nil {
+		return
+	}
+	if cmd.id != WSHR {
+		// The caller would have freed this data itself.
+		C.free(getChunk(int32(chunkID)).data)
+	}
+	releaseChunk(int32(chunkID))
+}
+
+/*
+ * Apply the global rules, and any overrides set by the caller, to the request
+ * that will be forwarded to the target.
+ */
+func (r *request) rewrite() {
+	r.dropFragment()
+	r.rewritePath()
+	r.stripPathPrefix()
+	r.addPathPrefix()
+	r.rewriteQuery()
+	r.routeABTest()
+	r.overrideScheme()
+	r.overridePort()
+	r.stripHopByHop()
+	r.rewriteAcceptEncoding()
+	// This must come last so that the other rules see canonical names.
+	r.applyHeaderCases()
+}
+
 func (r *request) flush() {
 	if r.origURL.String() != r.req.URL.String() {
 		uriCmd := command{
@@ -181,8 +586,8 @@ func (r *request) flush() {
 		}
 		r.cmds <- hdrCmd
 	}
-	if r.req.Body != r.origBody {
-		readAndSend(r, r.req.Body)
+	if r.req.Body != r.origBody || r.capturingRequestBody() {
+		readAndSend(r, r.hashBodyStream(r.req.Body))
 	}
 }
 
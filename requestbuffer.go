@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Optionally read the whole request body into memory before it is sent to
+ * the target. Then it can be sent with a Content-Length rather than chunked,
+ * and a hash of it can be added to the request headers for targets that
+ * want to check it.
+ */
+
+var errNotBuffering = errors.New("Request buffering must be enabled first")
+
+/*
+ * Turn buffering on or off. Since the hash requires buffering, turning
+ * buffering off turns off the hash too.
+ */
+func setRequestBuffering(enabled bool) {
+	updateSettings(func(s *settings) {
+		s.bufferRequests = enabled
+		if !enabled {
+			s.requestHashHeader = ""
+			s.requestHashAlgorithm = ""
+		}
+	})
+}
+
+/*
+ * Turn on hashing of the request body. An empty header name turns it off.
+ */
+func setRequestBodyHashHeader(name, algorithm string) error {
+	if name == "" {
+		updateSettings(func(s *settings) {
+			s.requestHashHeader = ""
+			s.requestHashAlgorithm = ""
+		})
+		return nil
+	}
+
+	alg := strings.ToLower(algorithm)
+	if bodyHashes[alg] == nil {
+		return fmt.Errorf("Unsupported hash algorithm: %s", algorithm)
+	}
+	var err error
+	updateSettings(func(s *settings) {
+		if !s.bufferRequests {
+			err = errNotBuffering
+			return
+		}
+		s.requestHashHeader = http.CanonicalHeaderKey(name)
+		s.requestHashAlgorithm = alg
+	})
+	return err
+}
+
+/*
+ * Hash the original body as it is read, if the target wants a hash, so that
+ * the hash is there even if a handler reads the body rather than us.
+ */
+func (r *request) hashOriginalBody() {
+	if r.settings.bufferRequests && r.settings.requestHashHeader != "" {
+		r.origBody.(*requestBody).hash = bodyHashes[r.settings.requestHashAlgorithm]()
+	}
+}
+
+/*
+ * Return true if there is a body to send to the target that we haven't
+ * read yet. If a handler already read the original body without replacing
+ * it, then the caller still has it and we leave it alone.
+ */
+func (r *request) hasUnreadBody() bool {
+	if r.req.Body != r.origBody {
+		return true
+	}
+	if b := r.origBody.(*requestBody); b.started || b.finished {
+		return false
+	}
+	// Transfer-Encoding is hop-by-hop, so it may be gone by now.
+	return r.req.ContentLength > 0 || r.origHeaders.Get("Transfer-Encoding") != ""
+}
+
+/*
+ * Read the whole body that will go to the target, after any handler changed
+ * it, so that its length, and its hash if required, can go in the headers.
+ * If a handler read all of the original body and left it as it was, only
+ * the hash is added. If it read part of it, there is no hash at all.
+ */
+func (r *request) bufferBody() {
+	s := r.settings
+	if !s.bufferRequests {
+		return
+	}
+	orig := r.origBody.(*requestBody)
+	if !r.hasUnreadBody() {
+		if r.req.Body == r.origBody && orig.sum != nil {
+			r.req.Header.Set(s.requestHashHeader, hex.EncodeToString(orig.sum))
+		}
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	var h hash.Hash
+	var w io.Writer = buf
+	if s.requestHashHeader != "" && r.req.Body != r.origBody {
+		// The original body hashes itself.
+		h = bodyHashes[s.requestHashAlgorithm]()
+		w = io.MultiWriter(buf, h)
+	}
+	_, err := io.Copy(w, r.req.Body)
+	r.req.Body.Close()
+	if err != nil {
+		// Answered with a 408 afterwards
+		if !r.durationExceeded() {
+			r.fail(err)
+		}
+		return
+	}
+
+	r.req.Body = ioutil.NopCloser(buf)
+	r.req.ContentLength = int64(buf.Len())
+	r.req.Header.Del("Transfer-Encoding")
+	r.req.Header.Set("Content-Length", strconv.Itoa(buf.Len()))
+	if h != nil {
+		r.req.Header.Set(s.requestHashHeader, hex.EncodeToString(h.Sum(nil)))
+	} else if orig.sum != nil {
+		r.req.Header.Set(s.requestHashHeader, hex.EncodeToString(orig.sum))
+	}
+}
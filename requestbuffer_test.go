@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Request Buffering", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		resetSettings()
+	})
+
+	hashOf := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+
+	It("Hash requires buffering", func() {
+		err := setRequestBodyHashHeader("X-Amz-Content-Sha256", "sha256")
+		Expect(err).Should(Equal(errNotBuffering))
+		Expect(getSettings().requestHashHeader).Should(BeEmpty())
+
+		setRequestBuffering(true)
+		Expect(setRequestBodyHashHeader("X-Amz-Content-Sha256", "sha256")).Should(Succeed())
+		setRequestBuffering(false)
+		Expect(getSettings().requestHashHeader).Should(BeEmpty())
+	})
+
+	It("No body", func() {
+		setRequestBuffering(true)
+		Expect(setRequestBodyHashHeader("X-Amz-Content-Sha256", "sha256")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Buffer chunked body", func() {
+		setRequestBuffering(true)
+		Expect(setRequestBodyHashHeader("x-amz-content-sha256", "SHA256")).Should(Succeed())
+		hdrs := addRequestHeader(makeRequestHeaders("PUT", "/pass", "text/plain", 0),
+			"Transfer-Encoding", "chunked")
+		err := beginRequest(id, hdrs)
+		Expect(err).Should(Succeed())
+
+		Expect(pollRequest(id, true)).Should(Equal("RBOD"))
+		sendRequestBodyChunk(id, false, []byte("Hello, "))
+		sendRequestBodyChunk(id, true, []byte("World!"))
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.+"))
+		newHdrs := http.Header{}
+		parseHeaders(newHdrs, cmd[4:])
+		Expect(newHdrs.Get("Content-Length")).Should(Equal("13"))
+		Expect(newHdrs.Get("Transfer-Encoding")).Should(BeEmpty())
+		Expect(newHdrs.Get("X-Amz-Content-Sha256")).Should(Equal(hashOf("Hello, World!")))
+
+		cmd = pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+		Expect(string(readBodyData(cmd))).Should(Equal("Hello, World!"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Hash of a body a handler read", func() {
+		setRequestBuffering(true)
+		Expect(setRequestBodyHashHeader("X-Body-Hash", "sha256")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("POST", "/readbody", "text/plain", 13))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("RBOD"))
+		sendRequestBodyChunk(id, true, []byte("Hello, World!"))
+
+		// The caller still has the body, so only the hash changes.
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.+"))
+		newHdrs := http.Header{}
+		parseHeaders(newHdrs, cmd[4:])
+		Expect(newHdrs.Get("X-Body-Hash")).Should(Equal(hashOf("Hello, World!")))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("No hash of a body a handler read part of", func() {
+		setRequestBuffering(true)
+		Expect(setRequestBodyHashHeader("X-Body-Hash", "sha256")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("POST", "/readanddiscard", "text/plain", 13))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("RBOD"))
+		sendRequestBodyChunk(id, false, []byte("Hello, "))
+		sendRequestBodyChunk(id, true, []byte("World!"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Hash replaced body", func() {
+		setRequestBuffering(true)
+		Expect(setRequestBodyHashHeader("X-Body-Hash", "sha256")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("POST", "/replacebody", "", 0))
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.+"))
+		newHdrs := http.Header{}
+		parseHeaders(newHdrs, cmd[4:])
+		Expect(newHdrs.Get("X-Body-Hash")).Should(Equal(hashOf("Hello! I am the server!")))
+
+		cmd = pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+		Expect(string(readBodyData(cmd))).Should(Equal("Hello! I am the server!"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+})
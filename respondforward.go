@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+ * Let a request handler answer right away, for instance with a 202, and
+ * still send the request to the target in the background, fire and forget.
+ * The response goes to the caller before the request body is read. Then
+ * the body is read in full, which the caller sends as usual, and the
+ * request is done. Weaver sends the request to the target itself afterwards,
+ * so the request URL must be absolute, for instance after RouteBySNI. What
+ * the target says is logged and counted in the stats, but the client never
+ * sees it. A body that is too big to hold isn't forwarded, a forward that
+ * takes too long is given up, and so is every forward that is still going
+ * when weaver shuts down.
+ */
+
+var errNoForwardTarget = errors.New("The request URL must be absolute to forward it in the background")
+var errForwardTooBig = errors.New("The request body is too big to forward in the background")
+
+// These are replaced by tests
+var maxBackgroundForwardBody int64 = 4 * 1024 * 1024
+var backgroundForwardTimeout = time.Minute
+
+/*
+ * RespondAndForward sends a response with the given status, headers, and
+ * body, then forwards the request with its complete body to the target in
+ * the background. Only a request handler can do this, before it writes
+ * anything else.
+ */
+func (h *httpResponse) RespondAndForward(status int, hdrs http.Header, body []byte) error {
+	r, ok := h.handler.(*request)
+	if !ok {
+		return errNotRequest
+	}
+	if h.headersFlushed {
+		return errResponseStarted
+	}
+	if !r.req.URL.IsAbs() {
+		return errNoForwardTarget
+	}
+
+	respHdrs := copyHeaders(hdrs)
+	respHdrs.Set("Content-Length", strconv.Itoa(len(body)))
+	h.headers = &respHdrs
+	h.WriteHeader(status)
+	h.Write(body)
+
+	reqBody, err := ioutil.ReadAll(io.LimitReader(r.req.Body, maxBackgroundForwardBody+1))
+	if err == nil && int64(len(reqBody)) > maxBackgroundForwardBody {
+		// The caller still sends the rest, so read it.
+		io.Copy(ioutil.Discard, r.req.Body)
+		err = errForwardTooBig
+	}
+	if err != nil {
+		// The response was already sent, so all we can do is not forward.
+		recordBackgroundForward(r.id, r.req, -1, err)
+		return nil
+	}
+	out, err := http.NewRequest(r.req.Method, r.req.URL.String(), bytes.NewReader(reqBody))
+	if err != nil {
+		recordBackgroundForward(r.id, r.req, -1, err)
+		return nil
+	}
+	out.Header = copyHeaders(r.req.Header)
+	stripHopByHopHeaders(out.Header)
+	out.Host = r.req.Host
+	go forwardInBackground(r.id, out)
+	return nil
+}
+
+/*
+ * The request may be freed while this runs, so it only has the copy.
+ */
+func forwardInBackground(id uint32, out *http.Request) {
+	managerLatch.Lock()
+	draining := drainSignal
+	managerLatch.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), backgroundForwardTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-draining:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	resp, err := upstreamClient.Do(out.WithContext(ctx))
+	if err != nil {
+		recordBackgroundForward(id, out, -1, err)
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	recordBackgroundForward(id, out, resp.StatusCode, nil)
+}
+
+/*
+ * Log failures, including a 5xx from the target, and count the outcome.
+ */
+func recordBackgroundForward(id uint32, req *http.Request, status int, err error) {
+	failed := err != nil || status >= 500
+	if err != nil {
+		log.Printf("Request %d: background forward of %s %s failed: %v",
+			id, req.Method, req.URL, err)
+	} else if failed {
+		log.Printf("Request %d: background forward of %s %s returned %d",
+			id, req.Method, req.URL, status)
+	}
+	updateStats(func(s *stats) {
+		s.BackgroundForwards++
+		if failed {
+			s.BackgroundForwardFailures++
+		}
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Respond and forward", func() {
+	var id uint32
+	var target *httptest.Server
+	var received chan string
+	var targetStatus int
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		received = make(chan string, 1)
+		targetStatus = http.StatusOK
+		target = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			w.WriteHeader(targetStatus)
+			received <- r.Method + " " + r.URL.Path + " " + string(body)
+		}))
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		target.Close()
+	})
+
+	begin := func(forwardTo string) {
+		hdrs := makeRequestHeaders("POST", "/respondforward", "text/plain", 11)
+		hdrs = addRequestHeader(hdrs, "X-Forward-To", forwardTo)
+		Expect(beginRequest(id, hdrs)).Should(Succeed())
+	}
+
+	// The response comes before the caller is asked for the body.
+	respond := func() {
+		Expect(pollRequest(id, true)).Should(Equal("SWCH202"))
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("WHDR"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("Content-Length")).Should(Equal("8"))
+		cmd = pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("WBOD"))
+		Expect(string(readBodyData(cmd))).Should(Equal("Accepted"))
+
+		Expect(pollRequest(id, true)).Should(Equal("RBOD"))
+		sendRequestBodyChunk(id, false, []byte("Hello, "))
+		sendRequestBodyChunk(id, true, []byte("Bob"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	}
+
+	It("Forwards the whole body", func() {
+		before := getStats()
+		begin(target.URL)
+		respond()
+		Eventually(received).Should(Receive(Equal("POST /respondforward Hello, Bob")))
+		Eventually(func() int64 {
+			return getStats().BackgroundForwards
+		}).Should(Equal(before.BackgroundForwards + 1))
+		Expect(getStats().BackgroundForwardFailures).Should(Equal(before.BackgroundForwardFailures))
+	})
+
+	It("Target fails", func() {
+		targetStatus = http.StatusInternalServerError
+		before := getStats()
+		begin(target.URL)
+		respond()
+		Eventually(received).Should(Receive())
+		Eventually(func() int64 {
+			return getStats().BackgroundForwardFailures
+		}).Should(Equal(before.BackgroundForwardFailures + 1))
+	})
+
+	It("Target is down", func() {
+		down := httptest.NewServer(http.NotFoundHandler())
+		down.Close()
+		before := getStats()
+		begin(down.URL)
+		respond()
+		Eventually(func() int64 {
+			return getStats().BackgroundForwardFailures
+		}).Should(Equal(before.BackgroundForwardFailures + 1))
+	})
+
+	It("Too big to hold", func() {
+		defer func(max int64) { maxBackgroundForwardBody = max }(maxBackgroundForwardBody)
+		maxBackgroundForwardBody = 8
+		before := getStats()
+		begin(target.URL)
+		respond()
+		Eventually(func() int64 {
+			return getStats().BackgroundForwardFailures
+		}).Should(Equal(before.BackgroundForwardFailures + 1))
+		Consistently(received).ShouldNot(Receive())
+	})
+
+	Describe("Target hangs", func() {
+		var hung *httptest.Server
+		var release chan struct{}
+
+		BeforeEach(func() {
+			release = make(chan struct{})
+			hung = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ioutil.ReadAll(r.Body)
+				select {
+				case <-r.Context().Done():
+				case <-release:
+				}
+			}))
+		})
+
+		AfterEach(func() {
+			close(release)
+			hung.Close()
+		})
+
+		It("Deadline", func() {
+			defer func(timeout time.Duration) { backgroundForwardTimeout = timeout }(backgroundForwardTimeout)
+			backgroundForwardTimeout = 50 * time.Millisecond
+			before := getStats()
+			begin(hung.URL)
+			respond()
+			Eventually(func() int64 {
+				return getStats().BackgroundForwardFailures
+			}).Should(Equal(before.BackgroundForwardFailures + 1))
+		})
+
+		It("Shutdown", func() {
+			before := getStats()
+			begin(hung.URL)
+			respond()
+			Consistently(func() int64 {
+				return getStats().BackgroundForwardFailures
+			}).Should(Equal(before.BackgroundForwardFailures))
+
+			managerLatch.Lock()
+			close(drainSignal)
+			drainSignal = make(chan struct{})
+			managerLatch.Unlock()
+			Eventually(func() int64 {
+				return getStats().BackgroundForwardFailures
+			}).Should(Equal(before.BackgroundForwardFailures + 1))
+		})
+	})
+
+	It("Needs an absolute URL", func() {
+		begin("")
+		// Without a target, the handler gets an error and the request is
+		// proxied as usual.
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+})
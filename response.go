@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"reflect"
 	"strconv"
+	"time"
 
 	"github.com/30x/gozerian/pipeline"
 )
@@ -19,6 +20,34 @@ type response struct {
 	origHeaders http.Header
 	origBody    io.Reader
 	readStarted bool
+	headersSent bool
+	observer    *bodyObserver
+	chaos       *chaosStream
+	written     bool
+	split       bool
+	transcodeTo string
+	// The decoded body that transcoding put in place of the target's
+	transcoded *decodedBody
+	bodyErr    error
+	sendLength bool
+	// The client speaks HTTP/1.0, so the body may need a length
+	http10Client bool
+	minify       minifier
+	substitute   []substitution
+	snippets     map[string]string
+	bytesSent    int64
+	trailer      *digestTrailer
+	// The client connection must be closed after the response
+	closeClient bool
+	// Weaver is reading the body itself, not for the handler
+	readingAhead bool
+	// The original body, with the chunk that was sniffed put back
+	sniffedBody io.ReadCloser
+	// Whether the handler has returned
+	phase handlerPhase
+	// Measured for the Server-Timing header
+	upstreamTime  time.Duration
+	filterStarted time.Time
 }
 
 func newResponse(id uint32, pd pipeline.Definition) *response {
@@ -43,6 +72,7 @@ func (r *response) Headers() http.Header {
 }
 
 func (r *response) ResponseWritten() {
+	r.written = true
 }
 
 func (r *response) StartRead() {
@@ -50,16 +80,65 @@ func (r *response) StartRead() {
 	// This limitation may be specific to nginx -- if so then we will make it
 	// configurable.
 	r.readStarted = true
-	r.flushHeaders()
+	if r.request.transparent || r.readingAhead {
+		return
+	}
+	if !r.hashingBody() && !(r.http10Client && !r.written) {
+		// Otherwise the headers wait until the whole body has been read,
+		// or until it is known that an HTTP/1.0 client doesn't need that.
+		r.flushHeaders()
+	}
+}
+
+func (r *response) SafePoint() {
+	// Pausing a request pauses its response as well.
+	r.request.park(&r.request.responseSlot)
+}
+
+func (r *response) ChunkSent(chunk []byte) {
+	r.bytesSent += int64(len(chunk))
+	if r.observer != nil {
+		r.observer.observe(chunk)
+	}
+	if r.trailer != nil {
+		r.trailer.hash.Write(chunk)
+	}
+	if r.request.capturingBodies() {
+		har := r.request.har
+		har.responseBody.capture(chunk, har.maxBody)
+	}
+}
+
+func (r *response) BodyStopped() chan bool {
+	// The response body is never cut short.
+	return nil
 }
 
 func (r *response) begin(status uint32, rawHeaders string, req *request) error {
 	r.request = req
+	if _, proxiedAt := req.timings(); !proxiedAt.IsZero() {
+		r.upstreamTime = time.Since(proxiedAt)
+	}
+	// A 1xx status is not final, so the target still wants the request body.
+	if status >= 200 && req.stopBody() {
+		r.cmds <- command{id: SBOD}
+	}
+	req.setState(stateResponse)
+	if req.har != nil {
+		req.har.responseAt = time.Now()
+	}
+	if req.settings.chaos != nil && !req.transparent {
+		r.chaos = newChaosStream(req.settings.chaos, r.cmds, req)
+	}
+	req.hold()
 	go r.startResponse(status, rawHeaders)
 	return nil
 }
 
 func (r *response) pollNB() string {
+	if r.chaos != nil {
+		return r.chaos.poll(false)
+	}
 	select {
 	case cmd := <-r.cmds:
 		return cmd.String()
@@ -69,43 +148,144 @@ func (r *response) pollNB() string {
 }
 
 func (r *response) poll() string {
+	if r.chaos != nil {
+		return r.chaos.poll(true)
+	}
 	cmd := <-r.cmds
 	return cmd.String()
 }
 
 func (r *response) startResponse(status uint32, rawHeaders string) {
+	defer r.request.release()
+	if status >= 200 {
+		defer r.request.releaseUpstream()
+	}
+
+	if r.request.transparent {
+		r.relayTransparent(status)
+		return
+	}
+
 	resp, err := parseHTTPResponse(status, rawHeaders)
 	if err != nil {
+		r.request.setState(stateDone)
+		countError()
 		r.cmds <- createErrorCommand(err)
 		return
 	}
 
 	resp.Request = r.request.req
 	r.resp = resp
+	recordUpstreamOutcome(upstreamHost(resp.Request), resp.StatusCode)
+	r.observer = newBodyObserver(r.request.observeAlgorithms)
 	r.origStatus = resp.StatusCode
 	r.origHeaders = copyHeaders(resp.Header)
 
 	resp.Body = &requestBody{
 		handler: r,
 	}
+	r.checkBodyLength()
 	r.origBody = resp.Body
+	r.fixContentType()
+	r.http10Client = r.mayNeedLength()
+	r.startTranscode()
+	r.decodeForClient()
+	r.minify = r.findMinifier()
+	r.substitute = r.findSubstitutions()
+	r.snippets = r.findSnippets()
 
 	rresp := &httpResponse{
 		handler: r,
 	}
 
+	r.request.takeSlot(&r.request.responseSlot, false)
+	r.filterStarted = time.Now()
 	r.request.pipe.ResponseHandlerFunc()(rresp, resp.Request, resp)
+	rresp.Flush()
+	// Streaming the rest of the body goes at the client's pace.
+	r.request.releaseSlot(&r.request.responseSlot)
+	r.phase.finish()
+	r.startSubstitution()
+	r.startInjection()
+	r.startMinify()
+	r.sendLength = r.needsLength()
 
-	if !r.readStarted {
+	if r.hashingBody() {
+		r.flushHashedBody()
+	} else if r.lengthPrefixing() {
+		r.flushLengthPrefixedBody()
+	} else if r.cachingNegative() {
+		r.flushCachedBody()
+	} else {
+		// This does nothing if reading the body already sent them.
 		r.flushHeaders()
+		r.flushBody()
+	}
+
+	r.request.recordQuotaBytes(r.bytesSent)
+
+	if r.bodyErr != nil {
+		// Part of the body is missing, so it must not look complete.
+		r.request.setState(stateDone)
+		countError()
+		r.cmds <- createErrorCommand(r.bodyErr)
+		return
+	}
+
+	if r.observer != nil {
+		r.request.setResponseDigests(r.observer.digests())
+	}
+	r.sendTrailer()
+	r.request.finishHAR(r.resp.StatusCode, r.resp.Proto, r.resp.Header)
+
+	r.SafePoint()
+	r.request.setState(stateDone)
+	done := command{id: DONE}
+	if r.closeClient {
+		done.msg = doneClose
 	}
-	r.flushBody()
+	r.cmds <- done
+}
 
-	r.cmds <- command{id: DONE}
+/*
+ * Apply the global rules to the response headers. This happens right
+ * before they are sent back to the caller.
+ */
+func (r *response) rewriteHeaders() {
+	r.stripHopByHop()
+	r.declareTrailer()
+	r.stripValidators()
+	r.setABCookie()
+	r.setServerTiming()
+	r.setCharset()
+	r.setExpires()
+	r.setTranscodeHeaders()
+	r.setCORS()
+	r.setVary()
+	// This must come last so that nothing adds a header after it.
+	r.request.dropResponseHeaders(r.resp.Header)
 }
 
 func (r *response) flushHeaders() {
-	if r.origStatus != r.resp.StatusCode {
+	if r.headersSent {
+		return
+	}
+	r.headersSent = true
+	r.rewriteHeaders()
+	if checkSplitHeaders(r.request, r.resp.StatusCode, r.resp.Header) {
+		r.failSplit()
+	}
+	statusChanged := r.origStatus != r.resp.StatusCode
+	if r.request.settings.statusInHeaders {
+		if statusChanged || !reflect.DeepEqual(r.origHeaders, r.resp.Header) {
+			r.cmds <- command{
+				id:  WHDR,
+				msg: formatStatusLine(r.resp.StatusCode) + serializeHeaders(r.resp.Header),
+			}
+		}
+		return
+	}
+	if statusChanged {
 		staCmd := command{
 			id:  WSTA,
 			msg: strconv.Itoa(r.resp.StatusCode),
@@ -122,7 +302,19 @@ func (r *response) flushHeaders() {
 }
 
 func (r *response) flushBody() {
-	if r.origBody != r.resp.Body {
+	if r.flushSplitBody() {
+		return
+	}
+	if r.transcoding() {
+		readAndSend(r, r.encodedBody())
+		return
+	}
+	// To observe or count a body that nobody touched, we have to send it
+	// ourselves.
+	observeOrig := (r.observer != nil || r.trailer != nil || r.request.countingQuotaBytes() ||
+		r.request.capturingBodies()) &&
+		!r.readStarted && !r.written
+	if r.origBody != r.resp.Body || observeOrig {
 		readAndSend(r, r.resp.Body)
 	}
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+/*
+ * Change the scheme used to reach the target for a single request. The
+ * caller does the dialing, so this turns the forwarded URI into an absolute
+ * one, which tells the caller to change the target, including whether to
+ * use TLS to reach it.
+ */
+
+func setSchemeOverride(id uint32, scheme string) error {
+	req := getRequest(id)
+	if req == nil {
+		return fmt.Errorf("Unknown request: %d", id)
+	}
+	scheme = strings.ToLower(scheme)
+	if scheme != "http" && scheme != "https" {
+		return fmt.Errorf("Invalid scheme: \"%s\"", scheme)
+	}
+	req.scheme = scheme
+	return nil
+}
+
+func (r *request) overrideScheme() {
+	if r.scheme == "" {
+		return
+	}
+
+	oldScheme := r.targetScheme()
+	if oldScheme == "https" && r.scheme == "http" {
+		log.Printf("Request %d: %s %s will be sent to the target without TLS",
+			r.id, r.req.Method, r.req.RequestURI)
+	}
+
+	newURL := *r.req.URL
+	newURL.Scheme = r.scheme
+	if newURL.Host == "" {
+		newURL.Host = r.req.Host
+	}
+	r.req.URL = &newURL
+}
+
+/*
+ * Return the scheme that will be used to reach the target. If the URI isn't
+ * already absolute, assume that the caller was going to use TLS if the
+ * client did.
+ */
+func (r *request) targetScheme() string {
+	if r.req.URL.Scheme != "" {
+		return r.req.URL.Scheme
+	}
+	if r.req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
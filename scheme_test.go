@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"log"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Scheme Override", func() {
+	var id uint32
+	var logged *bytes.Buffer
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		logged = &bytes.Buffer{}
+		log.SetOutput(logged)
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		log.SetOutput(os.Stderr)
+	})
+
+	expectURI := func(uri, expected string) {
+		err := beginRequest(id, makeRequestHeaders("GET", uri, "", 0))
+		Expect(err).Should(Succeed())
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WURI.*"))
+		Expect(cmd[4:]).Should(Equal(expected))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	}
+
+	It("Invalid", func() {
+		Expect(setSchemeOverride(id, "ftp")).ShouldNot(Succeed())
+		Expect(setSchemeOverride(0, "https")).ShouldNot(Succeed())
+	})
+
+	It("Upgrade", func() {
+		Expect(setSchemeOverride(id, "HTTPS")).Should(Succeed())
+		expectURI("/pass/secure?x=1", "https://localhost:1234/pass/secure?x=1")
+		Expect(logged.Len()).Should(BeZero())
+	})
+
+	It("Downgrade", func() {
+		Expect(setTLSInfo(id, tls.VersionTLS12, "")).Should(Succeed())
+		Expect(setSchemeOverride(id, "http")).Should(Succeed())
+		expectURI("/pass/plain", "http://localhost:1234/pass/plain")
+		Expect(logged.String()).Should(ContainSubstring("without TLS"))
+	})
+
+	It("Absolute URI", func() {
+		Expect(setSchemeOverride(id, "http")).Should(Succeed())
+		err := beginRequest(id, "GET https://example.com/pass HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		Expect(err).Should(Succeed())
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(Equal("WURIhttp://example.com/pass"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(logged.String()).Should(ContainSubstring("without TLS"))
+	})
+})
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+/*
+ * Serve static files from local directories, without running the handler or
+ * going to the target. The files are served by http.FileServer, which
+ * answers If-Modified-Since, and weaver adds an ETag made from the size and
+ * modification time of the file so that If-None-Match works too. The
+ * response is sent using the usual SWCH, WHDR, and WBOD commands.
+ *
+ * Only plain files are served. Directories without an index.html, anything
+ * with a path segment that starts with ".", and symlinks that lead outside
+ * the directory all look like missing files.
+ */
+
+func serveDirectory(prefix, dir string) error {
+	prefix = strings.TrimSpace(prefix)
+	if !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("Path prefix must start with \"/\": \"%s\"", prefix)
+	}
+	prefix = strings.TrimRight(prefix, "/")
+	if dir != "" {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("Not a directory: %s", dir)
+		}
+	}
+	updateSettings(func(s *settings) {
+		dirs := make(map[string]string)
+		for p, d := range s.staticDirs {
+			dirs[p] = d
+		}
+		if dir == "" {
+			delete(dirs, prefix)
+		} else {
+			dirs[prefix] = dir
+		}
+		s.staticDirs = dirs
+	})
+	return nil
+}
+
+/*
+ * Return the longest prefix that the path is under, and its directory.
+ */
+func (s *settings) staticDir(path string) (string, string) {
+	var prefix, dir string
+	found := false
+	for p, d := range s.staticDirs {
+		if (path == p || strings.HasPrefix(path, p+"/") || p == "") &&
+			(!found || len(p) > len(prefix)) {
+			prefix, dir, found = p, d, true
+		}
+	}
+	if !found {
+		return "", ""
+	}
+	return prefix, dir
+}
+
+func (r *request) serveStatic() bool {
+	if len(r.settings.staticDirs) == 0 {
+		return false
+	}
+	prefix, dir := r.settings.staticDir(r.req.URL.Path)
+	if dir == "" {
+		return false
+	}
+	// The response headers must not start as a copy of the request's.
+	r.resp.headers = &http.Header{}
+	root := staticFS{dir: dir}
+	files := http.StripPrefix(prefix, http.FileServer(root))
+	files.ServeHTTP(&staticETagWriter{httpResponse: r.resp, root: root, req: r.req,
+		prefix: prefix}, r.req)
+	return true
+}
+
+/*
+ * Set the ETag just before the file server looks at the headers, which is
+ * when it first asks for them.
+ */
+type staticETagWriter struct {
+	*httpResponse
+	root   http.FileSystem
+	req    *http.Request
+	prefix string
+	tagged bool
+}
+
+func (w *staticETagWriter) Header() http.Header {
+	h := w.httpResponse.Header()
+	if !w.tagged {
+		w.tagged = true
+		if etag := staticETag(w.root, strings.TrimPrefix(w.req.URL.Path, w.prefix)); etag != "" {
+			h.Set("ETag", etag)
+		}
+	}
+	return h
+}
+
+func staticETag(root http.FileSystem, name string) string {
+	f, err := root.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return ""
+	}
+	return fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size())
+}
+
+/*
+ * A file system that only opens what serveStatic is willing to serve.
+ */
+type staticFS struct {
+	dir string
+}
+
+func (fs staticFS) Open(name string) (http.File, error) {
+	name = path.Clean("/" + name)
+	for _, seg := range strings.Split(name, "/") {
+		if strings.HasPrefix(seg, ".") {
+			return nil, os.ErrNotExist
+		}
+	}
+	if !fs.inside(name) {
+		return nil, os.ErrNotExist
+	}
+	f, err := http.Dir(fs.dir).Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() && !fs.hasIndex(name) {
+		f.Close()
+		return nil, os.ErrNotExist
+	}
+	return f, nil
+}
+
+/*
+ * Whether the name, once symlinks are followed, is still under the directory.
+ */
+func (fs staticFS) inside(name string) bool {
+	root, err := filepath.EvalSymlinks(fs.dir)
+	if err != nil {
+		return false
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(fs.dir, filepath.FromSlash(name)))
+	if err != nil {
+		// Missing files are reported by Open.
+		return os.IsNotExist(err)
+	}
+	rel, err := filepath.Rel(root, resolved)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (fs staticFS) hasIndex(name string) bool {
+	index := path.Join(name, "index.html")
+	if !fs.inside(index) {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(fs.dir, filepath.FromSlash(index)))
+	return err == nil && !info.IsDir()
+}
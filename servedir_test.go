@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Static directories", func() {
+	var id uint32
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "weaver-static")
+		Expect(err).Should(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "hello.txt"),
+			[]byte("Hello, static world!"), 0644)).Should(Succeed())
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		resetSettings()
+		os.RemoveAll(dir)
+	})
+
+	// Send the request and return the status, headers, and body.
+	fetch := func(path string, extra ...string) (string, http.Header, string) {
+		hdrs := makeRequestHeaders("GET", path, "", 0)
+		for i := 0; i < len(extra); i += 2 {
+			hdrs = addRequestHeader(hdrs, extra[i], extra[i+1])
+		}
+		Expect(beginRequest(id, hdrs)).Should(Succeed())
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("SWCH"))
+		status := cmd[4:]
+		respHdrs := http.Header{}
+		body := ""
+		for cmd = pollRequest(id, true); cmd != "DONE"; cmd = pollRequest(id, true) {
+			switch cmd[:4] {
+			case "WHDR":
+				parseHeaders(respHdrs, cmd[4:])
+			case "WBOD":
+				body += string(readBodyData(cmd))
+			default:
+				Fail("Unexpected command " + cmd)
+			}
+		}
+		return status, respHdrs, body
+	}
+
+	It("Serve file", func() {
+		Expect(serveDirectory("/static/", dir)).Should(Succeed())
+		status, hdrs, body := fetch("/static/hello.txt")
+		Expect(status).Should(Equal("200"))
+		Expect(body).Should(Equal("Hello, static world!"))
+		Expect(hdrs.Get("Content-Type")).Should(HavePrefix("text/plain"))
+		Expect(hdrs.Get("ETag")).ShouldNot(BeEmpty())
+		Expect(hdrs.Get("Last-Modified")).ShouldNot(BeEmpty())
+		// Nothing is copied from the request.
+		Expect(hdrs.Get("Host")).Should(BeEmpty())
+	})
+
+	It("If-None-Match", func() {
+		Expect(serveDirectory("/static", dir)).Should(Succeed())
+		_, hdrs, _ := fetch("/static/hello.txt")
+		freeRequest(id)
+		id = createRequest(testHandler)
+		status, _, body := fetch("/static/hello.txt", "If-None-Match", hdrs.Get("ETag"))
+		Expect(status).Should(Equal("304"))
+		Expect(body).Should(BeEmpty())
+	})
+
+	It("If-Modified-Since", func() {
+		Expect(serveDirectory("/static", dir)).Should(Succeed())
+		since := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+		status, _, body := fetch("/static/hello.txt", "If-Modified-Since", since)
+		Expect(status).Should(Equal("304"))
+		Expect(body).Should(BeEmpty())
+	})
+
+	It("Missing file", func() {
+		Expect(serveDirectory("/static", dir)).Should(Succeed())
+		status, _, _ := fetch("/static/nope.txt")
+		Expect(status).Should(Equal("404"))
+	})
+
+	It("Directory index", func() {
+		Expect(os.Mkdir(filepath.Join(dir, "sub"), 0755)).Should(Succeed())
+		Expect(serveDirectory("/static", dir)).Should(Succeed())
+		status, _, _ := fetch("/static/sub/")
+		Expect(status).Should(Equal("404"))
+
+		Expect(ioutil.WriteFile(filepath.Join(dir, "sub", "index.html"),
+			[]byte("<p>Index</p>"), 0644)).Should(Succeed())
+		freeRequest(id)
+		id = createRequest(testHandler)
+		status, _, body := fetch("/static/sub/")
+		Expect(status).Should(Equal("200"))
+		Expect(body).Should(Equal("<p>Index</p>"))
+	})
+
+	It("Dot files", func() {
+		Expect(ioutil.WriteFile(filepath.Join(dir, ".htpasswd"),
+			[]byte("secret"), 0644)).Should(Succeed())
+		Expect(os.Mkdir(filepath.Join(dir, ".git"), 0755)).Should(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, ".git", "config"),
+			[]byte("secret"), 0644)).Should(Succeed())
+		Expect(serveDirectory("/static", dir)).Should(Succeed())
+		status, _, body := fetch("/static/.htpasswd")
+		Expect(status).Should(Equal("404"))
+		Expect(body).ShouldNot(ContainSubstring("secret"))
+		freeRequest(id)
+		id = createRequest(testHandler)
+		status, _, body = fetch("/static/.git/config")
+		Expect(status).Should(Equal("404"))
+		Expect(body).ShouldNot(ContainSubstring("secret"))
+	})
+
+	It("Symlinks", func() {
+		outside, err := ioutil.TempDir("", "weaver-outside")
+		Expect(err).Should(Succeed())
+		defer os.RemoveAll(outside)
+		Expect(ioutil.WriteFile(filepath.Join(outside, "secret.txt"),
+			[]byte("secret"), 0644)).Should(Succeed())
+		Expect(os.Symlink(filepath.Join(outside, "secret.txt"),
+			filepath.Join(dir, "out.txt"))).Should(Succeed())
+		Expect(os.Symlink(filepath.Join(dir, "hello.txt"),
+			filepath.Join(dir, "in.txt"))).Should(Succeed())
+		Expect(serveDirectory("/static", dir)).Should(Succeed())
+
+		status, _, body := fetch("/static/out.txt")
+		Expect(status).Should(Equal("404"))
+		Expect(body).ShouldNot(ContainSubstring("secret"))
+		freeRequest(id)
+		id = createRequest(testHandler)
+		status, _, body = fetch("/static/in.txt")
+		Expect(status).Should(Equal("200"))
+		Expect(body).Should(Equal("Hello, static world!"))
+	})
+
+	It("Other paths", func() {
+		Expect(serveDirectory("/pa", dir)).Should(Succeed())
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Removed", func() {
+		Expect(serveDirectory("/static", dir)).Should(Succeed())
+		Expect(serveDirectory("/static", "")).Should(Succeed())
+		Expect(getSettings().staticDirs).Should(BeEmpty())
+	})
+
+	It("Longest prefix", func() {
+		s := settings{staticDirs: map[string]string{"/a": "one", "/a/b": "two"}}
+		prefix, d := s.staticDir("/a/b/c")
+		Expect(prefix).Should(Equal("/a/b"))
+		Expect(d).Should(Equal("two"))
+		prefix, d = s.staticDir("/a/bc")
+		Expect(prefix).Should(Equal("/a"))
+		Expect(d).Should(Equal("one"))
+		_, d = s.staticDir("/ab")
+		Expect(d).Should(BeEmpty())
+	})
+
+	It("Invalid", func() {
+		Expect(serveDirectory("static", dir)).ShouldNot(Succeed())
+		Expect(serveDirectory("/static", filepath.Join(dir, "missing"))).ShouldNot(Succeed())
+		Expect(serveDirectory("/static", filepath.Join(dir, "hello.txt"))).ShouldNot(Succeed())
+	})
+})
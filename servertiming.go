@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+ * Add a Server-Timing header to the response so that browser tools can show
+ * where the time went. "upstream" is the time between the end of request
+ * processing and the start of the response, which is mostly the target.
+ * "filter" is the time spent in handlers. The header is sent before the
+ * body, so any time that a handler spends reading the response body after
+ * that isn't counted. "queue" is the time spent waiting for the priority
+ * scheduler, and is only sent if the request had to wait.
+ */
+
+func enableServerTiming(id uint32) error {
+	req := getRequest(id)
+	if req == nil {
+		return fmt.Errorf("Unknown request: %d", id)
+	}
+	req.serverTiming = true
+	return nil
+}
+
+func (r *response) setServerTiming() {
+	req := r.request
+	if !req.serverTiming {
+		return
+	}
+	filter, _ := req.timings()
+	if !r.filterStarted.IsZero() {
+		filter += time.Since(r.filterStarted)
+	}
+	timing := fmt.Sprintf("upstream;dur=%s, filter;dur=%s",
+		formatTimingDuration(r.upstreamTime), formatTimingDuration(filter))
+	if queued, queueWait := req.queueTiming(); queued {
+		timing += ", queue;dur=" + formatTimingDuration(queueWait)
+	}
+	if allowed := req.settings.allowedHeaders; allowed != nil &&
+		!allowed["Server-Timing"] && !req.extraHeaders["Server-Timing"] {
+		// Only our own timing gets through the allowlist.
+		r.resp.Header.Del("Server-Timing")
+		req.allowResponseHeader("Server-Timing")
+	}
+	r.resp.Header.Add("Server-Timing", timing)
+}
+
+/*
+ * Server-Timing durations are in milliseconds.
+ */
+func formatTimingDuration(d time.Duration) string {
+	return fmt.Sprintf("%.3f", float64(d)/float64(time.Millisecond))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var serverTimingRe = regexp.MustCompile(`^upstream;dur=([0-9.]+), ?filter;dur=([0-9.]+)$`)
+
+var _ = Describe("Server-Timing", func() {
+	var id uint32
+	var rid uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		rid = createResponse(testHandler)
+		Expect(rid).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		freeResponse(rid)
+	})
+
+	It("Unknown request", func() {
+		Expect(enableServerTiming(0)).ShouldNot(Succeed())
+	})
+
+	It("Header", func() {
+		Expect(enableServerTiming(id)).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		// Pretend that the target takes a while
+		time.Sleep(20 * time.Millisecond)
+		err = beginResponse(rid, id, 200, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+
+		cmd := pollResponse(rid, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("Server")).Should(Equal("Some test thing"))
+		// The caller's parser splits values at commas
+		match := serverTimingRe.FindStringSubmatch(strings.Join(hdrs["Server-Timing"], ","))
+		Expect(match).ShouldNot(BeNil())
+
+		upstream, _ := strconv.ParseFloat(match[1], 64)
+		filter, _ := strconv.ParseFloat(match[2], 64)
+		Expect(upstream).Should(BeNumerically(">=", 20))
+		Expect(upstream).Should(BeNumerically("<", 10000))
+		Expect(filter).Should(BeNumerically(">=", 0))
+		Expect(filter).Should(BeNumerically("<", upstream))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Disabled", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		err = beginResponse(rid, id, 200, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+})
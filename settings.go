@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+/*
+ * Global settings that change how every request and response is processed.
+ * They are changed using the "GoSet" functions in the C API. Each request
+ * takes a copy of the settings when it begins, so a change only affects
+ * requests that begin after it was made. Slices and maps in here must be
+ * replaced rather than modified in place so that copies are safe to use.
+ */
+
+const (
+	// AcceptEncodingPassthrough forwards whatever the client sent
+	AcceptEncodingPassthrough = "passthrough"
+	// AcceptEncodingIdentity asks the target not to encode the response body
+	AcceptEncodingIdentity = "identity"
+	// AcceptEncodingNormalize sends "gzip" if the client accepts it, or
+	// "identity" otherwise, so that the target caches fewer variants
+	AcceptEncodingNormalize = "normalize"
+)
+
+type settings struct {
+	acceptEncodingPolicy string
+	exactRewrites        map[string]string
+	regexpRewrites       []regexpRewrite
+	abTarget             *url.URL
+	abFraction           float64
+	strictHostCheck      bool
+	slowThreshold        time.Duration
+	maxRequestDuration   time.Duration
+	slowHandler          slowRequestHandler
+	minTLSVersion        uint16
+	bodyHashHeader       string
+	bodyHashAlgorithm    string
+	bufferRequests       bool
+	requestHashHeader    string
+	requestHashAlgorithm string
+	hashRequestBodies    bool
+	chaos                *chaosSpec
+	stripPrefix          string
+	strictStripPrefix    bool
+	addPrefix            string
+	negativeTTLs         map[int]time.Duration
+	queryOverrides       map[string]string
+	headerCases          map[string]string
+	rejectSplitHeaders   bool
+	compressCache        bool
+	normalizeURL         bool
+	debugLogging         bool
+	developmentMode      bool
+	transcodeResponses   bool
+	negotiateEncoding    bool
+	backendEncodings     []string
+	statusInHeaders      bool
+	keepFragments        bool
+	asyncFilterWindow    int
+	keepHopByHop         bool
+	http10Support        bool
+	maxHeaderLine        int
+	maxURILength         int
+	allowedAuthorities   map[string]bool
+	allowedHeaders       map[string]bool
+	minifyTypes          map[string]bool
+	imageQuality         int
+	substitutions        map[string][]substitution
+	quota                *quotaPolicy
+	keepValidators       bool
+	htmlSnippets         map[string]string
+	rateLimit            *rateLimiter
+	rateLimitKey         func(*http.Request) string
+	errorRenderer        ErrorRenderer
+	responseCharset      string
+	upstreamLimits       []*upstreamLimit
+	expiresMaxAge        uint32
+	expiresStatuses      map[int]bool
+	streamPayloads       bool
+	varyHeaders          []string
+	healthCheck          *healthCheck
+	healthEndpoint       *healthEndpoint
+	readinessPath        string
+	livenessPath         string
+	pprofEnabled         bool
+	pprofPath            string
+	pprofAllowed         []*net.IPNet
+	expvarPath           string
+	builtinRoutes        map[string]string
+	harSampler           *harSampler
+	harInterval          time.Duration
+	harRedact            map[string]bool
+	cors                 *corsPolicy
+	localPaths           []string
+	staticDirs           map[string]string
+}
+
+var defaultSettings = settings{
+	acceptEncodingPolicy: AcceptEncodingPassthrough,
+	maxURILength:         defaultMaxURILength,
+}
+
+var currentSettings = defaultSettings
+var settingsLock = sync.Mutex{}
+var configVersion uint64
+
+func getSettings() settings {
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+	return currentSettings
+}
+
+func updateSettings(update func(s *settings)) {
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+	update(&currentSettings)
+	configVersion++
+}
+
+/*
+ * Return a number that goes up every time the settings change.
+ */
+func getConfigVersion() uint64 {
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+	return configVersion
+}
+
+/*
+ * Put everything back the way it was at startup. This is mostly useful
+ * for testing.
+ */
+func resetSettings() {
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+	currentSettings = defaultSettings
+	configVersion++
+}
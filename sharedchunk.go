@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"unsafe"
+)
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+/*
+ * Shared chunks are immutable chunks that many requests may send at the same
+ * time without copying them. Each one is reference counted. The caller that
+ * stored it holds one reference, and every WSHR command that refers to it
+ * holds another, which the caller gives back using GoReleaseChunk.
+ */
+
+func storeSharedChunk(data unsafe.Pointer, len uint32) int32 {
+	chunkLock.Lock()
+	defer chunkLock.Unlock()
+
+	lastChunkID++
+	if lastChunkID < 0 {
+		lastChunkID = 1
+	}
+	chunks[lastChunkID] = chunk{
+		id:     lastChunkID,
+		len:    len,
+		data:   data,
+		shared: true,
+		refs:   1,
+	}
+	return lastChunkID
+}
+
+/*
+ * Copy data into a new shared chunk.
+ */
+func allocateSharedChunk(data []byte) int32 {
+	ptr, len := sliceToPtr(data)
+	return storeSharedChunk(ptr, len)
+}
+
+/*
+ * Add a reference to a shared chunk. Return false if there is no such
+ * shared chunk.
+ */
+func retainChunk(id int32) bool {
+	chunkLock.Lock()
+	defer chunkLock.Unlock()
+	c, found := chunks[id]
+	if !found || !c.shared {
+		return false
+	}
+	c.refs++
+	chunks[id] = c
+	return true
+}
+
+func sendSharedChunk(handler commandHandler, id int32) error {
+	if !retainChunk(id) {
+		return fmt.Errorf("Unknown shared chunk: %d", id)
+	}
+	handler.SafePoint()
+	c := getChunk(id)
+	handler.ChunkSent(unsafe.Slice((*byte)(c.data), c.len))
+	handler.Commands() <- command{
+		id:  WSHR,
+		msg: fmt.Sprintf("%x", id),
+	}
+	return nil
+}
+
+/*
+ * WriteSharedChunk writes a shared chunk as the next part of the response
+ * body without copying it. Handlers that know about weaver can find it
+ * using a type assertion on the http.ResponseWriter.
+ */
+func (h *httpResponse) WriteSharedChunk(id int32) error {
+	h.handler.ResponseWritten()
+	h.flush(http.StatusOK)
+	return sendSharedChunk(h.handler, id)
+}
+
+/*
+ * Copy the data out of a chunk without releasing it.
+ */
+func chunkBytes(id int32) []byte {
+	c := getChunk(id)
+	if c.data == nil {
+		return nil
+	}
+	return C.GoBytes(c.data, C.int(c.len))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Shared Chunks", func() {
+	It("Reference counting", func() {
+		id := allocateSharedChunk([]byte("Down for maintenance"))
+		Expect(retainChunk(id)).Should(BeTrue())
+		releaseChunk(id)
+		Expect(chunkBytes(id)).Should(Equal([]byte("Down for maintenance")))
+		releaseChunk(id)
+		Expect(chunkBytes(id)).Should(BeNil())
+		Expect(retainChunk(id)).Should(BeFalse())
+	})
+
+	It("Ordinary chunks are not shared", func() {
+		id := allocateChunk([]byte("Not shared"))
+		defer readBodyData(fmt.Sprintf("WBOD%x", id))
+		Expect(retainChunk(id)).Should(BeFalse())
+	})
+
+	It("Freed before polling", func() {
+		chunkID := allocateSharedChunk([]byte("Down for maintenance"))
+		id := createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		uri := "/sharedchunk?id=" + strconv.Itoa(int(chunkID))
+		Expect(beginRequest(id, makeRequestHeaders("GET", uri, "", 0))).Should(Succeed())
+		cmds := getRequest(id).cmds
+		// SWCH, WSHR, and DONE are all waiting.
+		Eventually(func() int { return len(cmds) }).Should(Equal(3))
+		freeRequest(id)
+
+		// Only the reference that we hold is left.
+		releaseChunk(chunkID)
+		Expect(chunkBytes(chunkID)).Should(BeNil())
+	})
+
+	It("Share between requests", func() {
+		const numRequests = 100
+		payload := []byte("{\"error\":\"Down for maintenance\"}")
+		chunkID := allocateSharedChunk(payload)
+		uri := "/sharedchunk?id=" + strconv.Itoa(int(chunkID))
+
+		ids := make([]uint32, numRequests)
+		for i := range ids {
+			ids[i] = createRequest(testHandler)
+			Expect(ids[i]).ShouldNot(BeZero())
+			defer freeRequest(ids[i])
+		}
+		for _, id := range ids {
+			err := beginRequest(id, makeRequestHeaders("GET", uri, "", 0))
+			Expect(err).Should(Succeed())
+		}
+
+		// Each request polls until it has seen the chunk, but nobody releases
+		// it until all of them have.
+		var seen sync.WaitGroup
+		var done sync.WaitGroup
+		seen.Add(numRequests)
+		done.Add(numRequests)
+		for _, id := range ids {
+			go func(id uint32) {
+				defer GinkgoRecover()
+				defer done.Done()
+				Expect(pollRequest(id, true)).Should(Equal("SWCH200"))
+				cmd := pollRequest(id, true)
+				Expect(cmd).Should(MatchRegexp("^WSHR.*"))
+				sharedID, err := strconv.ParseInt(cmd[4:], 16, 32)
+				Expect(err).Should(Succeed())
+				Expect(int32(sharedID)).Should(Equal(chunkID))
+				Expect(chunkBytes(chunkID)).Should(Equal(payload))
+				Expect(pollRequest(id, true)).Should(Equal("DONE"))
+				seen.Done()
+				seen.Wait()
+				releaseChunk(chunkID)
+			}(id)
+		}
+		done.Wait()
+
+		// The owner still has a reference.
+		Expect(chunkBytes(chunkID)).Should(Equal(payload))
+		releaseChunk(chunkID)
+		Expect(chunkBytes(chunkID)).Should(BeNil())
+	})
+})
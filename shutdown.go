@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+/*
+ * Shut down in order, so that a deploy doesn't turn responses that are
+ * already finished into errors. First, no new request or response may
+ * begin. Then, for up to the drain window, the caller may keep polling
+ * requests and responses whose commands are all queued, meaning that they
+ * reached DONE or ERRR and only need to be read. Once those have all been
+ * read, or the window is over, everything that is left is freed, including
+ * requests that are still waiting for the target.
+ *
+ * Handlers that stream for a long time, such as server-sent events, can
+ * watch the channel that Draining returns, which is closed when the
+ * shutdown begins, and finish up, for instance by sending a last event.
+ * Once a handler asks for it, the drain phase waits for that handler to
+ * return as well.
+ */
+
+var errShuttingDown = errors.New("Shutting down")
+
+// Protected by managerLatch
+var shuttingDown bool
+var drainSignal = make(chan struct{})
+
+// How often the drain phase checks the queues
+const drainPollInterval = 5 * time.Millisecond
+
+type shutdownResult struct {
+	// Requests and responses that existed when the shutdown began
+	Active int `json:"active"`
+	// Those that ended normally, before or during the drain phase
+	Drained int `json:"drained"`
+	// Those that were freed with work left to do
+	Cancelled   int   `json:"cancelled"`
+	DrainMillis int64 `json:"drainMillis"`
+}
+
+func isShuttingDown() bool {
+	managerLatch.Lock()
+	defer managerLatch.Unlock()
+	return shuttingDown
+}
+
+func shutdown(drainWindow time.Duration) shutdownResult {
+	managerLatch.Lock()
+	if !shuttingDown {
+		close(drainSignal)
+	}
+	shuttingDown = true
+	reqs := make(map[uint32]*request, len(requests))
+	for id, req := range requests {
+		reqs[id] = req
+	}
+	resps := make(map[uint32]*response, len(responses))
+	for id, resp := range responses {
+		resps[id] = resp
+	}
+	managerLatch.Unlock()
+
+	result := shutdownResult{Active: len(reqs) + len(resps)}
+	start := time.Now()
+	deadline := start.Add(drainWindow)
+	for anyDraining(reqs, resps) && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+	result.DrainMillis = int64(time.Since(start) / time.Millisecond)
+
+	for id, req := range reqs {
+		if isDrained(req, req.cmds) {
+			result.Drained++
+		} else {
+			result.Cancelled++
+			req.discardBody()
+		}
+		// The caller may not know yet, so the request isn't reused.
+		removeRequest(id, false)
+	}
+	for id, resp := range resps {
+		if resp.request != nil && isDrained(resp.request, resp.cmds) {
+			result.Drained++
+		} else {
+			result.Cancelled++
+		}
+		freeResponse(id)
+	}
+	return result
+}
+
+/*
+ * Draining returns a channel that is closed when weaver begins to shut
+ * down.
+ */
+func (h *httpResponse) Draining() <-chan struct{} {
+	if r := h.owner(); r != nil {
+		r.bodyLock.Lock()
+		r.watchingDrain = true
+		r.bodyLock.Unlock()
+	}
+	managerLatch.Lock()
+	defer managerLatch.Unlock()
+	return drainSignal
+}
+
+/*
+ * Return true if something is finished but the caller hasn't read all of
+ * its commands yet, or if a handler that watches for the drain is still
+ * running.
+ */
+func anyDraining(reqs map[uint32]*request, resps map[uint32]*response) bool {
+	for _, req := range reqs {
+		if isDraining(req, req.cmds) {
+			return true
+		}
+	}
+	for _, resp := range resps {
+		if resp.request != nil && isDraining(resp.request, resp.cmds) {
+			return true
+		}
+	}
+	return false
+}
+
+func isDraining(req *request, cmds chan command) bool {
+	switch req.getState() {
+	case stateDone:
+		return len(cmds) > 0
+	case stateRequest, stateResponse:
+		// A handler is running, not waiting for the target
+		req.bodyLock.Lock()
+		defer req.bodyLock.Unlock()
+		return req.watchingDrain
+	}
+	return false
+}
+
+func isDrained(req *request, cmds chan command) bool {
+	return req.getState() == stateDone && len(cmds) == 0
+}
+
+func getShutdownJSON(drainWindow time.Duration) string {
+	buf, err := json.Marshal(shutdown(drainWindow))
+	if err != nil {
+		return "{}"
+	}
+	return string(buf)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Shutdown", func() {
+	BeforeEach(func() {
+		// Don't count anything that other tests left behind.
+		freeAllRequests()
+	})
+
+	AfterEach(func() {
+		managerLatch.Lock()
+		shuttingDown = false
+		drainSignal = make(chan struct{})
+		managerLatch.Unlock()
+	})
+
+	startShutdown := func(window time.Duration) chan shutdownResult {
+		done := make(chan shutdownResult, 1)
+		go func() {
+			var result shutdownResult
+			Expect(json.Unmarshal([]byte(getShutdownJSON(window)), &result)).Should(Succeed())
+			done <- result
+		}()
+		Eventually(isShuttingDown).Should(BeTrue())
+		return done
+	}
+
+	It("Queued response survives", func() {
+		id := createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		err := beginRequest(id, makeRequestHeaders("GET", "/returnbody", "", 0))
+		Expect(err).Should(Succeed())
+		Eventually(func() requestState {
+			return getRequest(id).getState()
+		}).Should(Equal(stateDone))
+
+		done := startShutdown(10 * time.Second)
+		Expect(beginRequest(createRequest(testHandler), makeRequestHeaders("GET", "/pass", "", 0))).
+			Should(Equal(errShuttingDown))
+
+		Expect(pollRequest(id, true)).Should(Equal("SWCH200"))
+		cmd := pollRequest(id, true)
+		for cmd[:4] != "WBOD" {
+			cmd = pollRequest(id, true)
+		}
+		Expect(string(readBodyData(cmd))).Should(Equal("Hello! I am the server!"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		var result shutdownResult
+		Eventually(done).Should(Receive(&result))
+		Expect(result.Active).Should(Equal(1))
+		Expect(result.Drained).Should(Equal(1))
+		Expect(result.Cancelled).Should(BeZero())
+		Expect(result.DrainMillis).Should(BeNumerically("<", 10000))
+		Expect(getRequest(id)).Should(BeNil())
+	})
+
+	It("Streaming handler finishes", func() {
+		id := createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		err := beginRequest(id, makeRequestHeaders("GET", "/drainstream", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("SWCH200"))
+		Expect(pollRequest(id, true)).Should(HavePrefix("WHDR"))
+		Expect(string(readBodyData(pollRequest(id, true)))).Should(Equal("data: hello\n\n"))
+
+		done := startShutdown(10 * time.Second)
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("WBOD"))
+		Expect(string(readBodyData(cmd))).Should(Equal("event: bye\ndata: shutting down\n\n"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		var result shutdownResult
+		Eventually(done).Should(Receive(&result))
+		Expect(result.Drained).Should(Equal(1))
+		Expect(result.Cancelled).Should(BeZero())
+		Expect(result.DrainMillis).Should(BeNumerically("<", 10000))
+	})
+
+	It("Request waiting for the target is cancelled", func() {
+		id := createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		rid := createResponse(testHandler)
+		Expect(rid).ShouldNot(BeZero())
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		done := startShutdown(50 * time.Millisecond)
+		Expect(beginResponse(rid, id, 200, makeResponseHeaders("", 0))).
+			Should(Equal(errShuttingDown))
+
+		var result shutdownResult
+		Eventually(done).Should(Receive(&result))
+		Expect(result.Active).Should(Equal(2))
+		Expect(result.Drained).Should(BeZero())
+		Expect(result.Cancelled).Should(Equal(2))
+		Expect(pollRequest(id, false)).Should(Equal("ERRRUnknown request"))
+	})
+})
+
+/*
+ * Free every request and response that other tests left behind.
+ */
+func freeAllRequests() {
+	managerLatch.Lock()
+	var reqIDs []uint32
+	for id := range requests {
+		reqIDs = append(reqIDs, id)
+	}
+	var respIDs []uint32
+	for id := range responses {
+		respIDs = append(respIDs, id)
+	}
+	managerLatch.Unlock()
+
+	for _, id := range reqIDs {
+		freeRequest(id)
+	}
+	for _, id := range respIDs {
+		freeResponse(id)
+	}
+}
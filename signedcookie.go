@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/*
+ * Signed cookies, for session handlers that keep their state in a cookie
+ * and need to know that the client didn't change it. The value is the
+ * payload and an HMAC-SHA256 of the name and payload, both in URL-safe
+ * base64, separated by a dot. The name is signed too, so that one signed
+ * cookie can't be passed off as another. Handlers find VerifiedCookie and
+ * SetSignedCookie using a type assertion on the http.ResponseWriter.
+ */
+
+var (
+	errNoSigningKey    = errors.New("No key to sign the cookie with")
+	errCookieTampered  = errors.New("Cookie signature doesn't match")
+	errCookieMalformed = errors.New("Cookie isn't signed")
+	errNoCookieRequest = errors.New("No request to read the cookie from")
+)
+
+/*
+ * VerifiedCookie returns the payload of signed cookie "name" from the
+ * request, after checking its signature with "key." It returns
+ * http.ErrNoCookie if there is no such cookie.
+ */
+func (h *httpResponse) VerifiedCookie(name string, key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errNoSigningKey
+	}
+	r := h.owner()
+	if r == nil || r.req == nil {
+		return nil, errNoCookieRequest
+	}
+	c, err := r.req.Cookie(name)
+	if err != nil {
+		return nil, err
+	}
+	dot := strings.LastIndexByte(c.Value, '.')
+	if dot < 0 {
+		return nil, errCookieMalformed
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(c.Value[:dot])
+	if err != nil {
+		return nil, errCookieMalformed
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(c.Value[dot+1:])
+	if err != nil {
+		return nil, errCookieMalformed
+	}
+	if !hmac.Equal(sig, cookieSignature(name, c.Value[:dot], key)) {
+		return nil, errCookieTampered
+	}
+	return payload, nil
+}
+
+/*
+ * SetSignedCookie adds a Set-Cookie header for cookie "name" with
+ * "payload," signed with "key." The other attributes, such as Path and
+ * Secure, come from "opts," whose Name and Value are ignored.
+ */
+func (h *httpResponse) SetSignedCookie(name string, payload []byte, key []byte, opts http.Cookie) error {
+	if len(key) == 0 {
+		return errNoSigningKey
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	c := opts
+	c.Name = name
+	c.Value = encoded + "." +
+		base64.RawURLEncoding.EncodeToString(cookieSignature(name, encoded, key))
+	if err := c.Valid(); err != nil {
+		return fmt.Errorf("Invalid cookie: %v", err)
+	}
+	h.Header().Add("Set-Cookie", c.String())
+	return nil
+}
+
+func cookieSignature(name, encodedPayload string, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(name))
+	mac.Write([]byte{'='})
+	mac.Write([]byte(encodedPayload))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Signed cookies", func() {
+	key := []byte("a very secret key")
+
+	// Make a writer for a request that sends "cookie," if it isn't empty.
+	writerFor := func(cookie string) *httpResponse {
+		req, err := http.NewRequest("GET", "http://localhost:1234/", nil)
+		Expect(err).Should(Succeed())
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		return &httpResponse{handler: &request{req: req}}
+	}
+
+	// Sign "payload" and return the name=value pair that a client sends back.
+	sign := func(name string, payload []byte) string {
+		h := writerFor("")
+		Expect(h.SetSignedCookie(name, payload, key, http.Cookie{
+			Path:     "/",
+			HttpOnly: true,
+		})).Should(Succeed())
+		set := h.Header().Get("Set-Cookie")
+		Expect(set).Should(ContainSubstring("Path=/"))
+		Expect(set).Should(ContainSubstring("HttpOnly"))
+		return strings.SplitN(set, ";", 2)[0]
+	}
+
+	It("Round trip", func() {
+		payload := []byte(`{"user":"alice","roles":["admin"]}`)
+		cookie := sign("session", payload)
+		got, err := writerFor("other=1; "+cookie).VerifiedCookie("session", key)
+		Expect(err).Should(Succeed())
+		Expect(got).Should(Equal(payload))
+	})
+
+	It("Empty payload", func() {
+		got, err := writerFor(sign("session", nil)).VerifiedCookie("session", key)
+		Expect(err).Should(Succeed())
+		Expect(got).Should(BeEmpty())
+	})
+
+	It("Tampered", func() {
+		cookie := sign("session", []byte("user=alice"))
+		sig := cookie[strings.LastIndex(cookie, "."):]
+		forged := "session=" + base64.RawURLEncoding.EncodeToString([]byte("user=admin")) + sig
+		_, err := writerFor(forged).VerifiedCookie("session", key)
+		Expect(err).Should(Equal(errCookieTampered))
+
+		_, err = writerFor(cookie).VerifiedCookie("session", []byte("another key"))
+		Expect(err).Should(Equal(errCookieTampered))
+	})
+
+	It("Renamed", func() {
+		cookie := sign("session", []byte("user=alice"))
+		renamed := "admin" + strings.TrimPrefix(cookie, "session")
+		_, err := writerFor(renamed).VerifiedCookie("admin", key)
+		Expect(err).Should(Equal(errCookieTampered))
+	})
+
+	It("Missing and malformed", func() {
+		_, err := writerFor("").VerifiedCookie("session", key)
+		Expect(err).Should(Equal(http.ErrNoCookie))
+		_, err = writerFor("session=plain").VerifiedCookie("session", key)
+		Expect(err).Should(Equal(errCookieMalformed))
+		_, err = writerFor("session=!!!.abc").VerifiedCookie("session", key)
+		Expect(err).Should(Equal(errCookieMalformed))
+	})
+
+	It("Invalid", func() {
+		h := writerFor("")
+		Expect(h.SetSignedCookie("session", []byte("x"), nil, http.Cookie{})).Should(Equal(errNoSigningKey))
+		Expect(h.SetSignedCookie("bad name", []byte("x"), key, http.Cookie{})).ShouldNot(Succeed())
+		_, err := h.VerifiedCookie("session", nil)
+		Expect(err).Should(Equal(errNoSigningKey))
+	})
+})
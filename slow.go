@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"time"
+	"unsafe"
+)
+
+/*
+typedef void (*slowRequestHandler)(unsigned int id, unsigned int elapsedMs);
+
+static void callSlowRequestHandler(void* fn, unsigned int id, unsigned int elapsedMs) {
+	((slowRequestHandler)fn)(id, elapsedMs);
+}
+*/
+import "C"
+
+/*
+ * Slow request detection. When a threshold is set, each request starts a
+ * timer when it begins. If the request is still active when the timer
+ * fires, we log it and call the handler. The timer is stopped when the
+ * request is freed.
+ */
+
+type slowRequestHandler func(id, elapsedMs uint32)
+
+func setSlowRequestThreshold(threshold time.Duration, handler slowRequestHandler) {
+	updateSettings(func(s *settings) {
+		s.slowThreshold = threshold
+		s.slowHandler = handler
+	})
+}
+
+/*
+ * Wrap a C function pointer so that we can call it like a Go function.
+ */
+func cSlowRequestHandler(fn unsafe.Pointer) slowRequestHandler {
+	if fn == nil {
+		return nil
+	}
+	return func(id, elapsedMs uint32) {
+		C.callSlowRequestHandler(fn, C.uint(id), C.uint(elapsedMs))
+	}
+}
+
+func (r *request) startSlowTimer() {
+	if r.settings.slowThreshold <= 0 {
+		return
+	}
+	r.slowTimer = time.AfterFunc(r.settings.slowThreshold, r.reportSlow)
+}
+
+/*
+ * Return false if the timer may have fired, in which case it may still be
+ * looking at the request.
+ */
+func (r *request) stopSlowTimer() bool {
+	return r.slowTimer == nil || r.slowTimer.Stop()
+}
+
+func (r *request) reportSlow() {
+	if getRequest(r.id) != r {
+		// Already freed
+		return
+	}
+	state := r.getState()
+	if state == stateDone {
+		return
+	}
+
+	elapsed := r.age()
+	method, uri := r.getTarget()
+	log.Printf("Slow request %d: %s %s has been running for %s (state %s)",
+		r.id, method, uri, elapsed, state)
+	if r.settings.slowHandler != nil {
+		r.settings.slowHandler(r.id, uint32(elapsed/time.Millisecond))
+	}
+}
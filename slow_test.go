@@ -0,0 +1,59 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type slowReport struct {
+	id        uint32
+	elapsedMs uint32
+}
+
+var _ = Describe("Slow Requests", func() {
+	var id uint32
+	var reports chan slowReport
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		reports = make(chan slowReport, 10)
+		setSlowRequestThreshold(50*time.Millisecond, func(id, elapsedMs uint32) {
+			reports <- slowReport{id: id, elapsedMs: elapsedMs}
+		})
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		resetSettings()
+	})
+
+	It("Slow request", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/slowpass", "", 0))
+		Expect(err).Should(Succeed())
+
+		var report slowReport
+		Eventually(reports).Should(Receive(&report))
+		Expect(report.id).Should(Equal(id))
+		Expect(report.elapsedMs).Should(BeNumerically(">=", 50))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Fast request", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/return201", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(MatchRegexp("^SWCH.*"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Consistently(reports, 100*time.Millisecond).ShouldNot(Receive())
+	})
+
+	It("Freed request", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		freeRequest(id)
+		Consistently(reports, 100*time.Millisecond).ShouldNot(Receive())
+	})
+})
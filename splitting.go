@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+/*
+ * Handlers often copy something from the request into a response header,
+ * like a redirect target or a request ID. If that value came from a decoded
+ * "%0d%0a," it could end the header and start a new one, or even a new
+ * response. serializeHeaders never lets a newline through, but it can only
+ * turn it into a space. Handlers should use setReflectedHeader for values
+ * like these. Optionally, any response with a newline in a header is turned
+ * into a 500 instead, so that someone notices.
+ */
+
+const splitResponseMessage = "Internal server error"
+
+func setRejectSplitHeaders(reject bool) {
+	updateSettings(func(s *settings) {
+		s.rejectSplitHeaders = reject
+	})
+}
+
+/*
+ * Set a header to a value that came from the request. Control characters,
+ * including CR and LF, are percent-encoded so that they can't change the
+ * meaning of the response.
+ */
+func setReflectedHeader(h http.Header, name, value string) {
+	h.Set(name, escapeControls(value))
+}
+
+func escapeControls(value string) string {
+	buf := &bytes.Buffer{}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if (c < 0x20 && c != '\t') || c == 0x7f {
+			fmt.Fprintf(buf, "%%%02X", c)
+		} else {
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
+
+/*
+ * Return the name of the first header with a CR or LF in its name or value,
+ * or an empty string.
+ */
+func findSplitHeader(h http.Header) string {
+	for name, values := range h {
+		if strings.ContainsAny(name, "\r\n") {
+			return name
+		}
+		for _, v := range values {
+			if strings.ContainsAny(v, "\r\n") {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+/*
+ * Return true if the headers would have split the response, and such
+ * responses are rejected. The attempt is logged and counted.
+ */
+func checkSplitHeaders(r *request, status int, h http.Header) bool {
+	if !r.settings.rejectSplitHeaders {
+		return false
+	}
+	name := findSplitHeader(h)
+	if name == "" {
+		return false
+	}
+	log.Printf("Security: request %d: %s %s: header %q in %d response contains a newline",
+		r.id, r.req.Method, r.req.RequestURI, name, status)
+	updateStats(func(s *stats) {
+		s.SplitResponses++
+	})
+	return true
+}
+
+func splitResponseHeaders() http.Header {
+	hdrs := http.Header{}
+	hdrs.Set("Content-Type", "text/plain")
+	return hdrs
+}
+
+/*
+ * Replace the response from the target with a 500.
+ */
+func (r *response) failSplit() {
+	r.split = true
+	r.resp.StatusCode = http.StatusInternalServerError
+	r.resp.Header = splitResponseHeaders()
+	r.resp.Body = ioutil.NopCloser(bytes.NewBufferString(splitResponseMessage))
+}
+
+/*
+ * Send the body of the 500, and return true, if the response was replaced.
+ */
+func (r *response) flushSplitBody() bool {
+	if !r.split {
+		return false
+	}
+	sendBodyChunk(r, []byte(splitResponseMessage))
+	return true
+}
+
+/*
+ * Check the headers that a handler wrote, and if they must be replaced,
+ * return the new status.
+ */
+func (h *httpResponse) checkSplit(status int) int {
+	r := h.owner()
+	if h.headers == nil || r == nil || !checkSplitHeaders(r, status, *h.headers) {
+		return status
+	}
+	h.split = true
+	hdrs := splitResponseHeaders()
+	h.headers = &hdrs
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const splitPayload = "%0d%0aSet-Cookie:%20session=stolen%0d%0a%0d%0a<html>owned</html>"
+
+var _ = Describe("Response Splitting", func() {
+	var conn *testConn
+	var logged *bytes.Buffer
+
+	BeforeEach(func() {
+		conn = newTestConn(testHandler)
+		logged = &bytes.Buffer{}
+		log.SetOutput(logged)
+	})
+
+	AfterEach(func() {
+		conn.free()
+		resetSettings()
+		log.SetOutput(os.Stderr)
+	})
+
+	exchange := func(path string) *testExchange {
+		return conn.proxy(makeRequestHeaders("GET", path, "", 0), nil,
+			http.StatusOK, makeResponseHeaders("text/plain", 5), []byte("Hello"))
+	}
+
+	It("Escape", func() {
+		Expect(escapeControls("/next\r\nSet-Cookie: x=1")).Should(Equal("/next%0D%0ASet-Cookie: x=1"))
+		Expect(escapeControls("a\tb\x00c\x7f")).Should(Equal("a\tb%00c%7F"))
+		Expect(escapeControls("/plain?x=%0d")).Should(Equal("/plain?x=%0d"))
+	})
+
+	It("Serialize", func() {
+		h := http.Header{}
+		h.Set("Location", "/next\r\nSet-Cookie: x=1")
+		Expect(serializeHeaders(h)).Should(Equal("Location: /next  Set-Cookie: x=1\n"))
+	})
+
+	It("Short circuit", func() {
+		x := exchange("/reflectredirect?to=/next" + splitPayload)
+		Expect(x.err).Should(BeEmpty())
+		Expect(x.status).Should(Equal(http.StatusFound))
+		Expect(x.headers).ShouldNot(HaveKey("Set-Cookie"))
+		Expect(x.headers.Get("Location")).Should(HavePrefix("/next  Set-Cookie"))
+	})
+
+	It("Short circuit safe", func() {
+		setRejectSplitHeaders(true)
+		x := exchange("/reflectsafe?to=/next" + splitPayload)
+		Expect(x.status).Should(Equal(http.StatusFound))
+		Expect(x.headers.Get("Location")).Should(Equal(
+			"/next%0D%0ASet-Cookie: session=stolen%0D%0A%0D%0A<html>owned</html>"))
+		Expect(logged.Len()).Should(BeZero())
+	})
+
+	It("Short circuit strict", func() {
+		setRejectSplitHeaders(true)
+		before := getStats().SplitResponses
+		x := exchange("/reflectredirect?to=/next" + splitPayload)
+		Expect(x.err).Should(BeEmpty())
+		Expect(x.switched).Should(BeTrue())
+		Expect(x.status).Should(Equal(http.StatusInternalServerError))
+		Expect(x.headers).Should(Equal(http.Header{"Content-Type": {"text/plain"}}))
+		Expect(string(x.body)).Should(Equal(splitResponseMessage))
+		Expect(getStats().SplitResponses).Should(Equal(before + 1))
+		Expect(logged.String()).Should(ContainSubstring("Security"))
+		Expect(logged.String()).Should(ContainSubstring("Location"))
+	})
+
+	It("Filter", func() {
+		x := exchange("/reflectresponse?id=abc" + splitPayload)
+		Expect(x.err).Should(BeEmpty())
+		Expect(x.status).Should(Equal(http.StatusOK))
+		Expect(x.headers).ShouldNot(HaveKey("Set-Cookie"))
+		Expect(x.headers.Get("X-Request-Id")).Should(HavePrefix("abc "))
+		Expect(string(x.body)).Should(Equal("Hello"))
+	})
+
+	It("Filter strict", func() {
+		setRejectSplitHeaders(true)
+		before := getStats().SplitResponses
+		x := exchange("/reflectresponse?id=abc" + splitPayload)
+		Expect(x.err).Should(BeEmpty())
+		Expect(x.switched).Should(BeFalse())
+		Expect(x.status).Should(Equal(http.StatusInternalServerError))
+		Expect(x.headers).Should(Equal(http.Header{"Content-Type": {"text/plain"}}))
+		Expect(string(x.body)).Should(Equal(splitResponseMessage))
+		Expect(getStats().SplitResponses).Should(Equal(before + 1))
+		Expect(logged.String()).Should(ContainSubstring("X-Request-Id"))
+	})
+
+	It("Filter strict clean", func() {
+		setRejectSplitHeaders(true)
+		x := exchange("/reflectresponse?id=abc")
+		Expect(x.status).Should(Equal(http.StatusOK))
+		Expect(x.headers.Get("X-Request-Id")).Should(Equal("abc"))
+		Expect(string(x.body)).Should(Equal("Hello"))
+		Expect(logged.Len()).Should(BeZero())
+	})
+})
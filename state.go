@@ -0,0 +1,70 @@
+package main
+
+import (
+	"time"
+)
+
+/*
+ * Where a request is in its lifecycle. This is used for diagnostics, so
+ * it is updated and read under the request's own lock rather than the
+ * manager's.
+ */
+type requestState int32
+
+const (
+	stateNew requestState = iota
+	stateRequest
+	stateProxying
+	stateResponse
+	stateDone
+)
+
+var stateNames = []string{"new", "request", "proxying", "response", "done"}
+
+func (s requestState) String() string {
+	return stateNames[s]
+}
+
+/*
+ * Move the request along. The request and response run in different
+ * goroutines and may overlap, so the state never goes backwards.
+ */
+func (r *request) setState(s requestState) {
+	r.stateLock.Lock()
+	if s > r.state {
+		r.state = s
+	}
+	r.stateLock.Unlock()
+}
+
+func (r *request) getState() requestState {
+	r.stateLock.Lock()
+	defer r.stateLock.Unlock()
+	return r.state
+}
+
+/*
+ * Remember what the request was for so that we can describe it later
+ * from another goroutine.
+ */
+func (r *request) setTarget(method, uri string) {
+	r.stateLock.Lock()
+	r.method = method
+	r.uri = uri
+	r.stateLock.Unlock()
+}
+
+func (r *request) getTarget() (string, string) {
+	r.stateLock.Lock()
+	defer r.stateLock.Unlock()
+	return r.method, r.uri
+}
+
+func (r *request) age() time.Duration {
+	r.stateLock.Lock()
+	defer r.stateLock.Unlock()
+	if r.started.IsZero() {
+		return 0
+	}
+	return time.Since(r.started)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+/*
+ * Global counters that describe what has happened since the library was
+ * loaded. They are returned as a JSON object by GoGetStats.
+ */
+
+type stats struct {
+	Requests          int64 `json:"requests"`
+	Errors            int64 `json:"errors"`
+	HostMismatches    int64 `json:"hostMismatches"`
+	QueuedRequests    int64 `json:"queuedRequests"`
+	QueueRejections   int64 `json:"queueRejections"`
+	QueueWaitMillis   int64 `json:"queueWaitMillis"`
+	NegativeCacheHits int64 `json:"negativeCacheHits"`
+	SplitResponses    int64 `json:"splitResponses"`
+	HedgedRequests    int64 `json:"hedgedRequests"`
+	HedgeWins         int64 `json:"hedgeWins"`
+	DroppedHeaders    int64 `json:"droppedHeaders"`
+	ShortResponses    int64 `json:"shortResponses"`
+	LongResponses     int64 `json:"longResponses"`
+	DiscardedBytes    int64 `json:"discardedBytes"`
+	// The total size of the bodies that were compressed, before and after
+	CacheBytesBeforeCompression int64 `json:"cacheBytesBeforeCompression"`
+	CacheBytesAfterCompression  int64 `json:"cacheBytesAfterCompression"`
+	// The bodies that were minified, and their total size before and after
+	MinifiedResponses int64 `json:"minifiedResponses"`
+	MinifyBytesIn     int64 `json:"minifyBytesIn"`
+	MinifyBytesOut    int64 `json:"minifyBytesOut"`
+	// The images that were recompressed, and their total size before and after
+	OptimizedImages int64 `json:"optimizedImages"`
+	ImageBytesIn    int64 `json:"imageBytesIn"`
+	ImageBytesOut   int64 `json:"imageBytesOut"`
+	// The responses that were relayed in transparent mode, and their size
+	TransparentResponses int64 `json:"transparentResponses"`
+	TransparentBytes     int64 `json:"transparentBytes"`
+	// Requests to upstreams waiting for a slot under a concurrency limit
+	UpstreamQueued          int64 `json:"upstreamQueued"`
+	UpstreamQueueTimeouts   int64 `json:"upstreamQueueTimeouts"`
+	UpstreamQueueWaitMillis int64 `json:"upstreamQueueWaitMillis"`
+	// Requests that were forwarded after a handler had already responded
+	BackgroundForwards        int64 `json:"backgroundForwards"`
+	BackgroundForwardFailures int64 `json:"backgroundForwardFailures"`
+	// Memory pressure signals above none, and what the reclaimers freed
+	MemoryPressureSignals int64 `json:"memoryPressureSignals"`
+	ReclaimedBytes        int64 `json:"reclaimedBytes"`
+	// Handler settings that came after the point where they could apply
+	LateRegistrations int64 `json:"lateRegistrations"`
+}
+
+var currentStats = stats{}
+var statsLock = sync.Mutex{}
+
+func updateStats(update func(s *stats)) {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	update(&currentStats)
+}
+
+/*
+ * Count a request or response that ended with an error command.
+ */
+func countError() {
+	updateStats(func(s *stats) {
+		s.Errors++
+	})
+}
+
+func getStats() stats {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	return currentStats
+}
+
+func getStatsJSON() string {
+	s := getStats()
+	buf, err := json.Marshal(&s)
+	if err != nil {
+		return "{}"
+	}
+	return string(buf)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Response headers may start with an HTTP status line, such as
+ * "HTTP/1.1 404 Not Found," so that the status and the headers travel
+ * together. Weaver always accepts one in GoBeginResponse, where it wins over
+ * the status argument. It only sends one in WHDR if the caller asks for it,
+ * and in that case the status is never sent using WSTA.
+ */
+
+var statusLineRe = regexp.MustCompile(`^HTTP/([0-9])\.([0-9]) ([0-9]{3})(?: (.*))?$`)
+
+func setStatusInHeaders(enabled bool) {
+	updateSettings(func(s *settings) {
+		s.statusInHeaders = enabled
+	})
+}
+
+/*
+ * If the raw headers start with a status line, apply it to the response and
+ * return the rest of the headers.
+ */
+func parseStatusLine(resp *http.Response, rawHeaders string) (string, error) {
+	if !strings.HasPrefix(rawHeaders, "HTTP/") {
+		return rawHeaders, nil
+	}
+	line := rawHeaders
+	rest := ""
+	if i := strings.Index(rawHeaders, "\n"); i >= 0 {
+		line = rawHeaders[:i]
+		rest = rawHeaders[i+1:]
+	}
+	line = strings.TrimRight(line, "\r")
+
+	matches := statusLineRe.FindStringSubmatch(line)
+	if matches == nil {
+		return "", fmt.Errorf("Invalid HTTP status line: \"%s\"", line)
+	}
+	resp.ProtoMajor, _ = strconv.Atoi(matches[1])
+	resp.ProtoMinor, _ = strconv.Atoi(matches[2])
+	resp.Proto = fmt.Sprintf("HTTP/%d.%d", resp.ProtoMajor, resp.ProtoMinor)
+	resp.StatusCode, _ = strconv.Atoi(matches[3])
+	resp.Status = http.StatusText(resp.StatusCode)
+	return rest, nil
+}
+
+func formatStatusLine(status int) string {
+	return fmt.Sprintf("HTTP/1.1 %d %s\n", status, http.StatusText(status))
+}
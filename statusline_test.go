@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Status Line", func() {
+	var id uint32
+	var rid uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		rid = createResponse(testHandler)
+		Expect(rid).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		freeResponse(rid)
+		resetSettings()
+	})
+
+	begin := func(path string, status uint32, rawHeaders string) {
+		err := beginRequest(id, makeRequestHeaders("GET", path, "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		err = beginResponse(rid, id, status, rawHeaders)
+		Expect(err).Should(Succeed())
+	}
+
+	It("Parse", func() {
+		resp, err := parseHTTPResponse(200, "HTTP/1.0 404 Not Found\nServer: test\n")
+		Expect(err).Should(Succeed())
+		Expect(resp.StatusCode).Should(Equal(404))
+		Expect(resp.Proto).Should(Equal("HTTP/1.0"))
+		Expect(resp.Header.Get("Server")).Should(Equal("test"))
+
+		resp, err = parseHTTPResponse(200, "HTTP/1.1 204\n")
+		Expect(err).Should(Succeed())
+		Expect(resp.StatusCode).Should(Equal(204))
+
+		resp, err = parseHTTPResponse(201, "Server: test\n")
+		Expect(err).Should(Succeed())
+		Expect(resp.StatusCode).Should(Equal(201))
+
+		_, err = parseHTTPResponse(200, "HTTP/1.1 OK\n")
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("Old format", func() {
+		begin("/notfoundok", 404, makeResponseHeaders("", 0))
+		Expect(pollResponse(rid, true)).Should(Equal("WSTA200"))
+		cmd := pollResponse(rid, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("X-Original-Status")).Should(Equal("404"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Status line in", func() {
+		begin("/notfoundok", 200, "HTTP/1.1 404 Not Found\n"+makeResponseHeaders("", 0))
+		Expect(pollResponse(rid, true)).Should(Equal("WSTA200"))
+		Expect(pollResponse(rid, true)).Should(MatchRegexp("^WHDR.*"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Status line out", func() {
+		setStatusInHeaders(true)
+		begin("/notfoundok", 200, "HTTP/1.1 404 Not Found\n"+makeResponseHeaders("", 0))
+		cmd := pollResponse(rid, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		lines := strings.Split(cmd[4:], "\n")
+		Expect(lines[0]).Should(Equal("HTTP/1.1 200 OK"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("X-Original-Status")).Should(Equal("404"))
+		Expect(hdrs.Get("Server")).Should(Equal("Some test thing"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Status only", func() {
+		setStatusInHeaders(true)
+		begin("/responseerror", 200, makeResponseHeaders("", 0))
+		cmd := pollResponse(rid, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		Expect(cmd[4:]).Should(HavePrefix("HTTP/1.1 500 Internal Server Error\n"))
+		Expect(readBodyData(pollResponse(rid, true))).Should(Equal([]byte("Error in the server!")))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Unchanged", func() {
+		setStatusInHeaders(true)
+		begin("/notfoundok", 500, makeResponseHeaders("", 0))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+})
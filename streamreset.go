@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+)
+
+/*
+ * On HTTP/2, a client that gives up on a request sends RST_STREAM for its
+ * stream, and the other streams on the connection carry on. The caller
+ * passes that on with GoResetStream, which cancels the context of that one
+ * request, just as net/http does when a client disconnects, so handlers
+ * that watch req.Context() can stop early. The request body is abandoned,
+ * so a handler reading it gets an error instead of waiting forever. The
+ * caller must still free the request as usual.
+ */
+
+func resetStream(id uint32) error {
+	req := getRequest(id)
+	if req == nil {
+		return fmt.Errorf("Unknown request: %d", id)
+	}
+	req.cancel()
+	req.discardBody()
+	return nil
+}
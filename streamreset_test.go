@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Stream reset", func() {
+	It("Cancels only that request", func() {
+		waiting := createRequest(testHandler)
+		defer freeRequest(waiting)
+		other := createRequest(testHandler)
+		defer freeRequest(other)
+		Expect(beginRequest(waiting, makeRequestHeaders("GET", "/waitcancel", "", 0))).Should(Succeed())
+		Expect(beginRequest(other, makeRequestHeaders("GET", "/waitcancel", "", 0))).Should(Succeed())
+		Eventually(func() bool {
+			return getRequest(waiting).getState() == stateRequest &&
+				getRequest(other).getState() == stateRequest
+		}).Should(BeTrue())
+
+		Expect(resetStream(waiting)).Should(Succeed())
+		Expect(pollRequest(waiting, true)).Should(Equal("SWCH499"))
+		Expect(getRequest(other).ctx.Err()).Should(BeNil())
+		Consistently(func() string {
+			return pollRequest(other, false)
+		}, 50*time.Millisecond).Should(BeEmpty())
+
+		Expect(resetStream(other)).Should(Succeed())
+		Expect(pollRequest(other, true)).Should(Equal("SWCH499"))
+		Expect(getRequest(waiting).ctx.Err()).Should(Equal(context.Canceled))
+	})
+
+	It("Abandons the body", func() {
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		Expect(beginRequest(id, makeRequestHeaders("POST", "/readbody", "text/plain", 100))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("RBOD"))
+		Expect(resetStream(id)).Should(Succeed())
+		// The handler's read fails, so the request doesn't hang.
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Unknown request", func() {
+		Expect(resetStream(0)).ShouldNot(Succeed())
+	})
+})
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Parsers for the headers that handlers most often need to pick apart:
+ * Cache-Control, Link, and Set-Cookie, which uses http.Cookie. Values may
+ * be quoted strings with commas and semicolons in them, which is where
+ * hand-written parsers usually go wrong. Anything that isn't changed is
+ * written back exactly as it came, including directives and parameters
+ * that weaver doesn't know about. Handlers can't name the types here, so
+ * they use the methods below, which take and return plain values. They
+ * find them using a type assertion on the http.ResponseWriter.
+ */
+
+var errNoMessage = errors.New("The handler has no message whose headers it can change")
+
+/*
+ * Return the headers that the handler works on: those of the request that
+ * goes to the target, for a request handler, or of the response that goes
+ * to the client, for a response handler.
+ */
+func (h *httpResponse) messageHeader() http.Header {
+	switch handler := h.handler.(type) {
+	case *request:
+		return handler.req.Header
+	case *response:
+		return handler.resp.Header
+	}
+	return nil
+}
+
+/*
+ * Run "change" on the handler's headers, unless the handler has returned.
+ */
+func (h *httpResponse) changeHeader(what string, change func(http.Header)) error {
+	hdrs := h.messageHeader()
+	phase := h.phase()
+	if hdrs == nil || phase == nil {
+		return errNoMessage
+	}
+	if !phase.whileOpen(func() { change(hdrs) }) {
+		return tooLate(h.owner(), what)
+	}
+	return nil
+}
+
+/*
+ * CacheDirective returns the unquoted value of Cache-Control directive
+ * "name," in any case, and whether it is there.
+ */
+func (h *httpResponse) CacheDirective(name string) (string, bool) {
+	return ParseCacheControl(h.messageHeader()).Get(name)
+}
+
+/*
+ * SetCacheDirective sets Cache-Control directive "name" to "value," which
+ * may be empty, and quotes the value if it has to. The other directives are
+ * sent as they were.
+ */
+func (h *httpResponse) SetCacheDirective(name, value string) error {
+	return h.changeHeader("SetCacheDirective", func(hdrs http.Header) {
+		cc := ParseCacheControl(hdrs)
+		cc.Set(name, value)
+		cc.Apply(hdrs)
+	})
+}
+
+/*
+ * DelCacheDirective removes Cache-Control directive "name."
+ */
+func (h *httpResponse) DelCacheDirective(name string) error {
+	return h.changeHeader("DelCacheDirective", func(hdrs http.Header) {
+		cc := ParseCacheControl(hdrs)
+		cc.Del(name)
+		cc.Apply(hdrs)
+	})
+}
+
+/*
+ * Links returns the URLs of the links in the Link headers whose "rel"
+ * includes "rel," in order, or of every link if "rel" is empty.
+ */
+func (h *httpResponse) Links(rel string) []string {
+	var urls []string
+	for _, l := range ParseLinks(h.messageHeader()) {
+		if rel == "" || l.hasRel(rel) {
+			urls = append(urls, l.URL)
+		}
+	}
+	return urls
+}
+
+/*
+ * AddLink adds a Link header for "url" with the relation "rel," after any
+ * that are already there.
+ */
+func (h *httpResponse) AddLink(url, rel string) error {
+	link := Link{URL: url, Params: []LinkParam{{Name: "rel", Value: rel}}}
+	return h.changeHeader("AddLink", func(hdrs http.Header) {
+		hdrs.Add("Link", FormatLinks([]Link{link}))
+	})
+}
+
+/*
+ * CacheControl is a parsed Cache-Control header.
+ */
+type CacheControl struct {
+	Directives []CacheDirective
+}
+
+/*
+ * CacheDirective is one directive, such as max-age=60. Value is unquoted,
+ * and empty for a directive without one.
+ */
+type CacheDirective struct {
+	Name  string
+	Value string
+	// The directive as it was sent, which is written back if it is unchanged
+	raw string
+}
+
+/*
+ * ParseCacheControl parses every Cache-Control header in "h."
+ */
+func ParseCacheControl(h http.Header) CacheControl {
+	var cc CacheControl
+	for _, value := range h["Cache-Control"] {
+		for _, d := range splitHeaderList(value, ',') {
+			name, val, _ := splitHeaderParam(d)
+			if name != "" {
+				cc.Directives = append(cc.Directives, CacheDirective{Name: name, Value: val, raw: d})
+			}
+		}
+	}
+	return cc
+}
+
+func (cc *CacheControl) find(name string) int {
+	for i, d := range cc.Directives {
+		if strings.EqualFold(d.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+ * Has returns true if directive "name" is there, in any case.
+ */
+func (cc CacheControl) Has(name string) bool {
+	return cc.find(name) >= 0
+}
+
+/*
+ * Get returns the value of directive "name," and whether it is there.
+ */
+func (cc CacheControl) Get(name string) (string, bool) {
+	if i := cc.find(name); i >= 0 {
+		return cc.Directives[i].Value, true
+	}
+	return "", false
+}
+
+/*
+ * Seconds returns the value of a directive such as max-age as a duration,
+ * and false if it is missing or isn't a number of seconds.
+ */
+func (cc CacheControl) Seconds(name string) (time.Duration, bool) {
+	v, ok := cc.Get(name)
+	if !ok {
+		return 0, false
+	}
+	secs, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(secs) * time.Second, true
+}
+
+/*
+ * Set sets directive "name" to "value," which may be empty, replacing it
+ * where it is or adding it at the end.
+ */
+func (cc *CacheControl) Set(name, value string) {
+	d := CacheDirective{Name: name, Value: value}
+	if i := cc.find(name); i >= 0 {
+		cc.Directives[i] = d
+	} else {
+		cc.Directives = append(cc.Directives, d)
+	}
+}
+
+/*
+ * Del removes directive "name."
+ */
+func (cc *CacheControl) Del(name string) {
+	kept := cc.Directives[:0]
+	for _, d := range cc.Directives {
+		if !strings.EqualFold(d.Name, name) {
+			kept = append(kept, d)
+		}
+	}
+	cc.Directives = kept
+}
+
+func (cc CacheControl) String() string {
+	parts := make([]string, len(cc.Directives))
+	for i, d := range cc.Directives {
+		if d.raw != "" {
+			parts[i] = d.raw
+		} else {
+			parts[i] = formatHeaderParam(d.Name, d.Value, false)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+/*
+ * Apply replaces the Cache-Control header in "h," or removes it if there
+ * are no directives.
+ */
+func (cc CacheControl) Apply(h http.Header) {
+	if len(cc.Directives) == 0 {
+		h.Del("Cache-Control")
+	} else {
+		h.Set("Cache-Control", cc.String())
+	}
+}
+
+/*
+ * How long a shared cache may keep a response that it would otherwise keep
+ * for "ttl," or zero if it may not keep it at all.
+ */
+func (cc CacheControl) sharedFreshness(ttl time.Duration) time.Duration {
+	if cc.Has("no-store") || cc.Has("no-cache") || cc.Has("private") {
+		return 0
+	}
+	age, ok := cc.Seconds("s-maxage")
+	if !ok {
+		age, ok = cc.Seconds("max-age")
+	}
+	if ok && age < ttl {
+		return age
+	}
+	return ttl
+}
+
+/*
+ * Link is one link from a Link header.
+ */
+type Link struct {
+	URL    string
+	Params []LinkParam
+}
+
+/*
+ * LinkParam is a parameter of a link, such as rel="next." Value is
+ * unquoted, and Quoted says whether it was sent in quotes.
+ */
+type LinkParam struct {
+	Name   string
+	Value  string
+	Quoted bool
+}
+
+/*
+ * Get returns the value of parameter "name," in any case, or "".
+ */
+func (l Link) Get(name string) string {
+	for _, p := range l.Params {
+		if strings.EqualFold(p.Name, name) {
+			return p.Value
+		}
+	}
+	return ""
+}
+
+/*
+ * Return true if "rel" is one of the link's space-separated relations.
+ */
+func (l Link) hasRel(rel string) bool {
+	for _, r := range strings.Fields(l.Get("rel")) {
+		if strings.EqualFold(r, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * ParseLinks parses every Link header in "h," in order. Links without a
+ * URL in angle brackets are skipped.
+ */
+func ParseLinks(h http.Header) []Link {
+	var links []Link
+	for _, value := range h["Link"] {
+		for _, entry := range splitHeaderList(value, ',') {
+			if !strings.HasPrefix(entry, "<") {
+				continue
+			}
+			end := strings.IndexByte(entry, '>')
+			if end < 0 {
+				continue
+			}
+			link := Link{URL: entry[1:end]}
+			for _, p := range splitHeaderList(entry[end+1:], ';') {
+				name, val, quoted := splitHeaderParam(p)
+				if name != "" {
+					link.Params = append(link.Params, LinkParam{Name: name, Value: val, Quoted: quoted})
+				}
+			}
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+/*
+ * FormatLinks returns the value of a Link header with all of "links."
+ */
+func FormatLinks(links []Link) string {
+	parts := make([]string, len(links))
+	for i, l := range links {
+		buf := &strings.Builder{}
+		buf.WriteString("<" + l.URL + ">")
+		for _, p := range l.Params {
+			buf.WriteString("; ")
+			buf.WriteString(formatHeaderParam(p.Name, p.Value, p.Quoted))
+		}
+		parts[i] = buf.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+/*
+ * ParseSetCookies parses every Set-Cookie header in "h." Those that can't
+ * be parsed are skipped.
+ */
+func ParseSetCookies(h http.Header) []*http.Cookie {
+	var cookies []*http.Cookie
+	for _, value := range h["Set-Cookie"] {
+		if c := parseSetCookie(value); c != nil {
+			cookies = append(cookies, c)
+		}
+	}
+	return cookies
+}
+
+/*
+ * FormatSetCookie returns the value of a Set-Cookie header for "c." Unlike
+ * c.String, it keeps the attributes that http.Cookie doesn't know about.
+ */
+func FormatSetCookie(c *http.Cookie) string {
+	s := c.String()
+	if s != "" && len(c.Unparsed) > 0 {
+		s += "; " + strings.Join(c.Unparsed, "; ")
+	}
+	return s
+}
+
+/*
+ * Split "s" at each "sep" that isn't inside quotes or angle brackets, and
+ * trim the pieces. Empty pieces are dropped.
+ */
+func splitHeaderList(s string, sep byte) []string {
+	var parts []string
+	quoted, bracketed, escaped := false, false, false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"' && !bracketed:
+			quoted = !quoted
+		case c == '<' && !quoted:
+			bracketed = true
+		case c == '>' && !quoted:
+			bracketed = false
+		case c == sep && !quoted && !bracketed:
+			if part := strings.TrimSpace(s[start:i]); part != "" {
+				parts = append(parts, part)
+			}
+			start = i + 1
+		}
+	}
+	if part := strings.TrimSpace(s[start:]); part != "" {
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+/*
+ * Split "name=value" and unquote the value if it is quoted.
+ */
+func splitHeaderParam(p string) (string, string, bool) {
+	kv := strings.SplitN(p, "=", 2)
+	name := strings.TrimSpace(kv[0])
+	if len(kv) == 1 {
+		return name, "", false
+	}
+	val := strings.TrimSpace(kv[1])
+	if len(val) < 2 || val[0] != '"' || val[len(val)-1] != '"' {
+		return name, val, false
+	}
+	buf := &strings.Builder{}
+	for i := 1; i < len(val)-1; i++ {
+		if val[i] == '\\' && i+1 < len(val)-1 {
+			i++
+		}
+		buf.WriteByte(val[i])
+	}
+	return name, buf.String(), true
+}
+
+/*
+ * Write "name=value," quoting the value if asked to or if it has to be.
+ */
+func formatHeaderParam(name, value string, quote bool) string {
+	if value == "" && !quote {
+		return name
+	}
+	if !quote && !strings.ContainsAny(value, " \t\",;\\=()<>@:/[]?{}") {
+		return name + "=" + value
+	}
+	escaped := strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(value)
+	return name + "=\"" + escaped + "\""
+}
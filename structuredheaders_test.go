@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Structured headers", func() {
+	It("Cache-Control round trip", func() {
+		const value = `public, max-age=60, stale-while-revalidate=30, no-cache="Set-Cookie, X-Token", ext="a\"b"`
+		h := http.Header{"Cache-Control": {value}}
+		cc := ParseCacheControl(h)
+		Expect(cc.Directives).Should(HaveLen(5))
+		noCache, ok := cc.Get("No-Cache")
+		Expect(ok).Should(BeTrue())
+		Expect(noCache).Should(Equal("Set-Cookie, X-Token"))
+		ext, _ := cc.Get("ext")
+		Expect(ext).Should(Equal(`a"b`))
+		swr, ok := cc.Seconds("stale-while-revalidate")
+		Expect(ok).Should(BeTrue())
+		Expect(swr).Should(Equal(30 * time.Second))
+
+		out := http.Header{}
+		cc.Apply(out)
+		Expect(out.Get("Cache-Control")).Should(Equal(value))
+	})
+
+	It("Cache-Control changes", func() {
+		h := http.Header{"Cache-Control": {"max-age=60, Private", "x-custom=\"1, 2\""}}
+		cc := ParseCacheControl(h)
+		cc.Del("private")
+		cc.Set("max-age", "10")
+		cc.Set("no-cache", "Set-Cookie, X-Token")
+		cc.Apply(h)
+		Expect(h["Cache-Control"]).Should(Equal([]string{
+			`max-age=10, x-custom="1, 2", no-cache="Set-Cookie, X-Token"`,
+		}))
+
+		cc = CacheControl{}
+		cc.Apply(h)
+		Expect(h).ShouldNot(HaveKey("Cache-Control"))
+	})
+
+	It("Shared freshness", func() {
+		fresh := func(value string) time.Duration {
+			return ParseCacheControl(http.Header{"Cache-Control": {value}}).sharedFreshness(time.Minute)
+		}
+		Expect(fresh("")).Should(Equal(time.Minute))
+		Expect(fresh("max-age=10")).Should(Equal(10 * time.Second))
+		Expect(fresh("max-age=10, s-maxage=20")).Should(Equal(20 * time.Second))
+		Expect(fresh("max-age=3600")).Should(Equal(time.Minute))
+		Expect(fresh("no-store")).Should(BeZero())
+		Expect(fresh(`no-cache="Set-Cookie"`)).Should(BeZero())
+		Expect(fresh("private, max-age=10")).Should(BeZero())
+	})
+
+	It("Links", func() {
+		h := http.Header{"Link": {
+			`<https://example.com/style.css>; rel=preload; as=style, <https://example.com/a,b>; rel="next"`,
+			`</help>; rel="help"; title="Help; or, \"support\""; crossorigin`,
+		}}
+		links := ParseLinks(h)
+		Expect(links).Should(HaveLen(3))
+		Expect(links[0].URL).Should(Equal("https://example.com/style.css"))
+		Expect(links[0].Get("as")).Should(Equal("style"))
+		Expect(links[1].URL).Should(Equal("https://example.com/a,b"))
+		Expect(links[1].Get("REL")).Should(Equal("next"))
+		Expect(links[2].Get("title")).Should(Equal(`Help; or, "support"`))
+		Expect(links[2].Params[2]).Should(Equal(LinkParam{Name: "crossorigin"}))
+
+		Expect(FormatLinks(links)).Should(Equal(h["Link"][0] + ", " + h["Link"][1]))
+	})
+
+	It("Invalid links", func() {
+		links := ParseLinks(http.Header{"Link": {`https://nobrackets; rel=next, <https://ok>`}})
+		Expect(links).Should(Equal([]Link{{URL: "https://ok"}}))
+	})
+
+	It("Response handler", func() {
+		id := createRequest(testHandler)
+		defer freeRequest(id)
+		rid := createResponse(testHandler)
+		defer freeResponse(rid)
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/structuredheaders", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		hdrs := "Cache-Control: private, max-age=60, ext=\"a, b\"\n" +
+			"Link: </style.css>; rel=preload, </page/2>; rel=\"next last\"\n" +
+			makeResponseHeaders("text/plain", 0)
+		Expect(beginResponse(rid, id, 200, hdrs)).Should(Succeed())
+		cmd := pollResponse(rid, true)
+		Expect(cmd).Should(HavePrefix("WHDR"))
+		// Values with commas don't survive parseHeaders, so look at the lines.
+		lines := strings.Split(strings.TrimSpace(cmd[4:]), "\n")
+		Expect(lines).Should(ContainElement(`Cache-Control: max-age=60, ext="a, b", s-maxage=60`))
+		Expect(lines).Should(ContainElement(
+			`Link: </style.css>; rel=preload, </page/2>; rel="next last",</page/2>; rel=prefetch`))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("No message", func() {
+		h := &httpResponse{}
+		_, ok := h.CacheDirective("max-age")
+		Expect(ok).Should(BeFalse())
+		Expect(h.Links("")).Should(BeEmpty())
+		Expect(h.AddLink("/", "next")).Should(Equal(errNoMessage))
+	})
+
+	It("Set-Cookie keeps unknown attributes", func() {
+		h := http.Header{"Set-Cookie": {
+			"session=abc; Path=/; HttpOnly; Priority=High",
+			"=invalid",
+		}}
+		cookies := ParseSetCookies(h)
+		Expect(cookies).Should(HaveLen(1))
+		Expect(cookies[0].Name).Should(Equal("session"))
+		Expect(FormatSetCookie(cookies[0])).Should(Equal("session=abc; Path=/; HttpOnly; Priority=High"))
+	})
+})
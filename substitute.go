@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"regexp"
+	"strings"
+)
+
+/*
+ * Rewrite the text of response bodies of certain content types using
+ * regular expressions, for instance to add a script to every HTML page or
+ * to replace a domain name. A match may span chunks, so the whole body is
+ * read first, like minification, and the Content-Length is removed. The
+ * rules run in the order they were added, before anything is minified. A
+ * body that turns out to be too big to hold is sent as it is.
+ */
+
+// The biggest body that is rewritten. This is replaced by tests.
+var maxSubstitutedBody int64 = 4 * 1024 * 1024
+
+type substitution struct {
+	pattern     *regexp.Regexp
+	replacement []byte
+}
+
+/*
+ * Add a rule for "contentType." The replacement may refer to groups in the
+ * pattern using "$1" and so on. An empty pattern removes every rule for the
+ * content type.
+ */
+func setResponseSubstitution(contentType, pattern, replacement string) error {
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	var sub substitution
+	if pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		sub = substitution{pattern: re, replacement: []byte(replacement)}
+	}
+	updateSettings(func(s *settings) {
+		subs := make(map[string][]substitution)
+		for t, rules := range s.substitutions {
+			subs[t] = rules
+		}
+		if sub.pattern == nil {
+			delete(subs, contentType)
+		} else {
+			rules := make([]substitution, len(subs[contentType]), len(subs[contentType])+1)
+			copy(rules, subs[contentType])
+			subs[contentType] = append(rules, sub)
+		}
+		s.substitutions = subs
+	})
+	return nil
+}
+
+/*
+ * Decide, before the handler runs, which rules apply to the body. A body
+ * that is still compressed is left alone.
+ */
+func (r *response) findSubstitutions() []substitution {
+	subs := r.request.settings.substitutions
+	if len(subs) == 0 || r.resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(r.resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil
+	}
+	return subs[mediaType]
+}
+
+func (r *response) startSubstitution() {
+	if len(r.substitute) == 0 || r.written || r.headersSent {
+		return
+	}
+	r.resp.Header.Del("Content-Length")
+	r.resp.ContentLength = -1
+	r.resp.Body = &substitutedBody{
+		body:  r.resp.Body,
+		rules: r.substitute,
+	}
+}
+
+type substitutedBody struct {
+	body  io.ReadCloser
+	rules []substitution
+	out   io.Reader
+}
+
+func (b *substitutedBody) Read(p []byte) (int, error) {
+	if b.out == nil {
+		body, err := ioutil.ReadAll(io.LimitReader(b.body, maxSubstitutedBody+1))
+		if err != nil {
+			return 0, err
+		}
+		if int64(len(body)) > maxSubstitutedBody {
+			b.out = io.MultiReader(bytes.NewReader(body), b.body)
+			return b.out.Read(p)
+		}
+		for _, rule := range b.rules {
+			body = rule.pattern.ReplaceAll(body, rule.replacement)
+		}
+		b.out = bytes.NewReader(body)
+	}
+	return b.out.Read(p)
+}
+
+func (b *substitutedBody) Close() error {
+	return b.body.Close()
+}
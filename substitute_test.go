@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Response substitution", func() {
+	var id, rid uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		rid = createResponse(testHandler)
+		Expect(rid).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		freeResponse(rid)
+		resetSettings()
+	})
+
+	// Send the body in two chunks, and return the new headers and body.
+	run := func(contentType, body string) (http.Header, string) {
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		err = beginResponse(rid, id, 200, makeResponseHeaders(contentType, len(body)))
+		Expect(err).Should(Succeed())
+
+		hdrs := http.Header{}
+		buf := &bytes.Buffer{}
+		for cmd := pollResponse(rid, true); cmd != "DONE"; cmd = pollResponse(rid, true) {
+			switch cmd[:4] {
+			case "RBOD":
+				sendResponseBodyChunk(rid, false, []byte(body[:len(body)/2]))
+				sendResponseBodyChunk(rid, true, []byte(body[len(body)/2:]))
+			case "WHDR":
+				parseHeaders(hdrs, cmd[4:])
+			case "WBOD":
+				buf.Write(readBodyData(cmd))
+			default:
+				Fail("Unexpected command " + cmd)
+			}
+		}
+		return hdrs, buf.String()
+	}
+
+	It("Rules in order", func() {
+		Expect(setResponseSubstitution("text/html", "</body>",
+			"<script src=\"a.js\"></script></body>")).Should(Succeed())
+		Expect(setResponseSubstitution("Text/HTML", `(\w+)\.example\.com`,
+			"$1.example.org")).Should(Succeed())
+		Expect(setResponseSubstitution("text/html", "a\\.js", "b.js")).Should(Succeed())
+
+		hdrs, body := run("text/html; charset=utf-8",
+			"<body><a href=\"//www.example.com/\">x</a></body>")
+		Expect(hdrs.Get("Content-Length")).Should(BeEmpty())
+		Expect(body).Should(Equal(
+			"<body><a href=\"//www.example.org/\">x</a><script src=\"b.js\"></script></body>"))
+	})
+
+	It("Other content types", func() {
+		Expect(setResponseSubstitution("text/html", "foo", "bar")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		err = beginResponse(rid, id, 200, makeResponseHeaders("text/plain", 7))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Before minification", func() {
+		Expect(setResponseSubstitution("text/html", "X", "  Y  ")).Should(Succeed())
+		Expect(setResponseMinification("text/html", true)).Should(Succeed())
+		_, body := run("text/html", "<p>X</p>")
+		Expect(body).Should(Equal("<p> Y </p>"))
+	})
+
+	It("Too big", func() {
+		defer func(max int64) { maxSubstitutedBody = max }(maxSubstitutedBody)
+		maxSubstitutedBody = 8
+		Expect(setResponseSubstitution("text/html", "foo", "bar")).Should(Succeed())
+		_, body := run("text/html", "<p>foo and foo</p>")
+		Expect(body).Should(Equal("<p>foo and foo</p>"))
+	})
+
+	It("Remove rules", func() {
+		Expect(setResponseSubstitution("text/html", "foo", "bar")).Should(Succeed())
+		Expect(setResponseSubstitution("text/html", "", "")).Should(Succeed())
+		Expect(getSettings().substitutions).Should(BeEmpty())
+	})
+
+	It("Invalid pattern", func() {
+		Expect(setResponseSubstitution("text/html", "(", "")).ShouldNot(Succeed())
+		Expect(getSettings().substitutions).Should(BeEmpty())
+	})
+})
@@ -2,10 +2,17 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/30x/gozerian/pipeline"
@@ -54,6 +61,13 @@ func (p *TestPipe) Control() pipeline.Control {
 // help us a bit by saving test results for internal comparison
 var lastTestBody []byte
 
+// What "/inspectbody" saw, and whether it saw the end
+var lastInspectedBody []byte
+var lastInspectedEnd bool
+
+// The writers that "/late" was handled with, for calling them afterwards
+var lateWriters = make(chan http.ResponseWriter, 2)
+
 func testHandleRequest(msgID string, resp http.ResponseWriter, req *http.Request) {
 	switch req.URL.Path {
 	case "/pass":
@@ -62,6 +76,134 @@ func testHandleRequest(msgID string, resp http.ResponseWriter, req *http.Request
 	case "/slowpass":
 		time.Sleep(time.Second)
 
+	case "/validatexml", "/validatexmlstrict":
+		err := resp.(interface {
+			ValidateXML(bool) error
+		}).ValidateXML(req.URL.Path == "/validatexmlstrict")
+		if err != nil {
+			resp.WriteHeader(http.StatusBadRequest)
+			resp.Write([]byte(err.Error()))
+		}
+
+	case "/nobody":
+		resp.(interface {
+			NoBody() error
+		}).NoBody()
+		resp.Write([]byte("From the cache"))
+
+	case "/problem":
+		resp.(interface {
+			WriteProblem(int, string, string, string, map[string]interface{}) error
+		}).WriteProblem(http.StatusBadRequest,
+			"https://example.com/problems/missing-param", "",
+			"The \"id\" parameter is required",
+			map[string]interface{}{"instance": req.URL.Path, "param": "id", "status": 200})
+
+	case "/senderror":
+		resp.(interface {
+			SendError(int, error) error
+		}).SendError(http.StatusInternalServerError, &ProblemError{
+			Status: http.StatusConflict,
+			Title:  "Version conflict",
+			Detail: "The resource was changed by someone else",
+		})
+
+	case "/drainstream":
+		// Stream events until weaver shuts down, then say goodbye.
+		draining := resp.(interface {
+			Draining() <-chan struct{}
+		}).Draining()
+		resp.Header().Set("Content-Type", "text/event-stream")
+		resp.Write([]byte("data: hello\n\n"))
+		<-draining
+		resp.Write([]byte("event: bye\ndata: shutting down\n\n"))
+
+	case "/sni":
+		resp.(interface {
+			RouteBySNI(map[string]string) (string, bool)
+		}).RouteBySNI(map[string]string{
+			"api.example.com": "http://10.0.0.1:8080",
+			"*.example.com":   "http://10.0.0.2:8080/tenants",
+		})
+
+	case "/respondforward":
+		target, _ := url.Parse(req.Header.Get("X-Forward-To"))
+		req.URL.Scheme = target.Scheme
+		req.URL.Host = target.Host
+		resp.(interface {
+			RespondAndForward(int, http.Header, []byte) error
+		}).RespondAndForward(http.StatusAccepted,
+			http.Header{"Content-Type": []string{"text/plain"}}, []byte("Accepted"))
+
+	case "/inspectbody":
+		lastInspectedBody = nil
+		lastInspectedEnd = false
+		resp.(interface {
+			InspectDecodedRequestBody(func([]byte, bool)) error
+		}).InspectDecodedRequestBody(func(decoded []byte, last bool) {
+			lastInspectedBody = append(lastInspectedBody, decoded...)
+			lastInspectedEnd = last
+		})
+
+	case "/verdict":
+		resp.(interface {
+			SetVerdict(string) error
+		}).SetVerdict("request-seen")
+
+	case "/trailers":
+		resp.(interface {
+			SetRequestTrailerFilter(func(http.Header)) error
+		}).SetRequestTrailerFilter(func(trailers http.Header) {
+			trailers.Del("X-Secret")
+			trailers.Set("X-Filtered", "true")
+		})
+
+	case "/waitcancel":
+		select {
+		case <-req.Context().Done():
+			resp.WriteHeader(499)
+		case <-time.After(5 * time.Second):
+		}
+
+	case "/late":
+		lateWriters <- resp
+
+	case "/params/alice":
+		req.Header.Set("X-User", resp.(interface {
+			PathParam(string) string
+		}).PathParam("user"))
+
+	case "/emit":
+		resp.(interface {
+			EmitCommand(string, []byte) error
+		}).EmitCommand("trace.span", []byte{0, 1, 2, 'x'})
+
+	case "/chunksize":
+		resp.(interface {
+			SetResponseChunkSize(int) error
+		}).SetResponseChunkSize(10)
+		for i := 0; i < 3; i++ {
+			resp.Write([]byte("abcdefg"))
+		}
+		resp.(http.Flusher).Flush()
+		resp.Write([]byte("0123456789012"))
+
+	case "/transparent":
+		resp.(interface {
+			SetTransparentMode() error
+		}).SetTransparentMode()
+
+	case "/misdirected":
+		resp.(interface {
+			MisdirectedRequest() error
+		}).MisdirectedRequest()
+
+	case "/clientid":
+		ip, _, verified := resp.(interface {
+			ClientIdentity([]*net.IPNet) (net.IP, []net.IP, bool)
+		}).ClientIdentity(testTrustedProxies)
+		req.Header.Set("X-Client-IP", fmt.Sprintf("%s %t", ip, verified))
+
 	case "/readbody":
 		buf, err := ioutil.ReadAll(req.Body)
 		if err != nil {
@@ -86,6 +228,10 @@ func testHandleRequest(msgID string, resp http.ResponseWriter, req *http.Request
 		req.Body.Read(tmp)
 		req.Body.Close()
 
+	case "/streambody", "/echostream":
+		// Forward the body one chunk at a time without changing it.
+		req.Body = struct{ io.ReadCloser }{req.Body}
+
 	case "/replacebody":
 		req.Body = ioutil.NopCloser(bytes.NewBufferString("Hello! I am the server!"))
 
@@ -128,22 +274,170 @@ func testHandleRequest(msgID string, resp http.ResponseWriter, req *http.Request
 		resp.Write([]byte("Hello Again! "))
 		resp.Write([]byte("Time for a complete rewrite!"))
 
+	case "/sharedchunk":
+		id, _ := strconv.ParseInt(req.URL.Query().Get("id"), 10, 32)
+		resp.(interface {
+			WriteSharedChunk(int32) error
+		}).WriteSharedChunk(int32(id))
+
+	case "/proxyinfo":
+		if info := getProxyProtocolInfo(req); info != nil {
+			req.Header.Set("X-Proxy-Version", strconv.Itoa(info.Version))
+			req.Header.Set("X-Client-Addr", info.ClientAddr)
+			req.Header.Set("X-Proxy-Addr", info.ProxyAddr)
+		}
+
+	case "/soapaction":
+		resp.(interface {
+			SetHeaderCases(...string) error
+		}).SetHeaderCases("X-API-KEY", "X-TRACE-ID")
+		req.Header.Set("X-Api-Key", "secret")
+		resp.(interface {
+			SetHeaderCase(string) error
+		}).SetHeaderCase("SOAPAction")
+		req.Header.Set("Soapaction", "urn:GetQuote")
+
+	case "/requiretls12":
+		resp.(interface {
+			RequireMinTLS(uint16) bool
+		}).RequireMinTLS(tls.VersionTLS12)
+
+	case "/reflectredirect":
+		resp.Header().Set("Location", req.URL.Query().Get("to"))
+		resp.WriteHeader(http.StatusFound)
+		resp.Write([]byte("Moved"))
+
+	case "/reflectsafe":
+		setReflectedHeader(resp.Header(), "Location", req.URL.Query().Get("to"))
+		resp.WriteHeader(http.StatusFound)
+
 	case "/writeresponseheaders":
+	case "/notfoundok":
+	case "/reflectresponse":
+	case "/peekresponse":
+	case "/asyncfilter":
+	case "/typefilter":
+	case "/structuredheaders":
+	case "/allowheader":
+	case "/digesttrailer":
+	case "/patchresponse":
+	case "/rewritecookies":
 	case "/transformbody":
 	case "/transformbodychunks":
 	case "/responseerror":
 	case "/responseerror2":
 
 	default:
-		resp.WriteHeader(http.StatusNotFound)
+		// Anything under "/pass/" passes through too.
+		if !strings.HasPrefix(req.URL.Path, "/pass/") {
+			resp.WriteHeader(http.StatusNotFound)
+		}
 	}
 }
 
 func testHandleResponse(msgID string, w http.ResponseWriter, req *http.Request, resp *http.Response) {
 	switch req.URL.Path {
+	case "/echostream":
+		resp.Body = struct{ io.ReadCloser }{resp.Body}
+
+	case "/peekresponse":
+		w.(interface {
+			PeekResponseBody(int, func([]byte, http.Header, int) int) error
+		}).PeekResponseBody(16, func(prefix []byte, hdrs http.Header, status int) int {
+			if !bytes.HasPrefix(prefix, []byte("{\"error\"")) {
+				return PeekContinue
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("The target failed"))
+			return PeekAbort
+		})
+
+	case "/late":
+		lateWriters <- w
+
+	case "/asyncfilter":
+		w.(interface {
+			SetBodyFilterAsync(func([]byte, bool, func([]byte), func(error))) error
+		}).SetBodyFilterAsync(testAsyncFilter)
+
+	case "/typefilter":
+		w.(interface {
+			SetBodyFilterForTypes([]string, func([]byte, bool) []byte) error
+		}).SetBodyFilterForTypes([]string{"text/html", "application/*"}, func(chunk []byte, last bool) []byte {
+			if last {
+				return append(bytes.ToUpper(chunk), "<!-- filtered -->"...)
+			}
+			return bytes.ToUpper(chunk)
+		})
+
+	case "/structuredheaders":
+		headers := w.(interface {
+			CacheDirective(string) (string, bool)
+			SetCacheDirective(string, string) error
+			DelCacheDirective(string) error
+			Links(string) []string
+			AddLink(string, string) error
+		})
+		if maxAge, ok := headers.CacheDirective("max-age"); ok {
+			headers.SetCacheDirective("s-maxage", maxAge)
+		}
+		headers.DelCacheDirective("private")
+		if next := headers.Links("next"); len(next) > 0 {
+			headers.AddLink(next[0], "prefetch")
+		}
+
+	case "/verdict":
+		w.(interface {
+			SetVerdict(string) error
+		}).SetVerdict("response-seen")
+		resp.Body = struct{ io.ReadCloser }{resp.Body}
+
+	case "/digesttrailer":
+		w.(interface {
+			AddStreamingDigestTrailer(string) error
+		}).AddStreamingDigestTrailer("SHA-256")
+
+	case "/transparent":
+		resp.Header.Set("X-Should-Not-Appear", "yes")
+
+	case "/patchresponse":
+		patcher := w.(interface {
+			PatchResponseAt(int64, []byte) error
+		})
+		patcher.PatchResponseAt(5, []byte("1.2.3"))
+		patcher.PatchResponseAt(100, []byte("ignored"))
+
+	case "/allowheader":
+		w.(interface {
+			AllowResponseHeader(string)
+		}).AllowResponseHeader("x-custom")
+
+	case "/rewritecookies":
+		w.(interface {
+			RewriteSetCookies(func(*http.Cookie) *http.Cookie) error
+		}).RewriteSetCookies(func(c *http.Cookie) *http.Cookie {
+			if c.Name == "tracking" {
+				return nil
+			}
+			c.Domain = "proxy.example.com"
+			c.Secure = true
+			return c
+		})
+
 	case "/replacewithid":
 		resp.Header.Set("X-Apigee-MsgID", msgID)
 
+	case "/notfoundok":
+		// Pretend that an empty search is not an error
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Header.Set("X-Original-Status", strconv.Itoa(resp.StatusCode))
+			resp.StatusCode = http.StatusOK
+		}
+
+	case "/reflectresponse":
+		resp.Header.Set("X-Request-Id", req.URL.Query().Get("id"))
+
 	case "/writeresponseheaders":
 		resp.Header.Set("X-Apigee-ResponseHeader", "yes")
 
@@ -179,3 +473,42 @@ func testHandleResponse(msgID string, w http.ResponseWriter, req *http.Request,
 		resp.Header.Set("X-Apigee-Invisible", "yes")
 	}
 }
+
+// Proxies that "/clientid" trusts
+var testTrustedProxies = []*net.IPNet{
+	{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+	{IP: net.ParseIP("fd00::"), Mask: net.CIDRMask(8, 128)},
+}
+
+// Chunks that testAsyncFilter is working on now, and the most there have been
+var asyncFilterInFlight, asyncFilterMaxInFlight int32
+
+/*
+ * Upper-case each chunk on another goroutine, like a call to another service
+ * would. Earlier chunks take longer, so they finish out of order, and a chunk
+ * containing "bad" fails.
+ */
+func testAsyncFilter(chunk []byte, last bool, emit func([]byte), done func(error)) {
+	n := atomic.AddInt32(&asyncFilterInFlight, 1)
+	for max := atomic.LoadInt32(&asyncFilterMaxInFlight); n > max; max = atomic.LoadInt32(&asyncFilterMaxInFlight) {
+		if atomic.CompareAndSwapInt32(&asyncFilterMaxInFlight, max, n) {
+			break
+		}
+	}
+	delay := time.Duration(len(chunk)) * time.Millisecond
+	go func() {
+		time.Sleep(delay)
+		atomic.AddInt32(&asyncFilterInFlight, -1)
+		if bytes.Contains(chunk, []byte("bad")) {
+			done(errors.New("Filter failed"))
+			return
+		}
+		upper := bytes.ToUpper(chunk)
+		emit(upper[:len(upper)/2])
+		emit(upper[len(upper)/2:])
+		if last {
+			emit([]byte("."))
+		}
+		done(nil)
+	}()
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+/*
+ * testConn drives a request and its response through the same functions that
+ * the C exports call, so that tests can play the part of the caller without
+ * any C code.
+ */
+type testConn struct {
+	id  uint32
+	rid uint32
+}
+
+func newTestConn(handlerID string) *testConn {
+	return &testConn{
+		id:  createRequest(handlerID),
+		rid: createResponse(handlerID),
+	}
+}
+
+func (c *testConn) beginRequest(rawHeaders string) error {
+	return beginRequest(c.id, rawHeaders)
+}
+
+/*
+ * Return the next command, and false if "block" was false and there wasn't
+ * one yet.
+ */
+func (c *testConn) pollRequest(block bool) (command, bool) {
+	return toCommand(pollRequest(c.id, block))
+}
+
+func (c *testConn) sendRequestBody(last bool, chunk []byte) {
+	sendRequestBodyChunk(c.id, last, chunk)
+}
+
+func (c *testConn) beginResponse(status uint32, rawHeaders string) error {
+	return beginResponse(c.rid, c.id, status, rawHeaders)
+}
+
+func (c *testConn) pollResponse(block bool) (command, bool) {
+	return toCommand(pollResponse(c.rid, block))
+}
+
+func (c *testConn) sendResponseBody(last bool, chunk []byte) {
+	sendResponseBodyChunk(c.rid, last, chunk)
+}
+
+func (c *testConn) free() {
+	freeRequest(c.id)
+	freeResponse(c.rid)
+}
+
+func toCommand(s string) (command, bool) {
+	if s == "" {
+		return command{}, false
+	}
+	cmd, err := parseCommand(s)
+	Expect(err).Should(Succeed())
+	return cmd, true
+}
+
+/*
+ * What the caller ends up doing after processing all the commands.
+ */
+type testExchange struct {
+	targetURI     string
+	targetHeaders http.Header
+	targetBody    []byte
+	switched      bool
+	status        int
+	headers       http.Header
+	body          []byte
+	err           string
+}
+
+/*
+ * Proxy one request from start to finish, in the same way as the caller:
+ * the target responds with "status," "respHeaders," and "respBody" if the
+ * request gets that far.
+ */
+func (c *testConn) proxy(rawHeaders string, reqBody []byte,
+	status int, respHeaders string, respBody []byte) *testExchange {
+	x := &testExchange{
+		targetHeaders: http.Header{},
+		targetBody:    reqBody,
+		status:        status,
+		headers:       http.Header{},
+		body:          respBody,
+	}
+
+	Expect(c.beginRequest(rawHeaders)).Should(Succeed())
+	var replacedBody *bytes.Buffer
+	c.processCommands(x, c.pollRequest, func(cmd command) {
+		switch cmd.id {
+		case RBOD:
+			c.sendRequestBody(true, reqBody)
+		case WURI:
+			x.targetURI = cmd.msg
+		case WHDR:
+			if x.switched {
+				parseHeaders(x.headers, cmd.msg)
+			} else {
+				parseHeaders(x.targetHeaders, cmd.msg)
+			}
+		case SWCH:
+			x.switched = true
+			x.status, _ = strconv.Atoi(cmd.msg)
+			x.body = nil
+		case WBOD:
+			if x.switched {
+				x.body = append(x.body, getChunkData(cmd.msg)...)
+			} else {
+				if replacedBody == nil {
+					replacedBody = &bytes.Buffer{}
+				}
+				replacedBody.Write(getChunkData(cmd.msg))
+			}
+		case WSHR:
+			id, _ := strconv.ParseInt(cmd.msg, 16, 32)
+			x.body = append(x.body, chunkBytes(int32(id))...)
+			GoReleaseChunk(int32(id))
+		default:
+			Fail("Unexpected request command " + cmd.String())
+		}
+	})
+	if replacedBody != nil {
+		x.targetBody = replacedBody.Bytes()
+	}
+	if x.switched || x.err != "" {
+		return x
+	}
+
+	Expect(c.beginResponse(uint32(status), respHeaders)).Should(Succeed())
+	var replacedRespBody []byte
+	c.processCommands(x, c.pollResponse, func(cmd command) {
+		switch cmd.id {
+		case RBOD:
+			c.sendResponseBody(true, respBody)
+		case SBOD:
+			// The whole request body was already sent
+		case WSTA:
+			x.status, _ = strconv.Atoi(cmd.msg)
+		case WHDR:
+			parseHeaders(x.headers, cmd.msg)
+		case WBOD:
+			replacedRespBody = append(replacedRespBody, getChunkData(cmd.msg)...)
+		default:
+			Fail("Unexpected response command " + cmd.String())
+		}
+	})
+	if replacedRespBody != nil {
+		x.body = replacedRespBody
+	}
+	return x
+}
+
+func (c *testConn) processCommands(x *testExchange,
+	poll func(bool) (command, bool), process func(command)) {
+	for {
+		cmd, _ := poll(true)
+		switch cmd.id {
+		case DONE:
+			return
+		case ERRR:
+			x.err = cmd.msg
+			return
+		default:
+			process(cmd)
+		}
+	}
+}
+
+var _ = Describe("Command Parsing", func() {
+	It("Parse", func() {
+		cmd, err := parseCommand("WURI/foo?bar=baz")
+		Expect(err).Should(Succeed())
+		Expect(cmd).Should(Equal(command{id: WURI, msg: "/foo?bar=baz"}))
+
+		cmd, err = parseCommand("DONE")
+		Expect(err).Should(Succeed())
+		Expect(cmd).Should(Equal(command{id: DONE}))
+
+		_, err = parseCommand("XXXXfoo")
+		Expect(err).ShouldNot(Succeed())
+		_, err = parseCommand("WB")
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("Round trip", func() {
+		for id := DONE; id <= WSHR; id++ {
+			orig := command{id: id, msg: "message"}
+			cmd, err := parseCommand(orig.String())
+			Expect(err).Should(Succeed())
+			Expect(cmd).Should(Equal(orig))
+		}
+	})
+})
+
+var _ = Describe("End to End", func() {
+	var conn *testConn
+
+	BeforeEach(func() {
+		conn = newTestConn(testHandler)
+	})
+
+	AfterEach(func() {
+		conn.free()
+	})
+
+	reqBody := []byte("Hello, Target!")
+	respBody := []byte("Hello, Client!")
+
+	exchange := func(method, path string) *testExchange {
+		return conn.proxy(makeRequestHeaders(method, path, "text/plain", len(reqBody)),
+			reqBody, http.StatusOK, makeResponseHeaders("text/plain", len(respBody)), respBody)
+	}
+
+	It("Pass through", func() {
+		x := exchange("POST", "/pass")
+		Expect(x.err).Should(BeEmpty())
+		Expect(x.switched).Should(BeFalse())
+		Expect(x.targetURI).Should(BeEmpty())
+		Expect(x.targetHeaders).Should(BeEmpty())
+		Expect(x.targetBody).Should(Equal(reqBody))
+		Expect(x.status).Should(Equal(http.StatusOK))
+		Expect(x.headers).Should(BeEmpty())
+		Expect(x.body).Should(Equal(respBody))
+	})
+
+	It("Filtered request", func() {
+		x := exchange("POST", "/completerequest")
+		Expect(x.err).Should(BeEmpty())
+		Expect(x.switched).Should(BeFalse())
+		Expect(x.targetURI).Should(Equal("/totallynewurl"))
+		Expect(x.targetHeaders.Get("X-Apigee-Test")).Should(Equal("Complete"))
+		Expect(string(x.targetBody)).Should(Equal("Hello Again! Time for a complete rewrite!"))
+		Expect(x.body).Should(Equal(respBody))
+	})
+
+	It("Filtered response", func() {
+		x := exchange("GET", "/transformbodychunks")
+		Expect(x.err).Should(BeEmpty())
+		Expect(x.targetBody).Should(Equal(reqBody))
+		Expect(x.headers.Get("X-Apigee-Transformed")).Should(Equal("yes"))
+		Expect(string(x.body)).Should(Equal("{Hello, Client!}"))
+	})
+
+	It("Short circuit", func() {
+		x := exchange("GET", "/completeresponse")
+		Expect(x.err).Should(BeEmpty())
+		Expect(x.switched).Should(BeTrue())
+		Expect(x.status).Should(Equal(http.StatusCreated))
+		Expect(x.headers.Get("X-Apigee-Test")).Should(Equal("Complete"))
+		Expect(string(x.body)).Should(Equal("Hello Again! Time for a complete rewrite!"))
+	})
+
+	It("Error response", func() {
+		x := exchange("GET", "/responseerror")
+		Expect(x.err).Should(BeEmpty())
+		Expect(x.status).Should(Equal(http.StatusInternalServerError))
+		Expect(string(x.body)).Should(Equal("Error in the server!"))
+	})
+
+	It("Error", func() {
+		x := conn.proxy("Not an HTTP request\r\n\r\n", nil, http.StatusOK, "", nil)
+		Expect(x.err).ShouldNot(BeEmpty())
+		Expect(x.switched).Should(BeFalse())
+	})
+})
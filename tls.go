@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/*
+ * TLS is terminated by the caller, so it must tell us about the connection
+ * if it wants handlers to know. The information is made available in the
+ * standard "TLS" field of the http.Request. A global policy can reject
+ * requests that used a version of TLS that is too old, and handlers can
+ * require a newer version on their own routes using RequireMinTLS. Handlers
+ * can also pick the target by the server name that the client sent using
+ * SNI, with RouteBySNI. Both are found using a type assertion on the
+ * http.ResponseWriter.
+ */
+
+func setTLSInfo(id uint32, version uint16, serverName string) error {
+	req := getRequest(id)
+	if req == nil {
+		return fmt.Errorf("Unknown request: %d", id)
+	}
+	req.tls = &tls.ConnectionState{
+		Version:           version,
+		HandshakeComplete: true,
+		ServerName:        serverName,
+	}
+	return nil
+}
+
+func setMinTLSVersion(version uint16) {
+	updateSettings(func(s *settings) {
+		s.minTLSVersion = version
+	})
+}
+
+/*
+ * RequireMinTLS returns true if the request arrived over TLS with at least
+ * the specified version, such as tls.VersionTLS12. Otherwise, a request
+ * handler answers with a 426 that names the version in an Upgrade header,
+ * and it returns false. A response handler only gets the answer.
+ */
+func (h *httpResponse) RequireMinTLS(version uint16) bool {
+	r := h.owner()
+	if r == nil {
+		return false
+	}
+	if requireMinTLS(r.req, version) {
+		return true
+	}
+	if _, ok := h.handler.(*request); ok {
+		r.rejectWithHeaders(http.StatusUpgradeRequired,
+			fmt.Sprintf("TLS %s or later is required", tlsVersionName(version)),
+			http.Header{"Upgrade": {"TLS/" + tlsVersionName(version)}})
+	}
+	return false
+}
+
+/*
+ * Return true if the request arrived over TLS with at least the specified
+ * version.
+ */
+func requireMinTLS(req *http.Request, version uint16) bool {
+	return req.TLS != nil && req.TLS.Version >= version
+}
+
+/*
+ * Return a version such as tls.VersionTLS12 as "1.2."
+ */
+func tlsVersionName(version uint16) string {
+	if version >= tls.VersionTLS10 && version <= 0x03ff {
+		return fmt.Sprintf("1.%d", version-tls.VersionTLS10)
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+/*
+ * Enforce the global policy. It only applies to requests for which the
+ * caller supplied TLS information.
+ */
+func (r *request) checkTLS() bool {
+	min := r.settings.minTLSVersion
+	if min == 0 || r.req.TLS == nil || requireMinTLS(r.req, min) {
+		return true
+	}
+	r.reject(http.StatusForbidden,
+		fmt.Sprintf("TLS version 0x%04x is not allowed", r.req.TLS.Version))
+	return false
+}
+
+/*
+ * RouteBySNI looks up the SNI server name of the request in "routes," which
+ * maps server names to absolute upstream URLs, and sends the request to the
+ * upstream that it finds. A name like "*.example.com" matches any name with
+ * one more label, like the same name in a certificate, and "*" matches
+ * anything, but an exact match always wins. It returns the upstream and
+ * true if the request was routed. Only a request handler can route.
+ */
+func (h *httpResponse) RouteBySNI(routes map[string]string) (string, bool) {
+	r, ok := h.handler.(*request)
+	if !ok || r.req.TLS == nil {
+		return "", false
+	}
+	upstream, ok := matchSNI(r.req.TLS.ServerName, routes)
+	if !ok {
+		return "", false
+	}
+	target, err := url.Parse(upstream)
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		return "", false
+	}
+	newURL := *r.req.URL
+	newURL.Scheme = target.Scheme
+	newURL.Host = target.Host
+	newURL.Path = strings.TrimSuffix(target.Path, "/") + r.req.URL.Path
+	newURL.RawPath = ""
+	r.req.URL = &newURL
+	return upstream, true
+}
+
+func matchSNI(serverName string, routes map[string]string) (string, bool) {
+	name := strings.TrimSuffix(strings.ToLower(serverName), ".")
+	if name == "" {
+		return "", false
+	}
+	candidates := []string{name}
+	if dot := strings.IndexByte(name, '.'); dot > 0 {
+		candidates = append(candidates, "*"+name[dot:])
+	}
+	candidates = append(candidates, "*")
+	for _, c := range candidates {
+		for pattern, upstream := range routes {
+			if strings.TrimSuffix(strings.ToLower(pattern), ".") == c {
+				return upstream, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TLS Version", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		resetSettings()
+	})
+
+	It("Require TLS", func() {
+		Expect(requireMinTLS(&http.Request{}, tls.VersionTLS10)).Should(BeFalse())
+		req := &http.Request{
+			TLS: &tls.ConnectionState{Version: tls.VersionTLS12},
+		}
+		Expect(requireMinTLS(req, tls.VersionTLS12)).Should(BeTrue())
+		Expect(requireMinTLS(req, tls.VersionTLS13)).Should(BeFalse())
+		Expect(tlsVersionName(tls.VersionTLS13)).Should(Equal("1.3"))
+	})
+
+	It("Handler rejects plain HTTP", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/requiretls12", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("SWCH426"))
+	})
+
+	It("Unknown request", func() {
+		Expect(setTLSInfo(0, tls.VersionTLS12, "")).ShouldNot(Succeed())
+	})
+
+	It("Handler sees TLS info", func() {
+		Expect(setTLSInfo(id, tls.VersionTLS13, "example.com")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/requiretls12", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(getRequest(id).req.TLS.ServerName).Should(Equal("example.com"))
+	})
+
+	It("Handler rejects old TLS", func() {
+		Expect(setTLSInfo(id, tls.VersionTLS11, "")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/requiretls12", "", 0))
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^SWCH.*"))
+		Expect(cmd[4:]).Should(Equal("426"))
+		cmd = pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("Upgrade")).Should(Equal("TLS/1.2"))
+		cmd = pollRequest(id, true)
+		Expect(cmd).Should(HavePrefix("WBOD"))
+		Expect(string(readBodyData(cmd))).Should(ContainSubstring("TLS 1.2 or later is required"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Global minimum", func() {
+		GoSetMinTLSVersion(tls.VersionTLS12)
+		Expect(setTLSInfo(id, tls.VersionTLS10, "")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^SWCH.*"))
+		Expect(cmd[4:]).Should(Equal("403"))
+		Expect(pollRequest(id, true)).Should(MatchRegexp("^WHDR.*"))
+		readBodyData(pollRequest(id, true))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Global minimum allows new TLS", func() {
+		GoSetMinTLSVersion(tls.VersionTLS12)
+		Expect(setTLSInfo(id, tls.VersionTLS12, "")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Global minimum ignores plain HTTP", func() {
+		GoSetMinTLSVersion(tls.VersionTLS12)
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	route := func(serverName string) string {
+		if serverName != "" {
+			Expect(setTLSInfo(id, tls.VersionTLS12, serverName)).Should(Succeed())
+		}
+		err := beginRequest(id, makeRequestHeaders("GET", "/sni", "", 0))
+		Expect(err).Should(Succeed())
+		cmd := pollRequest(id, true)
+		if cmd == "DONE" {
+			return ""
+		}
+		Expect(cmd).Should(HavePrefix("WURI"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		return cmd[4:]
+	}
+
+	It("Route by exact SNI", func() {
+		Expect(route("API.example.com")).Should(Equal("http://10.0.0.1:8080/sni"))
+	})
+
+	It("Route by wildcard SNI", func() {
+		Expect(route("acme.example.com")).Should(Equal("http://10.0.0.2:8080/tenants/sni"))
+	})
+
+	It("Wildcard SNI matches one label", func() {
+		Expect(route("a.b.example.com")).Should(BeEmpty())
+	})
+
+	It("No SNI match", func() {
+		Expect(route("example.org")).Should(BeEmpty())
+	})
+
+	It("No TLS", func() {
+		Expect(route("")).Should(BeEmpty())
+	})
+
+	It("Match SNI", func() {
+		routes := map[string]string{
+			"a.example.com": "exact",
+			"*.example.com": "wildcard",
+			"*":             "default",
+		}
+		upstream, ok := matchSNI("a.example.com.", routes)
+		Expect(ok).Should(BeTrue())
+		Expect(upstream).Should(Equal("exact"))
+		upstream, _ = matchSNI("b.example.com", routes)
+		Expect(upstream).Should(Equal("wildcard"))
+		upstream, _ = matchSNI("example.com", routes)
+		Expect(upstream).Should(Equal("default"))
+		_, ok = matchSNI("", routes)
+		Expect(ok).Should(BeFalse())
+	})
+})
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Transcoding decodes a compressed response body before the handler sees
+ * it, so that the handler can read and transform it, and then compresses
+ * what is sent to the client using the encoding that the client likes best.
+ * Bodies that are hashed or cached are sent as they are, because both of
+ * those need to see the bytes that go to the client.
+ */
+
+var errEncodedBodyClosed = errors.New("The encoded body was closed")
+
+// The encodings that we can produce, in order of preference when the client
+// likes more than one of them equally
+var transcodeEncodings = []string{"gzip", "deflate"}
+
+var bodyEncoders = map[string]func(io.Writer) io.WriteCloser{
+	"gzip": func(w io.Writer) io.WriteCloser {
+		return gzip.NewWriter(w)
+	},
+	"deflate": func(w io.Writer) io.WriteCloser {
+		return zlib.NewWriter(w)
+	},
+}
+
+func setResponseTranscoding(enabled bool) {
+	updateSettings(func(s *settings) {
+		s.transcodeResponses = enabled
+	})
+}
+
+/*
+ * Return the encoding that the client prefers out of the ones that we can
+ * produce, or an empty string if it doesn't accept any of them.
+ */
+func preferredEncoding(acceptEncoding string) string {
+	best := ""
+	bestQuality := 0.0
+	for _, enc := range transcodeEncodings {
+		q := encodingQuality(acceptEncoding, enc)
+		if q > bestQuality {
+			best = enc
+			bestQuality = q
+		}
+	}
+	return best
+}
+
+/*
+ * Decode the body from the target, if it should be transcoded, and decide
+ * how to encode it for the client.
+ */
+func (r *response) startTranscode() {
+	s := r.request.settings
+	if (!s.transcodeResponses && !s.negotiateEncoding) || s.bodyHashHeader != "" ||
+		s.negativeTTLs[r.resp.StatusCode] > 0 || r.http10Client {
+		return
+	}
+	encoding := strings.ToLower(r.resp.Header.Get("Content-Encoding"))
+	if bodyDecoders[encoding] == nil {
+		return
+	}
+	accept := r.request.origHeaders.Get("Accept-Encoding")
+	if !s.transcodeResponses && acceptsEncoding(accept, encoding) {
+		// Negotiation only recompresses what the client can't decode
+		return
+	}
+	// If the client doesn't take anything we can produce, send it plain
+	preferred := preferredEncoding(accept)
+	r.resp.Header.Del("Content-Encoding")
+	r.resp.Header.Del("Content-Length")
+	r.resp.ContentLength = -1
+	r.transcoded = newDecodedBody(r.resp.Body, encoding)
+	r.resp.Body = r.transcoded
+	r.transcodeTo = preferred
+}
+
+/*
+ * If nothing read or replaced the decoded body, and the client is to get the
+ * encoding that the target sent, then put the target's body back as it was,
+ * with its length, instead of decoding and encoding it again.
+ */
+func (r *response) skipTranscode() {
+	if r.resp.Body != r.transcoded || r.readStarted ||
+		!strings.EqualFold(r.origHeaders.Get("Content-Encoding"), r.transcodeTo) {
+		return
+	}
+	r.resp.Body = r.transcoded.body
+	r.transcodeTo = ""
+	for _, name := range []string{"Content-Encoding", "Content-Length"} {
+		if values, found := r.origHeaders[name]; found {
+			r.resp.Header[name] = values
+		}
+	}
+	if length, err := strconv.ParseInt(r.origHeaders.Get("Content-Length"), 10, 64); err == nil {
+		r.resp.ContentLength = length
+	}
+}
+
+func (r *response) transcoding() bool {
+	return r.transcodeTo != "" && !r.written
+}
+
+func (r *response) setTranscodeHeaders() {
+	if !r.transcoding() {
+		return
+	}
+	r.skipTranscode()
+	if !r.transcoding() {
+		return
+	}
+	r.resp.Header.Set("Content-Encoding", r.transcodeTo)
+	r.resp.Header.Del("Content-Length")
+	addVary(r.resp.Header, "Accept-Encoding")
+}
+
+/*
+ * Return a reader that produces the body encoded for the client. Closing it
+ * before the end closes the pipe, so that the encoder gives up rather than
+ * waiting forever to write the rest.
+ */
+func (r *response) encodedBody() io.ReadCloser {
+	pr, pw := io.Pipe()
+	body := r.resp.Body
+	encoding := r.transcodeTo
+	go func() {
+		w := bodyEncoders[encoding](pw)
+		_, err := io.Copy(w, body)
+		body.Close()
+		if err == nil {
+			err = w.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return &encodedBody{pipe: pr}
+}
+
+type encodedBody struct {
+	pipe *io.PipeReader
+}
+
+func (b *encodedBody) Read(buf []byte) (int, error) {
+	return b.pipe.Read(buf)
+}
+
+func (b *encodedBody) Close() error {
+	return b.pipe.CloseWithError(errEncodedBodyClosed)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type closeRecorder struct {
+	io.Reader
+	lock   sync.Mutex
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *closeRecorder) isClosed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closed
+}
+
+var _ = Describe("Transcoding", func() {
+	var conn *testConn
+	msg := []byte("Hello, World!")
+
+	BeforeEach(func() {
+		conn = newTestConn(testHandler)
+		setResponseTranscoding(true)
+	})
+
+	AfterEach(func() {
+		conn.free()
+		resetSettings()
+	})
+
+	gzipped := func(b []byte) []byte {
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		w.Write(b)
+		w.Close()
+		return buf.Bytes()
+	}
+
+	exchange := func(path, acceptEncoding string, body []byte) *testExchange {
+		reqHdrs := addRequestHeader(makeRequestHeaders("GET", path, "", 0),
+			"Accept-Encoding", acceptEncoding)
+		respHdrs := "Content-Encoding: gzip\n" + makeResponseHeaders("text/plain", len(body))
+		return conn.proxy(reqHdrs, nil, http.StatusOK, respHdrs, body)
+	}
+
+	It("Preferred encoding", func() {
+		Expect(preferredEncoding("br;q=1, deflate;q=0.9, gzip;q=0.5")).Should(Equal("deflate"))
+		Expect(preferredEncoding("deflate, gzip")).Should(Equal("gzip"))
+		Expect(preferredEncoding("*;q=0.1")).Should(Equal("gzip"))
+		Expect(preferredEncoding("br")).Should(BeEmpty())
+		Expect(preferredEncoding("")).Should(BeEmpty())
+	})
+
+	It("Gzip to deflate", func() {
+		x := exchange("/transformbodychunks", "br;q=1, deflate;q=0.9, gzip;q=0.5", gzipped(msg))
+		Expect(x.err).Should(BeEmpty())
+		Expect(x.headers.Get("Content-Encoding")).Should(Equal("deflate"))
+		Expect(x.headers.Get("Content-Length")).Should(BeEmpty())
+		Expect(x.headers.Get("Vary")).Should(Equal("Accept-Encoding"))
+
+		zr, err := zlib.NewReader(bytes.NewReader(x.body))
+		Expect(err).Should(Succeed())
+		body, err := ioutil.ReadAll(zr)
+		Expect(err).Should(Succeed())
+		Expect(string(body)).Should(Equal("{Hello, World!}"))
+	})
+
+	It("Untouched body", func() {
+		// Nothing read it, and the client takes gzip, so it goes as it came.
+		body := gzipped(msg)
+		x := exchange("/pass", "gzip", body)
+		Expect(x.err).Should(BeEmpty())
+		Expect(x.headers).Should(BeEmpty())
+		Expect(x.body).Should(Equal(body))
+	})
+
+	It("Untouched body in another encoding", func() {
+		x := exchange("/pass", "deflate", gzipped(msg))
+		Expect(x.err).Should(BeEmpty())
+		Expect(x.headers.Get("Content-Encoding")).Should(Equal("deflate"))
+		Expect(x.headers.Get("Content-Length")).Should(BeEmpty())
+		zr, err := zlib.NewReader(bytes.NewReader(x.body))
+		Expect(err).Should(Succeed())
+		body, err := ioutil.ReadAll(zr)
+		Expect(err).Should(Succeed())
+		Expect(body).Should(Equal(msg))
+	})
+
+	It("Stop reading the encoded body", func() {
+		// Random data doesn't compress, so the encoder has a lot to write.
+		data := make([]byte, 1<<20)
+		rand.Read(data)
+		src := &closeRecorder{Reader: bytes.NewReader(data)}
+		r := &response{
+			resp:        &http.Response{Body: src},
+			transcodeTo: "gzip",
+		}
+		body := r.encodedBody()
+		buf := make([]byte, 10)
+		_, err := body.Read(buf)
+		Expect(err).Should(Succeed())
+		Expect(body.Close()).Should(Succeed())
+		Eventually(func() bool { return src.isClosed() }).Should(BeTrue())
+	})
+
+	It("Plain for the client", func() {
+		x := exchange("/transformbodychunks", "br", gzipped(msg))
+		Expect(x.err).Should(BeEmpty())
+		Expect(x.headers.Get("Content-Encoding")).Should(BeEmpty())
+		Expect(string(x.body)).Should(Equal("{Hello, World!}"))
+	})
+
+	It("Disabled", func() {
+		setResponseTranscoding(false)
+		body := gzipped(msg)
+		x := exchange("/pass", "deflate, gzip;q=0.5", body)
+		Expect(x.headers).Should(BeEmpty())
+		Expect(x.body).Should(Equal(body))
+	})
+
+	It("Negotiation recompresses", func() {
+		setResponseTranscoding(false)
+		setAcceptEncodingNegotiation(true)
+		Expect(setBackendEncodings("deflate")).Should(Succeed())
+		buf := &bytes.Buffer{}
+		w := zlib.NewWriter(buf)
+		w.Write(msg)
+		w.Close()
+
+		reqHdrs := addRequestHeader(makeRequestHeaders("GET", "/pass", "", 0),
+			"Accept-Encoding", "br, gzip")
+		respHdrs := "Content-Encoding: deflate\n" + makeResponseHeaders("text/plain", buf.Len())
+		x := conn.proxy(reqHdrs, nil, http.StatusOK, respHdrs, buf.Bytes())
+		Expect(x.err).Should(BeEmpty())
+		Expect(x.headers.Get("Content-Encoding")).Should(Equal("gzip"))
+		zr, err := gzip.NewReader(bytes.NewReader(x.body))
+		Expect(err).Should(Succeed())
+		body, err := ioutil.ReadAll(zr)
+		Expect(err).Should(Succeed())
+		Expect(body).Should(Equal(msg))
+	})
+
+	It("Negotiation keeps an encoding the client likes", func() {
+		setResponseTranscoding(false)
+		setAcceptEncodingNegotiation(true)
+		Expect(setBackendEncodings("gzip")).Should(Succeed())
+		body := gzipped(msg)
+		x := exchange("/pass", "br, gzip", body)
+		Expect(x.headers).Should(BeEmpty())
+		Expect(x.body).Should(Equal(body))
+	})
+
+	It("Negotiation keeps an encoding the client likes less", func() {
+		setResponseTranscoding(false)
+		setAcceptEncodingNegotiation(true)
+		Expect(setBackendEncodings("gzip")).Should(Succeed())
+		body := gzipped(msg)
+		x := exchange("/pass", "br, deflate, gzip;q=0.5", body)
+		Expect(x.headers).Should(BeEmpty())
+		Expect(x.body).Should(Equal(body))
+	})
+})
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+)
+
+/*
+ * Some routes must reach the client exactly as the target sent them, for
+ * compliance, but still be logged. A request handler can put a request in
+ * transparent mode. Then the response handler isn't called, none of the
+ * global rules touch the status or headers, and the body is relayed as the
+ * bytes that arrived, one WBOD for each chunk, so that they can be counted
+ * and digested. Weaver never sees the target's connection, since the caller
+ * makes it, so the status line, the headers, and the framing of the body
+ * are up to the caller to pass on as they were.
+ */
+
+var errTransparentTooLate = errors.New("Only a request handler can set transparent mode")
+
+/*
+ * SetTransparentMode stops weaver from changing the response to this
+ * request in any way.
+ */
+func (h *httpResponse) SetTransparentMode() error {
+	r, ok := h.handler.(*request)
+	if !ok {
+		return errTransparentTooLate
+	}
+	if !r.phase.whileOpen(func() {
+		r.transparent = true
+	}) {
+		return tooLate(r, "SetTransparentMode")
+	}
+	return nil
+}
+
+func (r *response) relayTransparent(status uint32) {
+	r.observer = newBodyObserver(r.request.observeAlgorithms)
+	if bodyAllowed(r.request.req, int(status)) {
+		readAndSend(r, &requestBody{handler: r})
+	}
+	updateStats(func(s *stats) {
+		s.TransparentResponses++
+		s.TransparentBytes += r.bytesSent
+	})
+	r.request.recordQuotaBytes(r.bytesSent)
+	if r.observer != nil {
+		r.request.setResponseDigests(r.observer.digests())
+	}
+	r.SafePoint()
+	r.request.setState(stateDone)
+	r.cmds <- command{id: DONE}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Transparent mode", func() {
+	var id, rid uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		rid = createResponse(testHandler)
+		Expect(rid).ShouldNot(BeZero())
+
+		// None of these may touch the response.
+		Expect(setResponseMinification("text/html", true)).Should(Succeed())
+		Expect(setResponseSubstitution("text/html", "Hello", "Bye")).Should(Succeed())
+		setResponseHeaderAllowlist(true, "Content-Type")
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		freeResponse(rid)
+		resetSettings()
+	})
+
+	// Relay "chunks" and return what came out.
+	relay := func(rawHeaders string, chunks ...string) []byte {
+		Expect(observeResponseBody(id, "sha256")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/transparent", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		err = beginResponse(rid, id, 200, rawHeaders)
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("RBOD"))
+		for i, c := range chunks {
+			sendResponseBodyChunk(rid, i == len(chunks)-1, []byte(c))
+		}
+
+		out := &bytes.Buffer{}
+		for cmd := pollResponse(rid, true); cmd != "DONE"; cmd = pollResponse(rid, true) {
+			// No WSTA or WHDR, and the body exactly as it was
+			Expect(cmd).Should(HavePrefix("WBOD"))
+			out.Write(readBodyData(cmd))
+		}
+		return out.Bytes()
+	}
+
+	expectObserved := func(in []byte) {
+		d := make(map[string]string)
+		Expect(json.Unmarshal([]byte(getResponseDigestsJSON(id)), &d)).Should(Succeed())
+		sum := sha256.Sum256(in)
+		Expect(d["sha256"]).Should(Equal(hex.EncodeToString(sum[:])))
+	}
+
+	It("Content-Length", func() {
+		before := getStats()
+		body := "<html>  Hello,\n\n   World  </html>"
+		out := relay("content-type: text/html\nContent-Length: 33\nConnection: close\n\n",
+			body[:10], body[10:])
+		Expect(string(out)).Should(Equal(body))
+		expectObserved(out)
+		after := getStats()
+		Expect(after.TransparentResponses - before.TransparentResponses).Should(BeEquivalentTo(1))
+		Expect(after.TransparentBytes - before.TransparentBytes).Should(BeEquivalentTo(len(body)))
+	})
+
+	It("Chunked", func() {
+		// The caller may pass the chunked framing through as it arrived.
+		wire := []string{"5\r\nHello\r\n", "7\r\n, World\r\n", "0\r\n\r\n"}
+		out := relay("Content-Type: text/html\nTransfer-Encoding: chunked\n\n", wire...)
+		Expect(string(out)).Should(Equal(wire[0] + wire[1] + wire[2]))
+		expectObserved(out)
+	})
+
+	It("Only from a request handler", func() {
+		h := &httpResponse{handler: &response{}}
+		Expect(h.SetTransparentMode()).Should(Equal(errTransparentTooLate))
+	})
+})
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+/*
+ * Change the options of the transport that weaver uses to talk to upstreams
+ * without tearing anything down. Each change builds a new transport, a
+ * "generation," and requests that start after it use it right away. The old
+ * generation keeps the requests that were already using it, and once the
+ * last of them is done its idle connections are closed. Requests that are
+ * still going when the drain timeout runs out are cancelled.
+ */
+
+/*
+ * TransportOptions are the settings for the upstream transport. Zero values
+ * mean the same as in http.Transport.
+ */
+type TransportOptions struct {
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+	// PEM certificates to trust instead of the system roots
+	RootCAs  []byte
+	ProxyURL string
+	// How long the old generation has to finish, or defaultTransportDrain
+	DrainTimeout time.Duration
+}
+
+const defaultTransportDrain = 30 * time.Second
+
+type transportGen struct {
+	transport *http.Transport
+	calls     map[uint64]context.CancelFunc
+	retired   bool
+	drain     *time.Timer
+}
+
+var transportLock = sync.Mutex{}
+var currentTransport = newTransportGen(http.DefaultTransport.(*http.Transport).Clone())
+var liveTransports = map[*transportGen]bool{currentTransport: true}
+var lastTransportCall uint64
+var transportOptions TransportOptions
+
+func newTransportGen(t *http.Transport) *transportGen {
+	return &transportGen{
+		transport: t,
+		calls:     make(map[uint64]context.CancelFunc),
+	}
+}
+
+/*
+ * ConfigureTransport replaces the upstream transport with one built from
+ * "opts." It returns an error, and changes nothing, if the options are
+ * invalid.
+ */
+func ConfigureTransport(opts TransportOptions) error {
+	t, err := buildTransport(opts)
+	if err != nil {
+		return err
+	}
+	drain := opts.DrainTimeout
+	if drain <= 0 {
+		drain = defaultTransportDrain
+	}
+
+	gen := newTransportGen(t)
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	transportOptions = opts
+	old := currentTransport
+	currentTransport = gen
+	liveTransports[gen] = true
+	old.retired = true
+	if len(old.calls) == 0 {
+		old.close()
+	} else if old.drain == nil {
+		old.drain = time.AfterFunc(drain, old.forceClose)
+	}
+	return nil
+}
+
+func buildTransport(opts TransportOptions) (*http.Transport, error) {
+	if opts.MaxIdleConns < 0 || opts.MaxIdleConnsPerHost < 0 ||
+		opts.MaxConnsPerHost < 0 || opts.IdleConnTimeout < 0 {
+		return nil, errors.New("Transport limits may not be negative")
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.MaxIdleConns > 0 {
+		t.MaxIdleConns = opts.MaxIdleConns
+	}
+	t.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+	t.MaxConnsPerHost = opts.MaxConnsPerHost
+	if opts.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = opts.IdleConnTimeout
+	}
+	if len(opts.RootCAs) > 0 {
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(opts.RootCAs) {
+			return nil, errors.New("No certificates found in the root CAs")
+		}
+		t.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	if opts.ProxyURL != "" {
+		u, err := url.Parse(opts.ProxyURL)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("Proxy must be an absolute URL: \"%s\"", opts.ProxyURL)
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+	if getSettings().developmentMode {
+		t.IdleConnTimeout = 0
+		t.TLSHandshakeTimeout = 0
+		t.ExpectContinueTimeout = 0
+		t.ResponseHeaderTimeout = 0
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.InsecureSkipVerify = true
+	}
+	return t, nil
+}
+
+/*
+ * Return the options that the current transport was built from.
+ */
+func getTransportOptions() TransportOptions {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	return transportOptions
+}
+
+type transportConfig struct {
+	MaxIdleConns        int    `json:"maxIdleConns"`
+	MaxIdleConnsPerHost int    `json:"maxIdleConnsPerHost"`
+	MaxConnsPerHost     int    `json:"maxConnsPerHost"`
+	IdleTimeoutMillis   int    `json:"idleTimeoutMillis"`
+	CAFile              string `json:"caFile"`
+	ProxyURL            string `json:"proxyURL"`
+	DrainTimeoutMillis  int    `json:"drainTimeoutMillis"`
+}
+
+/*
+ * Configure the transport from JSON, reading the root CAs from a file.
+ */
+func configureTransportJSON(config string) error {
+	var c transportConfig
+	d := json.NewDecoder(bytes.NewBufferString(config))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&c); err != nil {
+		return fmt.Errorf("Invalid transport configuration: %v", err)
+	}
+	opts := TransportOptions{
+		MaxIdleConns:        c.MaxIdleConns,
+		MaxIdleConnsPerHost: c.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     c.MaxConnsPerHost,
+		IdleConnTimeout:     time.Duration(c.IdleTimeoutMillis) * time.Millisecond,
+		ProxyURL:            c.ProxyURL,
+		DrainTimeout:        time.Duration(c.DrainTimeoutMillis) * time.Millisecond,
+	}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return err
+		}
+		opts.RootCAs = pem
+	}
+	return ConfigureTransport(opts)
+}
+
+/*
+ * Return how many generations still have connections or requests. More than
+ * one for long means that requests on an old generation aren't finishing.
+ */
+func transportGenerations() int {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	return len(liveTransports)
+}
+
+// Must be called with transportLock held.
+func (g *transportGen) close() {
+	if !liveTransports[g] {
+		return
+	}
+	delete(liveTransports, g)
+	if g.drain != nil {
+		g.drain.Stop()
+	}
+	g.transport.CloseIdleConnections()
+}
+
+func (g *transportGen) forceClose() {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	for id, cancel := range g.calls {
+		cancel()
+		delete(g.calls, id)
+	}
+	g.close()
+}
+
+func (g *transportGen) finish(id uint64) {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	if cancel := g.calls[id]; cancel != nil {
+		cancel()
+		delete(g.calls, id)
+	}
+	if g.retired && len(g.calls) == 0 {
+		g.close()
+	}
+}
+
+/*
+ * The round tripper that sends each request on the current generation, and
+ * keeps track of it until its body has been read or closed.
+ */
+type generationalTransport struct{}
+
+func (generationalTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	transportLock.Lock()
+	g := currentTransport
+	lastTransportCall++
+	id := lastTransportCall
+	g.calls[id] = cancel
+	transportLock.Unlock()
+
+	resp, err := g.transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		g.finish(id)
+		return nil, err
+	}
+	resp.Body = &pacedBody{
+		ReadCloser: resp.Body,
+		release:    func() { g.finish(id) },
+	}
+	return resp, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Transport reconfiguration", func() {
+	var server *httptest.Server
+	var entered chan bool
+	var unblock chan bool
+
+	BeforeEach(func() {
+		entered = make(chan bool, 10)
+		unblock = make(chan bool)
+		server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			entered <- true
+			if r.URL.Path == "/slow" {
+				<-unblock
+			}
+			w.Write([]byte("Secure"))
+		}))
+	})
+
+	AfterEach(func() {
+		close(unblock)
+		server.Close()
+		Expect(ConfigureTransport(TransportOptions{})).Should(Succeed())
+	})
+
+	serverCA := func() []byte {
+		return pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: server.Certificate().Raw,
+		})
+	}
+
+	get := func(path string) (string, error) {
+		resp, err := upstreamClient.Get(server.URL + path)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	It("New CA", func() {
+		_, err := get("/")
+		Expect(err).ShouldNot(Succeed())
+		Expect(ConfigureTransport(TransportOptions{RootCAs: serverCA()})).Should(Succeed())
+		body, err := get("/")
+		Expect(err).Should(Succeed())
+		Expect(body).Should(Equal("Secure"))
+	})
+
+	It("Drain in-flight requests", func() {
+		Expect(ConfigureTransport(TransportOptions{RootCAs: serverCA()})).Should(Succeed())
+		base := transportGenerations()
+		results := make(chan string, 1)
+		go func() {
+			body, _ := get("/slow")
+			results <- body
+		}()
+		Eventually(entered).Should(Receive())
+
+		// The old generation stays until its request is done.
+		Expect(ConfigureTransport(TransportOptions{
+			RootCAs:      serverCA(),
+			MaxIdleConns: 5,
+		})).Should(Succeed())
+		Expect(transportGenerations()).Should(Equal(base + 1))
+		body, err := get("/")
+		Expect(err).Should(Succeed())
+		Expect(body).Should(Equal("Secure"))
+
+		unblock <- true
+		Eventually(results).Should(Receive(Equal("Secure")))
+		Eventually(transportGenerations).Should(Equal(base))
+	})
+
+	It("Drain timeout", func() {
+		Expect(ConfigureTransport(TransportOptions{RootCAs: serverCA()})).Should(Succeed())
+		base := transportGenerations()
+		results := make(chan error, 1)
+		go func() {
+			_, err := get("/slow")
+			results <- err
+		}()
+		Eventually(entered).Should(Receive())
+
+		Expect(ConfigureTransport(TransportOptions{
+			RootCAs:      serverCA(),
+			DrainTimeout: 10 * time.Millisecond,
+		})).Should(Succeed())
+		Eventually(results).Should(Receive(HaveOccurred()))
+		Eventually(transportGenerations).Should(Equal(base))
+		unblock <- true
+	})
+
+	It("Health report", func() {
+		Expect(buildHealthReport(HealthOptions{}).TransportGenerations).Should(Equal(transportGenerations()))
+	})
+
+	It("JSON", func() {
+		dir, err := ioutil.TempDir("", "weaver-transport")
+		Expect(err).Should(Succeed())
+		defer os.RemoveAll(dir)
+		caFile := filepath.Join(dir, "ca.pem")
+		Expect(ioutil.WriteFile(caFile, serverCA(), 0644)).Should(Succeed())
+
+		Expect(configureTransportJSON(`{"caFile": "` + caFile +
+			`", "maxConnsPerHost": 4, "idleTimeoutMillis": 1000}`)).Should(Succeed())
+		_, err = get("/")
+		Expect(err).Should(Succeed())
+	})
+
+	It("Invalid", func() {
+		Expect(ConfigureTransport(TransportOptions{MaxConnsPerHost: -1})).ShouldNot(Succeed())
+		Expect(ConfigureTransport(TransportOptions{RootCAs: []byte("nope")})).ShouldNot(Succeed())
+		Expect(ConfigureTransport(TransportOptions{ProxyURL: "proxy:8080"})).ShouldNot(Succeed())
+		Expect(configureTransportJSON(`{"maxConns": 1}`)).ShouldNot(Succeed())
+		Expect(configureTransportJSON(`{"caFile": "/no/such/file"}`)).ShouldNot(Succeed())
+	})
+})
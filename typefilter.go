@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+/*
+ * Most responses don't need a body filter, so a response handler may give
+ * the media types that it wants to see, such as "text/html" or "text/*."
+ * The filter is only installed if the Content-Type of the response is one
+ * of them, and other responses go through untouched, without their body
+ * being read. A body that is still compressed is also left alone, since
+ * the filter couldn't make sense of it, and so is a response that can't
+ * have a body, such as a 304 or the response to a HEAD. Handlers find SetBodyFilterForTypes
+ * using a type assertion on the http.ResponseWriter.
+ */
+
+// A BodyFilter returns what to send in place of one chunk of the body.
+// "last" is true for the last chunk, which may be empty. It is declared as
+// an alias so that SetBodyFilterForTypes has a signature that handlers can
+// write down.
+type BodyFilter = func(chunk []byte, last bool) []byte
+
+/*
+ * SetBodyFilterForTypes passes the response body through "filter" if its
+ * media type matches one of "types." A type of the form "text/*" matches any
+ * subtype, and one with wildcards for both the type and the subtype
+ * matches any type. Like SetBodyFilterAsync, it must be called before the handler
+ * reads the body or returns.
+ */
+func (h *httpResponse) SetBodyFilterForTypes(types []string, filter BodyFilter) error {
+	for _, t := range types {
+		if _, _, err := mime.ParseMediaType(t); err != nil || !strings.Contains(t, "/") {
+			return fmt.Errorf("Invalid media type \"%s\"", t)
+		}
+	}
+	r, ok := h.handler.(*response)
+	if !ok {
+		return errNoResponseBody
+	}
+	if !bodyAllowed(r.request.req, r.resp.StatusCode) || isEncoded(r.resp.Header) ||
+		!matchesMediaType(r.resp.Header.Get("Content-Type"), types) {
+		return nil
+	}
+	err := h.SetBodyFilterAsync(func(chunk []byte, last bool, emit func([]byte), done func(error)) {
+		emit(filter(chunk, last))
+		done(nil)
+	})
+	if err != nil {
+		return err
+	}
+	// The filter may change the length.
+	r.resp.Header.Del("Content-Length")
+	r.resp.ContentLength = -1
+	return nil
+}
+
+func isEncoded(hdrs http.Header) bool {
+	encoding := strings.TrimSpace(hdrs.Get("Content-Encoding"))
+	return encoding != "" && !strings.EqualFold(encoding, "identity")
+}
+
+func matchesMediaType(contentType string, types []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		t, _, _ = mime.ParseMediaType(t)
+		if t == mediaType || t == "*/*" || (strings.HasSuffix(t, "/*") &&
+			strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+	return false
+}
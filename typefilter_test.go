@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Body filter by type", func() {
+	var id, rid uint32
+	var method string
+	var status uint32
+
+	BeforeEach(func() {
+		method = "GET"
+		status = 200
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		rid = createResponse(testHandler)
+		Expect(rid).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		freeResponse(rid)
+	})
+
+	// Send a response with the given headers and body, and return the
+	// headers that came back, and the body, or "" if it wasn't read.
+	run := func(hdrs http.Header, chunks ...string) (http.Header, string) {
+		Expect(beginRequest(id, makeRequestHeaders(method, "/typefilter", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(beginResponse(rid, id, status, serializeHeaders(hdrs))).Should(Succeed())
+		respHdrs := http.Header{}
+		var body []byte
+		for cmd := pollResponse(rid, true); cmd != "DONE"; cmd = pollResponse(rid, true) {
+			switch cmd[:4] {
+			case "RBOD":
+				go func() {
+					for i, c := range chunks {
+						sendResponseBodyChunk(rid, i == len(chunks)-1, []byte(c))
+					}
+				}()
+			case "WHDR":
+				parseHeaders(respHdrs, cmd[4:])
+			case "WBOD":
+				body = append(body, readBodyData(cmd)...)
+			default:
+				Fail("Unexpected command " + cmd)
+			}
+		}
+		return respHdrs, string(body)
+	}
+
+	It("HTML", func() {
+		hdrs := http.Header{}
+		hdrs.Set("Content-Type", "text/html; charset=utf-8")
+		hdrs.Set("Content-Length", "19")
+		respHdrs, body := run(hdrs, "<p>hello, ", "world</p>")
+		Expect(body).Should(Equal("<P>HELLO, WORLD</P><!-- filtered -->"))
+		Expect(respHdrs.Get("Content-Length")).Should(BeEmpty())
+	})
+
+	It("Wildcard", func() {
+		hdrs := http.Header{}
+		hdrs.Set("Content-Type", "application/json")
+		_, body := run(hdrs, `{"a": "b"}`)
+		Expect(body).Should(Equal(`{"A": "B"}<!-- filtered -->`))
+	})
+
+	It("Image", func() {
+		hdrs := http.Header{}
+		hdrs.Set("Content-Type", "image/png")
+		hdrs.Set("Content-Length", "4")
+		_, body := run(hdrs, "\x89PNG")
+		Expect(body).Should(BeEmpty())
+	})
+
+	It("Compressed", func() {
+		hdrs := http.Header{}
+		hdrs.Set("Content-Type", "text/html")
+		hdrs.Set("Content-Encoding", "br")
+		_, body := run(hdrs, "\x0b\x02")
+		Expect(body).Should(BeEmpty())
+	})
+
+	It("Identity", func() {
+		hdrs := http.Header{}
+		hdrs.Set("Content-Type", "text/html")
+		hdrs.Set("Content-Encoding", "identity")
+		_, body := run(hdrs, "<p>hello</p>")
+		Expect(body).Should(Equal("<P>HELLO</P><!-- filtered -->"))
+	})
+
+	It("HEAD", func() {
+		method = "HEAD"
+		hdrs := http.Header{}
+		hdrs.Set("Content-Type", "text/html")
+		hdrs.Set("Content-Length", "12")
+		respHdrs, body := run(hdrs)
+		Expect(body).Should(BeEmpty())
+		Expect(respHdrs).Should(BeEmpty())
+	})
+
+	It("Not modified", func() {
+		status = 304
+		hdrs := http.Header{}
+		hdrs.Set("Content-Type", "text/html")
+		hdrs.Set("Content-Length", "12")
+		respHdrs, body := run(hdrs)
+		Expect(body).Should(BeEmpty())
+		Expect(respHdrs).Should(BeEmpty())
+	})
+
+	It("Any type", func() {
+		Expect(matchesMediaType("image/png", []string{"*/*"})).Should(BeTrue())
+		Expect(matchesMediaType("", []string{"*/*"})).Should(BeFalse())
+	})
+
+	It("No type", func() {
+		_, body := run(http.Header{}, "<p>hello</p>")
+		Expect(body).Should(BeEmpty())
+	})
+
+	It("Invalid", func() {
+		w := &httpResponse{handler: &response{resp: &http.Response{Header: http.Header{}}}}
+		filter := func(chunk []byte, last bool) []byte { return chunk }
+		Expect(w.SetBodyFilterForTypes([]string{"html"}, filter)).ShouldNot(Succeed())
+		Expect(w.SetBodyFilterForTypes([]string{"text/"}, filter)).ShouldNot(Succeed())
+		w = &httpResponse{handler: &request{}}
+		Expect(w.SetBodyFilterForTypes([]string{"text/html"}, filter)).Should(Equal(errNoResponseBody))
+	})
+})
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Cap how many requests are in flight to an upstream host at once, for
+ * hosts that fall over under load. A request that finds the host at its cap
+ * waits for a slot, for up to a timeout, instead of failing right away.
+ * Requests that weaver makes itself are held by the transport of the client
+ * that it uses, so the cap applies to the host that is actually called,
+ * after any handler rewrites or hedging have picked it, and a request holds
+ * its slot until its body is closed. Requests that the caller proxies are
+ * held when they are handed back, after the handlers have rewritten them,
+ * and keep their slots until the response is done or the request is freed,
+ * because we can't see the caller's round trip. Every limit whose pattern
+ * matches the host applies, so a limit for "*" caps everything on top of
+ * the per-host ones.
+ */
+
+var errUpstreamBusy = errors.New("Timed out waiting for a connection to the upstream")
+
+type upstreamLimit struct {
+	pattern      string
+	queueTimeout time.Duration
+	slots        chan bool
+}
+
+/*
+ * SetUpstreamConcurrencyLimit limits the requests in flight to hosts that
+ * match "hostPattern," which uses the syntax of path.Match and may include a
+ * port. A "max" of zero removes the limit for that pattern.
+ */
+func SetUpstreamConcurrencyLimit(hostPattern string, max int, queueTimeout time.Duration) error {
+	hostPattern = strings.ToLower(strings.TrimSpace(hostPattern))
+	if _, err := path.Match(hostPattern, ""); err != nil || hostPattern == "" {
+		return fmt.Errorf("Invalid host pattern \"%s\"", hostPattern)
+	}
+	if max < 0 || queueTimeout < 0 {
+		return fmt.Errorf("Invalid limit for %s", hostPattern)
+	}
+	updateSettings(func(s *settings) {
+		var limits []*upstreamLimit
+		for _, l := range s.upstreamLimits {
+			if l.pattern != hostPattern {
+				limits = append(limits, l)
+			}
+		}
+		if max > 0 {
+			limits = append(limits, &upstreamLimit{
+				pattern:      hostPattern,
+				queueTimeout: queueTimeout,
+				slots:        make(chan bool, max),
+			})
+		}
+		s.upstreamLimits = limits
+	})
+	return nil
+}
+
+func (l *upstreamLimit) matches(u *url.URL) bool {
+	for _, host := range []string{u.Host, u.Hostname()} {
+		if ok, _ := path.Match(l.pattern, strings.ToLower(host)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Take a slot from every limit that applies to the URL, and return a
+ * function that gives them all back.
+ */
+func acquireUpstream(req *http.Request) (func(), error) {
+	s := getSettings()
+	return s.acquireUpstream(req.Context(), req.URL)
+}
+
+func (s *settings) acquireUpstream(ctx context.Context, u *url.URL) (func(), error) {
+	var held []*upstreamLimit
+	release := func() {
+		for _, l := range held {
+			<-l.slots
+		}
+	}
+	for _, l := range s.upstreamLimits {
+		if !l.matches(u) {
+			continue
+		}
+		if err := l.acquire(ctx, s.developmentMode); err != nil {
+			release()
+			return nil, err
+		}
+		held = append(held, l)
+	}
+	return release, nil
+}
+
+/*
+ * Wait for a slot for up to the queue timeout, or for as long as it takes
+ * if "forever" is true.
+ */
+func (l *upstreamLimit) acquire(ctx context.Context, forever bool) error {
+	select {
+	case l.slots <- true:
+		return nil
+	default:
+	}
+
+	updateStats(func(s *stats) {
+		s.UpstreamQueued++
+	})
+	start := time.Now()
+	var timeout <-chan time.Time
+	if !forever {
+		timer := time.NewTimer(l.queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var err error
+	select {
+	case l.slots <- true:
+	case <-timeout:
+		err = errUpstreamBusy
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	waited := time.Since(start)
+	updateStats(func(s *stats) {
+		s.UpstreamQueued--
+		s.UpstreamQueueWaitMillis += int64(waited / time.Millisecond)
+		if err == errUpstreamBusy {
+			s.UpstreamQueueTimeouts++
+		}
+	})
+	return err
+}
+
+/*
+ * Take the slots for a request that the caller will proxy. Return false if
+ * the request was rejected because a slot didn't come free in time.
+ */
+func (r *request) admitUpstream() bool {
+	if len(r.settings.upstreamLimits) == 0 {
+		return true
+	}
+	target := *r.req.URL
+	if target.Host == "" {
+		target.Host = r.req.Host
+	}
+	release, err := r.settings.acquireUpstream(r.ctx, &target)
+	if err != nil {
+		r.proxying = false
+		r.reject(http.StatusServiceUnavailable, err.Error())
+		return false
+	}
+	r.bodyLock.Lock()
+	r.upstreamRelease = release
+	r.bodyLock.Unlock()
+	return true
+}
+
+/*
+ * Give back the slots that a proxied request took, if it has any.
+ */
+func (r *request) releaseUpstream() {
+	r.bodyLock.Lock()
+	release := r.upstreamRelease
+	r.upstreamRelease = nil
+	r.bodyLock.Unlock()
+	if release != nil {
+		release()
+	}
+}
+
+func isUpstreamBusy(err error) bool {
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	return err == errUpstreamBusy
+}
+
+type pacedTransport struct {
+	base http.RoundTripper
+}
+
+func (t *pacedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	release, err := acquireUpstream(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &pacedBody{
+		ReadCloser: resp.Body,
+		release:    release,
+	}
+	return resp, nil
+}
+
+/*
+ * The slot is given back once the body has been read or closed.
+ */
+type pacedBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *pacedBody) Read(buf []byte) (int, error) {
+	n, err := b.ReadCloser.Read(buf)
+	if err != nil {
+		b.once.Do(b.release)
+	}
+	return n, err
+}
+
+func (b *pacedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
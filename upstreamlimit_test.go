@@ -0,0 +1,179 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Upstream concurrency limit", func() {
+	var server *httptest.Server
+	var inFlight, maxInFlight int32
+	var unblock chan bool
+
+	BeforeEach(func() {
+		inFlight = 0
+		maxInFlight = 0
+		unblock = make(chan bool)
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+			for max := atomic.LoadInt32(&maxInFlight); n > max; max = atomic.LoadInt32(&maxInFlight) {
+				if atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+					break
+				}
+			}
+			select {
+			case <-unblock:
+			case <-time.After(30 * time.Millisecond):
+			}
+			w.Write([]byte("Slow"))
+		}))
+	})
+
+	AfterEach(func() {
+		close(unblock)
+		server.Close()
+		resetSettings()
+	})
+
+	get := func() error {
+		resp, err := upstreamClient.Get(server.URL)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, err = ioutil.ReadAll(resp.Body)
+		return err
+	}
+
+	getAll := func(n int) []error {
+		errs := make([]error, n)
+		wg := sync.WaitGroup{}
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = get()
+			}(i)
+		}
+		wg.Wait()
+		return errs
+	}
+
+	It("Cap holds and excess requests wait", func() {
+		Expect(SetUpstreamConcurrencyLimit("127.0.0.1", 2, 10*time.Second)).Should(Succeed())
+		before := getStats()
+		for _, err := range getAll(6) {
+			Expect(err).Should(Succeed())
+		}
+		Expect(atomic.LoadInt32(&maxInFlight)).Should(BeEquivalentTo(2))
+		after := getStats()
+		Expect(after.UpstreamQueueWaitMillis).Should(BeNumerically(">", before.UpstreamQueueWaitMillis))
+		Expect(after.UpstreamQueued).Should(Equal(before.UpstreamQueued))
+	})
+
+	It("Global cap", func() {
+		Expect(SetUpstreamConcurrencyLimit("*", 1, 10*time.Second)).Should(Succeed())
+		Expect(SetUpstreamConcurrencyLimit("127.0.0.1", 3, 10*time.Second)).Should(Succeed())
+		for _, err := range getAll(3) {
+			Expect(err).Should(Succeed())
+		}
+		Expect(atomic.LoadInt32(&maxInFlight)).Should(BeEquivalentTo(1))
+	})
+
+	It("Other hosts", func() {
+		Expect(SetUpstreamConcurrencyLimit("billing.example.com", 1, 0)).Should(Succeed())
+		for _, err := range getAll(3) {
+			Expect(err).Should(Succeed())
+		}
+		Expect(atomic.LoadInt32(&maxInFlight)).Should(BeEquivalentTo(3))
+	})
+
+	It("Queue timeout", func() {
+		Expect(SetUpstreamConcurrencyLimit("127.0.0.1:*", 1, 5*time.Millisecond)).Should(Succeed())
+		before := getStats()
+		// The slot is held until the body is closed.
+		resp, err := upstreamClient.Get(server.URL)
+		Expect(err).Should(Succeed())
+		err = get()
+		Expect(isUpstreamBusy(err)).Should(BeTrue())
+		resp.Body.Close()
+		Expect(get()).Should(Succeed())
+		Expect(getStats().UpstreamQueueTimeouts).Should(Equal(before.UpstreamQueueTimeouts + 1))
+	})
+
+	It("503 when concatenating", func() {
+		Expect(SetUpstreamConcurrencyLimit("127.0.0.1", 1, 5*time.Millisecond)).Should(Succeed())
+		resp, err := upstreamClient.Get(server.URL)
+		Expect(err).Should(Succeed())
+		defer resp.Body.Close()
+
+		id := createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		defer freeRequest(id)
+		Expect(setConcatResponses(id, server.URL, false)).Should(Succeed())
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("SWCH503"))
+	})
+
+	It("Proxied requests", func() {
+		Expect(SetUpstreamConcurrencyLimit("localhost:*", 1, 5*time.Millisecond)).Should(Succeed())
+		first := createRequest(testHandler)
+		Expect(first).ShouldNot(BeZero())
+		defer freeRequest(first)
+		Expect(beginRequest(first, makeRequestHeaders("GET", "/pass", "", 0))).Should(Succeed())
+		Expect(pollRequest(first, true)).Should(Equal("DONE"))
+
+		// The first request holds the slot until its response is done.
+		second := createRequest(testHandler)
+		Expect(second).ShouldNot(BeZero())
+		defer freeRequest(second)
+		Expect(beginRequest(second, makeRequestHeaders("GET", "/pass", "", 0))).Should(Succeed())
+		Expect(pollRequest(second, true)).Should(Equal("SWCH503"))
+
+		rid := createResponse(testHandler)
+		defer freeResponse(rid)
+		Expect(beginResponse(rid, first, 200, makeResponseHeaders("text/plain", 0))).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+
+		third := createRequest(testHandler)
+		Expect(third).ShouldNot(BeZero())
+		defer freeRequest(third)
+		Expect(beginRequest(third, makeRequestHeaders("GET", "/pass", "", 0))).Should(Succeed())
+		Expect(pollRequest(third, true)).Should(Equal("DONE"))
+	})
+
+	It("Freed proxied requests", func() {
+		Expect(SetUpstreamConcurrencyLimit("localhost:*", 1, 5*time.Millisecond)).Should(Succeed())
+		first := createRequest(testHandler)
+		Expect(first).ShouldNot(BeZero())
+		Expect(beginRequest(first, makeRequestHeaders("GET", "/pass", "", 0))).Should(Succeed())
+		Expect(pollRequest(first, true)).Should(Equal("DONE"))
+		freeRequest(first)
+
+		second := createRequest(testHandler)
+		Expect(second).ShouldNot(BeZero())
+		defer freeRequest(second)
+		Expect(beginRequest(second, makeRequestHeaders("GET", "/pass", "", 0))).Should(Succeed())
+		Expect(pollRequest(second, true)).Should(Equal("DONE"))
+	})
+
+	It("Remove", func() {
+		Expect(SetUpstreamConcurrencyLimit("127.0.0.1", 1, 0)).Should(Succeed())
+		Expect(SetUpstreamConcurrencyLimit("127.0.0.1", 0, 0)).Should(Succeed())
+		Expect(getSettings().upstreamLimits).Should(BeEmpty())
+	})
+
+	It("Invalid", func() {
+		Expect(SetUpstreamConcurrencyLimit("[", 1, 0)).ShouldNot(Succeed())
+		Expect(SetUpstreamConcurrencyLimit("", 1, 0)).ShouldNot(Succeed())
+		Expect(SetUpstreamConcurrencyLimit("a", -1, 0)).ShouldNot(Succeed())
+	})
+})
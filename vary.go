@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/*
+ * A response that depends on request headers must say so in Vary, or a
+ * cache will hand it to clients that sent something else. The caller can
+ * list headers to add to every response, and features that change the
+ * response based on a request header add theirs too. Names that are already
+ * there are not added again.
+ */
+
+func setVaryHeader(list string) error {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name != "*" && strings.ContainsAny(name, " \t:;\"") {
+			return fmt.Errorf("Invalid header name: \"%s\"", name)
+		}
+		names = append(names, http.CanonicalHeaderKey(name))
+	}
+	updateSettings(func(s *settings) {
+		s.varyHeaders = names
+	})
+	return nil
+}
+
+func (r *response) setVary() {
+	addVary(r.resp.Header, r.request.settings.varyHeaders...)
+}
+
+/*
+ * Add names to the Vary header, as a single value, unless they are there
+ * already. "*" already covers everything.
+ */
+func addVary(h http.Header, names ...string) {
+	if len(names) == 0 {
+		return
+	}
+	var values []string
+	seen := make(map[string]bool)
+	for _, v := range h["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" || seen[strings.ToLower(name)] {
+				continue
+			}
+			seen[strings.ToLower(name)] = true
+			values = append(values, name)
+		}
+	}
+	if seen["*"] {
+		return
+	}
+	changed := false
+	for _, name := range names {
+		if !seen[strings.ToLower(name)] {
+			seen[strings.ToLower(name)] = true
+			values = append(values, name)
+			changed = true
+		}
+	}
+	if changed {
+		h.Set("Vary", strings.Join(values, ", "))
+	}
+}
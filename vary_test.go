@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Vary header", func() {
+	var id, rid uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+		rid = createResponse(testHandler)
+		Expect(rid).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+		freeResponse(rid)
+		resetSettings()
+	})
+
+	// Return the new Vary header, or nil if the headers didn't change.
+	run := func(extraHeaders string) []string {
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		err = beginResponse(rid, id, 200, extraHeaders+makeResponseHeaders("text/plain", 0))
+		Expect(err).Should(Succeed())
+
+		cmd := pollResponse(rid, true)
+		if cmd == "DONE" {
+			return nil
+		}
+		Expect(cmd).Should(HavePrefix("WHDR"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+		// Each value must be on one line.
+		var vary []string
+		for _, line := range strings.Split(cmd[4:], "\n") {
+			if strings.HasPrefix(line, "Vary: ") {
+				vary = append(vary, strings.TrimPrefix(line, "Vary: "))
+			}
+		}
+		return vary
+	}
+
+	It("Adds the configured headers", func() {
+		Expect(setVaryHeader("accept-language, Cookie")).Should(Succeed())
+		Expect(run("")).Should(Equal([]string{"Accept-Language, Cookie"}))
+	})
+
+	It("Appends without duplicates", func() {
+		Expect(setVaryHeader("Accept-Language, Cookie")).Should(Succeed())
+		Expect(run("Vary: Origin\nVary: cookie\n")).
+			Should(Equal([]string{"Origin, cookie, Accept-Language"}))
+	})
+
+	It("Nothing to add", func() {
+		Expect(setVaryHeader("Accept-Encoding")).Should(Succeed())
+		Expect(run("Vary: Accept-Encoding\n")).Should(BeNil())
+	})
+
+	It("Star covers everything", func() {
+		Expect(setVaryHeader("Cookie")).Should(Succeed())
+		Expect(run("Vary: *\n")).Should(BeNil())
+	})
+
+	It("Disabled", func() {
+		Expect(run("")).Should(BeNil())
+	})
+
+	It("Add", func() {
+		h := http.Header{}
+		addVary(h, "Accept-Encoding")
+		addVary(h, "Accept-Encoding")
+		Expect(h["Vary"]).Should(Equal([]string{"Accept-Encoding"}))
+		addVary(h)
+		Expect(h["Vary"]).Should(Equal([]string{"Accept-Encoding"}))
+	})
+
+	It("Invalid", func() {
+		Expect(setVaryHeader("Accept Language")).ShouldNot(Succeed())
+		Expect(setVaryHeader("X-Foo:")).ShouldNot(Succeed())
+		Expect(setVaryHeader("")).Should(Succeed())
+		Expect(getSettings().varyHeaders).Should(BeEmpty())
+	})
+})
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+ * Let a handler leave a short note for the caller about what it decided,
+ * such as which logging tier the connection belongs in. The caller reads it
+ * using GoGetRequestVerdict at any time until the request is freed, so it is
+ * there however the request ended, even with an ERRR. The request and
+ * response handlers share it, and the last one set wins. Handlers find
+ * SetVerdict using a type assertion on the http.ResponseWriter.
+ */
+
+const maxVerdictLength = 256
+
+var errNoVerdict = errors.New("No request to set a verdict on")
+
+/*
+ * SetVerdict sets the verdict, which must be printable ASCII and at most
+ * 256 bytes long.
+ */
+func (h *httpResponse) SetVerdict(verdict string) error {
+	if len(verdict) > maxVerdictLength {
+		return fmt.Errorf("Verdict is longer than %d bytes", maxVerdictLength)
+	}
+	for _, c := range []byte(verdict) {
+		if c < ' ' || c > '~' {
+			return fmt.Errorf("Invalid character in verdict: %q", c)
+		}
+	}
+	r := h.owner()
+	if r == nil {
+		return errNoVerdict
+	}
+	r.bodyLock.Lock()
+	r.verdict = verdict
+	r.bodyLock.Unlock()
+	return nil
+}
+
+func getVerdict(id uint32) string {
+	req := getRequest(id)
+	if req == nil {
+		return ""
+	}
+	req.bodyLock.Lock()
+	defer req.bodyLock.Unlock()
+	return req.verdict
+}
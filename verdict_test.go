@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Verdict", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+	})
+
+	// Send the response and return the last command.
+	respond := func(contentLength int, body string) string {
+		rid := createResponse(testHandler)
+		defer freeResponse(rid)
+		err := beginResponse(rid, id, 200, makeResponseHeaders("text/plain", contentLength))
+		Expect(err).Should(Succeed())
+		cmd := pollResponse(rid, true)
+		for ; cmd[:4] == "RBOD" || cmd[:4] == "WHDR" || cmd[:4] == "WBOD"; cmd = pollResponse(rid, true) {
+			if cmd == "RBOD" {
+				sendResponseBodyChunk(rid, true, []byte(body))
+			}
+		}
+		return cmd
+	}
+
+	It("None", func() {
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(getVerdict(id)).Should(BeEmpty())
+	})
+
+	It("Request", func() {
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/verdict", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(getVerdict(id)).Should(Equal("request-seen"))
+	})
+
+	It("Overwritten by response", func() {
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/verdict", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(respond(5, "Hello")).Should(Equal("DONE"))
+		Expect(getVerdict(id)).Should(Equal("response-seen"))
+	})
+
+	It("Error", func() {
+		Expect(beginRequest(id, makeRequestHeaders("GET", "/verdict", "", 0))).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(respond(20, "Hello")).Should(HavePrefix("ERRR"))
+		Expect(getVerdict(id)).Should(Equal("response-seen"))
+	})
+
+	It("Invalid", func() {
+		h := &httpResponse{handler: getRequest(id)}
+		Expect(h.SetVerdict("tier-2")).Should(Succeed())
+		Expect(h.SetVerdict("bad\nverdict")).ShouldNot(Succeed())
+		Expect(h.SetVerdict(strings.Repeat("x", maxVerdictLength+1))).ShouldNot(Succeed())
+		Expect(getVerdict(id)).Should(Equal("tier-2"))
+		Expect(getVerdict(1000000)).Should(BeEmpty())
+	})
+})
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+ * Let a request handler check that an XML request body is well-formed
+ * before it is forwarded. The body streams through the XML decoder and into
+ * a buffer, which becomes the body that is sent to the target. In strict
+ * mode, every namespace prefix must also be declared. Handlers find
+ * ValidateXML using a type assertion on the http.ResponseWriter. A body
+ * that is too big to hold is forwarded without being checked.
+ */
+
+// The biggest body that is validated. This is replaced by tests.
+var maxValidatedXMLBody int64 = 4 * 1024 * 1024
+
+var errNoRequestBody = errors.New("Only a request handler can validate the request body")
+
+/*
+ * ValidateXML reads the request body and returns an error, whose message
+ * is suitable for a 400 response, if it isn't well-formed XML. Either way,
+ * the body is still there to forward afterwards. If the body is bigger than
+ * maxValidatedXMLBody, it isn't checked, and nil is returned.
+ */
+func (h *httpResponse) ValidateXML(strict bool) error {
+	r, ok := h.handler.(*request)
+	if !ok {
+		return errNoRequestBody
+	}
+	buf := &bytes.Buffer{}
+	body := r.req.Body
+	limited := io.LimitReader(body, maxValidatedXMLBody+1)
+	err := validateXML(io.TeeReader(limited, buf), strict)
+	// Put back what we read, followed by anything we didn't.
+	r.req.Body = struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: io.MultiReader(buf, body),
+		Closer: body,
+	}
+	if int64(buf.Len()) > maxValidatedXMLBody {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid XML: %v", err)
+	}
+	return nil
+}
+
+type xmlScope struct {
+	name     xml.Name
+	prefixes map[string]bool
+}
+
+func validateXML(in io.Reader, strict bool) error {
+	d := xml.NewDecoder(in)
+	// RawToken leaves the prefixes alone, so we match the tags ourselves.
+	var stack []xmlScope
+	roots := 0
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if len(stack) == 0 {
+				roots++
+				if roots > 1 {
+					return errors.New("more than one root element")
+				}
+			}
+			scope := xmlScope{name: t.Name, prefixes: make(map[string]bool)}
+			for _, a := range t.Attr {
+				if a.Name.Space == "xmlns" {
+					scope.prefixes[a.Name.Local] = true
+				}
+			}
+			stack = append(stack, scope)
+			if strict {
+				if err := checkPrefixes(stack, t); err != nil {
+					return err
+				}
+			}
+		case xml.EndElement:
+			if len(stack) == 0 {
+				return fmt.Errorf("unexpected end element </%s>", xmlTagName(t.Name))
+			}
+			open := stack[len(stack)-1].name
+			if open != t.Name {
+				return fmt.Errorf("element <%s> closed by </%s>",
+					xmlTagName(open), xmlTagName(t.Name))
+			}
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) == 0 && len(bytes.TrimSpace(t)) > 0 {
+				return errors.New("text outside the root element")
+			}
+		}
+	}
+	if len(stack) > 0 {
+		return fmt.Errorf("element <%s> is not closed", xmlTagName(stack[len(stack)-1].name))
+	}
+	if roots == 0 {
+		return errors.New("no root element")
+	}
+	return nil
+}
+
+/*
+ * Check that the prefixes of an element and its attributes were declared
+ * on it or one of its parents.
+ */
+func checkPrefixes(stack []xmlScope, t xml.StartElement) error {
+	names := []xml.Name{t.Name}
+	for _, a := range t.Attr {
+		if a.Name.Space != "xmlns" {
+			names = append(names, a.Name)
+		}
+	}
+	for _, n := range names {
+		if n.Space == "" || n.Space == "xml" || xmlPrefixDeclared(stack, n.Space) {
+			continue
+		}
+		return fmt.Errorf("undeclared namespace prefix \"%s\" in <%s>",
+			n.Space, xmlTagName(t.Name))
+	}
+	return nil
+}
+
+func xmlPrefixDeclared(stack []xmlScope, prefix string) bool {
+	for i := len(stack) - 1; i >= 0; i-- {
+		if stack[i].prefixes[prefix] {
+			return true
+		}
+	}
+	return false
+}
+
+func xmlTagName(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return n.Space + ":" + n.Local
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("XML validation", func() {
+	var id uint32
+
+	BeforeEach(func() {
+		id = createRequest(testHandler)
+		Expect(id).ShouldNot(BeZero())
+	})
+
+	AfterEach(func() {
+		freeRequest(id)
+	})
+
+	// Send the body in two chunks, and return the status, which is zero if
+	// the request was forwarded, and the body that came back.
+	run := func(path, msg string) (string, string) {
+		err := beginRequest(id, makeRequestHeaders("POST", path, "text/xml", len(msg)))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("RBOD"))
+		sendRequestBodyChunk(id, false, []byte(msg[:len(msg)/2]))
+		sendRequestBodyChunk(id, true, []byte(msg[len(msg)/2:]))
+
+		status := ""
+		body := &bytes.Buffer{}
+		for cmd := pollRequest(id, true); cmd != "DONE"; cmd = pollRequest(id, true) {
+			switch cmd[:4] {
+			case "SWCH":
+				status = cmd[4:]
+			case "WBOD":
+				body.Write(readBodyData(cmd))
+			}
+		}
+		return status, body.String()
+	}
+
+	soap := "<?xml version=\"1.0\"?>\n" +
+		"<soap:Envelope xmlns:soap=\"http://www.w3.org/2003/05/soap-envelope\">" +
+		"<soap:Body><m:Price xmlns:m=\"urn:example\" m:currency=\"USD\">42</m:Price></soap:Body>" +
+		"</soap:Envelope>\n"
+
+	It("Well-formed", func() {
+		status, body := run("/validatexmlstrict", soap)
+		Expect(status).Should(BeEmpty())
+		Expect(body).Should(Equal(soap))
+	})
+
+	It("Too big to check", func() {
+		defer func(max int64) { maxValidatedXMLBody = max }(maxValidatedXMLBody)
+		maxValidatedXMLBody = 8
+		msg := "<a><b>text</a></b>"
+		status, body := run("/validatexml", msg)
+		Expect(status).Should(BeEmpty())
+		Expect(body).Should(Equal(msg))
+	})
+
+	It("Mismatched tags", func() {
+		status, body := run("/validatexml", "<a><b>text</a></b>")
+		Expect(status).Should(Equal("400"))
+		Expect(body).Should(Equal("Invalid XML: element <b> closed by </a>"))
+	})
+
+	It("Syntax error", func() {
+		status, body := run("/validatexml", "<a>\n<b attr=oops/></a>")
+		Expect(status).Should(Equal("400"))
+		Expect(body).Should(HavePrefix("Invalid XML: XML syntax error on line 2"))
+	})
+
+	It("Not closed", func() {
+		status, _ := run("/validatexml", "<a><b></b>")
+		Expect(status).Should(Equal("400"))
+	})
+
+	It("Two roots", func() {
+		status, _ := run("/validatexml", "<a/><b/>")
+		Expect(status).Should(Equal("400"))
+	})
+
+	It("Not XML", func() {
+		status, _ := run("/validatexml", "Hello, World!")
+		Expect(status).Should(Equal("400"))
+	})
+
+	It("Undeclared prefix", func() {
+		msg := "<soap:Envelope><soap:Body/></soap:Envelope>"
+		status, body := run("/validatexml", msg)
+		Expect(status).Should(BeEmpty())
+		Expect(body).Should(Equal(msg))
+
+		freeRequest(id)
+		id = createRequest(testHandler)
+		status, body = run("/validatexmlstrict", msg)
+		Expect(status).Should(Equal("400"))
+		Expect(body).Should(ContainSubstring("undeclared namespace prefix \"soap\""))
+	})
+
+	It("Undeclared attribute prefix", func() {
+		status, _ := run("/validatexmlstrict", "<a xmlns:x=\"urn:x\"><b x:ok=\"1\" y:bad=\"2\"/></a>")
+		Expect(status).Should(Equal("400"))
+	})
+})